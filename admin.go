@@ -0,0 +1,46 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// isAdminRequest reports whether the request presents the instance's admin
+// token, either as a bearer token or as the admin_token query param.
+// Without a token nothing is admin, see isLocalRequest.
+func isAdminRequest(adminToken string, r *http.Request) bool {
+	if len(adminToken) == 0 {
+		return false
+	}
+	presented := r.URL.Query().Get("admin_token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		presented = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(presented), []byte(adminToken)) == 1
+}
+
+// isLocalRequest is true for requests from loopback addresses.  Without an
+// admin token they may look at the admin pages, so a bare instance can
+// still be debugged locally, but behind a proxy on the same host every
+// visitor is loopback, so they never change anything.
+func isLocalRequest(r *http.Request) bool {
+	ip := net.ParseIP(networkIP(r))
+	return ip != nil && ip.IsLoopback()
+}
+
+// isSameSite is false for requests a browser sent from another site's
+// page, by their Origin or else Referer.  Tools that send neither pass.
+func isSameSite(r *http.Request) bool {
+	from := r.Header.Get("Origin")
+	if len(from) == 0 {
+		from = r.Header.Get("Referer")
+	}
+	if len(from) == 0 {
+		return true
+	}
+	parsed, err := url.Parse(from)
+	return err == nil && len(parsed.Host) > 0 && strings.EqualFold(parsed.Host, r.Host)
+}
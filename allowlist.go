@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+)
+
+// restrictToCIDRs only lets clients within the given networks reach the
+// wrapped handler, for intranet instances that should only be reachable
+// from corporate ranges or the VPN.  Must be wrapped by resolveClientIP.
+func restrictToCIDRs(allowed []*net.IPNet, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !containsIP(allowed, networkIP(r)) {
+			log.Printf("HTTP %s %s  blocked, client_ip: %s not in allowCIDR\n", r.Method, r.URL.Path, clientIP(r))
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(403)
+			w.Write([]byte(getForbiddenPageString()))
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func getForbiddenPageString() string {
+	return `<html>
+    <head>
+      <title>micro-chat</title>
+			<meta name="viewport" content="width=device-width, initial-scale=1.0">
+			<link rel="stylesheet" type="text/css" href="https://cdnjs.cloudflare.com/ajax/libs/skeleton/2.0.4/skeleton.min.css">
+			<link rel="stylesheet" href="https://cdnjs.cloudflare.com/ajax/libs/font-awesome/4.6.3/css/font-awesome.css">
+			<style>
+				body {
+					font-size: 1.7rem;
+					line-height: 1.4;
+					margin: 0.8rem 0 0.8rem 1.0rem;
+				}
+				h2 {
+					font-size: 2.4rem;
+				}
+				#footer {
+					font-size: 1.4rem;
+					color: #AAAAAA;
+					padding: 1rem;
+					text-align: center;
+				}
+			</style>
+    </head>
+    <body>
+			<div class="container">
+				<h2><i class="fa fa-lock"></i> micro-chat</h2>
+				<hr />
+				<p>This chat is only available from the internal network.  Connect to the VPN and try again.</p>
+			</div>
+			<div id="footer">
+			&copy; Urmom Lol 2016</div>
+    </body>
+  </html>`
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Usage analytics for /admin/analytics, worked out on request from whatever
+// chats are still kept (in memory and in the disk spill) so it's only ever
+// as far back as the retention window.
+type analyticsOptions struct {
+	Manager   *chatStore
+	Spill     *spillStore // nil without a spillDir
+	Retention time.Duration
+}
+
+type activityChat struct {
+	Timestamp int64
+	Topic     string
+	Name      string
+}
+
+// chartBar is one bar of a server rendered bar chart, Percent of the
+// chart's biggest bar.
+type chartBar struct {
+	Label   string
+	Count   int
+	Percent int
+}
+
+type usageAnalytics struct {
+	Chats          int
+	Spilled        int
+	Posters        int
+	PostersLastDay int
+	PerHour        []chartBar // the last 24 hours, oldest first
+	PerDay         []chartBar // every day in the retention window, oldest first
+	TopTopics      []chartBar
+	// how much of the memory budget and retention window is in use
+	BufferBytes    int64
+	BufferMax      int64
+	BufferPercent  int
+	OldestMs       int64
+	WindowPercent  int
+	RetentionHours int
+}
+
+// most chats read for a single report
+const maxAnalyticsChats = 200000
+
+func keptChats(opts analyticsOptions) (chats []activityChat, spilled int) {
+	for _, event := range opts.Manager.eventsMatching(func(event *chatEvent) bool {
+		_, ok := event.Data.(ChatPost)
+		return ok
+	}, maxAnalyticsChats) {
+		chat := event.Data.(ChatPost)
+		chats = append(chats, activityChat{event.Timestamp, chat.Topic, chat.DisplayName})
+	}
+	if opts.Spill != nil && len(chats) < maxAnalyticsChats {
+		events, err := opts.Spill.eventsMatching(func(spilled *spilledEvent) bool {
+			return spilled.Category != ALL_CHATS
+		}, maxAnalyticsChats-len(chats))
+		if err != nil {
+			log.Printf("Failed to read spilled chats for analytics: %q\n", err)
+		}
+		for _, event := range events {
+			var chat ChatPost
+			if json.Unmarshal(event.Data.(json.RawMessage), &chat) != nil || len(chat.Topic) == 0 {
+				// tombstones and anything else that isn't a chat
+				continue
+			}
+			chats = append(chats, activityChat{event.Timestamp, chat.Topic, chat.DisplayName})
+			spilled++
+		}
+	}
+	return chats, spilled
+}
+
+func barChart(labels []string, counts []int) []chartBar {
+	most := 0
+	for _, count := range counts {
+		if count > most {
+			most = count
+		}
+	}
+	bars := make([]chartBar, len(labels))
+	for i, label := range labels {
+		bars[i] = chartBar{Label: label, Count: counts[i]}
+		if most > 0 {
+			bars[i].Percent = counts[i] * 100 / most
+		}
+	}
+	return bars
+}
+
+func percentOf(part, whole int64) int {
+	if whole <= 0 {
+		return 0
+	}
+	if part >= whole {
+		return 100
+	}
+	return int(part * 100 / whole)
+}
+
+func computeAnalytics(opts analyticsOptions, now time.Time) usageAnalytics {
+	chats, spilled := keptChats(opts)
+	report := usageAnalytics{Chats: len(chats), Spilled: spilled, RetentionHours: int(opts.Retention / time.Hour)}
+	thisHour := now.UTC().Truncate(time.Hour)
+	today := now.UTC().Truncate(24 * time.Hour)
+	days := int(opts.Retention / (24 * time.Hour))
+	if opts.Retention%(24*time.Hour) != 0 || days == 0 {
+		days++
+	}
+	hourCounts, dayCounts := make([]int, 24), make([]int, days)
+	topicCounts := make(map[string]int)
+	posters, postersLastDay := make(map[string]bool), make(map[string]bool)
+	dayAgo := timeToEpochMilliseconds(now.Add(-24 * time.Hour))
+	for _, chat := range chats {
+		posted := time.Unix(0, chat.Timestamp*int64(time.Millisecond)).UTC()
+		if hour := int(thisHour.Sub(posted.Truncate(time.Hour)) / time.Hour); hour >= 0 && hour < 24 {
+			hourCounts[23-hour]++
+		}
+		if day := int(today.Sub(posted.Truncate(24*time.Hour)) / (24 * time.Hour)); day >= 0 && day < days {
+			dayCounts[days-1-day]++
+		}
+		topicCounts[chat.Topic]++
+		posters[chat.Name] = true
+		if chat.Timestamp >= dayAgo {
+			postersLastDay[chat.Name] = true
+		}
+		if report.OldestMs == 0 || chat.Timestamp < report.OldestMs {
+			report.OldestMs = chat.Timestamp
+		}
+	}
+	report.Posters, report.PostersLastDay = len(posters), len(postersLastDay)
+
+	hourLabels := make([]string, 24)
+	for i := range hourLabels {
+		hourLabels[i] = thisHour.Add(time.Duration(i-23) * time.Hour).Format("15:00")
+	}
+	report.PerHour = barChart(hourLabels, hourCounts)
+	dayLabels := make([]string, days)
+	for i := range dayLabels {
+		dayLabels[i] = today.Add(time.Duration(i-days+1) * 24 * time.Hour).Format("Mon Jan 2")
+	}
+	report.PerDay = barChart(dayLabels, dayCounts)
+
+	topics := make([]string, 0, len(topicCounts))
+	for topic := range topicCounts {
+		topics = append(topics, topic)
+	}
+	sort.Slice(topics, func(i, j int) bool {
+		if topicCounts[topics[i]] != topicCounts[topics[j]] {
+			return topicCounts[topics[i]] > topicCounts[topics[j]]
+		}
+		return topics[i] < topics[j]
+	})
+	if len(topics) > 10 {
+		topics = topics[:10]
+	}
+	counts := make([]int, len(topics))
+	for i, topic := range topics {
+		counts[i] = topicCounts[topic]
+	}
+	report.TopTopics = barChart(topics, counts)
+
+	usage := opts.Manager.usage()
+	report.BufferBytes, report.BufferMax = usage.Bytes, usage.MaxBytes
+	report.BufferPercent = percentOf(usage.Bytes, usage.MaxBytes)
+	if report.OldestMs > 0 {
+		report.WindowPercent = percentOf(timeToEpochMilliseconds(now)-report.OldestMs,
+			int64(opts.Retention/time.Millisecond))
+	}
+	return report
+}
+
+// getAnalyticsClosure serves GET /admin/analytics, a page of charts.
+func getAnalyticsClosure(opts analyticsOptions) func(w http.ResponseWriter, r *http.Request) {
+	page := template.Must(template.New("analytics_page").Funcs(template.FuncMap{
+		"postTime": serverTimes.minutes,
+		"mb": func(bytes int64) string {
+			return fmt.Sprintf("%.1f MB", float64(bytes)/(1024*1024))
+		},
+	}).Parse(getAnalyticsTemplateString()))
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		if err := page.Execute(w, computeAnalytics(opts, time.Now())); err != nil {
+			log.Printf("Failed to render analytics page: %q\n", err)
+		}
+	}
+}
+
+// publicStats is what GET /api/v1/stats shows anyone, counts only.
+type publicStats struct {
+	Chats         int   `json:"chats"` // kept in the retention window
+	ActiveTopics  int   `json:"active_topics"`
+	PostsLastHour int   `json:"posts_last_hour"`
+	UptimeSeconds int64 `json:"uptime_seconds"`
+	WindowHours   int   `json:"window_hours"`
+}
+
+// getPublicStatsClosure serves GET /api/v1/stats for status pages and
+// widgets.  Counts are cached for a bit so polling it stays cheap.
+func getPublicStatsClosure(opts analyticsOptions, stats *chatStats) func(w http.ResponseWriter, r *http.Request) {
+	var mu sync.Mutex
+	var cached publicStats
+	var cachedAt time.Time
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		mu.Lock()
+		if time.Since(cachedAt) > 30*time.Second {
+			chats, _ := keptChats(opts)
+			hourAgo := timeToEpochMilliseconds(time.Now().Add(-time.Hour))
+			topics := make(map[string]bool)
+			cached = publicStats{Chats: len(chats), WindowHours: int(opts.Retention / time.Hour)}
+			for _, chat := range chats {
+				topics[chat.Topic] = true
+				if chat.Timestamp >= hourAgo {
+					cached.PostsLastHour++
+				}
+			}
+			cached.ActiveTopics = len(topics)
+			cachedAt = time.Now()
+		}
+		current := cached
+		mu.Unlock()
+		current.UptimeSeconds = int64(time.Since(stats.started) / time.Second)
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		writeJSON(w, 200, current)
+	}
+}
+
+func getAnalyticsTemplateString() string {
+	return `<html>
+    <head>
+      <title>micro-chat analytics</title>
+			<meta name="viewport" content="width=device-width, initial-scale=1.0">
+			<link rel="stylesheet" type="text/css" href="https://cdnjs.cloudflare.com/ajax/libs/skeleton/2.0.4/skeleton.min.css">
+			<link rel="stylesheet" href="https://cdnjs.cloudflare.com/ajax/libs/font-awesome/4.6.3/css/font-awesome.css">
+			<style>
+				body {
+					font-size: 1.7rem;
+					line-height: 1.4;
+					margin: 0.8rem 0 0.8rem 1.0rem;
+				}
+				h2 {
+					font-size: 2.4rem;
+				}
+				h4 {
+					font-size: 2.0rem;
+					margin-top: 2.0rem;
+				}
+				table.chart {
+					width: 100%;
+				}
+				table.chart td {
+					padding: 0.2rem 0.6rem;
+					border: none;
+				}
+				table.chart td.label {
+					width: 10rem;
+					white-space: nowrap;
+					color: #777777;
+				}
+				table.chart td.count {
+					width: 6rem;
+					text-align: right;
+				}
+				div.bar {
+					height: 1.4rem;
+					min-width: 1px;
+					background-color: #1EAEDB;
+					border-radius: 0.3rem;
+				}
+				#footer {
+					font-size: 1.4rem;
+					color: #AAAAAA;
+					padding: 1rem;
+					text-align: center;
+				}
+			</style>
+    </head>
+    <body>
+			<div class="container">
+				<h2><i class="fa fa-bar-chart"></i> Usage</h2>
+				<p>
+					{{ .Chats }} chats kept{{ if .Spilled }} ({{ .Spilled }} spilled to disk){{ end }},
+					{{ .Posters }} unique posters ({{ .PostersLastDay }} in the last 24 hours).
+					{{ if .OldestMs }}Oldest chat posted {{ postTime .OldestMs }}.{{ end }}
+				</p>
+				<h4>Retention</h4>
+				<table class="chart">
+					<tr><td class="label">Buffer</td><td><div class="bar" style="width: {{ .BufferPercent }}%"></div></td>
+						<td class="count">{{ .BufferPercent }}%</td></tr>
+					<tr><td class="label">Window</td><td><div class="bar" style="width: {{ .WindowPercent }}%"></div></td>
+						<td class="count">{{ .WindowPercent }}%</td></tr>
+				</table>
+				<p><small>{{ mb .BufferBytes }} of {{ mb .BufferMax }} buffered, chats kept reach {{ .WindowPercent }}% of the way back through the {{ .RetentionHours }} hour retention window.</small></p>
+				<h4>Posts per hour</h4>
+				<table class="chart">
+					{{ range .PerHour }}
+					<tr><td class="label">{{ .Label }}</td><td><div class="bar" style="width: {{ .Percent }}%"></div></td><td class="count">{{ .Count }}</td></tr>
+					{{ end }}
+				</table>
+				<h4>Posts per day</h4>
+				<table class="chart">
+					{{ range .PerDay }}
+					<tr><td class="label">{{ .Label }}</td><td><div class="bar" style="width: {{ .Percent }}%"></div></td><td class="count">{{ .Count }}</td></tr>
+					{{ end }}
+				</table>
+				<h4>Top topics</h4>
+				<table class="chart">
+					{{ range .TopTopics }}
+					<tr><td class="label"><a href="/?topic={{ .Label }}">{{ .Label }}</a></td><td><div class="bar" style="width: {{ .Percent }}%"></div></td><td class="count">{{ .Count }}</td></tr>
+					{{ else }}
+					<tr><td>No chats yet.</td></tr>
+					{{ end }}
+				</table>
+				<p><small>Times are UTC.  See <a href="/admin/stats">/admin/stats</a> for the raw counters.</small></p>
+			</div>
+			<div id="footer">
+			&copy; Urmom Lol 2016</div>
+    </body>
+  </html>`
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultAnchorContext = 3
+	maxAnchorContext     = 20
+	// most of a topic's chats read looking for one
+	maxAnchorScan = 10000
+)
+
+type chatPageOptions struct {
+	Manager *chatStore
+	Spill   *spillStore // nil without a spillDir
+	Rooms   *encryptedRooms
+	Bans    *topicBans
+}
+
+// anchorChat is a chat on a chat's own page.
+type anchorChat struct {
+	ID          string
+	Timestamp   int64
+	DisplayName string
+	Message     string
+	Action      bool
+}
+
+// topicChats returns up to maxAnchorScan of the topic's newest chats from
+// memory and the disk spill, oldest first.  Burn after reading and encrypted
+// chats are left out.
+func topicChats(opts chatPageOptions, topic string) []anchorChat {
+	var chats []anchorChat
+	add := func(timestamp int64, chat ChatPost) {
+		if len(chat.ID) > 0 && !chat.Burn && !chat.Encrypted {
+			chats = append(chats, anchorChat{chat.ID, timestamp, chat.DisplayName, chat.Message, chat.Action})
+		}
+	}
+	for _, event := range opts.Manager.eventsMatching(func(event *chatEvent) bool {
+		_, ok := event.Data.(ChatPost)
+		return ok && event.Category == topic
+	}, maxAnchorScan) {
+		add(event.Timestamp, event.Data.(ChatPost))
+	}
+	if opts.Spill != nil && len(chats) < maxAnchorScan {
+		spilled, err := opts.Spill.eventsMatching(func(spilled *spilledEvent) bool {
+			return spilled.Category == topic
+		}, maxAnchorScan-len(chats))
+		if err != nil {
+			log.Printf("Failed to read spilled chats: %q\n", err)
+		}
+		for _, event := range spilled {
+			var chat ChatPost
+			if json.Unmarshal(event.Data.(json.RawMessage), &chat) == nil {
+				add(event.Timestamp, chat)
+			}
+		}
+	}
+	sort.Slice(chats, func(i, j int) bool { return chats[i].Timestamp < chats[j].Timestamp })
+	return chats
+}
+
+// getChatPageClosure serves GET /chat/<topic>/<id>[?context=N], a page with
+// just that chat and the N chats before and after it in its topic, for
+// citing a chat in a bug report or meeting minutes.  Chats are only there
+// while they're retained.
+func getChatPageClosure(opts chatPageOptions) func(w http.ResponseWriter, r *http.Request) {
+	page := template.Must(template.New("chat_page").Funcs(template.FuncMap{
+		"postTime": serverTimes.seconds,
+		"html": func(s string) template.HTML {
+			// chats are sanitized when they're posted
+			return template.HTML(s)
+		},
+	}).Parse(getChatPageTemplateString()))
+	return func(w http.ResponseWriter, r *http.Request) {
+		logRequest(r)
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/chat/"), "/", 2)
+		if len(parts) != 2 || !topicNameRegex.MatchString(parts[0]) || len(parts[1]) == 0 {
+			http.Error(w, "Expected /chat/<topic>/<chat id>.", 400)
+			return
+		}
+		topic, id := parts[0], parts[1]
+		context := defaultAnchorContext
+		if contextString := r.URL.Query().Get("context"); len(contextString) > 0 {
+			parsed, err := strconv.Atoi(contextString)
+			if err != nil || parsed < 0 || parsed > maxAnchorContext {
+				http.Error(w, "Invalid context arg, must be 0-"+strconv.Itoa(maxAnchorContext)+".", 400)
+				return
+			}
+			context = parsed
+		}
+		if opts.Rooms.has(topic) {
+			http.Error(w, "Chats in encrypted rooms can only be read in the room.", 404)
+			return
+		}
+		if opts.Bans.banned(r, topic, true) != nil {
+			http.Error(w, "You've been removed from this topic.", 403)
+			return
+		}
+		chats := topicChats(opts, topic)
+		found := -1
+		for i, chat := range chats {
+			if chat.ID == id {
+				found = i
+				break
+			}
+		}
+		if found < 0 {
+			http.Error(w, "No such chat, it may have expired.", 404)
+			return
+		}
+		start, end := found-context, found+context+1
+		if start < 0 {
+			start = 0
+		}
+		if end > len(chats) {
+			end = len(chats)
+		}
+		data := struct {
+			Topic     string
+			TopicPath string
+			Chat      anchorChat
+			Before    []anchorChat
+			After     []anchorChat
+		}{topic, "/?topic=" + url.QueryEscape(topic), chats[found], chats[start:found], chats[found+1 : end]}
+		if err := page.Execute(w, data); err != nil {
+			log.Printf("Failed to render chat page: %q\n", err)
+		}
+	}
+}
+
+func getChatPageTemplateString() string {
+	return `<html>
+    <head>
+      <title>{{ .Topic }} - micro-chat</title>
+			<meta name="viewport" content="width=device-width, initial-scale=1.0">
+			<link rel="icon" href="/favicon.ico">
+			<link rel="stylesheet" type="text/css" href="https://cdnjs.cloudflare.com/ajax/libs/skeleton/2.0.4/skeleton.min.css">
+			<link rel="stylesheet" href="https://cdnjs.cloudflare.com/ajax/libs/font-awesome/4.6.3/css/font-awesome.css">
+			<style>
+				body {
+					font-size: 1.7rem;
+					line-height: 1.4;
+					margin: 0.8rem 0 0.8rem 1.0rem;
+				}
+				h2 {
+					font-size: 2.4rem;
+				}
+				div.chat {
+					padding: 1.0rem;
+					margin-bottom: 1.0rem;
+					border-radius: 1.0rem;
+					box-shadow: 0 0.2rem 0.4rem 0 rgba(0, 0, 0, 0.2), 0 0.2rem 0.8rem 0 rgba(0, 0, 0, 0.19);
+				}
+				div.context {
+					opacity: 0.6;
+				}
+				div.anchored {
+					border: 0.2rem solid #00AA00;
+				}
+				div.chat img {
+					width: 100%;
+					height: auto;
+				}
+				div.displayName {
+					font-weight: bold;
+				}
+				div.postTime {
+					font-size: 1.4rem;
+					color: #999999;
+				}
+				div.postTime a {
+					color: #999999;
+				}
+				#footer {
+					font-size: 1.4rem;
+					color: #AAAAAA;
+					padding: 1rem;
+					text-align: center;
+				}
+			</style>
+    </head>
+    <body>
+			<div class="container">
+				<h2><a class="topic" href="{{ .TopicPath }}"><i class="fa fa-comments"></i> {{ .Topic }}</a></h2>
+				<a href="{{ .TopicPath }}#chat-{{ .Chat.ID }}">Open in the chat.</a>
+				<hr />
+				{{ range .Before }}
+				<div class="chat context">
+					<div class="msg">{{ if .Action }}<b>{{ html .DisplayName }}</b> {{ end }}{{ html .Message }}</div>
+					<div class="displayName">{{ html .DisplayName }}</div>
+					<div class="postTime"><a href="/chat/{{ $.Topic }}/{{ .ID }}">{{ postTime .Timestamp }}</a></div>
+				</div>
+				{{ end }}
+				{{ with .Chat }}
+				<div class="chat anchored" id="chat-{{ .ID }}">
+					<div class="msg">{{ if .Action }}<b>{{ html .DisplayName }}</b> {{ end }}{{ html .Message }}</div>
+					<div class="displayName">{{ html .DisplayName }}</div>
+					<div class="postTime">{{ postTime .Timestamp }}</div>
+				</div>
+				{{ end }}
+				{{ range .After }}
+				<div class="chat context">
+					<div class="msg">{{ if .Action }}<b>{{ html .DisplayName }}</b> {{ end }}{{ html .Message }}</div>
+					<div class="displayName">{{ html .DisplayName }}</div>
+					<div class="postTime"><a href="/chat/{{ $.Topic }}/{{ .ID }}">{{ postTime .Timestamp }}</a></div>
+				</div>
+				{{ end }}
+			</div>
+			<div id="footer">
+			&copy; Urmom Lol 2016</div>
+    </body>
+  </html>`
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// chatArchive keeps every topic's chats on disk for good (or for -archiveDays)
+// as one json lines file per topic and day, served as /archive pages.  Days
+// are the server's, in -timezone.  Chats meant to go away (burn, expiring and
+// encrypted ones) are never archived, and /admin/erase removes chats from
+// the archive as well.
+type chatArchive struct {
+	mu   sync.Mutex
+	dir  string
+	days int // 0 to keep forever
+}
+
+type archivedChat struct {
+	Timestamp int64    `json:"timestamp"`
+	Chat      ChatPost `json:"chat"`
+}
+
+const (
+	archiveDayLayout = "2006-01-02"
+	archiveSuffix    = ".jsonl"
+)
+
+func newChatArchive(dir string, days int) (*chatArchive, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	archive := &chatArchive{dir: dir, days: days}
+	if days > 0 {
+		go archive.reap()
+	}
+	return archive, nil
+}
+
+func archiveDay(ms int64) string {
+	return serverTimes.at(ms).Format(archiveDayLayout)
+}
+
+func (archive *chatArchive) dayPath(topic, day string) string {
+	return filepath.Join(archive.dir, topic, day+archiveSuffix)
+}
+
+// buffered appends chats to their topic's file for the day.  Registered
+// with chatStore.onBuffer.
+func (archive *chatArchive) buffered(event *chatEvent) {
+	chat, ok := event.Data.(ChatPost)
+	if !ok || chat.Burn || chat.ExpiresAt > 0 || chat.Encrypted || !topicNameRegex.MatchString(chat.Topic) {
+		return
+	}
+	line, err := json.Marshal(archivedChat{event.Timestamp, chat})
+	if err != nil {
+		log.Printf("Failed to encode chat for archive: %q\n", err)
+		return
+	}
+	archive.mu.Lock()
+	defer archive.mu.Unlock()
+	if err := os.MkdirAll(filepath.Join(archive.dir, chat.Topic), 0700); err != nil {
+		log.Printf("Failed to create archive dir: %q\n", err)
+		return
+	}
+	f, err := os.OpenFile(archive.dayPath(chat.Topic, archiveDay(event.Timestamp)), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("Failed to open archive: %q\n", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		log.Printf("Failed to write archive: %q\n", err)
+	}
+}
+
+// topicDays returns the days topic has archived chats, oldest first.
+// NOTE: callers must hold archive.mu
+func (archive *chatArchive) topicDays(topic string) ([]string, error) {
+	files, err := ioutil.ReadDir(filepath.Join(archive.dir, topic))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var days []string
+	for _, f := range files {
+		day := strings.TrimSuffix(f.Name(), archiveSuffix)
+		if _, err := time.Parse(archiveDayLayout, day); err == nil && strings.HasSuffix(f.Name(), archiveSuffix) {
+			days = append(days, day)
+		}
+	}
+	sort.Strings(days)
+	return days, nil
+}
+
+// NOTE: callers must hold archive.mu
+func (archive *chatArchive) readDay(topic, day string) ([]archivedChat, error) {
+	data, err := ioutil.ReadFile(archive.dayPath(topic, day))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var chats []archivedChat
+	for _, line := range strings.Split(string(data), "\n") {
+		var chat archivedChat
+		// a partial line from a crash is skipped
+		if json.Unmarshal([]byte(line), &chat) == nil {
+			chats = append(chats, chat)
+		}
+	}
+	return chats, nil
+}
+
+// archivedDay is one day of a topic for its archive page.
+type archivedDay struct {
+	Topic    string
+	Day      string
+	Chats    []archivedChat
+	Previous string // blank when this is the first day
+	Next     string // blank when this is the last day
+}
+
+// day returns topic's chats on day with the days archived before and after.
+func (archive *chatArchive) day(topic, day string) (*archivedDay, error) {
+	archive.mu.Lock()
+	defer archive.mu.Unlock()
+	days, err := archive.topicDays(topic)
+	if err != nil {
+		return nil, err
+	}
+	chats, err := archive.readDay(topic, day)
+	if err != nil {
+		return nil, err
+	}
+	found := &archivedDay{Topic: topic, Day: day, Chats: chats}
+	i := sort.SearchStrings(days, day)
+	if i > 0 {
+		found.Previous = days[i-1]
+	}
+	if i < len(days) && days[i] == day {
+		i++
+	}
+	if i < len(days) {
+		found.Next = days[i]
+	}
+	return found, nil
+}
+
+// latest returns the last day topic has archived chats, blank for none.
+func (archive *chatArchive) latest(topic string) (string, error) {
+	archive.mu.Lock()
+	defer archive.mu.Unlock()
+	days, err := archive.topicDays(topic)
+	if err != nil || len(days) == 0 {
+		return "", err
+	}
+	return days[len(days)-1], nil
+}
+
+// remove rewrites every archived day without the chats match picks,
+// returning how many it dropped.
+func (archive *chatArchive) remove(match func(chat ChatPost) bool) (int, error) {
+	archive.mu.Lock()
+	defer archive.mu.Unlock()
+	topics, err := ioutil.ReadDir(archive.dir)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, topic := range topics {
+		days, err := archive.topicDays(topic.Name())
+		if err != nil {
+			return removed, err
+		}
+		for _, day := range days {
+			path := archive.dayPath(topic.Name(), day)
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return removed, err
+			}
+			var kept []byte
+			dropped := false
+			for _, line := range strings.SplitAfter(string(data), "\n") {
+				var chat archivedChat
+				if json.Unmarshal([]byte(line), &chat) == nil && match(chat.Chat) {
+					removed++
+					dropped = true
+					continue
+				}
+				kept = append(kept, line...)
+			}
+			if !dropped {
+				continue
+			}
+			tmp := path + ".tmp"
+			if err := ioutil.WriteFile(tmp, kept, 0600); err != nil {
+				return removed, err
+			}
+			if err := os.Rename(tmp, path); err != nil {
+				return removed, err
+			}
+		}
+	}
+	return removed, nil
+}
+
+func (archive *chatArchive) reap() {
+	for range time.Tick(time.Hour) {
+		archive.expire()
+	}
+}
+
+// expire removes days older than archive.days.
+func (archive *chatArchive) expire() {
+	cutoff := archiveDay(timeToEpochMilliseconds(time.Now().AddDate(0, 0, -archive.days)))
+	archive.mu.Lock()
+	defer archive.mu.Unlock()
+	topics, err := ioutil.ReadDir(archive.dir)
+	if err != nil {
+		log.Printf("Failed to list archive: %q\n", err)
+		return
+	}
+	for _, topic := range topics {
+		days, err := archive.topicDays(topic.Name())
+		if err != nil {
+			log.Printf("Failed to list archive: %q\n", err)
+			continue
+		}
+		for _, day := range days {
+			if day >= cutoff {
+				break
+			}
+			if err := os.Remove(archive.dayPath(topic.Name(), day)); err != nil {
+				log.Printf("Failed to remove expired archive: %q\n", err)
+			}
+		}
+	}
+}
+
+// getArchiveClosure serves GET /archive/<topic>/<YYYY-MM-DD>, a day of a
+// topic's chats linking to the days before and after.  /archive/<topic>
+// goes to the latest day.
+func getArchiveClosure(archive *chatArchive, bans *topicBans) func(w http.ResponseWriter, r *http.Request) {
+	page := template.Must(template.New("archive_page").Funcs(template.FuncMap{
+		"postTime": serverTimes.clock,
+		"html": func(s string) template.HTML {
+			// chats are sanitized when they're posted
+			return template.HTML(s)
+		},
+	}).Parse(getArchiveTemplateString()))
+	return func(w http.ResponseWriter, r *http.Request) {
+		logRequest(r)
+		if r.Method != "GET" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		parts := strings.SplitN(strings.Trim(strings.TrimPrefix(r.URL.Path, "/archive/"), "/"), "/", 2)
+		topic := parts[0]
+		if !topicNameRegex.MatchString(topic) {
+			http.Error(w, "Expected /archive/<topic>/<YYYY-MM-DD>.", 400)
+			return
+		}
+		if bans.banned(r, topic, true) != nil {
+			http.Error(w, "You've been removed from this topic.", 403)
+			return
+		}
+		if len(parts) == 1 {
+			latest, err := archive.latest(topic)
+			if err != nil {
+				log.Printf("Failed to read archive: %q\n", err)
+				http.Error(w, "Failed to read archive.", 500)
+				return
+			}
+			if len(latest) == 0 {
+				http.Error(w, "Nothing archived in "+topic+" yet.", 404)
+				return
+			}
+			http.Redirect(w, r, "/archive/"+topic+"/"+latest, 302)
+			return
+		}
+		if _, err := time.Parse(archiveDayLayout, parts[1]); err != nil {
+			http.Error(w, "Expected /archive/<topic>/<YYYY-MM-DD>.", 400)
+			return
+		}
+		day, err := archive.day(topic, parts[1])
+		if err != nil {
+			log.Printf("Failed to read archive: %q\n", err)
+			http.Error(w, "Failed to read archive.", 500)
+			return
+		}
+		if len(day.Chats) == 0 {
+			w.WriteHeader(404)
+		}
+		if err := page.Execute(w, day); err != nil {
+			log.Printf("Failed to render archive page: %q\n", err)
+		}
+	}
+}
+
+func getArchiveTemplateString() string {
+	return `<html>
+    <head>
+      <title>{{ .Topic }} on {{ .Day }} - micro-chat</title>
+			<meta name="viewport" content="width=device-width, initial-scale=1.0">
+			<link rel="icon" href="/favicon.ico">
+			<link rel="stylesheet" type="text/css" href="https://cdnjs.cloudflare.com/ajax/libs/skeleton/2.0.4/skeleton.min.css">
+			<link rel="stylesheet" href="https://cdnjs.cloudflare.com/ajax/libs/font-awesome/4.6.3/css/font-awesome.css">
+			<style>
+				body {
+					font-size: 1.7rem;
+					line-height: 1.4;
+					margin: 0.8rem 0 0.8rem 1.0rem;
+				}
+				h2 {
+					font-size: 2.4rem;
+				}
+				div.chat {
+					padding: 1.0rem;
+					margin-bottom: 1.0rem;
+					border-radius: 1.0rem;
+					box-shadow: 0 0.2rem 0.4rem 0 rgba(0, 0, 0, 0.2), 0 0.2rem 0.8rem 0 rgba(0, 0, 0, 0.19);
+				}
+				div.chat img {
+					width: 100%;
+					height: auto;
+				}
+				div.postTime {
+					font-size: 1.4rem;
+					color: #999999;
+				}
+				div.days {
+					margin: 1.0rem 0;
+				}
+				a.next {
+					float: right;
+				}
+				#footer {
+					font-size: 1.4rem;
+					color: #AAAAAA;
+					padding: 1rem;
+					text-align: center;
+				}
+			</style>
+    </head>
+    <body>
+			<div class="container">
+				<h2><i class="fa fa-archive"></i> {{ .Topic }} on {{ .Day }}</h2>
+				<a href="/?topic={{ .Topic }}">Back to chat.</a>
+				<div class="days">
+					{{ if .Previous }}<a class="previous" href="/archive/{{ .Topic }}/{{ .Previous }}"><i class="fa fa-chevron-left"></i> {{ .Previous }}</a>{{ end }}
+					{{ if .Next }}<a class="next" href="/archive/{{ .Topic }}/{{ .Next }}">{{ .Next }} <i class="fa fa-chevron-right"></i></a>{{ end }}
+				</div>
+				<hr />
+				{{ range .Chats }}
+				<div class="chat" id="chat-{{ .Chat.ID }}">
+					<div class="msg">{{ if .Chat.Action }}<b>{{ html .Chat.DisplayName }}</b> {{ end }}{{ html .Chat.Message }}</div>
+					<div class="displayName" style="color: {{ if .Chat.NameColor }}{{ .Chat.NameColor }}{{ else }}inherit{{ end }}">{{ html .Chat.DisplayName }}</div>
+					<div class="postTime">{{ postTime .Timestamp }}</div>
+				</div>
+				{{ else }}
+				<p>Nothing archived in {{ .Topic }} on {{ .Day }}.</p>
+				{{ end }}
+				<div class="days">
+					{{ if .Previous }}<a class="previous" href="/archive/{{ .Topic }}/{{ .Previous }}"><i class="fa fa-chevron-left"></i> {{ .Previous }}</a>{{ end }}
+					{{ if .Next }}<a class="next" href="/archive/{{ .Topic }}/{{ .Next }}">{{ .Next }} <i class="fa fa-chevron-right"></i></a>{{ end }}
+				</div>
+			</div>
+			<div id="footer">
+			&copy; Urmom Lol 2016</div>
+    </body>
+  </html>`
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Attachment extensions we know how to check, and the sniffed content
+// types (prefixes) a file with that extension must have.  Anything not
+// listed here can't be allowed, since we'd have no idea what it really is.
+var attachmentSniffTypes = map[string][]string{
+	".pdf":  {"application/pdf"},
+	".txt":  {"text/plain"},
+	".csv":  {"text/plain"},
+	".md":   {"text/plain"},
+	".log":  {"text/plain"},
+	".json": {"text/plain"},
+	".zip":  {"application/zip"},
+	".gz":   {"application/x-gzip"},
+	".docx": {"application/zip"},
+	".xlsx": {"application/zip"},
+	".pptx": {"application/zip"},
+}
+
+// attachmentPolicy maps allowed extensions (with the dot) to their max size.
+type attachmentPolicy map[string]int64
+
+// parseAttachmentPolicy parses "pdf=5120,txt=256" style flag values, sizes
+// in KB.
+func parseAttachmentPolicy(value string) (attachmentPolicy, error) {
+	policy := make(attachmentPolicy)
+	for _, pair := range splitCommaList(value) {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("expected extension=KB, got %q", pair)
+		}
+		ext := "." + strings.ToLower(strings.TrimPrefix(strings.TrimSpace(parts[0]), "."))
+		if _, found := attachmentSniffTypes[ext]; !found {
+			return nil, fmt.Errorf("unsupported attachment type %q", ext)
+		}
+		kb, err := strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 32)
+		if err != nil || kb < 1 {
+			return nil, fmt.Errorf("expected extension=KB with KB >= 1, got %q", pair)
+		}
+		policy[ext] = int64(kb) * 1024
+	}
+	return policy, nil
+}
+
+// allows returns the size cap for a file with the given name extension and
+// sniffed type, or false if it isn't allowed.
+func (policy attachmentPolicy) allows(ext, contentType string) (int64, bool) {
+	maxBytes, found := policy[ext]
+	if !found {
+		return 0, false
+	}
+	for _, prefix := range attachmentSniffTypes[ext] {
+		if strings.HasPrefix(contentType, prefix) {
+			return maxBytes, true
+		}
+	}
+	return 0, false
+}
+
+func (policy attachmentPolicy) maxBytes() int64 {
+	var max int64
+	for _, maxBytes := range policy {
+		if maxBytes > max {
+			max = maxBytes
+		}
+	}
+	return max
+}
+
+// String lists the allowed extensions, for error messages.
+func (policy attachmentPolicy) String() string {
+	var exts []string
+	for ext := range policy {
+		exts = append(exts, strings.TrimPrefix(ext, "."))
+	}
+	sort.Strings(exts)
+	return strings.Join(exts, ", ")
+}
+
+// accept is the value for the file input's accept attribute.
+func (policy attachmentPolicy) accept() string {
+	var exts []string
+	for ext := range policy {
+		exts = append(exts, ext)
+	}
+	sort.Strings(exts)
+	return strings.Join(exts, ",")
+}
+
+func isAttachment(name string) bool {
+	_, found := attachmentSniffTypes[filepath.Ext(name)]
+	return found
+}
+
+// setAttachmentHeaders makes browsers download attachments rather than
+// render them, and keeps them sandboxed should one be opened anyway.
+func setAttachmentHeaders(w http.ResponseWriter, fileName string) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+fileName+`"`)
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+}
+
+// attachmentFileName keeps the safe part of a client supplied file name so
+// it can go in links and headers.  It always ends in the stored extension.
+func attachmentFileName(name, ext string) string {
+	name = filepath.Base(strings.Replace(name, `\`, "/", -1))
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	var safe strings.Builder
+	for _, c := range name {
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || strings.ContainsRune(" ._-", c) {
+			safe.WriteRune(c)
+		}
+	}
+	cleaned := strings.Trim(safe.String(), " .")
+	if len(cleaned) == 0 {
+		cleaned = "attachment"
+	}
+	if len(cleaned) > 64 {
+		cleaned = cleaned[:64]
+	}
+	return cleaned + ext
+}
+
+// escapeMarkdown backslash escapes characters that would change how a file
+// name renders in a markdown link.
+func escapeMarkdown(text string) string {
+	var escaped strings.Builder
+	for _, c := range text {
+		if strings.ContainsRune(`\`+"`*_{}[]()#+-.!", c) {
+			escaped.WriteRune('\\')
+		}
+		escaped.WriteRune(c)
+	}
+	return escaped.String()
+}
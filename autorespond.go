@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// autoResponders post canned replies for a topic's bot: a welcome to the
+// first chat of each session in the topic, and FAQ replies to chats that
+// mention one of a reply's keywords.  They're loaded from -autoRespondFile:
+//
+//	{"responders": [{"topic": "support", "bot_name": "HelpBot",
+//	  "welcome": "Hi! Someone will be with you shortly.",
+//	  "replies": [{"keywords": ["refund", "money back"], "reply": "See [refunds](/refunds)."}]}]}
+//
+// A blank topic answers in every topic that has no responder of its own.
+// Replies are markdown, rendered like any chat.
+type autoResponders struct {
+	manager   *chatStore
+	stats     *chatStats
+	renderer  *chatRenderer
+	retention time.Duration
+	byTopic   map[string]*autoResponder
+
+	mu sync.Mutex
+	// sessions welcomed, by topic and session
+	welcomed map[string]time.Time
+	// when each reply last went out, by topic and reply
+	replied map[string]time.Time
+}
+
+type autoResponder struct {
+	Topic   string         `json:"topic"`
+	BotName string         `json:"bot_name"`
+	Welcome string         `json:"welcome"`
+	Replies []autoFAQReply `json:"replies"`
+}
+
+type autoFAQReply struct {
+	Keywords []string `json:"keywords"`
+	Reply    string   `json:"reply"`
+	matcher  *regexp.Regexp
+}
+
+// the same reply isn't posted to a topic more often than this
+const autoReplyCooldown = time.Minute
+
+func loadAutoResponders(path, defaultBotName string, manager *chatStore, stats *chatStats, renderer *chatRenderer, retention time.Duration) (*autoResponders, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Responders []*autoResponder `json:"responders"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	responders := &autoResponders{manager: manager, stats: stats, renderer: renderer, retention: retention,
+		byTopic: make(map[string]*autoResponder), welcomed: make(map[string]time.Time), replied: make(map[string]time.Time)}
+	for _, responder := range file.Responders {
+		if _, dup := responders.byTopic[responder.Topic]; dup {
+			return nil, errors.New("more than one responder for topic " + responder.Topic)
+		}
+		if len(strings.TrimSpace(responder.BotName)) == 0 {
+			responder.BotName = defaultBotName
+		}
+		for i := range responder.Replies {
+			reply := &responder.Replies[i]
+			var words []string
+			for _, keyword := range reply.Keywords {
+				if keyword = strings.TrimSpace(keyword); len(keyword) > 0 {
+					words = append(words, regexp.QuoteMeta(keyword))
+				}
+			}
+			if len(words) == 0 || len(strings.TrimSpace(reply.Reply)) == 0 {
+				return nil, errors.New("replies need keywords and a reply")
+			}
+			reply.matcher = regexp.MustCompile(`(?i)\b(` + strings.Join(words, "|") + `)\b`)
+		}
+		responders.byTopic[responder.Topic] = responder
+	}
+	go responders.cleanup()
+	return responders, nil
+}
+
+// check lets everything through, autoResponders is a check to hear about
+// published chats.
+func (responders *autoResponders) check(r *http.Request, chat *ChatPost) *postRejection {
+	return nil
+}
+
+func (responders *autoResponders) published(r *http.Request, chat ChatPost) {
+	// scheduled chats aren't out yet, and nobody's reading encrypted ones
+	if chat.Encrypted || len(r.PostFormValue("publish_at")) > 0 {
+		return
+	}
+	responder, found := responders.byTopic[chat.Topic]
+	if !found {
+		if responder, found = responders.byTopic[""]; !found {
+			return
+		}
+	}
+	var replies []string
+	responders.mu.Lock()
+	if session := sessionID(r); len(responder.Welcome) > 0 && len(session) > 0 {
+		key := chat.Topic + "\x00" + session
+		if _, seen := responders.welcomed[key]; !seen {
+			replies = append(replies, responder.Welcome)
+		}
+		responders.welcomed[key] = time.Now()
+	}
+	text := plainText(chat.Message)
+	for i, reply := range responder.Replies {
+		key := chat.Topic + "\x00" + strconv.Itoa(i)
+		if reply.matcher.MatchString(text) && time.Since(responders.replied[key]) >= autoReplyCooldown {
+			responders.replied[key] = time.Now()
+			replies = append(replies, reply.Reply)
+		}
+	}
+	responders.mu.Unlock()
+	for _, reply := range replies {
+		botName := responders.renderer.renderName(responder.BotName)
+		bot := ChatPost{ID: randomID(8), Topic: chat.Topic, DisplayName: botName, NameColor: nameColor(botName),
+			Message: responders.renderer.renderMessage(chat.Topic, reply)}
+		if err := publishChat(responders.manager, responders.stats, bot); err != nil {
+			log.Printf("Failed to post auto response in %s: %v\n", chat.Topic, err)
+		}
+	}
+}
+
+// cleanup forgets welcomed sessions once their chats would have expired,
+// so they're welcomed again like anyone new to the topic.
+func (responders *autoResponders) cleanup() {
+	for range time.Tick(10 * time.Minute) {
+		responders.mu.Lock()
+		for key, at := range responders.welcomed {
+			if time.Since(at) > responders.retention {
+				delete(responders.welcomed, key)
+			}
+		}
+		for key, at := range responders.replied {
+			if time.Since(at) > autoReplyCooldown {
+				delete(responders.replied, key)
+			}
+		}
+		responders.mu.Unlock()
+	}
+}
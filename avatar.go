@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// avatarHandler serves GET /avatar/<display name>[?s=px], a deterministic
+// identicon so the same name always gets the same picture.  Names with an
+// email on file (registered names) get redirected to their Gravatar, with
+// the identicon style as Gravatar's own fallback.
+type avatarHandler struct {
+	// emailFor looks up the email behind a name, nil until names can be
+	// registered
+	emailFor func(name string) (string, bool)
+}
+
+const (
+	defaultAvatarPx = 64
+	maxAvatarPx     = 256
+	identiconCells  = 5
+)
+
+func (avatar *avatarHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+	name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/avatar/"), ".png")
+	if len(name) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	size := defaultAvatarPx
+	if sizeString := r.URL.Query().Get("s"); len(sizeString) > 0 {
+		parsed, err := strconv.Atoi(sizeString)
+		if err != nil || parsed < 16 || parsed > maxAvatarPx {
+			http.Error(w, "Invalid size, must be 16-"+strconv.Itoa(maxAvatarPx)+".", 400)
+			return
+		}
+		size = parsed
+	}
+	if avatar.emailFor != nil {
+		if email, found := avatar.emailFor(name); found {
+			w.Header().Set("Cache-Control", "public, max-age=3600")
+			http.Redirect(w, r, gravatarURL(email, size), http.StatusFound)
+			return
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, identicon(name, size)); err != nil {
+		http.Error(w, "Failed to draw avatar.", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(buf.Bytes()))
+}
+
+func gravatarURL(email string, size int) string {
+	sum := md5.Sum([]byte(strings.ToLower(strings.TrimSpace(email))))
+	return "https://www.gravatar.com/avatar/" + hex.EncodeToString(sum[:]) +
+		"?" + url.Values{"s": {strconv.Itoa(size)}, "d": {"identicon"}}.Encode()
+}
+
+// nameHue is where on the color wheel a name lands, shared by identicons
+// and name colors so a speaker's name matches their avatar.
+func nameHue(name string) float64 {
+	sum := sha256.Sum256([]byte(name))
+	return float64(uint16(sum[0])<<8|uint16(sum[1])) / 65536
+}
+
+// nameColor returns a stable css color for a rendered display name, dark
+// enough to read on the page background.
+func nameColor(displayName string) string {
+	c := hslColor(nameHue(html.UnescapeString(displayName)), 0.6, 0.38)
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// identicon draws a horizontally mirrored 5x5 grid in a color picked from
+// the name's hash, github style.
+func identicon(name string, size int) image.Image {
+	sum := sha256.Sum256([]byte(name))
+	foreground := hslColor(nameHue(name), 0.55, 0.55)
+	img := image.NewPaletted(image.Rect(0, 0, size, size), color.Palette{color.RGBA{0xf0, 0xf0, 0xf0, 0xff}, foreground})
+	// half a cell of margin on each side
+	cell := float64(size) / (identiconCells + 1)
+	margin := cell / 2
+	for row := 0; row < identiconCells; row++ {
+		for col := 0; col < (identiconCells+1)/2; col++ {
+			if sum[2+row*3+col]&1 == 0 {
+				continue
+			}
+			for _, c := range []int{col, identiconCells - 1 - col} {
+				x0, y0 := int(margin+float64(c)*cell), int(margin+float64(row)*cell)
+				x1, y1 := int(margin+float64(c+1)*cell), int(margin+float64(row+1)*cell)
+				for y := y0; y < y1; y++ {
+					for x := x0; x < x1; x++ {
+						img.SetColorIndex(x, y, 1)
+					}
+				}
+			}
+		}
+	}
+	return img
+}
+
+func hslColor(h, s, l float64) color.RGBA {
+	c := (1 - math.Abs(2*l-1)) * s
+	x := c * (1 - math.Abs(math.Mod(h*6, 2)-1))
+	m := l - c/2
+	var r, g, b float64
+	switch int(h * 6) {
+	case 0:
+		r, g, b = c, x, 0
+	case 1:
+		r, g, b = x, c, 0
+	case 2:
+		r, g, b = 0, c, x
+	case 3:
+		r, g, b = 0, x, c
+	case 4:
+		r, g, b = x, 0, c
+	default:
+		r, g, b = c, 0, x
+	}
+	return color.RGBA{uint8((r + m) * 255), uint8((g + m) * 255), uint8((b + m) * 255), 0xff}
+}
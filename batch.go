@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// most chats a single batch can publish
+const maxBatchChats = 100
+
+type batchChat struct {
+	Topic       string `json:"topic"`
+	DisplayName string `json:"display_name"`
+	Message     string `json:"message"`
+	// a picture of the remote poster, only shown for -bridgesFile bridges
+	// that allow avatars
+	AvatarURL string `json:"avatar_url,omitempty"`
+	// epoch ms, only orders the batch, chats are stamped when published
+	Timestamp int64 `json:"timestamp,omitempty"`
+}
+
+type batchResult struct {
+	Index     int    `json:"index"` // where the chat was in the request
+	ID        string `json:"id"`
+	EventID   int64  `json:"event_id"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// getBatchPostClosure serves POST /api/v1/chats:batch for importers and
+// bridges:
+//
+//	{"chats": [{"topic": "...", "display_name": "...", "message": "...", "timestamp": MS}, ...]}
+//
+// Every chat goes through the same checks as /post, counting against rate
+// limits and quotas as it's checked, and if any of them is rejected nothing
+// is published.  Chats /post would hold for review are rejected with a 422,
+// batches are never held.  Otherwise they're all published at once
+// in timestamp order and the response lists what they were assigned, in
+// request order.  Batches can't be scheduled or go to encrypted rooms, and
+// skip link previews and translations.
+//
+// Tokens mapped in -bridgesFile relay chats from another network: their
+// display_names are formatted to set them apart and the chats are marked
+// with where they came from, see bridgeMappings.
+func getBatchPostClosure(opts postOptions) func(w http.ResponseWriter, r *http.Request) {
+	reg := regexp.MustCompile("[^A-Za-z0-9]+")
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, int64(maxBatchChats)*(int64(opts.Renderer.limits.MessageLen)*4+1024))
+		var batch struct {
+			Chats []batchChat `json:"chats"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			writeJSON(w, 400, map[string]string{"error": "Invalid json body."})
+			return
+		}
+		if len(batch.Chats) == 0 || len(batch.Chats) > maxBatchChats {
+			writeJSON(w, 400, map[string]string{"error": fmt.Sprintf("A batch has to have 1-%d chats.", maxBatchChats)})
+			return
+		}
+		postedBy, _ := opts.Access.identify(r)
+		bridge := opts.Bridges.lookup(postedBy)
+		chats := make([]ChatPost, len(batch.Chats))
+		// the chats before a rejected one give back their places
+		release := func(passed []ChatPost) {
+			for _, chat := range passed {
+				notifyReleased(opts.Checks, r, chat)
+			}
+		}
+		reject := func(index int, topic, reason string, status int, message string) {
+			release(chats[:index])
+			opts.Stats.recordRejection(topic, reason)
+			writeJSON(w, status, map[string]interface{}{"error": message, "index": index})
+		}
+		for i, posted := range batch.Chats {
+			topic := truncateInput(normalizeTopic(posted.Topic, reg), int(opts.Renderer.limits.TopicLen))
+			if len(topic) == 0 || len(strings.TrimSpace(posted.DisplayName)) == 0 || len(strings.TrimSpace(posted.Message)) == 0 {
+				reject(i, topic, "blank_field", 400, "Blank/Invalid topic, display_name or message.")
+				return
+			}
+			if opts.Rooms.has(topic) {
+				reject(i, topic, "not_encrypted", 400, "Encrypted rooms only take chats encrypted by the room's page.")
+				return
+			}
+			chat := ChatPost{ID: randomID(8), Topic: topic}
+			rawMessage, err := opts.Renderer.applySlashCommand(posted.Message, &chat)
+			if err != nil {
+				reject(i, topic, "bad_command", 400, err.Error())
+				return
+			}
+			if bridge != nil {
+				posted.DisplayName = bridge.displayName(posted.DisplayName)
+				chat.Bridge = opts.Bridges.origin(bridge, posted.AvatarURL)
+			}
+			chat.DisplayName = opts.Renderer.renderName(posted.DisplayName)
+			chat.NameColor = nameColor(chat.DisplayName)
+			chat.Message = opts.Renderer.renderMessage(topic, rawMessage)
+			if rejection := runPostChecks(opts.Checks, r, &chat); rejection != nil {
+				release(chats[:i])
+				opts.Stats.recordRejection(topic, rejection.Reason)
+				writeRateLimitHeaders(w, opts.Checks, r)
+				body := rejectionBody(w, rejection)
+				body["index"] = i
+				status := rejection.Status
+				if rejection.Hold {
+					// holding part of a batch would break it up, so none of
+					// it is held and it mustn't look accepted
+					status = 422
+					body["error"] = "This chat would be held for moderator review, nothing in the batch was published."
+				}
+				writeJSON(w, status, body)
+				return
+			}
+			chats[i] = chat
+		}
+		// names are only reserved once the whole batch passed
+		claims := make([]nameClaim, len(chats))
+		for i, chat := range chats {
+			claims[i] = nameClaim{chat.Topic, chat.DisplayName}
+		}
+		if taken := opts.Names.claim(claims, "user:"+postedBy); taken >= 0 {
+			release(chats)
+			opts.Stats.recordRejection(chats[taken].Topic, "name_in_use")
+			writeJSON(w, 409, map[string]interface{}{"error": "Name in use, someone else is posting as " + chats[taken].DisplayName + " in this topic right now.",
+				"index": taken})
+			return
+		}
+		order := make([]int, len(chats))
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(i, j int) bool {
+			return batch.Chats[order[i]].Timestamp < batch.Chats[order[j]].Timestamp
+		})
+		pending := make([]pendingEvent, len(order))
+		for i, index := range order {
+			pending[i] = pendingEvent{chats[index].Topic, chats[index]}
+		}
+		events, err := opts.Manager.publishAll(pending)
+		if err != nil {
+			release(chats)
+			writeJSON(w, 500, map[string]string{"error": "Failed to publish chats: " + err.Error()})
+			return
+		}
+		results := make([]batchResult, len(chats))
+		for i, index := range order {
+			opts.Stats.recordPost(chats[index])
+			notifyPublished(opts.Checks, r, chats[index])
+			results[index] = batchResult{Index: index, ID: chats[index].ID, EventID: events[i].ID, Timestamp: events[i].Timestamp}
+		}
+		writeRateLimitHeaders(w, opts.Checks, r)
+		writeJSON(w, 200, map[string][]batchResult{"chats": results})
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Published list of current Tor exit node addresses, one per line.
+const torExitListURL = "https://check.torproject.org/torbulkexitlist"
+
+// ipBlocklist refuses posts from addresses on periodically refreshed lists
+// (the Tor exit list, open proxy lists, ...) or listed by DNSBL zones.  Some
+// public deployments get nearly all of their abuse through these.
+type ipBlocklist struct {
+	mu     sync.Mutex
+	urls   []string
+	zones  []string
+	client *http.Client
+	// from the downloaded lists
+	ips  map[string]bool
+	nets []*net.IPNet
+	// cached dnsbl answers
+	dnsblCache map[string]dnsblAnswer
+}
+
+type dnsblAnswer struct {
+	listed  bool
+	checked time.Time
+}
+
+const (
+	dnsblCacheTime = time.Hour
+	// for all of a lookup's zones, it holds up the post
+	dnsblLookupTimeout = 2 * time.Second
+)
+
+func newIPBlocklist(urls, zones []string, refresh time.Duration) *ipBlocklist {
+	blocklist := &ipBlocklist{
+		urls:       urls,
+		zones:      zones,
+		client:     &http.Client{Timeout: 30 * time.Second},
+		ips:        make(map[string]bool),
+		dnsblCache: make(map[string]dnsblAnswer),
+	}
+	if len(urls) > 0 || len(zones) > 0 {
+		go func() {
+			for {
+				blocklist.refresh()
+				time.Sleep(refresh)
+			}
+		}()
+	}
+	return blocklist
+}
+
+// refresh downloads the lists again and forgets expired dnsbl answers.
+func (blocklist *ipBlocklist) refresh() {
+	blocklist.mu.Lock()
+	for ip, answer := range blocklist.dnsblCache {
+		if time.Since(answer.checked) >= dnsblCacheTime {
+			delete(blocklist.dnsblCache, ip)
+		}
+	}
+	blocklist.mu.Unlock()
+	if len(blocklist.urls) == 0 {
+		return
+	}
+	ips := make(map[string]bool)
+	var nets []*net.IPNet
+	for _, url := range blocklist.urls {
+		listIPs, listNets, err := blocklist.download(url)
+		if err != nil {
+			// keep using the previous lists rather than unblocking
+			// everything because one download failed
+			log.Printf("Failed to refresh blocklist %s: %v\n", url, err)
+			return
+		}
+		for ip := range listIPs {
+			ips[ip] = true
+		}
+		nets = append(nets, listNets...)
+	}
+	blocklist.mu.Lock()
+	blocklist.ips, blocklist.nets = ips, nets
+	blocklist.mu.Unlock()
+	log.Printf("Refreshed blocklists: %d addresses, %d networks\n", len(ips), len(nets))
+}
+
+// download fetches a list of IPs or CIDRs, one per line.  Blank lines and
+// anything after a # are ignored.
+func (blocklist *ipBlocklist) download(url string) (map[string]bool, []*net.IPNet, error) {
+	resp, err := blocklist.client.Get(url)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	ips := make(map[string]bool)
+	var nets []*net.IPNet
+	scanner := bufio.NewScanner(io.LimitReader(resp.Body, 64*1024*1024))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		if strings.Contains(line, "/") {
+			if _, ipNet, err := net.ParseCIDR(line); err == nil {
+				nets = append(nets, ipNet)
+			}
+		} else if ip := net.ParseIP(line); ip != nil {
+			ips[ip.String()] = true
+		}
+	}
+	return ips, nets, scanner.Err()
+}
+
+func (blocklist *ipBlocklist) listed(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	blocklist.mu.Lock()
+	onList := blocklist.ips[parsed.String()] || containsIP(blocklist.nets, ip)
+	answer, cached := blocklist.dnsblCache[ip]
+	blocklist.mu.Unlock()
+	if onList {
+		return true
+	}
+	if len(blocklist.zones) == 0 || parsed.To4() == nil {
+		// dnsbl zones generally only cover ipv4
+		return false
+	}
+	if cached && time.Since(answer.checked) < dnsblCacheTime {
+		return answer.listed
+	}
+	listed := blocklist.dnsblListed(parsed.To4())
+	blocklist.mu.Lock()
+	blocklist.dnsblCache[ip] = dnsblAnswer{listed: listed, checked: time.Now()}
+	blocklist.mu.Unlock()
+	return listed
+}
+
+// dnsblListed looks up d.c.b.a.zone for each zone; any 127.0.0.x answer
+// means the address is listed.  Zones that don't answer in time count as
+// not listed.
+func (blocklist *ipBlocklist) dnsblListed(ip net.IP) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsblLookupTimeout)
+	defer cancel()
+	reversed := fmt.Sprintf("%d.%d.%d.%d", ip[3], ip[2], ip[1], ip[0])
+	for _, zone := range blocklist.zones {
+		addrs, err := net.DefaultResolver.LookupHost(ctx, reversed+"."+zone)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if strings.HasPrefix(addr, "127.0.0.") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (blocklist *ipBlocklist) check(r *http.Request, chat *ChatPost) *postRejection {
+	if !blocklist.listed(networkIP(r)) {
+		return nil
+	}
+	return &postRejection{Reason: "blocklisted_ip", Status: 403,
+		Message: "Posting is not allowed from your network (Tor, proxy or blocklisted address)."}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// bridgeMappings decide how chats relayed from other networks (IRC, Matrix,
+// Slack, ...) through /post or /api/v1/chats:batch are shown, keyed by the
+// account or api token the bridge posts with:
+//
+//	{"bridges": [{"poster": "libera-bridge", "network": "irc", "badge": "IRC",
+//	  "name_format": "{name}@libera", "avatars": false}]}
+//
+// A mapped poster's chats have their display_name run through name_format
+// and carry a bridge origin the page shows as a badge.  Only mapped posters
+// get an origin, and native posters can't take a name that looks like one
+// of the formats, so the two can't be mistaken for each other.
+type bridgeMappings struct {
+	byPoster map[string]*bridgeMapping
+	renderer *chatRenderer
+}
+
+type bridgeMapping struct {
+	Poster  string `json:"poster"`
+	Network string `json:"network"` // irc, matrix, slack, ...
+	Badge   string `json:"badge"`   // shown next to names, the network when blank
+	// {name} is the remote name and {network} the network, "{name} ({network})"
+	// when blank
+	NameFormat string `json:"name_format"`
+	// use the avatar_url hints the bridge sends, identicons otherwise
+	Avatars bool `json:"avatars"`
+	// the format's text around {name}, what native names can't have
+	prefix, suffix string
+}
+
+// chatOrigin is where a bridged chat came from.
+type chatOrigin struct {
+	Network string `json:"network"`
+	Badge   string `json:"badge"`
+	Avatar  string `json:"avatar,omitempty"` // the bridge's hint, proxied with -camo
+}
+
+const (
+	maxBridgeBadgeLen = 16
+	maxAvatarURLLen   = 512
+)
+
+var bridgeNetworkRegex = regexp.MustCompile(`^[a-z0-9_.-]{1,32}$`)
+
+func loadBridgeMappings(path string, renderer *chatRenderer) (*bridgeMappings, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Bridges []*bridgeMapping `json:"bridges"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	bridges := &bridgeMappings{byPoster: make(map[string]*bridgeMapping), renderer: renderer}
+	for _, bridge := range file.Bridges {
+		if len(bridge.Poster) == 0 {
+			return nil, errors.New("bridges need a poster")
+		}
+		if _, dup := bridges.byPoster[bridge.Poster]; dup {
+			return nil, errors.New("more than one bridge for poster " + bridge.Poster)
+		}
+		if !bridgeNetworkRegex.MatchString(bridge.Network) {
+			return nil, errors.New("bridge " + bridge.Poster + " needs a network of a-z0-9_.-")
+		}
+		if len(strings.TrimSpace(bridge.Badge)) == 0 {
+			bridge.Badge = bridge.Network
+		}
+		if len(bridge.Badge) > maxBridgeBadgeLen {
+			return nil, errors.New("bridge " + bridge.Poster + " has a badge longer than 16 characters")
+		}
+		if len(bridge.NameFormat) == 0 {
+			bridge.NameFormat = "{name} ({network})"
+		}
+		format := strings.Replace(bridge.NameFormat, "{network}", bridge.Network, -1)
+		if strings.Count(format, "{name}") != 1 {
+			return nil, errors.New("bridge " + bridge.Poster + " name_format needs {name} once")
+		}
+		parts := strings.SplitN(format, "{name}", 2)
+		bridge.prefix, bridge.suffix = parts[0], parts[1]
+		bridges.byPoster[bridge.Poster] = bridge
+	}
+	return bridges, nil
+}
+
+// lookup returns the bridge the request posts as, nil for native posters.
+func (bridges *bridgeMappings) lookup(postedBy string) *bridgeMapping {
+	if bridges == nil || len(postedBy) == 0 {
+		return nil
+	}
+	return bridges.byPoster[postedBy]
+}
+
+// displayName is the raw remote name as shown here, before rendering.
+func (bridge *bridgeMapping) displayName(remoteName string) string {
+	return bridge.prefix + strings.TrimSpace(remoteName) + bridge.suffix
+}
+
+// origin is what a bridged chat carries, with the avatar hint when the
+// bridge is trusted with them and it's a plain https url.
+func (bridges *bridgeMappings) origin(bridge *bridgeMapping, avatarURL string) *chatOrigin {
+	origin := &chatOrigin{Network: bridge.Network, Badge: bridge.Badge}
+	// it ends up in an img src as is
+	if !bridge.Avatars || len(avatarURL) == 0 || len(avatarURL) > maxAvatarURLLen || strings.ContainsAny(avatarURL, "\"'<>` \\") {
+		return origin
+	}
+	parsed, err := url.Parse(avatarURL)
+	if err != nil || parsed.Scheme != "https" || len(parsed.Host) == 0 {
+		return origin
+	}
+	origin.Avatar = parsed.String()
+	if bridges.renderer.camo != nil {
+		origin.Avatar = bridges.renderer.camo.proxiedURL(origin.Avatar)
+	}
+	return origin
+}
+
+// check keeps native posters from taking names formatted like a bridge's.
+func (bridges *bridgeMappings) check(r *http.Request, chat *ChatPost) *postRejection {
+	if chat.Bridge != nil || chat.System {
+		return nil
+	}
+	name := html.UnescapeString(chat.DisplayName)
+	for _, bridge := range bridges.byPoster {
+		if len(bridge.prefix)+len(bridge.suffix) > 0 && len(name) > len(bridge.prefix)+len(bridge.suffix) &&
+			strings.HasPrefix(name, bridge.prefix) && strings.HasSuffix(name, bridge.suffix) {
+			return &postRejection{Reason: "bridge_name", Status: 409,
+				Message: "Names formatted like " + html.EscapeString(bridge.NameFormat) + " are for chats bridged from " + bridge.Network + "."}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// chatTombstone is published in place of a chat that was removed before the
+// global retention ran out, pages drop the chat with that id when they see
+// one.
+type chatTombstone struct {
+	Tombstone string `json:"tombstone"`
+	Topic     string `json:"topic"`
+	Reason    string `json:"reason"` // burned or expired
+}
+
+// Burn-after-reading chats are removed this long after they are first
+// delivered, so every long poll woken by the same publish still gets them.
+const burnGrace = 2 * time.Second
+
+const maxBurnMinutes = 24 * 60
+
+// parseBurn parses the post form's burn value: "read" to burn once the chat
+// has been delivered, or a number of minutes to burn it after.
+func parseBurn(value string) (afterRead bool, after time.Duration, ok bool) {
+	if value == "read" {
+		return true, 0, true
+	}
+	minutes, err := strconv.Atoi(value)
+	if err != nil || minutes < 1 || minutes > maxBurnMinutes {
+		return false, 0, false
+	}
+	return false, time.Duration(minutes) * time.Minute, true
+}
+
+// parseExpireAfter parses the post form's expire_after value, a duration
+// like "1h" or "30m" that has to be shorter than the global retention.
+func parseExpireAfter(value string, retention time.Duration) (time.Duration, bool) {
+	after, err := time.ParseDuration(value)
+	if err != nil || after < time.Minute || after >= retention {
+		return 0, false
+	}
+	return after, true
+}
+
+// chatBurner removes chats from the store ahead of the global retention:
+// burn chats once they've been delivered to a subscriber, and any chat
+// whose expires_at has passed.
+type chatBurner struct {
+	manager *chatStore
+	mu      sync.Mutex
+	pending map[string]bool // ids waiting out burnGrace
+}
+
+func newChatBurner(manager *chatStore) *chatBurner {
+	burner := &chatBurner{manager: manager, pending: make(map[string]bool)}
+	manager.onDeliver(burner.delivered)
+	go burner.run()
+	return burner
+}
+
+// delivered is registered as a chatStore delivery callback.
+func (burner *chatBurner) delivered(events []*chatEvent) {
+	for _, event := range events {
+		chat, ok := event.Data.(ChatPost)
+		if !ok || !chat.Burn {
+			continue
+		}
+		burner.mu.Lock()
+		if burner.pending[chat.ID] {
+			burner.mu.Unlock()
+			continue
+		}
+		burner.pending[chat.ID] = true
+		burner.mu.Unlock()
+		time.AfterFunc(burnGrace, func() {
+			burner.burn("burned", func(other ChatPost) bool { return other.ID == chat.ID })
+			burner.mu.Lock()
+			delete(burner.pending, chat.ID)
+			burner.mu.Unlock()
+		})
+	}
+}
+
+// run is the reaper for chats with their own expiry.
+func (burner *chatBurner) run() {
+	for range time.Tick(5 * time.Second) {
+		now := timeToEpochMilliseconds(time.Now())
+		burner.burn("expired", func(chat ChatPost) bool { return chat.ExpiresAt > 0 && chat.ExpiresAt <= now })
+	}
+}
+
+// burn removes the chats match picks from every category and publishes a
+// tombstone for each of them.
+func (burner *chatBurner) burn(reason string, match func(ChatPost) bool) {
+	removed := burner.manager.remove(func(event *chatEvent) bool {
+		chat, ok := event.Data.(ChatPost)
+		return ok && len(chat.ID) > 0 && match(chat)
+	})
+	for _, event := range removed {
+		chat := event.Data.(ChatPost)
+		burner.manager.Publish(chat.Topic, chatTombstone{Tombstone: chat.ID, Topic: chat.Topic, Reason: reason})
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"golang.org/x/net/html"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// camoProxy re-serves external images from our own origin so readers'
+// browsers never hit arbitrary third party hosts (which leaks their IPs).
+// Image urls are rewritten when a chat is rendered to
+//
+//	/camo/<hmac of url>?url=<url>
+//
+// and the hmac keeps the proxy from being used to fetch arbitrary urls.
+type camoProxy struct {
+	key         []byte
+	client      *http.Client
+	maxBytes    int64
+	thumbnailPx int
+
+	mu         sync.Mutex
+	cache      map[string]*list.Element
+	lru        *list.List // front is most recently used
+	cacheBytes int64
+	maxCache   int64
+}
+
+type camoImage struct {
+	url         string
+	contentType string
+	data        []byte
+	fetched     time.Time
+}
+
+type camoOptions struct {
+	Key           []byte
+	MaxImageBytes int64
+	CacheBytes    int64
+	// proxied images larger than this get scaled down, 0 to serve as is
+	ThumbnailPx int
+}
+
+const camoCacheTime = 24 * time.Hour
+
+func newCamoProxy(opts camoOptions) *camoProxy {
+	return &camoProxy{
+		key:         opts.Key,
+		client:      newSafeHTTPClient(10 * time.Second),
+		maxBytes:    opts.MaxImageBytes,
+		thumbnailPx: opts.ThumbnailPx,
+		cache:       make(map[string]*list.Element),
+		lru:         list.New(),
+		maxCache:    opts.CacheBytes,
+	}
+}
+
+func (camo *camoProxy) digest(imageURL string) string {
+	mac := hmac.New(sha256.New, camo.key)
+	mac.Write([]byte(imageURL))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+func (camo *camoProxy) proxiedURL(imageURL string) string {
+	return "/camo/" + camo.digest(imageURL) + "?url=" + url.QueryEscape(imageURL)
+}
+
+// rewrite points every external <img src> in sanitized chat html at the
+// proxy.  Relative urls (our own uploads) are left alone.
+func (camo *camoProxy) rewrite(message string) string {
+	tokenizer := html.NewTokenizer(strings.NewReader(message))
+	var out bytes.Buffer
+	for {
+		tokenType := tokenizer.Next()
+		switch tokenType {
+		case html.ErrorToken:
+			return out.String()
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			if token.Data == "img" {
+				for i, attr := range token.Attr {
+					if attr.Key == "src" && (strings.HasPrefix(attr.Val, "http://") || strings.HasPrefix(attr.Val, "https://")) {
+						token.Attr[i].Val = camo.proxiedURL(attr.Val)
+					}
+				}
+			}
+			out.WriteString(token.String())
+		default:
+			out.Write(tokenizer.Raw())
+		}
+	}
+}
+
+func (camo *camoProxy) cached(imageURL string) *camoImage {
+	camo.mu.Lock()
+	defer camo.mu.Unlock()
+	elem, found := camo.cache[imageURL]
+	if !found {
+		return nil
+	}
+	image := elem.Value.(*camoImage)
+	if time.Since(image.fetched) > camoCacheTime {
+		camo.removeElement(elem)
+		return nil
+	}
+	camo.lru.MoveToFront(elem)
+	return image
+}
+
+func (camo *camoProxy) store(image *camoImage) {
+	camo.mu.Lock()
+	defer camo.mu.Unlock()
+	if elem, found := camo.cache[image.url]; found {
+		camo.removeElement(elem)
+	}
+	camo.cache[image.url] = camo.lru.PushFront(image)
+	camo.cacheBytes += int64(len(image.data))
+	for camo.cacheBytes > camo.maxCache && camo.lru.Len() > 0 {
+		camo.removeElement(camo.lru.Back())
+	}
+}
+
+// NOTE: callers must hold camo.mu
+func (camo *camoProxy) removeElement(elem *list.Element) {
+	image := camo.lru.Remove(elem).(*camoImage)
+	delete(camo.cache, image.url)
+	camo.cacheBytes -= int64(len(image.data))
+}
+
+func (camo *camoProxy) fetch(imageURL string) (*camoImage, error) {
+	resp, err := camo.client.Get(imageURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, camo.maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > camo.maxBytes {
+		return nil, fmt.Errorf("image larger than %d bytes", camo.maxBytes)
+	}
+	// trust the content, not the remote server's content-type header
+	contentType := http.DetectContentType(data)
+	if _, found := uploadImageTypes[contentType]; !found {
+		return nil, fmt.Errorf("not a supported image: %s", contentType)
+	}
+	if camo.thumbnailPx > 0 {
+		if thumb, thumbType, ok, err := makeThumbnail(data, camo.thumbnailPx); err == nil && ok {
+			data, contentType = thumb, thumbType
+		}
+	}
+	return &camoImage{url: imageURL, contentType: contentType, data: data, fetched: time.Now()}, nil
+}
+
+// ServeHTTP handles GET /camo/<digest>?url=<url>
+func (camo *camoProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+	imageURL := r.URL.Query().Get("url")
+	digest := strings.TrimPrefix(r.URL.Path, "/camo/")
+	if !hmac.Equal([]byte(digest), []byte(camo.digest(imageURL))) {
+		http.Error(w, "Invalid signature.", 403)
+		return
+	}
+	image := camo.cached(imageURL)
+	if image == nil {
+		var err error
+		image, err = camo.fetch(imageURL)
+		if err != nil {
+			log.Printf("Failed to proxy image %s: %v\n", imageURL, err)
+			http.Error(w, "Failed to fetch image.", 502)
+			return
+		}
+		camo.store(image)
+	}
+	w.Header().Set("Content-Type", image.contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	http.ServeContent(w, r, "", image.fetched, bytes.NewReader(image.data))
+}
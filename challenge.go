@@ -0,0 +1,274 @@
+package main
+
+import (
+	"crypto/sha256"
+	"math/bits"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// riskChallenge only challenges posters that look automated, everyone else
+// never sees it.  Each chat is scored on how its poster (their session, or
+// their IP range without one) and their IP range (/24, /48) are behaving:
+//
+//	+1 for each chat beyond 3 from the range in the last minute
+//	+2 for 2 or more links, or links making up most of the chat
+//	+1 for a poster not seen before
+//	+1 for a range nobody posted from in the last day
+//	+2 for a poster whose range changed since their last chat
+//
+// At -challengeScore or more the chat is refused with a 428 until the
+// poster solves a proof of work from /challenge, which their browser does in
+// a second or two.  Solving it lets them post unchallenged for a while.
+// Accounts and api tokens are never challenged.
+type riskChallenge struct {
+	mu         sync.Mutex
+	threshold  int
+	bits       int
+	access     *accessControl
+	posters    map[string]*riskPoster
+	ranges     map[string]*riskRange // by networkRangeKey
+	challenges map[string]*issuedChallenge
+}
+
+type riskPoster struct {
+	lastRange   string
+	lastSeen    time.Time
+	passedUntil time.Time
+}
+
+type riskRange struct {
+	recent   []time.Time // chats published in the last minute
+	lastPost time.Time
+}
+
+type issuedChallenge struct {
+	poster  string
+	expires time.Time
+}
+
+const (
+	// how long a challenge can take to solve
+	challengeTTL = 5 * time.Minute
+	// how long solving one lets a poster skip them
+	challengePass = 10 * time.Minute
+	// most unsolved challenges held at once
+	maxOpenChallenges = 10000
+	// chats a minute before each one counts against the range
+	riskVelocityFree = 3
+	// most posters and ranges tracked, past it new ones are only scored
+	maxRiskPosters = 50000
+	maxRiskRanges  = 50000
+)
+
+var riskLinkRegex = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s"'<>]+`)
+
+func newRiskChallenge(threshold, difficulty int, access *accessControl) *riskChallenge {
+	challenge := &riskChallenge{threshold: threshold, bits: difficulty, access: access,
+		posters: make(map[string]*riskPoster), ranges: make(map[string]*riskRange),
+		challenges: make(map[string]*issuedChallenge)}
+	go challenge.cleanup()
+	return challenge
+}
+
+// riskKey is who a chat is scored against.
+func riskKey(r *http.Request) string {
+	if session := sessionID(r); len(session) > 0 {
+		return session
+	}
+	return "ip:" + networkRangeKey(r)
+}
+
+// NOTE: callers must hold challenge.mu
+func (challenge *riskChallenge) score(r *http.Request, chat *ChatPost, poster *riskPoster, now time.Time) int {
+	score := 0
+	recent := 0
+	ipRange := networkRangeKey(r)
+	known, found := challenge.ranges[ipRange]
+	if found {
+		for _, at := range known.recent {
+			if now.Sub(at) < time.Minute {
+				recent++
+			}
+		}
+	}
+	if recent >= riskVelocityFree {
+		score += recent + 1 - riskVelocityFree
+	}
+	links := len(riskLinkRegex.FindAllString(chat.Message, -1))
+	words := len(strings.Fields(plainText(chat.Message)))
+	if links >= 2 || (links > 0 && 2*links >= words) {
+		score += 2
+	}
+	if poster == nil {
+		score++
+	} else if len(poster.lastRange) > 0 && poster.lastRange != ipRange {
+		score += 2
+	}
+	if !found || now.Sub(known.lastPost) >= 24*time.Hour {
+		score++
+	}
+	return score
+}
+
+func (challenge *riskChallenge) check(r *http.Request, chat *ChatPost) *postRejection {
+	if challenge.access.allows(r, rolePoster) {
+		return nil
+	}
+	now := time.Now()
+	challenge.mu.Lock()
+	defer challenge.mu.Unlock()
+	poster := challenge.posters[riskKey(r)]
+	if poster != nil && now.Before(poster.passedUntil) {
+		return nil
+	}
+	if challenge.score(r, chat, poster, now) < challenge.threshold {
+		return nil
+	}
+	return &postRejection{Reason: "challenge", Status: 428,
+		Message: "Please confirm you're not a bot, your browser needs javascript for that."}
+}
+
+func (challenge *riskChallenge) published(r *http.Request, chat ChatPost) {
+	now := time.Now()
+	challenge.mu.Lock()
+	defer challenge.mu.Unlock()
+	ipRange := networkRangeKey(r)
+	known, found := challenge.ranges[ipRange]
+	if !found && len(challenge.ranges) < maxRiskRanges {
+		known = &riskRange{}
+		challenge.ranges[ipRange] = known
+	}
+	if known != nil {
+		kept := known.recent[:0]
+		for _, at := range known.recent {
+			if now.Sub(at) < time.Minute {
+				kept = append(kept, at)
+			}
+		}
+		known.recent = append(kept, now)
+		known.lastPost = now
+	}
+	key := riskKey(r)
+	poster, found := challenge.posters[key]
+	if !found {
+		if len(challenge.posters) >= maxRiskPosters {
+			return
+		}
+		poster = &riskPoster{}
+		challenge.posters[key] = poster
+	}
+	poster.lastRange = ipRange
+	poster.lastSeen = now
+}
+
+// evictOldest makes room for a poster who solved a challenge, they did
+// the work so they get remembered.
+// NOTE: callers must hold challenge.mu
+func (challenge *riskChallenge) evictOldest() {
+	oldest := ""
+	for key, poster := range challenge.posters {
+		if len(oldest) == 0 || poster.lastSeen.Before(challenge.posters[oldest].lastSeen) {
+			oldest = key
+		}
+	}
+	delete(challenge.posters, oldest)
+}
+
+// solvedChallenge reports whether sha256("token:answer") starts with want
+// zero bits.
+func solvedChallenge(token, answer string, want int) bool {
+	sum := sha256.Sum256([]byte(token + ":" + answer))
+	zeros := 0
+	for _, b := range sum {
+		zeros += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return zeros >= want
+}
+
+// cleanup forgets posters and ranges after a day, and challenges nobody
+// solved in time.
+func (challenge *riskChallenge) cleanup() {
+	for range time.Tick(time.Minute) {
+		now := time.Now()
+		challenge.mu.Lock()
+		for key, poster := range challenge.posters {
+			if now.Sub(poster.lastSeen) >= 24*time.Hour && now.After(poster.passedUntil) {
+				delete(challenge.posters, key)
+			}
+		}
+		for ipRange, known := range challenge.ranges {
+			if now.Sub(known.lastPost) >= 24*time.Hour {
+				delete(challenge.ranges, ipRange)
+			}
+		}
+		for token, issued := range challenge.challenges {
+			if now.After(issued.expires) {
+				delete(challenge.challenges, token)
+			}
+		}
+		challenge.mu.Unlock()
+	}
+}
+
+// getChallengeClosure serves /challenge:
+//
+//	GET returns {"token": T, "bits": N}
+//	POST token and answer, where sha256("T:answer") starts with N zero bits
+//
+// Each token can be solved once, by the session it was issued to.
+func getChallengeClosure(challenge *riskChallenge) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			ensureSession(w, r)
+			token := randomID(16)
+			challenge.mu.Lock()
+			if len(challenge.challenges) >= maxOpenChallenges {
+				challenge.mu.Unlock()
+				writeJSON(w, 503, map[string]string{"error": "Too many open challenges, try again in a few minutes."})
+				return
+			}
+			challenge.challenges[token] = &issuedChallenge{poster: riskKey(r), expires: time.Now().Add(challengeTTL)}
+			challenge.mu.Unlock()
+			writeJSON(w, 200, map[string]interface{}{"token": token, "bits": challenge.bits})
+		case "POST":
+			token := r.PostFormValue("token")
+			answer := r.PostFormValue("answer")
+			key := riskKey(r)
+			now := time.Now()
+			challenge.mu.Lock()
+			defer challenge.mu.Unlock()
+			issued, found := challenge.challenges[token]
+			if !found || issued.poster != key || now.After(issued.expires) {
+				writeJSON(w, 404, map[string]string{"error": "Unknown or expired challenge, get a new one."})
+				return
+			}
+			if len(answer) > 32 || !solvedChallenge(token, answer, challenge.bits) {
+				writeJSON(w, 400, map[string]string{"error": "Wrong answer."})
+				return
+			}
+			delete(challenge.challenges, token)
+			poster, found := challenge.posters[key]
+			if !found {
+				if len(challenge.posters) >= maxRiskPosters {
+					challenge.evictOldest()
+				}
+				// so it doesn't count as a first chat
+				poster = &riskPoster{lastRange: networkRangeKey(r)}
+				challenge.posters[key] = poster
+			}
+			poster.lastSeen = now
+			poster.passedUntil = now.Add(challengePass)
+			writeJSON(w, 200, map[string]int64{"passed_until": timeToEpochMilliseconds(poster.passedUntil)})
+		default:
+			http.Error(w, "Invalid request method.", 405)
+		}
+	}
+}
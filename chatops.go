@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// chatOps carries out /admin commands moderators type into a topic:
+//
+//	/admin lock [reason]       only moderators can post until unlocked
+//	/admin unlock
+//	/admin slowmode 30s        one chat per poster every 30s, off to stop
+//	/admin ban @name [10m]     topic ban whoever last posted as name
+//
+// The command itself isn't posted, what it did is, as a system chat.  It's
+// also the post check that enforces locks and slow mode.
+type chatOps struct {
+	manager *chatStore
+	stats   *chatStats
+	access  *accessControl
+	bans    *topicBans
+
+	mu       sync.Mutex
+	locked   map[string]string        // topic -> who locked it
+	slowmode map[string]time.Duration // topic -> time between chats
+	// when each poster last posted, by topic and session or address, for
+	// topics in slow mode
+	lastPost map[string]time.Time
+}
+
+const maxSlowmode = time.Hour
+
+// the name system chats are posted under
+const systemChatName = "system"
+
+func newChatOps(manager *chatStore, stats *chatStats, access *accessControl, bans *topicBans) *chatOps {
+	ops := &chatOps{manager: manager, stats: stats, access: access, bans: bans, locked: make(map[string]string),
+		slowmode: make(map[string]time.Duration), lastPost: make(map[string]time.Time)}
+	go ops.cleanup()
+	return ops
+}
+
+// isAdminCommand is true for messages chatOps should run instead of post.
+func isAdminCommand(message string) bool {
+	fields := strings.Fields(message)
+	return len(fields) > 0 && strings.ToLower(fields[0]) == "/admin"
+}
+
+// slowKeys are who a slow mode limit is kept against, the poster's session
+// and their address, so dropping cookies doesn't start them over.
+func slowKeys(r *http.Request, topic string) []string {
+	keys := []string{topic + "\x00ip:" + networkKey(r)}
+	if session := sessionID(r); len(session) > 0 {
+		keys = append(keys, topic+"\x00"+session)
+	}
+	return keys
+}
+
+func (ops *chatOps) check(r *http.Request, chat *ChatPost) *postRejection {
+	_, postedRole := ops.access.identify(r)
+	if postedRole >= roleModerator {
+		return nil
+	}
+	ops.mu.Lock()
+	defer ops.mu.Unlock()
+	if _, locked := ops.locked[chat.Topic]; locked {
+		return &postRejection{Reason: "topic_locked", Status: 403, Message: "This topic is locked, only moderators can post."}
+	}
+	// bots and announcers pace themselves with rate limits instead
+	interval, slow := ops.slowmode[chat.Topic]
+	if !slow || postedRole >= rolePoster {
+		return nil
+	}
+	for _, key := range slowKeys(r, chat.Topic) {
+		if wait := interval - time.Since(ops.lastPost[key]); wait > 0 {
+			return &postRejection{Reason: "slowmode", Status: 429,
+				Message: fmt.Sprintf("Slow mode is on, you can post again in %ds.", int(wait/time.Second)+1)}
+		}
+	}
+	return nil
+}
+
+func (ops *chatOps) published(r *http.Request, chat ChatPost) {
+	ops.mu.Lock()
+	defer ops.mu.Unlock()
+	if _, slow := ops.slowmode[chat.Topic]; slow {
+		for _, key := range slowKeys(r, chat.Topic) {
+			ops.lastPost[key] = time.Now()
+		}
+	}
+}
+
+// run carries out the /admin command in message for moderator by, posting
+// what it did to topic.  Errors are the usage mistakes to show them.
+func (ops *chatOps) run(by string, renderer *chatRenderer, topic, message string) error {
+	fields := strings.Fields(message)[1:]
+	if len(fields) == 0 {
+		return fmt.Errorf("Usage: /admin lock [reason] | unlock | slowmode 30s|off | ban @name [10m]")
+	}
+	var result string
+	switch strings.ToLower(fields[0]) {
+	case "lock":
+		ops.mu.Lock()
+		ops.locked[topic] = by
+		ops.mu.Unlock()
+		result = by + " locked the topic, only moderators can post."
+		if reason := strings.Join(fields[1:], " "); len(reason) > 0 {
+			result += "  Reason: " + reason
+		}
+	case "unlock":
+		ops.mu.Lock()
+		_, locked := ops.locked[topic]
+		delete(ops.locked, topic)
+		ops.mu.Unlock()
+		if !locked {
+			return fmt.Errorf("This topic isn't locked.")
+		}
+		result = by + " unlocked the topic."
+	case "slowmode":
+		if len(fields) != 2 {
+			return fmt.Errorf("Usage: /admin slowmode 30s|off")
+		}
+		if strings.ToLower(fields[1]) == "off" {
+			ops.mu.Lock()
+			delete(ops.slowmode, topic)
+			ops.mu.Unlock()
+			result = by + " turned slow mode off."
+			break
+		}
+		interval, ok := parseOpsDuration(fields[1])
+		if !ok || interval < time.Second || interval > maxSlowmode {
+			return fmt.Errorf("Invalid slow mode interval, must be 1s to 1h or off.")
+		}
+		ops.mu.Lock()
+		ops.slowmode[topic] = interval
+		ops.mu.Unlock()
+		result = by + " turned slow mode on, one chat every " + interval.String() + "."
+	case "ban":
+		if len(fields) < 2 || len(fields) > 3 || !strings.HasPrefix(fields[1], "@") {
+			return fmt.Errorf("Usage: /admin ban @name [10m]")
+		}
+		duration := 10 * time.Minute
+		if len(fields) == 3 {
+			var ok bool
+			if duration, ok = parseOpsDuration(fields[2]); !ok || duration < time.Minute || duration > maxTopicBan {
+				return fmt.Errorf("Invalid ban duration, must be 1m to 30 days worth.")
+			}
+		}
+		name := renderer.renderName(strings.TrimPrefix(fields[1], "@"))
+		latest := ops.manager.eventsMatching(func(event *chatEvent) bool {
+			chat, ok := event.Data.(ChatPost)
+			return ok && event.Category == topic && chat.DisplayName == name
+		}, 1)
+		var poster chatPoster
+		found := len(latest) > 0
+		if found {
+			poster, found = ops.bans.poster(latest[0].Data.(ChatPost).ID)
+		}
+		if !found {
+			return fmt.Errorf("No recent chats from %s in this topic.", name)
+		}
+		ops.bans.add(&topicBan{ID: randomID(8), Topic: topic, Session: poster.session, ClientIP: poster.clientIP,
+			UntilMs: timeToEpochMilliseconds(time.Now().Add(duration)), By: by, Fingerprint: &poster.fingerprint})
+		// renderMessage escapes it, so it mustn't be already
+		result = by + " removed " + html.UnescapeString(name) + " from the topic for " + duration.String() + "."
+	default:
+		return fmt.Errorf("Unknown /admin command %s, expected lock, unlock, slowmode or ban.", html.EscapeString(fields[0]))
+	}
+	chat := ChatPost{ID: randomID(8), Topic: topic, DisplayName: systemChatName, System: true,
+		Message: renderer.renderMessage(topic, result)}
+	if err := publishChat(ops.manager, ops.stats, chat); err != nil {
+		log.Printf("Failed to post /admin result in %s: %v\n", topic, err)
+	}
+	return nil
+}
+
+// parseOpsDuration reads durations like 30s or 10m, or plain seconds.
+func parseOpsDuration(value string) (time.Duration, bool) {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second, true
+	}
+	duration, err := time.ParseDuration(value)
+	return duration, err == nil
+}
+
+func (ops *chatOps) cleanup() {
+	for range time.Tick(time.Minute) {
+		ops.mu.Lock()
+		for key, at := range ops.lastPost {
+			if time.Since(at) > maxSlowmode {
+				delete(ops.lastPost, key)
+			}
+		}
+		ops.mu.Unlock()
+	}
+}
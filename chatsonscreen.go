@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// chatsOnScreen decides how many chats a page shows.  Topics listed in
+// the -topicChatsOnScreen flag get their own default, and a ?limit= query
+// param can pick anything up to what the topic's buffer holds.
+type chatsOnScreen struct {
+	Default   uint
+	PerTopic  map[string]uint
+	MaxFactor uint // buffers hold this many screens worth of chats
+}
+
+// parseTopicChatsOnScreen parses "topicA=200,topicB=20" style flag values.
+func parseTopicChatsOnScreen(value string) (map[string]uint, error) {
+	perTopic := make(map[string]uint)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if len(pair) == 0 {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || len(strings.TrimSpace(parts[0])) == 0 {
+			return nil, fmt.Errorf("expected topic=number, got %q", pair)
+		}
+		num, err := strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 32)
+		if err != nil || num < 1 {
+			return nil, fmt.Errorf("expected topic=number with number >= 1, got %q", pair)
+		}
+		perTopic[strings.TrimSpace(parts[0])] = uint(num)
+	}
+	return perTopic, nil
+}
+
+func (screen chatsOnScreen) topicDefault(topic string) uint {
+	if num, found := screen.PerTopic[topic]; found {
+		return num
+	}
+	return screen.Default
+}
+
+// bufferSize is how many events the store keeps for the given category.
+// We keep more than we show so stats by topic can go further back.
+func (screen chatsOnScreen) bufferSize(category string) int {
+	return int(screen.topicDefault(category) * screen.MaxFactor)
+}
+
+// forRequest honors a ?limit= override, capped at what the topic buffers.
+func (screen chatsOnScreen) forRequest(topic string, r *http.Request) uint {
+	num := screen.topicDefault(topic)
+	if limitString := r.URL.Query().Get("limit"); len(limitString) > 0 {
+		limit, err := strconv.ParseUint(limitString, 10, 32)
+		if err == nil && limit >= 1 {
+			num = uint(limit)
+		}
+	}
+	if max := uint(screen.bufferSize(topic)); num > max {
+		num = max
+	}
+	return num
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ChatStore is durable storage for every buffered event, so chats outlive a
+// restart and history can reach past what's in memory.  Backends (SQLite,
+// Postgres, Redis, ...) register a driver from an init func in a file of
+// their own, like filestore.go does, and are picked with -chatStore
+// driver:dsn.
+//
+// Events come back oldest first.  Their Data can be left as the stored
+// json.RawMessage, it's decoded before anything else sees it.
+type ChatStore interface {
+	// Append stores events already buffered, with their ids, in id order.
+	Append(events []*chatEvent) error
+	// Query returns up to limit of topic's newest events older than before
+	// (epoch ms), oldest first.  It's never asked for ALL_CHATS.
+	Query(topic string, before int64, limit int) ([]*chatEvent, error)
+	// Expire drops every event older than before (epoch ms).
+	Expire(before int64) error
+	// Snapshot returns every stored event, oldest first, to buffer again at
+	// startup.
+	Snapshot() ([]*chatEvent, error)
+}
+
+// chatStoreEraser is a ChatStore that can remove chats, for deleted chats
+// and /admin/erase.  Without it deleted chats are only left out of the
+// buffer at startup, and erasing fails.
+type chatStoreEraser interface {
+	// Remove drops the events match picks, returning how many.
+	Remove(match func(*chatEvent) bool) (int, error)
+}
+
+var chatStoreDrivers = make(map[string]func(dsn string) (ChatStore, error))
+
+func registerChatStore(name string, open func(dsn string) (ChatStore, error)) {
+	if _, found := chatStoreDrivers[name]; found {
+		panic("chat store driver registered twice: " + name)
+	}
+	chatStoreDrivers[name] = open
+}
+
+func chatStoreDriverNames() []string {
+	var names []string
+	for name := range chatStoreDrivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// openChatStore opens a -chatStore driver:dsn.
+func openChatStore(spec string) (ChatStore, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	open, found := chatStoreDrivers[parts[0]]
+	if !found || len(parts) < 2 || len(parts[1]) == 0 {
+		return nil, fmt.Errorf("must be driver:dsn with one of the drivers: %s", strings.Join(chatStoreDriverNames(), ", "))
+	}
+	return open(parts[1])
+}
+
+// chatPersistence keeps the manager's events in a ChatStore until they're as
+// old as the buffer's ttl.
+type chatPersistence struct {
+	store ChatStore
+	ttl   time.Duration
+}
+
+func newChatPersistence(store ChatStore, ttl time.Duration) *chatPersistence {
+	persisted := &chatPersistence{store: store, ttl: ttl}
+	go persisted.reap()
+	return persisted
+}
+
+func (persisted *chatPersistence) cutoff() int64 {
+	return timeToEpochMilliseconds(time.Now().Add(-persisted.ttl))
+}
+
+func (persisted *chatPersistence) reap() {
+	for range time.Tick(time.Minute) {
+		if err := persisted.store.Expire(persisted.cutoff()); err != nil {
+			log.Printf("Failed to expire stored chats: %q\n", err)
+		}
+	}
+}
+
+// buffered is registered as a chatStore buffer callback.  Burn after reading
+// and expiring chats never touch disk, and a tombstone removes its chat.
+func (persisted *chatPersistence) buffered(event *chatEvent) {
+	if chat, ok := event.Data.(ChatPost); ok && (chat.Burn || chat.ExpiresAt > 0) {
+		return
+	}
+	if err := persisted.store.Append([]*chatEvent{event}); err != nil {
+		log.Printf("Failed to store event: %q\n", err)
+		return
+	}
+	if tombstone, ok := event.Data.(chatTombstone); ok {
+		if _, err := persisted.remove(func(chat ChatPost) bool { return chat.ID == tombstone.Tombstone }); err != nil && err != errCantErase {
+			log.Printf("Failed to remove stored chat: %q\n", err)
+		}
+	}
+}
+
+var errCantErase = errors.New("the chatStore driver can't remove chats")
+
+// remove drops the stored chats match picks, returning how many.
+func (persisted *chatPersistence) remove(match func(chat ChatPost) bool) (int, error) {
+	eraser, ok := persisted.store.(chatStoreEraser)
+	if !ok {
+		return 0, errCantErase
+	}
+	return eraser.Remove(func(event *chatEvent) bool {
+		chat, ok := decodeStored(event).Data.(ChatPost)
+		return ok && len(chat.ID) > 0 && match(chat)
+	})
+}
+
+// decodeStored decodes the event's data if the store left it as json.
+func decodeStored(event *chatEvent) *chatEvent {
+	if raw, ok := event.Data.(json.RawMessage); ok {
+		event.Data = decodeEventData(raw)
+	}
+	return event
+}
+
+// restore buffers the stored events that haven't expired, returning how
+// many.
+func (persisted *chatPersistence) restore(manager *chatStore) (int, error) {
+	cutoff := persisted.cutoff()
+	if err := persisted.store.Expire(cutoff); err != nil {
+		return 0, err
+	}
+	events, err := persisted.store.Snapshot()
+	if err != nil {
+		return 0, err
+	}
+	var live []*chatEvent
+	for _, event := range events {
+		if event.Timestamp >= cutoff {
+			live = append(live, decodeStored(event))
+		}
+	}
+	return manager.restore(live), nil
+}
+
+// eventsBefore returns up to limit of the category's stored events older
+// than before, oldest first.  The firehose and multi topic views are only
+// ever served from memory.
+func (persisted *chatPersistence) eventsBefore(category string, before int64, limit int) ([]*chatEvent, error) {
+	if persisted == nil || category == ALL_CHATS || strings.Contains(category, ",") {
+		return nil, nil
+	}
+	events, err := persisted.store.Query(category, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	cutoff := persisted.cutoff()
+	var live []*chatEvent
+	for _, event := range events {
+		if event.Timestamp >= cutoff {
+			live = append(live, decodeStored(event))
+		}
+	}
+	return live, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// postRejection explains why a post check refused a chat.
+type postRejection struct {
+	Reason  string // short key recorded in stats
+	Status  int
+	Message string
+	// hold the chat for moderator review instead of dropping it
+	Hold bool
+}
+
+// postCheck inspects a rendered chat before it is published.  Returning
+// nil lets the chat through to the next check.
+type postCheck interface {
+	check(r *http.Request, chat *ChatPost) *postRejection
+}
+
+// postObserver is implemented by checks that need to know when a chat they
+// let through was actually published (ex: to count it against a quota).
+type postObserver interface {
+	published(r *http.Request, chat ChatPost)
+}
+
+// postReserver is implemented by observers that count a chat as soon as
+// check lets it through, so concurrent posts can't all get in under a limit.
+// released gives the chat's place back when it isn't published after all
+// (a later check refused it, it was held, or publishing failed), published
+// makes it stick.
+type postReserver interface {
+	released(r *http.Request, chat ChatPost)
+}
+
+// rateLimit is where a client stands against a limit on posting.
+type rateLimit struct {
+	Limit     int
+	Remaining int
+	Reset     time.Time // when Remaining next goes up
+}
+
+// postLimiter is implemented by checks that limit how often a client can
+// post, so responses can tell well-behaved bots how to pace themselves.
+type postLimiter interface {
+	limitFor(r *http.Request) (rateLimit, bool) // false when r isn't limited
+}
+
+// writeRateLimitHeaders sets X-RateLimit-Limit/Remaining/Reset (epoch
+// seconds) for the tightest limit the client is under, and Retry-After once
+// it has nothing left.  Nothing is set when no limits are configured.
+func writeRateLimitHeaders(w http.ResponseWriter, checks []postCheck, r *http.Request) {
+	var tightest *rateLimit
+	for _, c := range checks {
+		if limiter, ok := c.(postLimiter); ok {
+			limit, limited := limiter.limitFor(r)
+			if limited && (tightest == nil || limit.Remaining < tightest.Remaining) {
+				tightest = &limit
+			}
+		}
+	}
+	if tightest == nil {
+		return
+	}
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(tightest.Limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(tightest.Remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(tightest.Reset.Unix(), 10))
+	if tightest.Remaining == 0 {
+		retryIn := time.Until(tightest.Reset)/time.Second + 1
+		w.Header().Set("Retry-After", strconv.FormatInt(int64(retryIn), 10))
+	}
+}
+
+// wantsJSON is true for api clients that asked for json responses.
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// writeRejection answers with why a chat was refused, as json for api
+// clients:
+//
+//	{"error": "...", "reason": "daily_quota", "retry_after": SECONDS}
+//
+// where retry_after is only there for rate limits.
+func writeRejection(w http.ResponseWriter, r *http.Request, checks []postCheck, rejection *postRejection) {
+	writeRateLimitHeaders(w, checks, r)
+	if !wantsJSON(r) {
+		http.Error(w, rejection.Message, rejection.Status)
+		return
+	}
+	writeJSON(w, rejection.Status, rejectionBody(w, rejection))
+}
+
+func rejectionBody(w http.ResponseWriter, rejection *postRejection) map[string]interface{} {
+	body := map[string]interface{}{"error": rejection.Message, "reason": rejection.Reason}
+	if retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After")); err == nil && rejection.Status == 429 {
+		body["retry_after"] = retryAfter
+	}
+	return body
+}
+
+// runPostChecks runs the checks in order, stopping at the first rejection.
+// A rejected chat's places with the checks before it are given back, one
+// that passed is counted by every check until notifyPublished or
+// notifyReleased.
+func runPostChecks(checks []postCheck, r *http.Request, chat *ChatPost) *postRejection {
+	for i, c := range checks {
+		if rejection := c.check(r, chat); rejection != nil {
+			notifyReleased(checks[:i], r, *chat)
+			return rejection
+		}
+	}
+	return nil
+}
+
+// notifyReleased is for chats that passed the checks but won't be
+// published, or not with this request.
+func notifyReleased(checks []postCheck, r *http.Request, chat ChatPost) {
+	for _, c := range checks {
+		if reserver, ok := c.(postReserver); ok {
+			reserver.released(r, chat)
+		}
+	}
+}
+
+func notifyPublished(checks []postCheck, r *http.Request, chat ChatPost) {
+	for _, c := range checks {
+		if observer, ok := c.(postObserver); ok {
+			observer.published(r, chat)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+// Package client posts to and subscribes to topics on a micro-chat server,
+// so bots don't each have to write their own long poll loop.
+//
+//	c := client.New("https://chat.example.com", "bot-token")
+//	chats, err := c.Subscribe(ctx, "support")
+//	for chat := range chats {
+//		c.Post(ctx, chat.Topic, "echo-bot", chat.Message)
+//	}
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client talks to one micro-chat server.  Change its fields before using
+// it, not after.
+type Client struct {
+	BaseURL string
+	// bot token sent as a bearer token, blank to post anonymously
+	Token      string
+	HTTPClient *http.Client
+	// how long each long poll waits for new chats, at most 120s
+	PollTimeout time.Duration
+	// retries back off from a second up to this
+	MaxBackoff time.Duration
+	// optional, told about failed polls as they're retried
+	Logf func(format string, args ...interface{})
+}
+
+// ChatPost is a chat as the server sends it.  Messages are rendered html.
+type ChatPost struct {
+	ID          string `json:"id"`
+	DisplayName string `json:"display_name"`
+	Message     string `json:"message"`
+	Topic       string `json:"topic"`
+	Action      bool   `json:"action,omitempty"`
+	NameColor   string `json:"name_color,omitempty"`
+	Burn        bool   `json:"burn,omitempty"`
+	ExpiresAt   int64  `json:"expires_at,omitempty"`
+	Encrypted   bool   `json:"encrypted,omitempty"`
+	Verified    string `json:"verified,omitempty"`
+	// set on chats a bridge relayed from another network
+	Bridge *ChatOrigin `json:"bridge,omitempty"`
+	// Timestamp (epoch ms) and EventID of the event it came in, save
+	// EventID to pick up where you left off with SubscribeFrom
+	Timestamp int64 `json:"-"`
+	EventID   int64 `json:"-"`
+}
+
+// ChatOrigin is the network a bridged chat came from, and the badge and
+// avatar the server shows it with.
+type ChatOrigin struct {
+	Network string `json:"network"`
+	Badge   string `json:"badge"`
+	Avatar  string `json:"avatar,omitempty"`
+}
+
+// ErrRejected wraps errors the server answered with a 4xx, retrying the
+// same request won't help.
+var ErrRejected = errors.New("rejected by server")
+
+func New(baseURL, token string) *Client {
+	return &Client{
+		BaseURL:     strings.TrimRight(baseURL, "/"),
+		Token:       token,
+		HTTPClient:  &http.Client{Timeout: 2 * time.Minute},
+		PollTimeout: 50 * time.Second,
+		MaxBackoff:  time.Minute,
+	}
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body url.Values) ([]byte, error) {
+	var req *http.Request
+	var err error
+	if body != nil {
+		req, err = http.NewRequest(method, c.BaseURL+path, strings.NewReader(body.Encode()))
+	} else {
+		req, err = http.NewRequest(method, c.BaseURL+path, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if len(c.Token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+		return nil, fmt.Errorf("%w: %d %s", ErrRejected, resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("server returned %d %s", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	return data, nil
+}
+
+// Post publishes a chat.  Posts aren't retried, a rejected chat (a check
+// failed, the name is taken, ...) comes back as an ErrRejected error with
+// the server's reason.
+func (c *Client) Post(ctx context.Context, topic, displayName, message string) error {
+	_, err := c.do(ctx, "POST", "/post", url.Values{"topic": {topic}, "display_name": {displayName},
+		"message": {message}, "doAjax": {"yes"}})
+	return err
+}
+
+// Subscribe sends chats posted to topic from now on until ctx is done, then
+// closes the channel.  Failed polls are retried with backoff and resume
+// after the last chat received, so nothing is missed or repeated while the
+// server keeps it buffered.  The channel is also closed when the server
+// rejects the subscription outright (ex: a ban).
+func (c *Client) Subscribe(ctx context.Context, topic string) (<-chan ChatPost, error) {
+	return c.SubscribeFrom(ctx, topic, 0)
+}
+
+// SubscribeFrom is Subscribe starting after the event lastID, a chat's
+// EventID, rather than from now.
+func (c *Client) SubscribeFrom(ctx context.Context, topic string, lastID int64) (<-chan ChatPost, error) {
+	if len(topic) == 0 {
+		return nil, errors.New("blank topic")
+	}
+	if c.PollTimeout < time.Second || c.PollTimeout > 120*time.Second {
+		return nil, errors.New("PollTimeout has to be 1-120s")
+	}
+	chats := make(chan ChatPost)
+	go c.poll(ctx, topic, lastID, chats)
+	return chats, nil
+}
+
+type pollResponse struct {
+	Events []struct {
+		// blank from servers older than event types
+		Type      string          `json:"type"`
+		Timestamp int64           `json:"timestamp"`
+		ID        int64           `json:"id"`
+		Data      json.RawMessage `json:"data"`
+	} `json:"events"`
+	Timeout   string `json:"timeout"`
+	Timestamp int64  `json:"timestamp"`
+	Error     string `json:"error"`
+}
+
+func (c *Client) poll(ctx context.Context, topic string, lastID int64, chats chan<- ChatPost) {
+	defer close(chats)
+	// until there's an id to resume from, start from when we subscribed
+	sinceTime := time.Now().UnixNano() / int64(time.Millisecond)
+	backoff := time.Duration(0)
+	for ctx.Err() == nil {
+		query := url.Values{"timeout": {strconv.Itoa(int(c.PollTimeout / time.Second))}, "category": {topic}}
+		if lastID > 0 {
+			query.Set("last_id", strconv.FormatInt(lastID, 10))
+		} else {
+			query.Set("since_time", strconv.FormatInt(sinceTime, 10))
+		}
+		data, err := c.do(ctx, "GET", "/subscribe?"+query.Encode(), nil)
+		var resp pollResponse
+		if err == nil {
+			err = json.Unmarshal(data, &resp)
+		}
+		if err == nil && len(resp.Error) > 0 {
+			err = errors.New(resp.Error)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			if errors.Is(err, ErrRejected) {
+				c.logf("Subscription to %s rejected, giving up: %v", topic, err)
+				return
+			}
+			backoff = nextBackoff(backoff, c.MaxBackoff)
+			c.logf("Polling %s failed, retrying in %v: %v", topic, backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		backoff = 0
+		for _, event := range resp.Events {
+			lastID = event.ID
+			if len(event.Type) > 0 && event.Type != "chat" && event.Type != "system" {
+				continue
+			}
+			var chat ChatPost
+			// tombstones and anything else without a message aren't chats
+			if json.Unmarshal(event.Data, &chat) != nil || len(chat.Message) == 0 {
+				continue
+			}
+			chat.Timestamp, chat.EventID = event.Timestamp, event.ID
+			select {
+			case chats <- chat:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// nextBackoff doubles up to max, with jitter so a restarted server isn't
+// hit by every bot at once.
+func nextBackoff(last, max time.Duration) time.Duration {
+	next := 2 * last
+	if next < time.Second {
+		next = time.Second
+	}
+	if next > max {
+		next = max
+	}
+	return next/2 + time.Duration(rand.Int63n(int64(next/2)+1))
+}
+
+func (c *Client) logf(format string, args ...interface{}) {
+	if c.Logf != nil {
+		c.Logf(format, args...)
+	}
+}
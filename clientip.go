@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type clientIPKey struct{}
+
+// resolvedIP is what resolveClientIP works out about a request.
+type resolvedIP struct {
+	client  string // anonymized in privacy mode
+	network string
+	anon    *ipAnonymizer
+}
+
+// clientIP returns the address of the client that sent the request, or its
+// anonymized form in privacy mode.  This is what logging, quotas, rate limits
+// and bans should all key on.
+func clientIP(r *http.Request) string {
+	if resolved, ok := r.Context().Value(clientIPKey{}).(resolvedIP); ok {
+		return resolved.client
+	}
+	return remoteHost(r)
+}
+
+// networkIP is the client's real address even in privacy mode.  It's only
+// for checks against networks (loopback, CIDR lists, blocklists, GeoIP) and
+// must never be logged or kept.
+func networkIP(r *http.Request) string {
+	if resolved, ok := r.Context().Value(clientIPKey{}).(resolvedIP); ok {
+		return resolved.network
+	}
+	return remoteHost(r)
+}
+
+// networkKeySalt keeps networkKey from being reversed, it's new each run
+var networkKeySalt = []byte(randomID(16))
+
+// networkKey stands for networkIP where a client has to be told apart even
+// when it drops its cookies (one vote per person, abuse limits), without
+// keeping the address itself.
+func networkKey(r *http.Request) string {
+	return saltedKey(networkIP(r))
+}
+
+// networkRangeKey is networkKey for the /24 or /48 the client is in.
+func networkRangeKey(r *http.Request) string {
+	ip := networkIP(r)
+	if parsed := net.ParseIP(ip); parsed != nil {
+		ip = truncatedIP(parsed)
+	}
+	return saltedKey(ip)
+}
+
+func saltedKey(value string) string {
+	mac := hmac.New(sha256.New, networkKeySalt)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil)[:12])
+}
+
+// anonymizedIP returns an IP an admin typed in the way clientIP reports
+// them, so bans and lookups by IP still match in privacy mode.
+func anonymizedIP(r *http.Request, ip string) string {
+	resolved, _ := r.Context().Value(clientIPKey{}).(resolvedIP)
+	return resolved.anon.anonymize(ip)
+}
+
+// privateIPs is true in privacy mode.
+func privateIPs(r *http.Request) bool {
+	resolved, _ := r.Context().Value(clientIPKey{}).(resolvedIP)
+	return resolved.anon != nil
+}
+
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// parseCIDRs parses a list of CIDRs, treating bare IPs as single hosts.
+func parseCIDRs(values []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			if ip := net.ParseIP(value); ip != nil && ip.To4() != nil {
+				value += "/32"
+			} else {
+				value += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, ipNet := range nets {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveClientIP wraps the whole server so every handler sees the real
+// client IP.  X-Forwarded-For is only believed when the request came from a
+// trusted proxy, in which case the right-most untrusted hop is the client.
+// anon, when set, anonymizes the IP clientIP reports.
+func resolveClientIP(trustedProxies []*net.IPNet, anon *ipAnonymizer, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := remoteHost(r)
+		if containsIP(trustedProxies, ip) {
+			hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+			for i := len(hops) - 1; i >= 0; i-- {
+				hop := strings.TrimSpace(hops[i])
+				if net.ParseIP(hop) == nil {
+					break
+				}
+				ip = hop
+				if !containsIP(trustedProxies, hop) {
+					break
+				}
+			}
+		}
+		resolved := resolvedIP{client: anon.anonymize(ip), network: ip, anon: anon}
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPKey{}, resolved)))
+	})
+}
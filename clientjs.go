@@ -0,0 +1,170 @@
+package main
+
+import (
+	"net/http"
+)
+
+// getClientScriptClosure serves /static/microchat.js, the long poll client
+// the chat and embed pages use, for other pages that want to build their own
+// UI against this server.  It has no dependencies.
+func getClientScriptClosure() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		w.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		w.Write([]byte(getClientScriptString()))
+	}
+}
+
+func getClientScriptString() string {
+	return `// micro-chat client.
+//
+//   var conn = MicroChat.connect("some-topic", function(chat, event) {
+//     // chat.display_name and chat.message are sanitized html
+//   }, options);
+//   conn.post("my name", "hello").then(...);
+//   conn.close();
+//
+// events are {type, schema_version, timestamp, id, category, data}, chat
+// and system events go to the callback and the rest to their option.
+//
+// options, all optional:
+//   baseURL      server to talk to, blank for the page's own
+//   sinceTime    epoch ms to start from, defaults to now
+//   lastID       an event.id to resume after, wins over sinceTime
+//   maxBatch     only the newest this many events of a response are handed on
+//   onTombstone  function(chatID, event) for chats that were removed
+//   onFlag       function(chatID, hidden, reports, event) when enough people
+//                reported a chat to hide it, or a moderator showed it again
+//   onLike       function(chatID, likes, event) when a chat was liked
+//   onBatch      function(events) after each response's events were handed on
+//   onError      function(message) when a poll fails, it's retried shortly
+//   query        extra query string for /subscribe, ex: "&admin_token=..."
+var MicroChat = (function() {
+	function post(baseURL, topic, displayName, message) {
+		return new Promise(function(resolve, reject) {
+			var xhr = new XMLHttpRequest();
+			xhr.open("POST", (baseURL || "") + "/post");
+			xhr.setRequestHeader("Content-Type", "application/x-www-form-urlencoded");
+			xhr.onload = function() {
+				if (xhr.status == 200) {
+					resolve();
+				} else {
+					reject(xhr.responseText);
+				}
+			};
+			xhr.onerror = function() {
+				reject("Connection failed.");
+			};
+			xhr.send("doAjax=yes&topic=" + encodeURIComponent(topic) + "&display_name=" + encodeURIComponent(displayName) +
+				"&message=" + encodeURIComponent(message));
+		});
+	}
+
+	function connect(topic, onMessage, options) {
+		options = options || {};
+		var base = options.baseURL || "";
+		var lastID = options.lastID || 0;
+		var sinceTime = options.sinceTime || Date.now();
+		var closed = false;
+		var xhr = null;
+		var timer = null;
+
+		function next(delay) {
+			if (!closed) {
+				timer = setTimeout(poll, delay);
+			}
+		}
+
+		function failed(message) {
+			if (options.onError) {
+				options.onError(message);
+			}
+			next(3000);
+		}
+
+		function poll() {
+			// resume from exactly the last event we got once there is one
+			var since = lastID ? "&last_id=" + lastID : "&since_time=" + sinceTime;
+			xhr = new XMLHttpRequest();
+			xhr.open("GET", base + "/subscribe?timeout=50&category=" + encodeURIComponent(topic) + since + (options.query || ""));
+			xhr.onload = function() {
+				var data = null;
+				try {
+					data = JSON.parse(xhr.responseText);
+				} catch (e) {
+				}
+				if (!data || data.error || xhr.status != 200) {
+					failed((data && data.error) || "Unexpected response, status " + xhr.status + ".");
+					return;
+				}
+				// oldest first
+				var events = data.events || [];
+				var start = options.maxBatch && events.length > options.maxBatch ? events.length - options.maxBatch : 0;
+				for (var i = 0; i < events.length; i++) {
+					lastID = events[i].id || lastID;
+					sinceTime = events[i].timestamp;
+				}
+				for (var i = start; i < events.length; i++) {
+					var data = events[i].data;
+					switch (events[i].type) {
+					case "chat":
+					case "system":
+						onMessage(data, events[i]);
+						break;
+					case "tombstone":
+						if (options.onTombstone) {
+							options.onTombstone(data.tombstone, events[i]);
+						}
+						break;
+					case "reaction":
+						if (options.onLike) {
+							options.onLike(data.liked, data.likes, events[i]);
+						}
+						break;
+					case "flag":
+						if (options.onFlag) {
+							options.onFlag(data.flagged, data.hidden, data.reports, events[i]);
+						}
+						break;
+					}
+					// kinds this script doesn't know yet are skipped
+				}
+				if (events.length > 0 && options.onBatch) {
+					options.onBatch(events.slice(start));
+				}
+				next(10);
+			};
+			xhr.onerror = function() {
+				failed("Connection failed.");
+			};
+			xhr.send();
+		}
+		poll();
+
+		return {
+			post: function(displayName, message) {
+				return post(base, topic, displayName, message);
+			},
+			// an id to resume from with options.lastID, 0 before the first event
+			lastID: function() {
+				return lastID;
+			},
+			close: function() {
+				closed = true;
+				clearTimeout(timer);
+				if (xhr) {
+					xhr.abort();
+				}
+			}
+		};
+	}
+
+	return { connect: connect, post: post };
+})();
+`
+}
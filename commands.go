@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// slashCommand rewrites chats that start with /<name>.  Commands see the
+// raw markdown (everything after the command name) before it's rendered,
+// and may also flag the chat, like /me marking it as an action.
+type slashCommand struct {
+	Help string
+	Run  func(renderer *chatRenderer, args string, chat *ChatPost) (string, error)
+}
+
+var slashCommands = make(map[string]slashCommand)
+
+func registerSlashCommand(name, help string, run func(renderer *chatRenderer, args string, chat *ChatPost) (string, error)) {
+	slashCommands[name] = slashCommand{Help: help, Run: run}
+}
+
+var commandTopicRegex = regexp.MustCompile("[^A-Za-z0-9]+")
+
+func init() {
+	registerSlashCommand("me", "/me waves -- posts an action", func(renderer *chatRenderer, args string, chat *ChatPost) (string, error) {
+		if len(strings.TrimSpace(args)) == 0 {
+			return "", fmt.Errorf("Usage: /me does something")
+		}
+		chat.Action = true
+		return args, nil
+	})
+	registerSlashCommand("shrug", `/shrug [message] -- appends ¯\_(ツ)_/¯`, func(renderer *chatRenderer, args string, chat *ChatPost) (string, error) {
+		return strings.TrimSpace(args + ` ¯\\\_(ツ)\_/¯`), nil
+	})
+	registerSlashCommand("topic", "/topic name [message] -- links to a topic", func(renderer *chatRenderer, args string, chat *ChatPost) (string, error) {
+		fields := strings.SplitN(strings.TrimSpace(args), " ", 2)
+		topic := truncateInput(normalizeTopic(fields[0], commandTopicRegex), int(renderer.limits.TopicLen))
+		if len(topic) == 0 {
+			return "", fmt.Errorf("Usage: /topic name [message]")
+		}
+		message := "[#" + topic + "](/?topic=" + topic + ")"
+		if len(fields) > 1 {
+			message += " " + fields[1]
+		}
+		return message, nil
+	})
+}
+
+// applySlashCommand returns the message with its leading command, if any,
+// carried out.  Starting a message with // posts it as is, minus one slash.
+func (renderer *chatRenderer) applySlashCommand(message string, chat *ChatPost) (string, error) {
+	if !strings.HasPrefix(message, "/") {
+		return message, nil
+	}
+	if strings.HasPrefix(message, "//") {
+		return message[1:], nil
+	}
+	name, args := message[1:], ""
+	if i := strings.IndexAny(name, " \t\r\n"); i >= 0 {
+		name, args = name[:i], strings.TrimLeft(name[i:], " \t")
+	}
+	command, found := slashCommands[strings.ToLower(name)]
+	if !found {
+		return "", fmt.Errorf("Unknown command /%s.  Available commands: %s.  Start your message with // to post it as is.",
+			html.EscapeString(name), slashCommandList())
+	}
+	return command.Run(renderer, args, chat)
+}
+
+func slashCommandList() string {
+	var names []string
+	for name := range slashCommands {
+		names = append(names, "/"+name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
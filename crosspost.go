@@ -0,0 +1,56 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// most topics one chat can be posted to by listing them, comma separated,
+// in the topic field
+const maxCrossPostTopics = 3
+
+// splitTopics normalizes and truncates each comma separated topic in the
+// topic field, dropping blanks and repeats.  The first one is where the chat
+// is posted from.
+func splitTopics(field string, reg *regexp.Regexp, maxLen int) []string {
+	var topics []string
+	seen := make(map[string]bool)
+	for _, topic := range strings.Split(field, ",") {
+		topic = truncateInput(normalizeTopic(topic, reg), maxLen)
+		if len(topic) == 0 || seen[topic] {
+			continue
+		}
+		seen[topic] = true
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+// crossPosts copies chat into each of the other topics, every copy with its
+// own id and noting the topics the rest went to.
+func crossPosts(chat ChatPost, others []string) []ChatPost {
+	if len(others) == 0 {
+		return []ChatPost{chat}
+	}
+	all := append([]string{chat.Topic}, others...)
+	chats := make([]ChatPost, len(all))
+	for i, topic := range all {
+		chats[i] = chat
+		if i > 0 {
+			chats[i].ID = randomID(8)
+		}
+		chats[i].Topic = topic
+		for _, other := range all {
+			if other != topic {
+				chats[i].AlsoPostedIn = append(chats[i].AlsoPostedIn, other)
+			}
+		}
+	}
+	return chats
+}
+
+// TopicFieldLen is how long the topic field can be, for a full list of
+// topics and their commas.
+func (limits inputLimits) TopicFieldLen() uint {
+	return (limits.TopicLen + 1) * maxCrossPostTopics
+}
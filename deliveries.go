@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// deliveryQueue sends everything this server pushes out on its own (topic
+// webhooks, push notifications) and retries what fails.  Network errors,
+// 408, 429 and 5xx responses are retried with exponential backoff (and
+// Retry-After when given); anything else, or running out of attempts, is a
+// dead letter: logged, appended to -deadLetterFile when set, and kept for
+// /admin/deliveries.  Each target host gets a queue and worker of its own,
+// so one that's slow to answer only holds up its own deliveries.
+//
+// Every request carries X-Microchat-Delivery (the same id on each attempt,
+// for receivers to drop repeats) and X-Microchat-Timestamp (epoch seconds
+// of the attempt).  With a secret, X-Microchat-Signature is
+// sha256=<hex hmac of the body> and X-Microchat-Signature-V2 is
+// sha256=<hex hmac of "timestamp.body">, so receivers can refuse replays.
+type deliveryQueue struct {
+	mu             sync.Mutex
+	targets        map[string]chan *pendingDelivery // by url host
+	deadLetterPath string                           // blank to only log them
+	failures       []deliveryFailure
+	counts         deliveryCounts
+}
+
+// outboundDelivery is one request to send, built again for each attempt.
+type outboundDelivery struct {
+	Kind   string // webhook, ntfy, gotify
+	Client *http.Client
+	URL    string
+	Header http.Header
+	Body   []byte
+	Secret string // signs the body when set
+}
+
+type pendingDelivery struct {
+	outboundDelivery
+	id       string
+	attempts int
+}
+
+// deliveryFailure is a failed attempt, for /admin/deliveries.
+type deliveryFailure struct {
+	ID       string `json:"id"`
+	Kind     string `json:"kind"`
+	URL      string `json:"url"` // scheme and host only
+	Attempt  int    `json:"attempt"`
+	Status   int    `json:"status,omitempty"`
+	Error    string `json:"error,omitempty"`
+	AtMs     int64  `json:"at_ms"`
+	GaveUp   bool   `json:"gave_up"`
+	RetryInS int    `json:"retry_in_s,omitempty"`
+}
+
+type deliveryCounts struct {
+	Delivered  uint64 `json:"delivered"`
+	Retried    uint64 `json:"retried"`
+	DeadLetter uint64 `json:"dead_letters"`
+	Dropped    uint64 `json:"dropped"` // the target's queue was full
+}
+
+const (
+	// per target
+	deliveryQueueSize   = 200
+	maxDeliveryTargets  = 256
+	maxDeliveryAttempts = 6
+	// first retry, doubling each time after
+	deliveryBackoff    = 2 * time.Second
+	maxDeliveryBackoff = 5 * time.Minute
+	// failed attempts kept for /admin/deliveries
+	maxDeliveryFailures = 200
+)
+
+func newDeliveryQueue(deadLetterPath string) *deliveryQueue {
+	return &deliveryQueue{targets: make(map[string]chan *pendingDelivery), deadLetterPath: deadLetterPath}
+}
+
+// redactedURL is the scheme and host of a delivery's url, the path and
+// query of webhook urls are often secrets.
+func redactedURL(raw string) string {
+	parsed, err := url.Parse(raw)
+	if err != nil || len(parsed.Host) == 0 {
+		return "(invalid url)"
+	}
+	return parsed.Scheme + "://" + parsed.Host
+}
+
+// send queues delivery, dropping it when its target's queue is full.
+func (deliveries *deliveryQueue) send(delivery outboundDelivery) {
+	pending := &pendingDelivery{outboundDelivery: delivery, id: randomID(8)}
+	if !deliveries.enqueue(pending) {
+		log.Printf("Delivery queue full, dropping %s delivery %s for %s\n", delivery.Kind, pending.id, redactedURL(delivery.URL))
+	}
+}
+
+func (deliveries *deliveryQueue) enqueue(pending *pendingDelivery) bool {
+	host := ""
+	if parsed, err := url.Parse(pending.URL); err == nil {
+		host = parsed.Host
+	}
+	deliveries.mu.Lock()
+	queue, found := deliveries.targets[host]
+	if !found && len(deliveries.targets) >= maxDeliveryTargets {
+		// only webhooks admins added get here, it'd take a lot of them
+		queue, found = deliveries.targets[""]
+		host = ""
+	}
+	if !found {
+		queue = make(chan *pendingDelivery, deliveryQueueSize)
+		deliveries.targets[host] = queue
+		go deliveries.work(queue)
+	}
+	deliveries.mu.Unlock()
+	select {
+	case queue <- pending:
+		return true
+	default:
+		deliveries.mu.Lock()
+		deliveries.counts.Dropped++
+		deliveries.mu.Unlock()
+		return false
+	}
+}
+
+func (deliveries *deliveryQueue) work(queue chan *pendingDelivery) {
+	for pending := range queue {
+		pending.attempts++
+		status, retryAfter, err := deliveries.attempt(pending)
+		if err == nil {
+			deliveries.mu.Lock()
+			deliveries.counts.Delivered++
+			deliveries.mu.Unlock()
+			continue
+		}
+		retry := pending.attempts < maxDeliveryAttempts &&
+			(status == 0 || status == 408 || status == 429 || status >= 500)
+		wait := deliveryBackoff << uint(pending.attempts-1)
+		if wait > maxDeliveryBackoff {
+			wait = maxDeliveryBackoff
+		}
+		// spread out retries of everything that failed at once
+		wait += time.Duration(rand.Int63n(int64(wait / 4)))
+		if retryAfter > wait && retryAfter <= maxDeliveryBackoff {
+			wait = retryAfter
+		}
+		failure := deliveryFailure{ID: pending.id, Kind: pending.Kind, URL: redactedURL(pending.URL), Attempt: pending.attempts,
+			Error: err.Error(), AtMs: timeToEpochMilliseconds(time.Now()), GaveUp: !retry}
+		if status > 0 {
+			failure.Status = status
+		}
+		if retry {
+			failure.RetryInS = int(wait / time.Second)
+		}
+		deliveries.failed(failure, pending)
+		if retry {
+			time.AfterFunc(wait, func() {
+				if !deliveries.enqueue(pending) {
+					deliveries.failed(deliveryFailure{ID: pending.id, Kind: pending.Kind, URL: redactedURL(pending.URL),
+						Attempt: pending.attempts, Error: "queue full when retrying", AtMs: timeToEpochMilliseconds(time.Now()),
+						GaveUp: true}, pending)
+				}
+			})
+		}
+	}
+}
+
+// attempt sends the delivery once, returning the response status (0 when
+// there wasn't one) and how long it asked to wait before a retry.
+func (deliveries *deliveryQueue) attempt(pending *pendingDelivery) (int, time.Duration, error) {
+	req, err := http.NewRequest("POST", pending.URL, bytes.NewReader(pending.Body))
+	if err != nil {
+		// retrying won't fix the url
+		return -1, 0, err
+	}
+	for name, values := range pending.Header {
+		req.Header[name] = values
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("X-Microchat-Delivery", pending.id)
+	req.Header.Set("X-Microchat-Timestamp", timestamp)
+	if len(pending.Secret) > 0 {
+		req.Header.Set("X-Microchat-Signature", "sha256="+signDelivery(pending.Secret, pending.Body))
+		req.Header.Set("X-Microchat-Signature-V2", "sha256="+signDelivery(pending.Secret, append([]byte(timestamp+"."), pending.Body...)))
+	}
+	resp, err := pending.Client.Do(req)
+	if err != nil {
+		// without the url it quotes
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		return 0, 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return resp.StatusCode, 0, nil
+	}
+	var retryAfter time.Duration
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		retryAfter = time.Duration(seconds) * time.Second
+	}
+	return resp.StatusCode, retryAfter, fmt.Errorf("returned status %d", resp.StatusCode)
+}
+
+func signDelivery(secret string, data []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// failed records a failed attempt, and writes out the dead letter when it
+// was the last one.
+func (deliveries *deliveryQueue) failed(failure deliveryFailure, pending *pendingDelivery) {
+	deliveries.mu.Lock()
+	defer deliveries.mu.Unlock()
+	deliveries.failures = append(deliveries.failures, failure)
+	if len(deliveries.failures) > maxDeliveryFailures {
+		deliveries.failures = deliveries.failures[len(deliveries.failures)-maxDeliveryFailures:]
+	}
+	if !failure.GaveUp {
+		deliveries.counts.Retried++
+		log.Printf("%s delivery %s to %s failed (attempt %d), retrying in %ds: %v\n", failure.Kind, failure.ID,
+			failure.URL, failure.Attempt, failure.RetryInS, failure.Error)
+		return
+	}
+	deliveries.counts.DeadLetter++
+	log.Printf("%s delivery %s to %s failed for good after %d attempts: %v\n", failure.Kind, failure.ID,
+		failure.URL, failure.Attempt, failure.Error)
+	if len(deliveries.deadLetterPath) == 0 {
+		return
+	}
+	line, err := json.Marshal(struct {
+		deliveryFailure
+		// all of it, to deliver again by hand
+		FullURL string          `json:"full_url"`
+		Body    json.RawMessage `json:"body,omitempty"`
+		Text    string          `json:"text,omitempty"`
+	}{deliveryFailure: failure, FullURL: pending.URL, Body: jsonOrNil(pending.Body), Text: textOrBlank(pending.Body)})
+	if err != nil {
+		log.Printf("Failed to encode dead letter: %q\n", err)
+		return
+	}
+	f, err := os.OpenFile(deliveries.deadLetterPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("Failed to open deadLetterFile: %q\n", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		log.Printf("Failed to write dead letter: %q\n", err)
+	}
+}
+
+// jsonOrNil and textOrBlank keep a dead letter's body readable, as json
+// when it's json and as a string when it isn't.
+func jsonOrNil(body []byte) json.RawMessage {
+	if json.Valid(body) {
+		return body
+	}
+	return nil
+}
+
+func textOrBlank(body []byte) string {
+	if json.Valid(body) {
+		return ""
+	}
+	return string(body)
+}
+
+// getDeliveriesClosure serves GET /admin/deliveries, the counts and the
+// latest failed attempts, newest first.
+func getDeliveriesClosure(deliveries *deliveryQueue) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		deliveries.mu.Lock()
+		failures := make([]deliveryFailure, len(deliveries.failures))
+		for i, failure := range deliveries.failures {
+			failures[len(failures)-1-i] = failure
+		}
+		counts := deliveries.counts
+		queued := 0
+		for _, queue := range deliveries.targets {
+			queued += len(queue)
+		}
+		deliveries.mu.Unlock()
+		writeJSON(w, 200, map[string]interface{}{"queued": queued, "counts": counts, "failures": failures})
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// duplicateFilter rejects a chat when the same client already posted the
+// identical message to the same topic within a short window, which covers
+// both accidental double submits and copy-paste spam.
+type duplicateFilter struct {
+	mu     sync.Mutex
+	window time.Duration
+	seen   map[[sha256.Size]byte]time.Time
+}
+
+func newDuplicateFilter(window time.Duration) *duplicateFilter {
+	filter := &duplicateFilter{window: window, seen: make(map[[sha256.Size]byte]time.Time)}
+	go filter.cleanup()
+	return filter
+}
+
+func (filter *duplicateFilter) key(r *http.Request, chat *ChatPost) [sha256.Size]byte {
+	return sha256.Sum256([]byte(clientIP(r) + "\x00" + chat.Topic + "\x00" + chat.Message))
+}
+
+func (filter *duplicateFilter) check(r *http.Request, chat *ChatPost) *postRejection {
+	filter.mu.Lock()
+	defer filter.mu.Unlock()
+	if posted, found := filter.seen[filter.key(r, chat)]; found && time.Since(posted) < filter.window {
+		return &postRejection{Reason: "duplicate", Status: 409,
+			Message: "Duplicate post.  You just posted that same message to this topic."}
+	}
+	return nil
+}
+
+func (filter *duplicateFilter) published(r *http.Request, chat ChatPost) {
+	filter.mu.Lock()
+	defer filter.mu.Unlock()
+	filter.seen[filter.key(r, &chat)] = time.Now()
+}
+
+func (filter *duplicateFilter) cleanup() {
+	for range time.Tick(filter.window) {
+		filter.mu.Lock()
+		for key, posted := range filter.seen {
+			if time.Since(posted) >= filter.window {
+				delete(filter.seen, key)
+			}
+		}
+		filter.mu.Unlock()
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Encrypted chats are "e2e1:<iv>:<ciphertext>" with both parts base64url,
+// a 12 byte AES-GCM iv and at least the 16 byte tag.
+var encryptedMessageRegex = regexp.MustCompile(`^e2e1:[A-Za-z0-9_-]{16}:[A-Za-z0-9_-]{22,}$`)
+
+// encryptedRooms tracks the topics created as end-to-end encrypted rooms.
+// Chats posted to them are opaque blobs the server stores and relays but
+// never renders; the room key only ever lives in the invite link's
+// fragment, which browsers don't send to the server.
+type encryptedRooms struct {
+	mu    sync.Mutex
+	ttl   time.Duration
+	max   int
+	rooms map[string]int64 // topic -> last used, epoch ms
+}
+
+func newEncryptedRooms(ttl time.Duration, max int) *encryptedRooms {
+	rooms := &encryptedRooms{ttl: ttl, max: max, rooms: make(map[string]int64)}
+	go rooms.cleanup()
+	return rooms
+}
+
+// create registers a new room under a random topic.
+func (rooms *encryptedRooms) create() (string, bool) {
+	rooms.mu.Lock()
+	defer rooms.mu.Unlock()
+	if len(rooms.rooms) >= rooms.max {
+		return "", false
+	}
+	topic := "secret-" + randomID(6)
+	rooms.rooms[topic] = timeToEpochMilliseconds(time.Now())
+	return topic, true
+}
+
+// has reports whether topic is an encrypted room, keeping it alive when it
+// is.  Safe to call on a nil *encryptedRooms.
+func (rooms *encryptedRooms) has(topic string) bool {
+	if rooms == nil {
+		return false
+	}
+	rooms.mu.Lock()
+	defer rooms.mu.Unlock()
+	if _, found := rooms.rooms[topic]; !found {
+		return false
+	}
+	rooms.rooms[topic] = timeToEpochMilliseconds(time.Now())
+	return true
+}
+
+// cleanup forgets rooms nobody has used since their chats expired.
+func (rooms *encryptedRooms) cleanup() {
+	for range time.Tick(time.Minute) {
+		cutoff := timeToEpochMilliseconds(time.Now().Add(-rooms.ttl))
+		rooms.mu.Lock()
+		for topic, lastUsed := range rooms.rooms {
+			if lastUsed < cutoff {
+				delete(rooms.rooms, topic)
+			}
+		}
+		rooms.mu.Unlock()
+	}
+}
+
+// maxEncryptedLen is the longest blob a message within limits encrypts to:
+// up to 4 utf-8 bytes per rune plus the tag, base64url encoded, plus the
+// prefix and iv.
+func maxEncryptedLen(limits inputLimits) int {
+	return (int(limits.MessageLen)*4+16)*4/3 + 4 + len("e2e1::") + 16
+}
+
+// getNewRoomClosure serves POST /api/v1/rooms, returning the topic of a new
+// encrypted room: {"topic": "secret-<hex>"}.  The client makes the key.
+func getNewRoomClosure(rooms *encryptedRooms, creation *topicCreation) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		if !creation.mayCreate(r) {
+			writeJSON(w, 403, map[string]string{"error": "Starting a new room needs an invite code or an account."})
+			return
+		}
+		topic, ok := rooms.create()
+		if !ok {
+			writeJSON(w, 503, map[string]string{"error": "Too many encrypted rooms, try again later."})
+			return
+		}
+		writeJSON(w, 200, map[string]string{"topic": topic})
+	}
+}
+
+// getE2EScriptClosure serves /e2e.js, the client side crypto for encrypted
+// rooms.  It only uses the browser's WebCrypto, so there is nothing third
+// party the operator could swap out.
+func getE2EScriptClosure() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		w.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		w.Write([]byte(getE2EScriptString()))
+	}
+}
+
+func getE2EScriptString() string {
+	return `// End-to-end encryption for micro-chat rooms.  The room key is in the
+// page's #key= fragment, chats are AES-GCM encrypted before they are posted
+// and decrypted after they arrive, so the server only sees ciphertext.
+var microchatE2E = (function() {
+	function toBase64URL(bytes) {
+		var binary = "";
+		for (var i = 0; i < bytes.length; i++) {
+			binary += String.fromCharCode(bytes[i]);
+		}
+		return btoa(binary).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+	}
+
+	function fromBase64URL(text) {
+		text = text.replace(/-/g, "+").replace(/_/g, "/");
+		while (text.length % 4) {
+			text += "=";
+		}
+		var binary = atob(text);
+		var bytes = new Uint8Array(binary.length);
+		for (var i = 0; i < binary.length; i++) {
+			bytes[i] = binary.charCodeAt(i);
+		}
+		return bytes;
+	}
+
+	var keyMatch = location.hash.match(/[#&]key=([A-Za-z0-9_-]{43})/);
+	var key = null;
+	if (keyMatch && window.crypto && crypto.subtle) {
+		key = crypto.subtle.importKey("raw", fromBase64URL(keyMatch[1]), "AES-GCM", false, ["encrypt", "decrypt"]);
+	}
+
+	return {
+		hasKey: function() {
+			return key !== null;
+		},
+		// a fresh 256 bit room key, for the #key= fragment
+		newKey: function() {
+			return toBase64URL(crypto.getRandomValues(new Uint8Array(32)));
+		},
+		encrypt: function(text) {
+			if (!key) {
+				return Promise.reject(new Error("no room key"));
+			}
+			var iv = crypto.getRandomValues(new Uint8Array(12));
+			return key.then(function(k) {
+				return crypto.subtle.encrypt({ name: "AES-GCM", iv: iv }, k, new TextEncoder().encode(text));
+			}).then(function(ciphertext) {
+				return "e2e1:" + toBase64URL(iv) + ":" + toBase64URL(new Uint8Array(ciphertext));
+			});
+		},
+		decrypt: function(blob) {
+			var parts = blob.split(":");
+			if (!key || parts.length != 3 || parts[0] != "e2e1") {
+				return Promise.reject(new Error("not decryptable"));
+			}
+			return key.then(function(k) {
+				return crypto.subtle.decrypt({ name: "AES-GCM", iv: fromBase64URL(parts[1]) }, k, fromBase64URL(parts[2]));
+			}).then(function(plaintext) {
+				return new TextDecoder().decode(plaintext);
+			});
+		}
+	};
+})();
+`
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// embedOptions configures /embed/<topic>, a slim read-only live view of a
+// topic other sites can put in an iframe.
+type embedOptions struct {
+	// origins allowed to frame it, "*" for any
+	Origins  []string
+	OnScreen chatsOnScreen
+	Limits   inputLimits
+	Rooms    *encryptedRooms
+	Bans     *topicBans
+}
+
+// frameAncestors is the CSP frame-ancestors source list for the origins.
+func (opts embedOptions) frameAncestors() string {
+	for _, origin := range opts.Origins {
+		if origin == "*" {
+			return "*"
+		}
+	}
+	return "'self' " + strings.Join(opts.Origins, " ")
+}
+
+// getEmbedClosure serves GET /embed/<topic>.  Only these pages may be framed,
+// and only by the configured origins; the full chat page stays same origin.
+func getEmbedClosure(opts embedOptions) func(w http.ResponseWriter, r *http.Request) {
+	page := template.Must(template.New("embed_page").Parse(getEmbedTemplateString()))
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		topic := strings.TrimPrefix(r.URL.Path, "/embed/")
+		// encrypted rooms can't be read without the key from their invite link
+		if !topicNameRegex.MatchString(topic) || len(topic) > int(opts.Limits.TopicLen) || opts.Rooms.has(topic) {
+			http.Error(w, "Not found.", 404)
+			return
+		}
+		if opts.Bans.banned(r, topic, true) != nil {
+			http.Error(w, "You've been removed from this topic.", 403)
+			return
+		}
+		w.Header().Set("Content-Security-Policy", "frame-ancestors "+opts.frameAncestors())
+		data := struct {
+			Topic            string
+			NumChatsOnScreen uint
+		}{topic, opts.OnScreen.forRequest(topic, r)}
+		if err := page.Execute(w, data); err != nil {
+			log.Printf("Failed to render embed page: %q\n", err)
+		}
+	}
+}
+
+func getEmbedTemplateString() string {
+	return `<html>
+    <head>
+      <title>micro-chat: {{ .Topic }}</title>
+			<meta name="viewport" content="width=device-width, initial-scale=1.0">
+			<style>
+				body {
+					font-family: "Raleway", "HelveticaNeue", "Helvetica Neue", Helvetica, Arial, sans-serif;
+					font-size: 1.4rem;
+					line-height: 1.4;
+					margin: 0.4rem;
+				}
+				html {
+					font-size: 62.5%;
+				}
+				#header {
+					font-weight: bold;
+					margin-bottom: 0.6rem;
+				}
+				#header a {
+					color: #1EAEDB;
+					text-decoration: none;
+				}
+				div.chat {
+					margin: 0 0 0.5rem 0;
+					padding: 0.6rem;
+					border: 1px solid #AAAAAA;
+					border-radius: 0.8rem;
+				}
+				div.chat img {
+					max-width: 100%;
+					height: auto;
+				}
+				div.msg p {
+					margin: 0;
+				}
+				div.meta {
+					font-size: 1.2rem;
+					color: #999999;
+				}
+				#noChatsYet {
+					color: #999999;
+				}
+			</style>
+    </head>
+    <body>
+			<div id="header"><a href="/?topic={{ .Topic }}" target="_blank">{{ .Topic }}</a></div>
+			<div id="chats"><div id="noChatsYet">No chats yet.</div></div>
+			<script src="/static/microchat.js"></script>
+			<script>
+				(function() {
+					var topic = {{ .Topic }};
+					var maxChats = {{ .NumChatsOnScreen }};
+					var chats = document.getElementById("chats");
+
+					function chatDiv(event) {
+						var div = document.createElement("div");
+						div.className = "chat";
+						div.setAttribute("data-id", event.data.id || "");
+						var msg = document.createElement("div");
+						msg.className = "msg";
+						// names and messages are sanitized html when they're posted
+						msg.innerHTML = event.data.action ? "<b>" + event.data.display_name + "</b> " + event.data.message : event.data.message;
+						var meta = document.createElement("div");
+						meta.className = "meta";
+						meta.innerHTML = (event.data.action ? "" : event.data.display_name + " &middot; ") + new Date(event.timestamp).toLocaleTimeString();
+						div.appendChild(msg);
+						div.appendChild(meta);
+						return div;
+					}
+
+					// the whole buffer on the first poll, then just what's new
+					MicroChat.connect(topic, function(chat, event) {
+						var empty = document.getElementById("noChatsYet");
+						if (empty) {
+							empty.remove();
+						}
+						chats.insertBefore(chatDiv(event), chats.firstChild);
+					}, {
+						sinceTime: 1,
+						maxBatch: maxChats,
+						onTombstone: function(chatID) {
+							var burned = chats.querySelector("div.chat[data-id='" + chatID + "']");
+							if (burned) {
+								burned.remove();
+							}
+						},
+						onBatch: function() {
+							while (chats.children.length > maxChats) {
+								chats.removeChild(chats.lastChild);
+							}
+						}
+					});
+				})();
+			</script>
+    </body>
+  </html>`
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// Subscribe response encodings, picked with the encoding query param.
+//
+// compact is json with what a client can carry over left out: a chat's
+// topic when it's the event's category, and its display_name and
+// name_color when they're the same as the previous event's in the response.
+// msgpack is the regular response as MessagePack.
+const (
+	encodingJSON    = "json"
+	encodingCompact = "compact"
+	encodingMsgpack = "msgpack"
+)
+
+func validEncoding(encoding string) bool {
+	return len(encoding) == 0 || encoding == encodingJSON || encoding == encodingCompact || encoding == encodingMsgpack
+}
+
+// writeEncoded writes a 200 response in the encoding the request asked for.
+func writeEncoded(w http.ResponseWriter, r *http.Request, data interface{}) {
+	encoding := r.URL.Query().Get("encoding")
+	if encoding != encodingCompact && encoding != encodingMsgpack {
+		writeJSON(w, 200, data)
+		return
+	}
+	generic, err := toGeneric(data)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": "Failed to encode response."})
+		return
+	}
+	if encoding == encodingCompact {
+		compactEvents(generic)
+		writeJSON(w, 200, generic)
+		return
+	}
+	var buf bytes.Buffer
+	writeMsgpack(&buf, generic)
+	w.Header().Set("Content-Type", "application/msgpack")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.WriteHeader(200)
+	w.Write(buf.Bytes())
+}
+
+// toGeneric round trips data through json, so it's encoded exactly the way
+// the json responses are.  Numbers are kept as json.Number so ids stay exact.
+func toGeneric(data interface{}) (interface{}, error) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.UseNumber()
+	var generic interface{}
+	err = decoder.Decode(&generic)
+	return generic, err
+}
+
+func compactEvents(response interface{}) {
+	top, _ := response.(map[string]interface{})
+	events, _ := top["events"].([]interface{})
+	if len(events) == 0 {
+		return
+	}
+	top["encoding"] = encodingCompact
+	var lastName, lastColor interface{}
+	for _, item := range events {
+		event, _ := item.(map[string]interface{})
+		data, _ := event["data"].(map[string]interface{})
+		if data == nil {
+			continue
+		}
+		if data["topic"] == event["category"] {
+			delete(data, "topic")
+		}
+		name, hasName := data["display_name"]
+		if !hasName {
+			continue
+		}
+		color := data["name_color"]
+		if name == lastName && color == lastColor {
+			delete(data, "display_name")
+			delete(data, "name_color")
+		}
+		lastName, lastColor = name, color
+	}
+}
+
+// writeMsgpack encodes the values json decodes into.
+func writeMsgpack(buf *bytes.Buffer, value interface{}) {
+	switch v := value.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		if i, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			writeMsgpackInt(buf, i)
+			return
+		}
+		f, _ := v.Float64()
+		buf.WriteByte(0xcb)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+	case string:
+		n := len(v)
+		switch {
+		case n < 32:
+			buf.WriteByte(0xa0 | byte(n))
+		case n <= math.MaxUint8:
+			buf.Write([]byte{0xd9, byte(n)})
+		case n <= math.MaxUint16:
+			buf.WriteByte(0xda)
+			binary.Write(buf, binary.BigEndian, uint16(n))
+		default:
+			buf.WriteByte(0xdb)
+			binary.Write(buf, binary.BigEndian, uint32(n))
+		}
+		buf.WriteString(v)
+	case []interface{}:
+		writeMsgpackLen(buf, len(v), 0x90, 0xdc)
+		for _, item := range v {
+			writeMsgpack(buf, item)
+		}
+	case map[string]interface{}:
+		writeMsgpackLen(buf, len(v), 0x80, 0xde)
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			writeMsgpack(buf, key)
+			writeMsgpack(buf, v[key])
+		}
+	}
+}
+
+// array and map headers, fix is the fixarray/fixmap prefix and wide the 16
+// bit one, the 32 bit one follows it.
+func writeMsgpackLen(buf *bytes.Buffer, n int, fix, wide byte) {
+	switch {
+	case n < 16:
+		buf.WriteByte(fix | byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(wide)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(wide + 1)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+func writeMsgpackInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0 && i < 128:
+		buf.WriteByte(byte(i))
+	case i < 0 && i >= -32:
+		buf.WriteByte(byte(int8(i)))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(i))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, i)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+)
+
+// Every event goes out in an envelope saying what kind of event it is and
+// which version of that kind's data it carries, so clients can skip kinds
+// they don't know instead of guessing from the fields of data:
+//
+//	{"type": "chat", "schema_version": 1, "timestamp": ..., "id": ..., "category": "...", "data": {...}}
+//
+// Adding fields to a kind's data keeps its version, changing what existing
+// fields mean bumps it.
+const eventSchemaVersion = 1
+
+// Event types
+const (
+	eventChat      = "chat"
+	eventSystem    = "system" // a chat /admin commands post
+	eventTombstone = "tombstone"
+	eventReaction  = "reaction" // a chat's like count
+	eventFlag      = "flag"     // a chat hidden or shown again
+	eventPresence  = "presence"
+	eventTopic     = "topic" // a topic's summary changed
+	eventUnknown   = "unknown"
+)
+
+// typedEvent is event data that knows its type.
+type typedEvent interface {
+	eventType() string
+}
+
+func (chat ChatPost) eventType() string {
+	if chat.System {
+		return eventSystem
+	}
+	return eventChat
+}
+
+func (chatTombstone) eventType() string      { return eventTombstone }
+func (chatLike) eventType() string           { return eventReaction }
+func (chatFlag) eventType() string           { return eventFlag }
+func (presenceSummary) eventType() string    { return eventPresence }
+func (topicSummaryUpdate) eventType() string { return eventTopic }
+
+// eventTypeOf returns data's type, decoding it first when it's still json
+// (spilled and replicated events).
+func eventTypeOf(data interface{}) string {
+	if raw, ok := data.(json.RawMessage); ok {
+		data = decodeEventData(raw)
+	}
+	if typed, ok := data.(typedEvent); ok {
+		return typed.eventType()
+	}
+	return eventUnknown
+}
+
+// MarshalJSON writes the event in its envelope.
+func (event chatEvent) MarshalJSON() ([]byte, error) {
+	// without the methods, so encoding it doesn't come back here
+	type fields chatEvent
+	return json.Marshal(struct {
+		Type          string `json:"type"`
+		SchemaVersion int    `json:"schema_version"`
+		fields
+	}{eventTypeOf(event.Data), eventSchemaVersion, fields(event)})
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// posterIPs remembers which IP posted each chat for as long as chats are
+// kept, only so /admin/erase can find someone's chats by IP.  It's in memory
+// only, so chats spilled before a restart can only be erased by name.
+type posterIPs struct {
+	mu        sync.Mutex
+	retention time.Duration
+	byChat    map[string]posterIP
+}
+
+type posterIP struct {
+	ip string
+	at time.Time
+}
+
+func newPosterIPs(retention time.Duration) *posterIPs {
+	posters := &posterIPs{retention: retention, byChat: make(map[string]posterIP)}
+	go posters.cleanup()
+	return posters
+}
+
+// check lets everything through, posterIPs is a check to hear about
+// published chats.
+func (posters *posterIPs) check(r *http.Request, chat *ChatPost) *postRejection {
+	return nil
+}
+
+func (posters *posterIPs) published(r *http.Request, chat ChatPost) {
+	posters.mu.Lock()
+	defer posters.mu.Unlock()
+	posters.byChat[chat.ID] = posterIP{clientIP(r), time.Now()}
+}
+
+func (posters *posterIPs) postedBy(chatID, ip string) bool {
+	posters.mu.Lock()
+	defer posters.mu.Unlock()
+	return posters.byChat[chatID].ip == ip
+}
+
+func (posters *posterIPs) forget(chatID string) {
+	posters.mu.Lock()
+	defer posters.mu.Unlock()
+	delete(posters.byChat, chatID)
+}
+
+func (posters *posterIPs) cleanup() {
+	for range time.Tick(time.Hour) {
+		cutoff := time.Now().Add(-posters.retention)
+		posters.mu.Lock()
+		for id, poster := range posters.byChat {
+			if poster.at.Before(cutoff) {
+				delete(posters.byChat, id)
+			}
+		}
+		posters.mu.Unlock()
+	}
+}
+
+type eraseOptions struct {
+	Manager *chatStore
+	Spill   *spillStore // nil without -spillDir
+	Held    *holdQueue
+	Posters *posterIPs
+	Archive *chatArchive     // nil without -archiveDir
+	Stored  *chatPersistence // nil without -chatStore
+}
+
+// getEraseClosure serves POST /admin/erase with display_name and/or ip, for
+// deletion requests.  Every chat matching all of the given args is removed
+// from memory, the spill directory, the archive, the -chatStore and the
+// hold queue, and a tombstone is published for each so open pages drop them
+// too.  Names are matched ignoring case.
+func getEraseClosure(opts eraseOptions) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		name := strings.TrimSpace(r.PostFormValue("display_name"))
+		ip := anonymizedIP(r, strings.TrimSpace(r.PostFormValue("ip")))
+		if len(name) == 0 && len(ip) == 0 {
+			writeJSON(w, 400, map[string]string{"error": "Missing display_name and/or ip arg."})
+			return
+		}
+		matches := func(id, displayName string) bool {
+			return (len(name) == 0 || strings.EqualFold(plainText(displayName), name)) &&
+				(len(ip) == 0 || opts.Posters.postedBy(id, ip))
+		}
+		var erased []chatTombstone
+		for _, event := range opts.Manager.remove(func(event *chatEvent) bool {
+			chat, ok := event.Data.(ChatPost)
+			return ok && len(chat.ID) > 0 && matches(chat.ID, chat.DisplayName)
+		}) {
+			chat := event.Data.(ChatPost)
+			erased = append(erased, chatTombstone{Tombstone: chat.ID, Topic: chat.Topic, Reason: "erased"})
+		}
+		buffered := len(erased)
+		var spillErr error
+		if opts.Spill != nil {
+			var spilled []*spilledEvent
+			spilled, spillErr = opts.Spill.remove(func(event *spilledEvent) bool {
+				var chat struct {
+					ID          string `json:"id"`
+					DisplayName string `json:"display_name"`
+				}
+				return json.Unmarshal(event.Data, &chat) == nil && len(chat.ID) > 0 && len(chat.DisplayName) > 0 &&
+					matches(chat.ID, chat.DisplayName)
+			})
+			for _, event := range spilled {
+				var chat ChatPost
+				json.Unmarshal(event.Data, &chat)
+				// pre ALL_CHATS view spills can have a copy under both
+				if event.Category != ALL_CHATS {
+					erased = append(erased, chatTombstone{Tombstone: chat.ID, Topic: chat.Topic, Reason: "erased"})
+				}
+			}
+		}
+		archived := 0
+		var archiveErr error
+		if opts.Archive != nil {
+			archived, archiveErr = opts.Archive.remove(func(chat ChatPost) bool {
+				return len(chat.ID) > 0 && matches(chat.ID, chat.DisplayName)
+			})
+		}
+		stored := 0
+		var storeErr error
+		if opts.Stored != nil {
+			stored, storeErr = opts.Stored.remove(func(chat ChatPost) bool {
+				return matches(chat.ID, chat.DisplayName)
+			})
+		}
+		held := opts.Held.remove(func(held *heldChat) bool {
+			return (len(name) == 0 || strings.EqualFold(plainText(held.Chat.DisplayName), name)) &&
+				(len(ip) == 0 || held.ClientIP == ip)
+		})
+		for _, tombstone := range erased {
+			opts.Manager.Publish(tombstone.Topic, tombstone)
+			opts.Posters.forget(tombstone.Tombstone)
+		}
+		if spillErr != nil {
+			log.Printf("Failed to erase spilled chats: %v\n", spillErr)
+			writeJSON(w, 500, map[string]string{"error": "Failed to erase spilled chats: " + spillErr.Error()})
+			return
+		}
+		if archiveErr != nil {
+			log.Printf("Failed to erase archived chats: %v\n", archiveErr)
+			writeJSON(w, 500, map[string]string{"error": "Failed to erase archived chats: " + archiveErr.Error()})
+			return
+		}
+		if storeErr != nil {
+			log.Printf("Failed to erase stored chats: %v\n", storeErr)
+			writeJSON(w, 500, map[string]string{"error": "Failed to erase stored chats: " + storeErr.Error()})
+			return
+		}
+		// what was asked to be erased doesn't belong in the logs either
+		log.Printf("Erased %d chats, %d archived chats, %d stored chats and %d held chats\n", len(erased), archived, stored, held)
+		writeJSON(w, 200, map[string]int{"buffered": buffered, "spilled": len(erased) - buffered, "archived": archived,
+			"stored": stored, "held": held})
+	}
+}
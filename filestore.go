@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"sort"
+)
+
+func init() {
+	registerChatStore("file", func(dsn string) (ChatStore, error) {
+		return newFileChatStore(dsn)
+	})
+}
+
+// fileChatStore is the built in ChatStore, -chatStore file:/some/dir.  It
+// keeps events as json lines in hourly segments, like the spill directory
+// does, and can't be the same directory as -spillDir.
+type fileChatStore struct {
+	spill *spillStore
+}
+
+func newFileChatStore(dir string) (*fileChatStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	// no ttl, and so no reaper of its own, Expire says what's expired
+	return &fileChatStore{spill: &spillStore{dir: dir}}, nil
+}
+
+func (store *fileChatStore) Append(events []*chatEvent) error {
+	for _, event := range events {
+		if err := store.spill.write(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *fileChatStore) Query(topic string, before int64, limit int) ([]*chatEvent, error) {
+	return store.spill.eventsBefore(topic, before, limit)
+}
+
+func (store *fileChatStore) Expire(before int64) error {
+	store.spill.mu.Lock()
+	defer store.spill.mu.Unlock()
+	store.spill.expiredBefore = before
+	return store.spill.expireLocked(before)
+}
+
+func (store *fileChatStore) Snapshot() ([]*chatEvent, error) {
+	store.spill.mu.Lock()
+	defer store.spill.mu.Unlock()
+	starts, err := store.spill.segments()
+	if err != nil {
+		return nil, err
+	}
+	var events []*chatEvent
+	for _, start := range starts {
+		segmentEvents, err := store.spill.readSegment(start, store.spill.expiredBefore, func(*spilledEvent) bool { return true })
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, segmentEvents...)
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].ID < events[j].ID })
+	return events, nil
+}
+
+func (store *fileChatStore) Remove(match func(*chatEvent) bool) (int, error) {
+	removed, err := store.spill.remove(func(spilled *spilledEvent) bool {
+		return match(&chatEvent{Timestamp: spilled.Timestamp, ID: spilled.ID, Category: spilled.Category, Data: spilled.Data})
+	})
+	return len(removed), err
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Fingerprints recognize a banned poster coming back from another address
+// with a fresh session.  Neither part is proof, a device cookie can be
+// cleared and plenty of people share a browser's headers, so a match only
+// holds the chat for a moderator to look at.  Headers alone would match
+// everyone on the same browser and locale, they only count from the same
+// IP range.
+const deviceCookieName = "microchat_device"
+
+var deviceIDRegex = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// the headers a browser sends the same way on every request, whatever
+// address it's on
+var fingerprintHeaders = []string{"User-Agent", "Accept-Language", "Accept-Encoding",
+	"Sec-Ch-Ua", "Sec-Ch-Ua-Platform", "Sec-Ch-Ua-Mobile", "Dnt"}
+
+type fingerprint struct {
+	Device  string `json:"device,omitempty"`  // hashed device cookie
+	Headers string `json:"headers,omitempty"` // hashed browser headers
+	Range   string `json:"-"`                 // networkRangeKey
+}
+
+// ensureDevice gives the browser a device cookie if it has none.  It's
+// kept apart from the session so starting a new session doesn't reset it.
+func ensureDevice(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(deviceCookieName); err == nil && deviceIDRegex.MatchString(cookie.Value) {
+		return
+	}
+	id := randomID(16)
+	r.AddCookie(&http.Cookie{Name: deviceCookieName, Value: id})
+	http.SetCookie(w, &http.Cookie{
+		Name:     deviceCookieName,
+		Value:    id,
+		Path:     "/",
+		Expires:  time.Now().Add(2 * 365 * 24 * time.Hour),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Secure:   r.TLS != nil,
+	})
+}
+
+func fingerprintHash(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:8])
+}
+
+// requestFingerprint fingerprints the request's browser.  Headers is blank
+// for clients that send too little to tell apart, like most bots.
+func requestFingerprint(r *http.Request) fingerprint {
+	fp := fingerprint{Range: networkRangeKey(r)}
+	if cookie, err := r.Cookie(deviceCookieName); err == nil && deviceIDRegex.MatchString(cookie.Value) {
+		fp.Device = fingerprintHash(cookie.Value)
+	}
+	if len(r.Header.Get("User-Agent")) > 0 && len(r.Header.Get("Accept-Language")) > 0 {
+		values := make([]string, len(fingerprintHeaders))
+		for i, header := range fingerprintHeaders {
+			values[i] = r.Header.Get(header)
+		}
+		fp.Headers = fingerprintHash(strings.Join(values, "\x00"))
+	}
+	return fp
+}
+
+// matches is true when both fingerprints have the same device, or the same
+// headers from the same IP range.
+func (fp fingerprint) matches(other fingerprint) bool {
+	return (len(fp.Device) > 0 && fp.Device == other.Device) ||
+		(len(fp.Headers) > 0 && fp.Headers == other.Headers && fp.Range == other.Range)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// Firehose modes, i.e. who gets to watch the ALL_CHATS stream.
+const (
+	firehosePublic = "public"
+	firehoseAdmin  = "admin"
+	firehoseOff    = "off"
+)
+
+type firehosePolicy struct {
+	Mode   string
+	Access *accessControl
+}
+
+func (policy firehosePolicy) visibleTo(r *http.Request) bool {
+	switch policy.Mode {
+	case firehosePublic:
+		return true
+	case firehoseAdmin:
+		// moderators need to see everything to moderate it
+		return policy.Access.allows(r, roleModerator)
+	}
+	return false
+}
+
+// guard wraps handlers that take a category query param so the ALL_CHATS
+// category is only served to those allowed to see it.
+func (policy firehosePolicy) guard(handler func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("category") == ALL_CHATS && !policy.visibleTo(r) {
+			writeJSON(w, 403, map[string]string{"error": "The all chats stream is not available on this server."})
+			return
+		}
+		handler(w, r)
+	}
+}
+
+type topicSummary struct {
+	Topic      string `json:"topic"`
+	Count      int    `json:"count"`
+	LastPostMs int64  `json:"last_post_ms"`
+}
+
+// topicSummaries lists buffered topics without any of their content, for
+// the recent/popular boards when the firehose isn't visible.
+func (store *chatStore) topicSummaries() []topicSummary {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	var summaries []topicSummary
+	for category, buf := range store.categories {
+		if len(buf.events) == 0 {
+			continue
+		}
+		summaries = append(summaries, topicSummary{category, len(buf.events), buf.events[len(buf.events)-1].Timestamp})
+	}
+	return summaries
+}
+
+// getTopicsClosure serves /topics?limit=N with the most recent and most
+// popular topics currently buffered.
+func getTopicsClosure(manager *chatStore, maxTopicListNum uint) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		limit := int(maxTopicListNum)
+		if limitString := r.URL.Query().Get("limit"); len(limitString) > 0 {
+			requested, err := strconv.Atoi(limitString)
+			if err != nil || requested < 1 {
+				writeJSON(w, 400, map[string]string{"error": "Invalid limit arg."})
+				return
+			}
+			if requested < limit {
+				limit = requested
+			}
+		}
+		recent := manager.topicSummaries()
+		popular := make([]topicSummary, len(recent))
+		copy(popular, recent)
+		sort.Slice(recent, func(i, j int) bool { return recent[i].LastPostMs > recent[j].LastPostMs })
+		sort.Slice(popular, func(i, j int) bool { return popular[i].Count > popular[j].Count })
+		if len(recent) > limit {
+			recent = recent[:limit]
+			popular = popular[:limit]
+		}
+		if recent == nil {
+			recent, popular = []topicSummary{}, []topicSummary{}
+		}
+		writeJSON(w, 200, map[string][]topicSummary{"recent": recent, "popular": popular})
+	}
+}
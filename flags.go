@@ -0,0 +1,263 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// chatReports is the queue of chats people reported for moderators to look
+// at.  Once hideAfter distinct people (sessions on different IPs) report a
+// chat it's collapsed behind a shield on everyone's page, until a moderator
+// clears its reports.
+type chatReports struct {
+	manager   *chatStore
+	hideAfter int // 0 to never hide
+	mu        sync.Mutex
+	reports   map[string]*chatReport // by chat id
+	perIP     map[string]*reportWindow
+}
+
+// reportWindow counts an IP's reports in the current hour.
+type reportWindow struct {
+	startMs int64
+	count   int
+}
+
+type chatReport struct {
+	Chat      ChatPost        `json:"chat"`
+	Reports   int             `json:"reports"`
+	Reasons   []string        `json:"reasons,omitempty"`
+	FirstMs   int64           `json:"first_ms"`
+	LastMs    int64           `json:"last_ms"`
+	Hidden    bool            `json:"hidden"`
+	Cleared   bool            `json:"cleared"` // a moderator kept it, it won't be hidden again
+	reporters map[string]bool // sessions and networkKeys
+	expiresMs int64           // when the chat would have, and its reports go
+}
+
+// chatFlag is published to a chat's topic when it's hidden or shown again,
+// pages collapse or restore the chat with that id when they see one.
+type chatFlag struct {
+	Flagged string `json:"flagged"`
+	Topic   string `json:"topic"`
+	Reports int    `json:"reports"`
+	Hidden  bool   `json:"hidden"`
+}
+
+const (
+	maxReportReason  = 200
+	maxReportReasons = 20
+	// reports an IP can make an hour
+	maxReportsPerHour = 30
+)
+
+func newChatReports(manager *chatStore, hideAfter int) *chatReports {
+	reports := &chatReports{manager: manager, hideAfter: hideAfter, reports: make(map[string]*chatReport),
+		perIP: make(map[string]*reportWindow)}
+	manager.onBuffer(reports.buffered)
+	go reports.cleanup()
+	return reports
+}
+
+// buffered drops the reports of chats that were removed, burned, expired
+// or erased, so no copy outlives them.  Registered with chatStore.onBuffer.
+func (reports *chatReports) buffered(event *chatEvent) {
+	if tombstone, ok := event.Data.(chatTombstone); ok {
+		reports.mu.Lock()
+		delete(reports.reports, tombstone.Tombstone)
+		reports.mu.Unlock()
+	}
+}
+
+// limited counts a report from the IP with key, true once it's made too
+// many this hour.
+func (reports *chatReports) limited(key string) bool {
+	now := timeToEpochMilliseconds(time.Now())
+	reports.mu.Lock()
+	defer reports.mu.Unlock()
+	window, found := reports.perIP[key]
+	if !found || now-window.startMs >= int64(time.Hour/time.Millisecond) {
+		window = &reportWindow{startMs: now}
+		reports.perIP[key] = window
+	}
+	window.count++
+	return window.count > maxReportsPerHour
+}
+
+// report records a report of the chat from session on the IP with key,
+// false when either already had.  The chat is hidden when that makes enough
+// reports.
+func (reports *chatReports) report(chat ChatPost, session, key, reason string, expiresMs int64) (*chatReport, bool) {
+	now := timeToEpochMilliseconds(time.Now())
+	reports.mu.Lock()
+	report, found := reports.reports[chat.ID]
+	if !found {
+		report = &chatReport{Chat: chat, FirstMs: now, reporters: make(map[string]bool), expiresMs: expiresMs}
+		reports.reports[chat.ID] = report
+	}
+	if report.reporters[session] || report.reporters["ip:"+key] {
+		reports.mu.Unlock()
+		return report, false
+	}
+	report.reporters[session] = true
+	report.reporters["ip:"+key] = true
+	report.Reports++
+	report.LastMs = now
+	if len(reason) > 0 && len(report.Reasons) < maxReportReasons {
+		report.Reasons = append(report.Reasons, reason)
+	}
+	hide := reports.hideAfter > 0 && !report.Hidden && !report.Cleared && report.Reports >= reports.hideAfter
+	if hide {
+		report.Hidden = true
+	}
+	flag := chatFlag{Flagged: chat.ID, Topic: chat.Topic, Reports: report.Reports, Hidden: true}
+	reports.mu.Unlock()
+	if hide {
+		reports.publish(flag)
+	}
+	return report, true
+}
+
+// clear empties the chat's reports, showing it again if it was hidden.
+func (reports *chatReports) clear(chatID string) bool {
+	reports.mu.Lock()
+	report, found := reports.reports[chatID]
+	if !found {
+		reports.mu.Unlock()
+		return false
+	}
+	wasHidden := report.Hidden
+	report.Hidden, report.Cleared, report.Reports, report.Reasons = false, true, 0, nil
+	report.reporters = make(map[string]bool)
+	flag := chatFlag{Flagged: chatID, Topic: report.Chat.Topic}
+	reports.mu.Unlock()
+	if wasHidden {
+		reports.publish(flag)
+	}
+	return true
+}
+
+func (reports *chatReports) publish(flag chatFlag) {
+	if err := reports.manager.Publish(flag.Topic, flag); err != nil {
+		log.Printf("Failed to publish flag of chat %s: %v\n", flag.Flagged, err)
+	}
+}
+
+// list returns the chats with open reports, most reported first.
+func (reports *chatReports) list() []*chatReport {
+	reports.mu.Lock()
+	defer reports.mu.Unlock()
+	list := []*chatReport{}
+	for _, report := range reports.reports {
+		if report.Reports > 0 {
+			list = append(list, report)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Reports != list[j].Reports {
+			return list[i].Reports > list[j].Reports
+		}
+		return list[i].LastMs > list[j].LastMs
+	})
+	return list
+}
+
+func (reports *chatReports) cleanup() {
+	for range time.Tick(time.Minute) {
+		now := timeToEpochMilliseconds(time.Now())
+		reports.mu.Lock()
+		for id, report := range reports.reports {
+			if report.expiresMs <= now {
+				delete(reports.reports, id)
+			}
+		}
+		for key, window := range reports.perIP {
+			if now-window.startMs >= int64(time.Hour/time.Millisecond) {
+				delete(reports.perIP, key)
+			}
+		}
+		reports.mu.Unlock()
+	}
+}
+
+// getReportClosure serves POST /report with chat_id and an optional
+// reason, one report per chat from each session and IP.  It needs a session
+// the browser already had, so dropping cookies doesn't make a new reporter:
+//
+//	{"reports": 3, "hidden": true}
+func getReportClosure(reports *chatReports, manager *chatStore, retention time.Duration) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		session := sessionID(r)
+		if len(session) == 0 {
+			writeJSON(w, 403, map[string]string{"error": "Reporting needs cookies, reload the page and try again."})
+			return
+		}
+		key := networkKey(r)
+		if reports.limited(key) {
+			writeJSON(w, 429, map[string]string{"error": "Too many reports, try again later."})
+			return
+		}
+		chatID := r.PostFormValue("chat_id")
+		found := manager.eventsMatching(func(event *chatEvent) bool {
+			chat, ok := event.Data.(ChatPost)
+			return ok && chat.ID == chatID
+		}, 1)
+		if len(chatID) == 0 || len(found) == 0 {
+			writeJSON(w, 404, map[string]string{"error": "No such chat, it may have been removed."})
+			return
+		}
+		chat := found[0].Data.(ChatPost)
+		if chat.System {
+			writeJSON(w, 400, map[string]string{"error": "System chats can't be reported."})
+			return
+		}
+		reason := truncateInput(strings.TrimSpace(r.PostFormValue("reason")), maxReportReason)
+		expiresMs := found[0].Timestamp + int64(retention/time.Millisecond)
+		report, counted := reports.report(chat, session, key, reason, expiresMs)
+		if !counted {
+			writeJSON(w, 409, map[string]string{"error": "You already reported this chat."})
+			return
+		}
+		reports.mu.Lock()
+		defer reports.mu.Unlock()
+		writeJSON(w, 200, map[string]interface{}{"reports": report.Reports, "hidden": report.Hidden})
+	}
+}
+
+// getReportsClosure serves GET /admin/reports, the open reports.
+func getReportsClosure(reports *chatReports) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		list := reports.list()
+		reports.mu.Lock()
+		defer reports.mu.Unlock()
+		writeJSON(w, 200, map[string][]*chatReport{"reports": list})
+	}
+}
+
+// getReportsClearClosure serves POST /admin/reports/clear?id=<chat id>,
+// keeping the chat and showing it again if it was hidden.
+func getReportsClearClosure(reports *chatReports) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		if !reports.clear(r.FormValue("id")) {
+			http.Error(w, "No reports of that chat.", 404)
+			return
+		}
+		w.Write([]byte("ok"))
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"github.com/oschwald/maxminddb-golang"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// geoBlocker restricts posting (and optionally subscribing) by the country
+// a client's IP maps to in a MaxMind style MMDB database.  Used by instances
+// that are legally required to restrict access or are drowning in regional
+// spam.
+type geoBlocker struct {
+	db    *maxminddb.Reader
+	allow map[string]bool
+	deny  map[string]bool
+}
+
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+func newGeoBlocker(dbPath string, allow, deny []string) (*geoBlocker, error) {
+	db, err := maxminddb.Open(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	blocker := &geoBlocker{db: db, allow: make(map[string]bool), deny: make(map[string]bool)}
+	for _, country := range allow {
+		blocker.allow[strings.ToUpper(country)] = true
+	}
+	for _, country := range deny {
+		blocker.deny[strings.ToUpper(country)] = true
+	}
+	return blocker, nil
+}
+
+// country returns the ISO code for the ip, blank when unknown.
+func (blocker *geoBlocker) country(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	var record geoRecord
+	if err := blocker.db.Lookup(parsed, &record); err != nil {
+		return ""
+	}
+	return strings.ToUpper(record.Country.ISOCode)
+}
+
+// allowed applies the deny list, then the allow list when there is one.
+// Clients whose country can't be determined only get through when there's
+// no allow list.
+func (blocker *geoBlocker) allowed(r *http.Request) bool {
+	country := blocker.country(networkIP(r))
+	if blocker.deny[country] {
+		return false
+	}
+	if len(blocker.allow) > 0 && !blocker.allow[country] {
+		return false
+	}
+	return true
+}
+
+func (blocker *geoBlocker) check(r *http.Request, chat *ChatPost) *postRejection {
+	if blocker.allowed(r) {
+		return nil
+	}
+	return &postRejection{Reason: "geo_blocked", Status: 403,
+		Message: "Posting is not available in your region."}
+}
+
+// guardSubscribe wraps subscription handlers when blocking applies to
+// reading as well as posting.
+func (blocker *geoBlocker) guardSubscribe(handler func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !blocker.allowed(r) {
+			writeJSON(w, 403, map[string]string{"error": "This chat is not available in your region."})
+			return
+		}
+		handler(w, r)
+	}
+}
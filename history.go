@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 500
+)
+
+// getHistoryClosure serves /history?category=C[&before=MS][&limit=N], the
+// newest events older than before (oldest first).  Events still in memory are
+// used first and older ones come from the disk spill and then the -chatStore
+// when enabled.  With
+// sort=top it's the most liked chats still in memory instead, most liked
+// first.  Either way likes has the like counts of the chats returned.
+func getHistoryClosure(manager *chatStore, spill *spillStore, stored *chatPersistence, likes *chatLikes) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		query := r.URL.Query()
+		category := query.Get("category")
+		if len(category) == 0 || len(category) > 1024 {
+			writeJSON(w, 400, map[string]string{"error": "Invalid category, must be 1-1024 characters long."})
+			return
+		}
+		before := timeToEpochMilliseconds(time.Now()) + 1
+		if beforeString := query.Get("before"); len(beforeString) > 0 {
+			var err error
+			before, err = strconv.ParseInt(beforeString, 10, 64)
+			if err != nil {
+				writeJSON(w, 400, map[string]string{"error": "Invalid before arg."})
+				return
+			}
+		}
+		limit := defaultHistoryLimit
+		if limitString := query.Get("limit"); len(limitString) > 0 {
+			var err error
+			limit, err = strconv.Atoi(limitString)
+			if err != nil || limit < 1 || limit > maxHistoryLimit {
+				writeJSON(w, 400, map[string]string{"error": "Invalid limit arg, must be 1-" + strconv.Itoa(maxHistoryLimit) + "."})
+				return
+			}
+		}
+		top := false
+		switch query.Get("sort") {
+		case "", "time":
+		case "top":
+			top = true
+		default:
+			writeJSON(w, 400, map[string]string{"error": "Invalid sort arg, must be time or top."})
+			return
+		}
+
+		var events []*chatEvent
+		if top {
+			events = likes.top(manager, category, before, limit)
+		} else {
+			events = manager.eventsBefore(category, before, limit)
+		}
+		if !top && len(events) < limit && spill != nil {
+			// everything on disk for this category is older than what's in memory
+			if len(events) > 0 {
+				before = events[0].Timestamp
+			}
+			older, err := spill.eventsBefore(category, before, limit-len(events))
+			if err != nil {
+				log.Printf("Failed to read spilled history: %q\n", err)
+			} else {
+				// decoded so event filters (like mutes) see them as chats
+				for _, event := range older {
+					var chat ChatPost
+					if raw, ok := event.Data.(json.RawMessage); ok && json.Unmarshal(raw, &chat) == nil && len(chat.Topic) > 0 {
+						event.Data = chat
+					}
+				}
+				events = append(older, events...)
+			}
+		}
+		if !top && len(events) < limit && stored != nil {
+			if len(events) > 0 {
+				before = events[0].Timestamp
+			}
+			older, err := stored.eventsBefore(category, before, limit-len(events))
+			if err != nil {
+				log.Printf("Failed to read stored history: %q\n", err)
+			} else {
+				events = append(older, events...)
+			}
+		}
+		events = filterEvents(r, events)
+		if events == nil {
+			events = []*chatEvent{}
+		}
+		writeJSON(w, 200, map[string]interface{}{"events": events, "likes": likes.counts(events)})
+	}
+}
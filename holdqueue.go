@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// holdQueue keeps chats that a post check flagged for moderator review
+// instead of rejecting them outright.  Approved chats get published as if
+// they had just been posted.
+type holdQueue struct {
+	mu   sync.Mutex
+	max  int
+	held map[string]*heldChat
+}
+
+type heldChat struct {
+	ID       string   `json:"id"`
+	Chat     ChatPost `json:"chat"`
+	Reason   string   `json:"reason"`
+	ClientIP string   `json:"client_ip"`
+	HeldAtMs int64    `json:"held_at_ms"`
+	// what the post checks hear about it with once it's approved
+	request *http.Request
+}
+
+func newHoldQueue(max int) *holdQueue {
+	return &holdQueue{max: max, held: make(map[string]*heldChat)}
+}
+
+func (queue *holdQueue) hold(r *http.Request, chat ChatPost, reason string) {
+	held := &heldChat{ID: randomID(8), Chat: chat, Reason: reason, ClientIP: clientIP(r),
+		HeldAtMs: timeToEpochMilliseconds(time.Now()), request: r.Clone(r.Context())}
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	queue.held[held.ID] = held
+	for len(queue.held) > queue.max {
+		// full, drop the oldest held chat
+		var oldest *heldChat
+		for _, h := range queue.held {
+			if oldest == nil || h.HeldAtMs < oldest.HeldAtMs {
+				oldest = h
+			}
+		}
+		delete(queue.held, oldest.ID)
+	}
+}
+
+// take removes and returns the held chat, or nil if there's no such id.
+func (queue *holdQueue) take(id string) *heldChat {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	held := queue.held[id]
+	delete(queue.held, id)
+	return held
+}
+
+// remove drops the held chats match picks, returning how many.
+func (queue *holdQueue) remove(match func(*heldChat) bool) int {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	removed := 0
+	for id, held := range queue.held {
+		if match(held) {
+			delete(queue.held, id)
+			removed++
+		}
+	}
+	return removed
+}
+
+func (queue *holdQueue) list() []*heldChat {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	list := make([]*heldChat, 0, len(queue.held))
+	for _, held := range queue.held {
+		list = append(list, held)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].HeldAtMs < list[j].HeldAtMs })
+	return list
+}
+
+// getHeldListClosure serves GET /admin/held
+func getHeldListClosure(queue *holdQueue) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		writeJSON(w, 200, map[string][]*heldChat{"held": queue.list()})
+	}
+}
+
+// getHeldDecisionClosure serves POST /admin/held/approve?id= and
+// /admin/held/reject?id=
+func getHeldDecisionClosure(queue *holdQueue, approve bool, publish func(r *http.Request, chat ChatPost)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		held := queue.take(r.FormValue("id"))
+		if held == nil {
+			http.Error(w, "No such held chat.", 404)
+			return
+		}
+		if approve {
+			publish(held.request, held.Chat)
+		}
+		w.Write([]byte("ok"))
+	}
+}
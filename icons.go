@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// serverIcon is an icon file read at startup.
+type serverIcon struct {
+	data        []byte
+	contentType string
+}
+
+// loadIcon reads an .ico, .png or .svg icon.
+func loadIcon(path string) (*serverIcon, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	contentType := http.DetectContentType(data)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".ico":
+		contentType = "image/x-icon"
+	case ".svg":
+		contentType = "image/svg+xml"
+	}
+	return &serverIcon{data, contentType}, nil
+}
+
+// the default favicon, a speech bubble in the pages' green
+var defaultFavicon = &serverIcon{[]byte(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 32 32">` +
+	`<path fill="#00AA00" d="M4 4h24a2 2 0 0 1 2 2v15a2 2 0 0 1-2 2H13l-7 6v-6H4a2 2 0 0 1-2-2V6a2 2 0 0 1 2-2z"/>` +
+	`</svg>`), "image/svg+xml"}
+
+// getIconClosure serves an icon, the favicon at /favicon.ico and the app
+// icon at /apple-touch-icon.png.
+func getIconClosure(icon *serverIcon) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		w.Header().Set("Content-Type", icon.contentType)
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		w.Write(icon.data)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The name someone posts as is bound to their session by a server signed
+// cookie, instead of riding along in links where anyone can edit it.
+const identityCookieName = "microchat_name"
+
+type identitySigner struct {
+	key []byte
+}
+
+func (signer identitySigner) mac(session, name string) string {
+	mac := hmac.New(sha256.New, signer.key)
+	mac.Write([]byte(session + "\x00" + name))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// bind issues the cookie binding name (as typed, not rendered) to session.
+func (signer identitySigner) bind(w http.ResponseWriter, r *http.Request, session, name string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     identityCookieName,
+		Value:    base64.RawURLEncoding.EncodeToString([]byte(name)) + "." + signer.mac(session, name),
+		Path:     "/",
+		Expires:  time.Now().Add(365 * 24 * time.Hour),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Secure:   r.TLS != nil,
+	})
+}
+
+// name returns the name bound to the request's session, blank when it has
+// no valid identity cookie.
+func (signer identitySigner) name(r *http.Request) string {
+	session := sessionID(r)
+	if len(session) == 0 {
+		return ""
+	}
+	cookie, err := r.Cookie(identityCookieName)
+	if err != nil {
+		return ""
+	}
+	parts := strings.SplitN(cookie.Value, ".", 2)
+	if len(parts) != 2 {
+		return ""
+	}
+	name, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || !hmac.Equal([]byte(parts[1]), []byte(signer.mac(session, string(name)))) {
+		return ""
+	}
+	return string(name)
+}
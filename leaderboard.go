@@ -0,0 +1,250 @@
+package main
+
+import (
+	"html"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// leaderboard ranks display names by how many chats they posted in the last
+// window, instance wide or in a topic.  It's counted from the chats still in
+// memory, so erased chats stop counting and the window can't be longer than
+// chats are kept.  Boards are cached for a bit since they scan every chat.
+type leaderboard struct {
+	manager  *chatStore
+	window   time.Duration
+	firehose firehosePolicy
+	mu       sync.Mutex
+	cached   map[string]cachedLeaders // by topic and hours
+}
+
+type leader struct {
+	Rank        int    `json:"rank"`
+	DisplayName string `json:"display_name"` // as typed, not html escaped
+	NameColor   string `json:"name_color,omitempty"`
+	Posts       int    `json:"posts"`
+	lastMs      int64
+}
+
+type cachedLeaders struct {
+	at      time.Time
+	leaders []*leader
+}
+
+const (
+	maxLeaders          = 100
+	leaderboardCacheTTL = 30 * time.Second
+	maxCachedBoards     = 1000
+)
+
+func newLeaderboard(manager *chatStore, window time.Duration, firehose firehosePolicy) *leaderboard {
+	return &leaderboard{manager: manager, window: window, firehose: firehose, cached: make(map[string]cachedLeaders)}
+}
+
+// leaders returns the top posters of the last window (all topics when topic
+// is blank), most posts first and ties going to whoever posted last.
+func (board *leaderboard) leaders(topic string, window time.Duration) []*leader {
+	key := topic + "\x00" + window.String()
+	board.mu.Lock()
+	if cached, found := board.cached[key]; found && time.Since(cached.at) < leaderboardCacheTTL {
+		board.mu.Unlock()
+		return cached.leaders
+	}
+	board.mu.Unlock()
+
+	since := timeToEpochMilliseconds(time.Now().Add(-window))
+	byName := make(map[string]*leader)
+	board.manager.eventsMatching(func(event *chatEvent) bool {
+		chat, ok := event.Data.(ChatPost)
+		// encrypted rooms' names are only for their room
+		if !ok || chat.System || chat.Encrypted || event.Timestamp < since || (len(topic) > 0 && chat.Topic != topic) {
+			return false
+		}
+		key := strings.ToLower(chat.DisplayName)
+		poster, found := byName[key]
+		if !found {
+			poster = &leader{DisplayName: html.UnescapeString(chat.DisplayName)}
+			byName[key] = poster
+		}
+		poster.Posts++
+		if event.Timestamp > poster.lastMs {
+			poster.lastMs = event.Timestamp
+			poster.NameColor = chat.NameColor
+		}
+		// nothing needs the events themselves
+		return false
+	}, 0)
+	leaders := make([]*leader, 0, len(byName))
+	for _, poster := range byName {
+		leaders = append(leaders, poster)
+	}
+	sort.Slice(leaders, func(i, j int) bool {
+		if leaders[i].Posts != leaders[j].Posts {
+			return leaders[i].Posts > leaders[j].Posts
+		}
+		return leaders[i].lastMs > leaders[j].lastMs
+	})
+	if len(leaders) > maxLeaders {
+		leaders = leaders[:maxLeaders]
+	}
+	for i, poster := range leaders {
+		poster.Rank = i + 1
+		// equal counts share a rank
+		if i > 0 && poster.Posts == leaders[i-1].Posts {
+			poster.Rank = leaders[i-1].Rank
+		}
+	}
+
+	board.mu.Lock()
+	if len(board.cached) >= maxCachedBoards {
+		board.cached = make(map[string]cachedLeaders)
+	}
+	board.cached[key] = cachedLeaders{time.Now(), leaders}
+	board.mu.Unlock()
+	return leaders
+}
+
+// leaderboardRequest reads the topic, hours (up to the board's window) and
+// limit args.  Like user pages, the instance wide board is only for those
+// who can see the firehose.
+func leaderboardRequest(board *leaderboard, r *http.Request) (topic string, window time.Duration, limit int, err string) {
+	query := r.URL.Query()
+	topic = query.Get("topic")
+	if len(topic) == 0 && !board.firehose.visibleTo(r) {
+		return "", 0, 0, "A topic arg is required on this server."
+	}
+	window = board.window
+	maxHours := int(board.window / time.Hour)
+	if hoursString := query.Get("hours"); len(hoursString) > 0 {
+		hours, parseErr := strconv.Atoi(hoursString)
+		if parseErr != nil || hours < 1 || hours > maxHours {
+			return "", 0, 0, "Invalid hours arg, must be 1-" + strconv.Itoa(maxHours) + "."
+		}
+		window = time.Duration(hours) * time.Hour
+	}
+	limit = 20
+	if limitString := query.Get("limit"); len(limitString) > 0 {
+		parsed, parseErr := strconv.Atoi(limitString)
+		if parseErr != nil || parsed < 1 || parsed > maxLeaders {
+			return "", 0, 0, "Invalid limit arg, must be 1-" + strconv.Itoa(maxLeaders) + "."
+		}
+		limit = parsed
+	}
+	return topic, window, limit, ""
+}
+
+func (board *leaderboard) top(topic string, window time.Duration, limit int) []*leader {
+	leaders := board.leaders(topic, window)
+	if len(leaders) > limit {
+		leaders = leaders[:limit]
+	}
+	return leaders
+}
+
+// getLeaderboardAPIClosure serves GET /api/v1/leaderboard[?topic=T][&hours=N][&limit=N]
+//
+//	{"topic": "", "hours": 24, "leaders": [{"rank": 1, "display_name": "joe", "posts": 42}]}
+func getLeaderboardAPIClosure(board *leaderboard) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		topic, window, limit, errMessage := leaderboardRequest(board, r)
+		if len(errMessage) > 0 {
+			writeJSON(w, 400, map[string]string{"error": errMessage})
+			return
+		}
+		writeJSON(w, 200, map[string]interface{}{"topic": topic, "hours": int(window / time.Hour),
+			"leaders": board.top(topic, window, limit)})
+	}
+}
+
+// getLeaderboardPageClosure serves GET /leaderboard, the html version.
+func getLeaderboardPageClosure(board *leaderboard) func(w http.ResponseWriter, r *http.Request) {
+	page := template.Must(template.New("leaderboard_page").Parse(getLeaderboardTemplateString()))
+	return func(w http.ResponseWriter, r *http.Request) {
+		logRequest(r)
+		if r.Method != "GET" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		topic, window, limit, errMessage := leaderboardRequest(board, r)
+		if len(errMessage) > 0 {
+			http.Error(w, errMessage, 400)
+			return
+		}
+		data := struct {
+			Topic   string
+			Hours   int
+			Leaders []*leader
+		}{topic, int(window / time.Hour), board.top(topic, window, limit)}
+		if err := page.Execute(w, data); err != nil {
+			log.Printf("Failed to render leaderboard: %q\n", err)
+		}
+	}
+}
+
+func getLeaderboardTemplateString() string {
+	return `<html>
+    <head>
+      <title>micro-chat</title>
+			<meta name="viewport" content="width=device-width, initial-scale=1.0">
+			<link rel="icon" href="/favicon.ico">
+			<link rel="stylesheet" type="text/css" href="https://cdnjs.cloudflare.com/ajax/libs/skeleton/2.0.4/skeleton.min.css">
+			<link rel="stylesheet" href="https://cdnjs.cloudflare.com/ajax/libs/font-awesome/4.6.3/css/font-awesome.css">
+			<style>
+				body {
+					font-size: 1.7rem;
+					line-height: 1.4;
+					margin: 0.8rem 0 0.8rem 1.0rem;
+				}
+				h2 {
+					font-size: 2.4rem;
+				}
+				td.rank {
+					color: #999999;
+				}
+				a.userLink {
+					text-decoration: none;
+				}
+				#footer {
+					font-size: 1.4rem;
+					color: #AAAAAA;
+					padding: 1rem;
+					text-align: center;
+				}
+			</style>
+    </head>
+    <body>
+			<div class="container">
+				<h2><i class="fa fa-trophy"></i> Top posters{{ if .Topic }} in {{ .Topic }}{{ end }}</h2>
+				<a href="/{{ if .Topic }}?topic={{ .Topic }}{{ end }}">Back to chat.</a>
+				<p>Chats posted in the last {{ .Hours }} hour{{ if ne .Hours 1 }}s{{ end }}.</p>
+				{{ if .Leaders }}
+				<table class="u-full-width">
+					<tbody>
+						{{ range .Leaders }}
+						<tr>
+							<td class="rank">{{ .Rank }}</td>
+							<td><a class="userLink" style="color: {{ if .NameColor }}{{ .NameColor }}{{ else }}inherit{{ end }}" href="/user/{{ .DisplayName }}{{ if $.Topic }}?topic={{ $.Topic }}{{ end }}">{{ .DisplayName }}</a></td>
+							<td>{{ .Posts }}</td>
+						</tr>
+						{{ end }}
+					</tbody>
+				</table>
+				{{ else }}
+				<p>No chats yet{{ if .Topic }} in {{ .Topic }}{{ end }}.</p>
+				{{ end }}
+			</div>
+			<div id="footer">
+			&copy; Urmom Lol 2016</div>
+    </body>
+  </html>`
+}
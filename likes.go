@@ -0,0 +1,180 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// chatLikes counts likes of buffered chats, one per session and IP, so
+// dropping cookies doesn't get anyone another like.  Each like
+// publishes the chat's new count to its topic so pages update live.
+type chatLikes struct {
+	manager *chatStore
+	mu      sync.Mutex
+	likes   map[string]*chatLikeCount // by chat id
+}
+
+type chatLikeCount struct {
+	likes     int
+	likers    map[string]bool // sessions and networkKeys
+	expiresMs int64           // when the chat would have, and its likes go
+}
+
+// chatLike is published to a chat's topic with its count after each like.
+type chatLike struct {
+	Liked string `json:"liked"`
+	Topic string `json:"topic"`
+	Likes int    `json:"likes"`
+}
+
+func newChatLikes(manager *chatStore) *chatLikes {
+	likes := &chatLikes{manager: manager, likes: make(map[string]*chatLikeCount)}
+	manager.onBuffer(likes.buffered)
+	go likes.cleanup()
+	return likes
+}
+
+// buffered forgets the likes of chats that were removed and keeps counts
+// liked on another server (that this one replicates) up to date.
+// Registered with chatStore.onBuffer.
+func (likes *chatLikes) buffered(event *chatEvent) {
+	likes.mu.Lock()
+	defer likes.mu.Unlock()
+	switch data := event.Data.(type) {
+	case chatTombstone:
+		delete(likes.likes, data.Tombstone)
+	case chatLike:
+		count, found := likes.likes[data.Liked]
+		if !found {
+			count = &chatLikeCount{likers: make(map[string]bool), expiresMs: event.Timestamp + maxLikeRetention}
+			likes.likes[data.Liked] = count
+		}
+		if data.Likes > count.likes {
+			count.likes = data.Likes
+		}
+	}
+}
+
+// how long counts from replicated likes are kept, without the chat's expiry
+const maxLikeRetention = int64(7 * 24 * time.Hour / time.Millisecond)
+
+// like records a like of the chat from session on the IP with key, false
+// when either already had.
+func (likes *chatLikes) like(chat ChatPost, session, key string, expiresMs int64) (int, bool) {
+	likes.mu.Lock()
+	count, found := likes.likes[chat.ID]
+	if !found {
+		count = &chatLikeCount{likers: make(map[string]bool), expiresMs: expiresMs}
+		likes.likes[chat.ID] = count
+	}
+	if count.likers[session] || count.likers["ip:"+key] {
+		likes.mu.Unlock()
+		return count.likes, false
+	}
+	count.likers[session] = true
+	count.likers["ip:"+key] = true
+	count.likes++
+	like := chatLike{Liked: chat.ID, Topic: chat.Topic, Likes: count.likes}
+	likes.mu.Unlock()
+	if err := likes.manager.Publish(chat.Topic, like); err != nil {
+		log.Printf("Failed to publish like of chat %s: %v\n", chat.ID, err)
+	}
+	return like.Likes, true
+}
+
+// counts returns the like counts of the events' chats that have any.
+func (likes *chatLikes) counts(events []*chatEvent) map[string]int {
+	counts := make(map[string]int)
+	likes.mu.Lock()
+	defer likes.mu.Unlock()
+	for _, event := range events {
+		if chat, ok := event.Data.(ChatPost); ok {
+			if count, found := likes.likes[chat.ID]; found && count.likes > 0 {
+				counts[chat.ID] = count.likes
+			}
+		}
+	}
+	return counts
+}
+
+// top returns category's buffered chats from before, most liked first
+// (newest first among equals).  Chats nobody liked aren't included.
+func (likes *chatLikes) top(manager *chatStore, category string, before int64, limit int) []*chatEvent {
+	likes.mu.Lock()
+	liked := make(map[string]int, len(likes.likes))
+	for id, count := range likes.likes {
+		if count.likes > 0 {
+			liked[id] = count.likes
+		}
+	}
+	likes.mu.Unlock()
+	if len(liked) == 0 {
+		return nil
+	}
+	events := manager.eventsMatching(func(event *chatEvent) bool {
+		chat, ok := event.Data.(ChatPost)
+		return ok && chat.Topic == category && event.Timestamp < before && liked[chat.ID] > 0
+	}, len(liked))
+	// newest first already, a stable sort keeps it for ties
+	sort.SliceStable(events, func(i, j int) bool {
+		return liked[events[i].Data.(ChatPost).ID] > liked[events[j].Data.(ChatPost).ID]
+	})
+	if len(events) > limit {
+		events = events[:limit]
+	}
+	return events
+}
+
+func (likes *chatLikes) cleanup() {
+	for range time.Tick(time.Minute) {
+		now := timeToEpochMilliseconds(time.Now())
+		likes.mu.Lock()
+		for id, count := range likes.likes {
+			if count.expiresMs <= now {
+				delete(likes.likes, id)
+			}
+		}
+		likes.mu.Unlock()
+	}
+}
+
+// getLikeClosure serves POST /like/<chat id>, one like per chat from each
+// session and IP:
+//
+//	{"likes": 4}
+func getLikeClosure(likes *chatLikes, manager *chatStore, bans *topicBans, retention time.Duration) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		chatID := strings.TrimPrefix(r.URL.Path, "/like/")
+		found := manager.eventsMatching(func(event *chatEvent) bool {
+			chat, ok := event.Data.(ChatPost)
+			return ok && chat.ID == chatID
+		}, 1)
+		if len(chatID) == 0 || len(found) == 0 {
+			writeJSON(w, 404, map[string]string{"error": "No such chat, it may have been removed."})
+			return
+		}
+		chat := found[0].Data.(ChatPost)
+		if chat.System {
+			writeJSON(w, 400, map[string]string{"error": "System chats can't be liked."})
+			return
+		}
+		if bans.banned(r, chat.Topic, false) != nil {
+			writeJSON(w, 403, map[string]string{"error": "You've been removed from this topic."})
+			return
+		}
+		count, counted := likes.like(chat, ensureSession(w, r), networkKey(r), found[0].Timestamp+int64(retention/time.Millisecond))
+		if !counted {
+			writeJSON(w, 409, map[string]interface{}{"error": "You already liked this chat.", "likes": count})
+			return
+		}
+		writeJSON(w, 200, map[string]int{"likes": count})
+	}
+}
@@ -1,15 +1,22 @@
 package main
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"flag"
-	"github.com/jcuga/golongpoll"
+	"fmt"
 	"github.com/microcosm-cc/bluemonday"
 	"github.com/russross/blackfriday"
-	"html/template"
+	"html"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
 	"regexp"
 	"strings"
+	"time"
 )
 
 const (
@@ -18,13 +25,149 @@ const (
 
 func main() {
 	listenAddress := flag.String("addr", ":8080", "address:port to serve.")
+	publicURL := flag.String("publicURL", "", "scheme and host people reach this server at, used in links it hands out like QR codes (taken from each request when blank), ex: https://chat.example.com")
+	crawlerSnapshot := flag.String("crawlerSnapshot", snapshotCrawlers, "when topic pages include their latest chats in the html: off, crawlers (search engine and link preview user agents) or always")
+	favicon := flag.String("favicon", "", ".ico, .png or .svg file served as /favicon.ico (a built in icon when blank)")
+	appIcon := flag.String("appIcon", "", "square .png (180x180 or larger) served as /apple-touch-icon.png for home screen shortcuts")
+	templateBlocks := flag.String("templateBlocks", "", "file of {{ define \"head\" }}, \"nav\", \"footer\" or \"scripts\" template blocks added to the chat page")
+	templateData := flag.String("templateData", "", "json object file handed to templateBlocks as .Extra")
+	themesDir := flag.String("themesDir", "", "directory of theme directories, each with an optional index.html page template, blocks.html and theme.css")
+	theme := flag.String("theme", defaultThemeName, "theme for visitors that haven't picked one with ?theme=")
+	timezone := flag.String("timezone", "UTC", "IANA timezone (or Local) for times in server rendered pages")
+	locale := flag.String("locale", "iso", "how server rendered pages write times: "+localeNames())
+	robotsFile := flag.String("robotsFile", "", "file served as /robots.txt (a default allowing topic pages and pointing at /sitemap.xml when blank)")
 	maxChatLifeHours := flag.Uint("maxChatHrs", 24, "how long chats are stored (hours)")
+	standbyOf := flag.String("standbyOf", "", "base url of a primary to run as a warm standby of, following its /admin/replication feed and refusing posts until promoted")
+	standbyToken := flag.String("standbyToken", "", "admin token on the standbyOf primary")
+	standbyPromoteSec := flag.Uint("standbyPromoteSec", 0, "promote the standby once the primary has been unreachable this long (seconds), 0 to only promote with POST /admin/standby")
+	autoRespondFile := flag.String("autoRespondFile", "", "json file of per topic auto responders: welcome messages and FAQ keyword replies")
+	autoRespondBotName := flag.String("autoRespondBotName", "bot", "name auto responders post as when theirs isn't set")
+	replicaOf := flag.String("replicaOf", "", "base url of a primary to run as a read replica of, serving only /subscribe and /subscribe/topics from its replication feed and redirecting everything else to it")
+	replicaToken := flag.String("replicaToken", "", "admin token on the replicaOf primary")
+	raftSelf := flag.String("raftSelf", "", "this server's base url as its raft peers reach it, to run as one of a cluster sharing a publish log")
+	raftPeers := flag.String("raftPeers", "", "comma separated base urls of the other servers in the raft cluster (at least 2)")
+	raftDir := flag.String("raftDir", "raft", "directory for this server's raft log and snapshot")
+	raftToken := flag.String("raftToken", "", "secret shared by the raft cluster's servers")
+	reapIntervalSec := flag.Uint("reapIntervalSec", 30, "how often expired chats are swept out (seconds), see the reaper in /admin/stats")
 	topicRefreshSeconds := flag.Uint("topicRefreshSec", 30, "how often the popular/recent topic boards are refreshed in browser (seconds)")
 	maxTopicListNum := flag.Uint("maxTopicLists", 10, "how many topics listed in top popular/recent topics")
 	numChatsOnScreen := flag.Uint("chatsOnScreen", 50, "How many chats to display on a screen.")
+	topicChatsOnScreen := flag.String("topicChatsOnScreen", "", "per topic chatsOnScreen overrides, ex: support=200,random=20")
+	maxTopicLen := flag.Uint("maxTopicLen", 48, "max topic length (characters)")
+	maxNameLen := flag.Uint("maxNameLen", 28, "max display name length (characters)")
+	maxMessageLen := flag.Uint("maxMessageLen", 512, "max chat message length (characters)")
+	maxBufferMB := flag.Uint("maxBufferMB", 64, "max memory used to buffer chats (MB), the topics using the most are evicted from first")
+	maxTopicBufferKB := flag.Uint("maxTopicBufferKB", 8192, "max memory used to buffer a single topic's chats (KB)")
+	topicBufferKB := flag.String("topicBufferKB", "", "per topic maxTopicBufferKB overrides, ex: support=32768,random=1024")
+	archiveDir := flag.String("archiveDir", "", "directory where every topic's chats are archived, browsable as /archive/<topic>/<YYYY-MM-DD> (disabled when blank)")
+	archiveDays := flag.Uint("archiveDays", 0, "days of archived chats kept (0 to keep them forever)")
+	sessionsFile := flag.String("sessionsFile", "", "json file revoked sessions are saved to, so they stay logged out across restarts (memory only when blank)")
+	welcomeFile := flag.String("welcomeFile", "", "html file (house rules and such) first time visitors have to agree to before the chat page loads (off when blank)")
+	chatStoreSpec := flag.String("chatStore", "", "durable store every chat is kept in until it expires, reloaded at startup, as driver:dsn ex: file:/var/lib/micro-chat (disabled when blank)")
+	spillDir := flag.String("spillDir", "", "directory where chats evicted from memory are kept until they expire (disabled when blank)")
+	adminToken := flag.String("adminToken", "", "token required for /admin pages and changes (loopback may only look when blank)")
+	dailyPostQuota := flag.Uint("dailyPostQuota", 0, "max chats a single IP can post per rolling 24 hours (0 for no limit)")
+	challengeScore := flag.Uint("challengeScore", 0, "risk score (see challenge.go) at which a poster has to solve a proof of work before their chat is accepted (0 to never challenge)")
+	challengeBits := flag.Uint("challengeBits", 18, "proof of work difficulty for challengeScore, in leading zero bits")
+	duplicateWindowSeconds := flag.Uint("duplicateWindowSec", 60, "reject identical chats from the same IP to the same topic within this many seconds (0 to allow)")
+	maxLinks := flag.Uint("maxLinks", 0, "max distinct links allowed in a chat (0 for no limit)")
+	blockShorteners := flag.Bool("blockShorteners", false, "refuse chats linking through url shorteners")
+	blockFirstLink := flag.Bool("blockFirstLink", false, "refuse links in the first chat from an IP (per 24 hours)")
+	spamAction := flag.String("spamAction", "reject", "what to do with chats matching link spam rules: reject or hold")
+	moderationURL := flag.String("moderationURL", "", "url each chat is POSTed to for an allow/reject/hold verdict (disabled when blank)")
+	moderationTimeoutMs := flag.Uint("moderationTimeoutMs", 2000, "how long to wait on the moderation url (milliseconds)")
+	moderationFailOpen := flag.Bool("moderationFailOpen", true, "publish chats when the moderation url fails or times out")
+	toxicityKind := flag.String("toxicity", "", "score each chat's toxicity with: generic or perspective (disabled when blank)")
+	toxicityURL := flag.String("toxicityURL", "", "scoring endpoint, required for generic, defaults to Google's for perspective")
+	toxicityKey := flag.String("toxicityKey", "", "perspective API key, or bearer token sent to a generic endpoint")
+	toxicityThreshold := flag.Float64("toxicityThreshold", 0.8, "hold chats scoring at least this (0-1) for moderator review")
+	toxicityTimeoutMs := flag.Uint("toxicityTimeoutMs", 2000, "how long to wait on the scoring endpoint (milliseconds)")
+	geoipDB := flag.String("geoipDB", "", "path to a MaxMind style MMDB country database used for -allowCountries/-denyCountries")
+	allowCountries := flag.String("allowCountries", "", "comma separated ISO country codes allowed to post (all when blank)")
+	denyCountries := flag.String("denyCountries", "", "comma separated ISO country codes not allowed to post")
+	geoBlockSubscribe := flag.Bool("geoBlockSubscribe", false, "apply the country allow/deny lists to reading chats too")
+	trustedProxies := flag.String("trustedProxies", "", "comma separated CIDRs of reverse proxies whose X-Forwarded-For is trusted")
+	privacyMode := flag.String("privacyMode", privacyOff, "anonymize client IPs before they're logged or used as keys: off, truncate (/24, /48) or hash")
+	privacySalt := flag.String("privacySalt", "", "key for privacyMode hash, so hashed IPs stay the same across restarts (random when blank)")
+	allowCIDR := flag.String("allowCIDR", "", "comma separated CIDRs that may access this server at all (everyone when blank)")
+	blockTor := flag.Bool("blockTor", false, "refuse chats from Tor exit nodes")
+	blocklistURLs := flag.String("blocklistURLs", "", "comma separated urls of IP/CIDR lists (one per line) not allowed to post")
+	blocklistRefreshMin := flag.Uint("blocklistRefreshMin", 60, "how often blocklists are downloaded again (minutes)")
+	dnsblZones := flag.String("dnsbl", "", "comma separated DNSBL zones checked before accepting a chat, ex: zen.spamhaus.org")
+	flagHideThreshold := flag.Uint("flagHideThreshold", 0, "hide a chat behind a click to view shield once this many people reported it, until a moderator clears its reports (0 to never hide)")
+	leaderboardHours := flag.Uint("leaderboardHours", 24, "rolling window of /leaderboard's top posters, at most maxChatLifeHours (0 to turn it off)")
+	profanityFile := flag.String("profanityFile", "", "file listing words (one per line) that aren't allowed in chats")
+	profanityMode := flag.String("profanityMode", "reject", "what to do with chats containing profanityFile words: reject or mask")
+	uploadStorageType := flag.String("uploadStorage", "local", "where uploads are stored: local (in uploadDir) or s3")
+	uploadDir := flag.String("uploadDir", "", "directory where uploaded images are stored (local uploads disabled when blank)")
+	s3Endpoint := flag.String("s3Endpoint", "s3.amazonaws.com", "S3 compatible endpoint (host:port) for s3 uploadStorage")
+	s3Bucket := flag.String("s3Bucket", "", "bucket for s3 uploadStorage")
+	s3Prefix := flag.String("s3Prefix", "uploads/", "object name prefix for s3 uploadStorage")
+	s3Region := flag.String("s3Region", "", "region for s3 uploadStorage")
+	s3AccessKey := flag.String("s3AccessKey", os.Getenv("AWS_ACCESS_KEY_ID"), "access key for s3 uploadStorage (defaults to $AWS_ACCESS_KEY_ID)")
+	s3SecretKey := flag.String("s3SecretKey", os.Getenv("AWS_SECRET_ACCESS_KEY"), "secret key for s3 uploadStorage (defaults to $AWS_SECRET_ACCESS_KEY)")
+	s3UseSSL := flag.Bool("s3UseSSL", true, "use https to talk to the s3 endpoint")
+	maxUploadKB := flag.Uint("maxUploadKB", 2048, "max size of an uploaded image (KB)")
+	maxUploadsMB := flag.Uint("maxUploadsMB", 1024, "max total size of stored uploads (MB), 0 for no limit")
+	attachments := flag.String("attachments", "", "non-image file types that can be uploaded with their max size in KB, e.g. pdf=5120,txt=256,zip=10240")
+	maxVoiceSec := flag.Uint("maxVoiceSec", 120, "longest voice note that can be uploaded (seconds), 0 to disable voice notes")
+	scanClamd := flag.String("scanClamd", "", "scan uploads with clamd before storing them, unix:/path/to/clamd.sock or tcp:host:port")
+	scanURL := flag.String("scanURL", "", "scan uploads by POSTing them to this url before storing them")
+	scanTimeoutMs := flag.Uint("scanTimeoutMs", 10000, "how long an upload scan may take (milliseconds)")
+	quarantineDir := flag.String("quarantineDir", "", "directory where uploads that fail scanning are kept (discarded when blank)")
+	thumbnailPx := flag.Uint("thumbnailPx", 480, "uploaded images larger than this (pixels) are shown as a thumbnail linking to the original, 0 to disable")
+	camo := flag.Bool("camo", false, "serve images in chats through our own /camo/ proxy so readers don't hit third party hosts")
+	nameReserveMins := flag.Uint("nameReserveMins", 30, "how long a display name stays reserved to whoever last posted with it in a topic (minutes, 0 disables)")
+	identityKey := flag.String("identityKey", "", "secret used to sign the cookie binding display names to sessions (random when blank, everyone picks a name again after a restart)")
+	camoKey := flag.String("camoKey", "", "secret used to sign /camo/ urls (random when blank, breaking proxied images across restarts)")
+	camoCacheMB := flag.Uint("camoCacheMB", 32, "memory used to cache proxied images (MB)")
+	camoThumbnails := flag.Bool("camoThumbnails", false, "scale proxied images down to thumbnailPx")
+	unfurl := flag.Bool("unfurl", false, "fetch link previews (title, description, image) for the first link in each chat")
+	translateKind := flag.String("translate", "", "translate every chat with: libretranslate or deepl (off when blank)")
+	translateURL := flag.String("translateURL", "", "LibreTranslate server or DeepL api url, ex: https://api-free.deepl.com")
+	translateKey := flag.String("translateKey", "", "LibreTranslate or DeepL api key")
+	translateLangs := flag.String("translateLangs", "en", "comma separated language codes chats are translated to")
+	translateTimeoutMs := flag.Uint("translateTimeoutMs", 3000, "how long translating a chat may take (milliseconds)")
+	unfurlTimeoutMs := flag.Uint("unfurlTimeoutMs", 3000, "how long fetching a link preview may take (milliseconds)")
+	presenceOn := flag.Bool("presence", true, "track and show how many people are watching each topic")
+	signingKeysDir := flag.String("signingKeys", "", "directory of <name>.pub minisign and <name>.asc PGP public keys chats can be signed with (disabled when blank)")
+	encryptedRoomsOn := flag.Bool("encryptedRooms", false, "let people create end-to-end encrypted rooms (moderators can't read them)")
+	usersFile := flag.String("usersFile", "", "json file of accounts ({\"users\": [{\"name\", \"role\", \"token\"}]}) with read-only, poster, moderator or admin roles, also where /admin/users saves them")
+	restrictNewTopics := flag.Bool("restrictNewTopics", false, "only accounts and invite codes (from /admin/topic-invites) can start new topics, anyone can post to existing ones")
+	snippetsFile := flag.String("snippetsFile", "", "json file where canned responses added through /admin/snippets are saved, posted with /snippet name (kept in memory when blank)")
+	deadLetterFile := flag.String("deadLetterFile", "", "json lines file webhooks and notifications that failed every retry are appended to (only logged when blank)")
+	webhooksFile := flag.String("webhooksFile", "", "json file where topic webhooks added through /admin/webhooks are saved (kept in memory when blank)")
+	notifyKind := flag.String("notify", "", "push notification service to alert for mentions and keywords: ntfy or gotify (off when blank)")
+	notifyURL := flag.String("notifyURL", "", "ntfy topic url (ex: https://ntfy.sh/my-chat) or Gotify server url")
+	notifyToken := flag.String("notifyToken", "", "ntfy access token or Gotify application token")
+	notifyMentions := flag.String("notifyMentions", "", "comma separated names to alert for when @mentioned")
+	notifyKeywords := flag.String("notifyKeywords", "", "comma separated words to alert for")
+	notifyTopics := flag.String("notifyTopics", "", "comma separated topics to alert for (all topics when blank)")
+	bridgesFile := flag.String("bridgesFile", "", "json file mapping the accounts and api tokens bridges post with to their network, name format and badge ({\"bridges\": [{\"poster\", \"network\", \"badge\", \"name_format\", \"avatars\"}]})")
+	webhookPrivateURLs := flag.Bool("webhookPrivateURLs", false, "let webhooks POST to private and loopback addresses, for tooling on the same network")
+	shortLinksFile := flag.String("shortLinksFile", "", "file /t/ short links are saved to (kept in memory when blank)")
+	embedOrigins := flag.String("embedOrigins", "", "comma separated origins (ex: https://example.com) allowed to frame read-only /embed/<topic> pages, * for any (disabled when blank)")
+	richEmbedsList := flag.String("richEmbeds", "", "comma separated sites whose links get an embedded player or map: youtube, vimeo, openstreetmap (off when blank)")
+	plainTextOn := flag.Bool("plainText", false, "render chats as plain text with linked urls, no markdown (images, headers and so on)")
+	topicRenderFile := flag.String("topicRenderFile", "", "json file where per topic render rules set through /admin/topic-render are saved (kept in memory when blank)")
+	plainTextTopics := flag.String("plainTextTopics", "", "comma separated topics rendered as plain text even without plainText")
+	announceTopics := flag.String("announceTopics", "", "comma separated topics only posters (bots), moderators and admins can post to")
+	botTokens := flag.String("botTokens", "", "bearer tokens bots can post with (and schedule chats), e.g. announcer=TOKEN,reminders=TOKEN2")
+	tokensFile := flag.String("tokensFile", "", "json file where api tokens made through /admin/tokens are saved (kept in memory when blank)")
+	firehoseMode := flag.String("firehose", firehosePublic, "who can watch the stream of all chats: public, admin or off")
+	flag.Parse()
+	// before anything that renders times is set up
+	formatter, err := newTimeFormatter(*timezone, *locale)
+	if err != nil {
+		log.Fatalf("Invalid timezone/locale cmdline arg: %v\n", err)
+	}
+	serverTimes = formatter
 	if *maxChatLifeHours < 1 {
 		log.Fatalf("maxChatHrs cmdline arg must be >= 1\n")
 	}
+	if *reapIntervalSec < 1 {
+		log.Fatalf("reapIntervalSec cmdline arg must be >= 1\n")
+	}
 	if *topicRefreshSeconds < 1 {
 		log.Fatalf("topicRefreshSec cmdline arg must be >= 1\n")
 	}
@@ -34,33 +177,727 @@ func main() {
 	if *numChatsOnScreen < 1 {
 		log.Fatalf("chatsOnScreen cmdline arg must be >= 1\n")
 	}
-	flag.Parse()
+	if *maxTopicLen < 1 {
+		log.Fatalf("maxTopicLen cmdline arg must be >= 1\n")
+	}
+	if *maxNameLen < 1 {
+		log.Fatalf("maxNameLen cmdline arg must be >= 1\n")
+	}
+	if *maxMessageLen < 1 {
+		log.Fatalf("maxMessageLen cmdline arg must be >= 1\n")
+	}
+	if *maxBufferMB < 1 {
+		log.Fatalf("maxBufferMB cmdline arg must be >= 1\n")
+	}
+	perTopicOnScreen, err := parseTopicChatsOnScreen(*topicChatsOnScreen)
+	if err != nil {
+		log.Fatalf("Invalid topicChatsOnScreen cmdline arg: %v\n", err)
+	}
+	if *maxTopicBufferKB < 1 {
+		log.Fatalf("maxTopicBufferKB cmdline arg must be >= 1\n")
+	}
+	perTopicBufferKB, err := parseTopicChatsOnScreen(*topicBufferKB)
+	if err != nil {
+		log.Fatalf("Invalid topicBufferKB cmdline arg: %v\n", err)
+	}
+	if *blocklistRefreshMin < 1 {
+		log.Fatalf("blocklistRefreshMin cmdline arg must be >= 1\n")
+	}
+	if *profanityMode != "reject" && *profanityMode != "mask" {
+		log.Fatalf("profanityMode cmdline arg must be one of: reject, mask\n")
+	}
+	if *maxUploadKB < 1 {
+		log.Fatalf("maxUploadKB cmdline arg must be >= 1\n")
+	}
+	tokens, err := parseAPITokens(*botTokens)
+	if err != nil {
+		log.Fatalf("Invalid botTokens cmdline arg: %v\n", err)
+	}
+	if len(*tokensFile) > 0 {
+		if err := tokens.load(*tokensFile); err != nil {
+			log.Fatalf("Invalid tokensFile cmdline arg: %v\n", err)
+		}
+	}
+	access, err := newAccessControl(*adminToken, tokens, *usersFile)
+	if err != nil {
+		log.Fatalf("Invalid usersFile cmdline arg: %v\n", err)
+	}
+	snippets, err := loadSnippets(*snippetsFile)
+	if err != nil {
+		log.Fatalf("Invalid snippetsFile cmdline arg: %v\n", err)
+	}
+	registerSlashCommand("snippet", "/snippet name [message] -- posts a canned response", snippets.run)
+	announce := make(map[string]bool)
+	for _, topic := range splitCommaList(*announceTopics) {
+		announce[topic] = true
+	}
+	attachmentTypes, err := parseAttachmentPolicy(*attachments)
+	if err != nil {
+		log.Fatalf("Invalid attachments cmdline arg: %v\n", err)
+	}
+	if len(*scanClamd) > 0 && len(*scanURL) > 0 {
+		log.Fatalf("only one of the scanClamd and scanURL cmdline args may be set\n")
+	}
+	if *uploadStorageType != "local" && *uploadStorageType != "s3" {
+		log.Fatalf("uploadStorage cmdline arg must be one of: local, s3\n")
+	}
+	if *spamAction != "reject" && *spamAction != "hold" {
+		log.Fatalf("spamAction cmdline arg must be one of: reject, hold\n")
+	}
+	if len(*toxicityKind) > 0 {
+		if *toxicityKind != toxicityGeneric && *toxicityKind != toxicityPerspective {
+			log.Fatalf("toxicity cmdline arg must be one of: generic, perspective\n")
+		}
+		if *toxicityKind == toxicityGeneric && len(*toxicityURL) == 0 {
+			log.Fatalf("toxicityURL cmdline arg is required for generic scoring\n")
+		}
+		if *toxicityKind == toxicityPerspective && len(*toxicityKey) == 0 {
+			log.Fatalf("toxicityKey cmdline arg is required for perspective scoring\n")
+		}
+		if *toxicityThreshold < 0 || *toxicityThreshold > 1 {
+			log.Fatalf("toxicityThreshold cmdline arg must be between 0 and 1\n")
+		}
+	}
+	if *crawlerSnapshot != snapshotOff && *crawlerSnapshot != snapshotCrawlers && *crawlerSnapshot != snapshotAlways {
+		log.Fatalf("crawlerSnapshot cmdline arg must be one of: off, crawlers, always\n")
+	}
+	if *privacyMode != privacyOff && *privacyMode != privacyTruncate && *privacyMode != privacyHash {
+		log.Fatalf("privacyMode cmdline arg must be one of: off, truncate, hash\n")
+	}
+	if *firehoseMode != firehosePublic && *firehoseMode != firehoseAdmin && *firehoseMode != firehoseOff {
+		log.Fatalf("firehose cmdline arg must be one of: public, admin, off\n")
+	}
 
+	onScreen := chatsOnScreen{Default: *numChatsOnScreen, PerTopic: perTopicOnScreen, MaxFactor: 10}
+	topicBufferBytes := func(category string) int64 {
+		if kb, found := perTopicBufferKB[category]; found {
+			return int64(kb) * 1024
+		}
+		return int64(*maxTopicBufferKB) * 1024
+	}
 	// Our chat server is just a longpoll/pub-sub server.
-	manager, err := golongpoll.StartLongpoll(golongpoll.Options{
+	manager := newChatStore(storeOptions{
 		// make more than we show so we can collect stats by topic further back
-		MaxEventBufferSize:     int(*numChatsOnScreen) * 10,
-		EventTimeToLiveSeconds: int(*maxChatLifeHours) * 60 * 60,
+		MaxEventsPerCategory: onScreen.bufferSize,
+		MaxBytesPerCategory:  topicBufferBytes,
+		MaxBytes:             int64(*maxBufferMB) * 1024 * 1024,
+		EventTTL:             time.Duration(*maxChatLifeHours) * time.Hour,
+		ReapInterval:         time.Duration(*reapIntervalSec) * time.Second,
+		MaxTimeout:           120 * time.Second,
 	})
+
+	limits := inputLimits{TopicLen: *maxTopicLen, NameLen: *maxNameLen, MessageLen: *maxMessageLen}
+	topicRules, err := loadTopicRenderRules(*topicRenderFile)
 	if err != nil {
-		log.Fatalf("Failed to create chat longpoll manager: %q\n", err)
+		log.Fatalf("Invalid topicRenderFile cmdline arg: %v\n", err)
+	}
+	renderer := &chatRenderer{limits: limits, plain: *plainTextOn, plainTopics: make(map[string]bool), topics: topicRules}
+	for _, topic := range splitCommaList(*plainTextTopics) {
+		renderer.plainTopics[topic] = true
+	}
+	if names := splitCommaList(*richEmbedsList); len(names) > 0 {
+		if renderer.embeds, err = newRichEmbeds(names); err != nil {
+			log.Fatalf("Invalid richEmbeds cmdline arg: %v\n", err)
+		}
+	}
+	if *camo {
+		key := []byte(*camoKey)
+		if len(key) == 0 {
+			log.Printf("No camoKey given, using a random one.  Proxied images in chats posted before a restart will break.\n")
+			key = []byte(randomID(32))
+		}
+		camoOpts := camoOptions{Key: key, MaxImageBytes: int64(*maxUploadKB) * 1024, CacheBytes: int64(*camoCacheMB) * 1024 * 1024}
+		if *camoThumbnails {
+			camoOpts.ThumbnailPx = int(*thumbnailPx)
+		}
+		renderer.camo = newCamoProxy(camoOpts)
+		http.Handle("/camo/", renderer.camo)
+	}
+	if *unfurl {
+		renderer.unfurler = newLinkUnfurler(time.Duration(*unfurlTimeoutMs)*time.Millisecond, renderer.camo)
+	}
+	if len(*translateKind) > 0 {
+		if *translateKind != translateLibre && *translateKind != translateDeepL {
+			log.Fatalf("translate cmdline arg must be one of: libretranslate, deepl\n")
+		}
+		if !validWebhookURL(*translateURL) {
+			log.Fatalf("translateURL cmdline arg must be an http(s) url\n")
+		}
+		langs := splitCommaList(strings.ToLower(*translateLangs))
+		if len(langs) == 0 || len(langs) > 10 {
+			log.Fatalf("translateLangs cmdline arg must list 1-10 languages\n")
+		}
+		renderer.translator = newChatTranslator(*translateKind, *translateURL, *translateKey, langs,
+			time.Duration(*translateTimeoutMs)*time.Millisecond)
+	}
+	firehose := firehosePolicy{Mode: *firehoseMode, Access: access}
+	proxies, err := parseCIDRs(splitCommaList(*trustedProxies))
+	if err != nil {
+		log.Fatalf("Invalid trustedProxies cmdline arg: %v\n", err)
+	}
+	allowedNets, err := parseCIDRs(splitCommaList(*allowCIDR))
+	if err != nil {
+		log.Fatalf("Invalid allowCIDR cmdline arg: %v\n", err)
+	}
+	stats := newChatStats(manager)
+	manager.onEvict(stats.recordEviction)
+	// right after the api token limits, it's the cheapest check and
+	// moderators expect it to stick
+	bans := newTopicBans(10000)
+	creation := newTopicCreation(*restrictNewTopics, access, manager)
+	posters := newPosterIPs(time.Duration(*maxChatLifeHours) * time.Hour)
+	ops := newChatOps(manager, stats, access, bans)
+	checks := []postCheck{tokens, bans, ops, creation, posters}
+	// the checks on who is posting rather than what, uploads get them too
+	uploadChecks := []postCheck{bans}
+	var bridges *bridgeMappings
+	if len(*bridgesFile) > 0 {
+		if bridges, err = loadBridgeMappings(*bridgesFile, renderer); err != nil {
+			log.Fatalf("Invalid bridgesFile cmdline arg: %v\n", err)
+		}
+		checks = append(checks, bridges)
+	}
+	var standby *standbyReplica
+	if len(*standbyOf) > 0 {
+		standby, err = newStandbyReplica(manager, *standbyOf, *standbyToken, time.Duration(*standbyPromoteSec)*time.Second)
+		if err != nil {
+			log.Fatalf("Invalid standbyOf cmdline arg: %v\n", err)
+		}
+		// before anything counts the post against a limit
+		checks = append([]postCheck{standby}, checks...)
+	}
+	var cluster *raftNode
+	if len(*raftSelf) > 0 {
+		peers := splitCommaList(*raftPeers)
+		if len(peers) < 2 {
+			log.Fatalf("raftPeers cmdline arg must list at least 2 other servers\n")
+		}
+		if len(*raftToken) == 0 {
+			log.Fatalf("raftToken cmdline arg is required with raftSelf\n")
+		}
+		if standby != nil {
+			log.Fatalf("standbyOf and raftSelf cmdline args can't be used together\n")
+		}
+		cluster, err = newRaftNode(manager, *raftSelf, peers, *raftToken, *raftDir)
+		if err != nil {
+			log.Fatalf("Failed to start raft: %v\n", err)
+		}
+		checks = append([]postCheck{cluster}, checks...)
+	}
+	subscribeGuard := func(handler func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+		return handler
+	}
+	if len(*allowCountries) > 0 || len(*denyCountries) > 0 {
+		if len(*geoipDB) == 0 {
+			log.Fatalf("geoipDB cmdline arg is required with allowCountries/denyCountries\n")
+		}
+		geo, err := newGeoBlocker(*geoipDB, splitCommaList(*allowCountries), splitCommaList(*denyCountries))
+		if err != nil {
+			log.Fatalf("Failed to open geoipDB: %q\n", err)
+		}
+		checks = append(checks, geo)
+		uploadChecks = append(uploadChecks, geo)
+		if *geoBlockSubscribe {
+			subscribeGuard = geo.guardSubscribe
+		}
+	}
+	if len(*profanityFile) > 0 {
+		profanity, err := loadProfanityFilter(*profanityFile)
+		if err != nil {
+			log.Fatalf("Failed to load profanityFile: %q\n", err)
+		}
+		if *profanityMode == "mask" {
+			renderer.profanity = profanity
+		} else {
+			checks = append(checks, profanity)
+		}
+	}
+	blocklists := splitCommaList(*blocklistURLs)
+	if *blockTor {
+		blocklists = append(blocklists, torExitListURL)
+	}
+	if len(blocklists) > 0 || len(*dnsblZones) > 0 {
+		blocklist := newIPBlocklist(blocklists, splitCommaList(*dnsblZones),
+			time.Duration(*blocklistRefreshMin)*time.Minute)
+		checks = append(checks, blocklist)
+		uploadChecks = append(uploadChecks, blocklist)
+	}
+	if *dailyPostQuota > 0 {
+		checks = append(checks, newDailyQuota(*dailyPostQuota))
+	}
+	var challenge *riskChallenge
+	if *challengeScore > 0 {
+		if *challengeBits < 8 || *challengeBits > 28 {
+			log.Fatalf("challengeBits cmdline arg must be 8-28\n")
+		}
+		challenge = newRiskChallenge(int(*challengeScore), int(*challengeBits), access)
+		checks = append(checks, challenge)
+	}
+	if *duplicateWindowSeconds > 0 {
+		checks = append(checks, newDuplicateFilter(time.Duration(*duplicateWindowSeconds)*time.Second))
+	}
+	if *maxLinks > 0 || *blockShorteners || *blockFirstLink {
+		checks = append(checks, newLinkSpamFilter(linkSpamOptions{MaxLinks: *maxLinks,
+			BlockShortener: *blockShorteners, BlockFirstLink: *blockFirstLink, Hold: *spamAction == "hold"}))
+	}
+	if len(*toxicityKind) > 0 {
+		checks = append(checks, newToxicityScorer(*toxicityKind, *toxicityURL, *toxicityKey, *toxicityThreshold,
+			time.Duration(*toxicityTimeoutMs)*time.Millisecond))
+	}
+	if len(*moderationURL) > 0 {
+		// last since it's the most expensive check
+		checks = append(checks, newModerationHook(*moderationURL,
+			time.Duration(*moderationTimeoutMs)*time.Millisecond, *moderationFailOpen))
+	}
+	held := newHoldQueue(1000)
+	if len(*replicaOf) > 0 {
+		if standby != nil || cluster != nil {
+			log.Fatalf("replicaOf cmdline arg can't be used with standbyOf or raftSelf\n")
+		}
+		replica, err := newReadReplica(manager, *replicaOf, *replicaToken)
+		if err != nil {
+			log.Fatalf("Invalid replicaOf cmdline arg: %v\n", err)
+		}
+		// nothing else is set up, a replica only ever buffers what the
+		// primary sends it
+		mux := http.NewServeMux()
+		mux.HandleFunc("/subscribe", stats.trackHandler("subscribe",
+			subscribeGuard(firehose.guard(stats.trackSubscribers(manager.SubscriptionHandler)))))
+		summaries := newTopicSummaryStream(manager, time.Duration(*maxChatLifeHours)*time.Hour)
+		mux.HandleFunc("/subscribe/topics", stats.trackHandler("subscribe_topics",
+			subscribeGuard(getTopicSummariesSubscribeClosure(summaries, firehose))))
+		mux.HandleFunc("/admin/replica", stats.trackHandler("admin_replica",
+			access.requireScope(scopeRead, roleReadOnly, getStandbyClosure(replica))))
+		mux.HandleFunc("/admin/stats", stats.trackHandler("admin_stats",
+			access.requireScope(scopeRead, roleReadOnly, getStatsClosure(stats, manager))))
+		mux.HandleFunc("/", getPrimaryRedirectClosure(*replicaOf))
+		log.Printf("Launching read replica of %s on %s\n", *replicaOf, *listenAddress)
+		var handler http.Handler = mux
+		if len(allowedNets) > 0 {
+			handler = restrictToCIDRs(allowedNets, handler)
+		}
+		http.ListenAndServe(*listenAddress, resolveClientIP(proxies, newIPAnonymizer(*privacyMode, *privacySalt), handler))
+		return
+	}
+	var spill *spillStore
+	if len(*spillDir) > 0 {
+		spill, err = newSpillStore(*spillDir, time.Duration(*maxChatLifeHours)*time.Hour)
+		if err != nil {
+			log.Fatalf("Failed to create spill directory: %q\n", err)
+		}
+		manager.onEvict(spill.spillEvicted)
+	}
+	var stored *chatPersistence
+	if len(*chatStoreSpec) > 0 {
+		if len(*spillDir) > 0 && *chatStoreSpec == "file:"+*spillDir {
+			log.Fatalf("chatStore cmdline arg can't be the spillDir\n")
+		}
+		// the raft log is what restores a cluster member's chats
+		if cluster != nil {
+			log.Fatalf("chatStore and raftSelf cmdline args can't be used together\n")
+		}
+		backend, err := openChatStore(*chatStoreSpec)
+		if err != nil {
+			log.Fatalf("Invalid chatStore cmdline arg: %v\n", err)
+		}
+		stored = newChatPersistence(backend, time.Duration(*maxChatLifeHours)*time.Hour)
+		restored, err := stored.restore(manager)
+		if err != nil {
+			log.Fatalf("Failed to restore chats from chatStore: %v\n", err)
+		}
+		log.Printf("Restored %d events from chatStore\n", restored)
+		manager.onBuffer(stored.buffered)
+	}
+	var archive *chatArchive
+	if len(*archiveDir) > 0 {
+		archive, err = newChatArchive(*archiveDir, int(*archiveDays))
+		if err != nil {
+			log.Fatalf("Failed to create archive directory: %q\n", err)
+		}
+		manager.onBuffer(archive.buffered)
+	}
+	identity := identitySigner{key: []byte(*identityKey)}
+	if len(identity.key) == 0 {
+		log.Printf("No identityKey given, using a random one.  Display names will have to be picked again after a restart.\n")
+		identity.key = []byte(randomID(32))
+	}
+	sessions, err := loadSessionRegistry(*sessionsFile, access)
+	if err != nil {
+		log.Fatalf("Failed to load sessionsFile: %q\n", err)
+	}
+	checks = append(checks, sessions)
+	var names *nameReservations
+	if *nameReserveMins > 0 {
+		names = newNameReservations(time.Duration(*nameReserveMins) * time.Minute)
+	}
+	var signers *signingKeys
+	if len(*signingKeysDir) > 0 {
+		if signers, err = loadSigningKeys(*signingKeysDir); err != nil {
+			log.Fatalf("Invalid signingKeys cmdline arg: %v\n", err)
+		}
+	}
+	var rooms *encryptedRooms
+	if *encryptedRoomsOn {
+		rooms = newEncryptedRooms(time.Duration(*maxChatLifeHours)*time.Hour, 10000)
+		creation.Rooms = rooms
+		http.HandleFunc("/api/v1/rooms", stats.trackHandler("rooms", getNewRoomClosure(rooms, creation)))
+		http.HandleFunc("/e2e.js", stats.trackHandler("e2e_js", getE2EScriptClosure()))
+	}
+	var storage uploadStorage
+	if *uploadStorageType == "s3" {
+		if len(*s3Bucket) == 0 {
+			log.Fatalf("s3Bucket cmdline arg is required with s3 uploadStorage\n")
+		}
+		storage, err = newS3Storage(s3Options{Endpoint: *s3Endpoint, Bucket: *s3Bucket, Prefix: *s3Prefix,
+			Region: *s3Region, AccessKey: *s3AccessKey, SecretKey: *s3SecretKey, UseSSL: *s3UseSSL})
+	} else if len(*uploadDir) > 0 {
+		storage, err = newLocalStorage(*uploadDir)
+	}
+	if err != nil {
+		log.Fatalf("Failed to set up upload storage: %q\n", err)
+	}
+	var space *uploadSpace
+	if storage != nil {
+		if space, err = newUploadSpace(storage, int64(*maxUploadsMB)*1024*1024); err != nil {
+			log.Fatalf("Failed to list stored uploads: %q\n", err)
+		}
+		uploads := uploadOptions{Storage: storage, MaxBytes: int64(*maxUploadKB) * 1024, ThumbnailPx: int(*thumbnailPx),
+			MaxVoiceDuration: time.Duration(*maxVoiceSec) * time.Second, Attachments: attachmentTypes,
+			QuarantineDir: *quarantineDir, Space: space, Checks: uploadChecks}
+		scanTimeout := time.Duration(*scanTimeoutMs) * time.Millisecond
+		if len(*scanClamd) > 0 {
+			if uploads.Scanner, err = newClamdScanner(*scanClamd, scanTimeout); err != nil {
+				log.Fatalf("Invalid scanClamd cmdline arg: %v\n", err)
+			}
+		} else if len(*scanURL) > 0 {
+			uploads.Scanner = newWebhookScanner(*scanURL, scanTimeout)
+		}
+		if err := newQuarantineDir(*quarantineDir); err != nil {
+			log.Fatalf("Failed to create quarantineDir: %q\n", err)
+		}
+		http.HandleFunc("/upload", stats.trackHandler("upload", getUploadClosure(uploads)))
+		http.HandleFunc("/uploads/", stats.trackHandler("uploads", getUploadedFileClosure(uploads)))
+	}
+	http.HandleFunc("/static/microchat.js", stats.trackHandler("client_js", getClientScriptClosure()))
+	extensions, err := loadPageExtensions(*templateBlocks, *templateData)
+	if err != nil {
+		log.Fatalf("Failed to load templateBlocks/templateData: %v\n", err)
+	}
+	themes, err := loadThemes(*themesDir, *theme, extensions)
+	if err != nil {
+		log.Fatalf("Failed to load themes: %v\n", err)
+	}
+	var welcome *welcomeGate
+	if len(*welcomeFile) > 0 {
+		if welcome, err = newWelcomeGate(*welcomeFile); err != nil {
+			log.Fatalf("Failed to read welcomeFile: %v\n", err)
+		}
+		http.HandleFunc(welcomePath, stats.trackHandler("welcome", getWelcomeAgreeClosure(welcome)))
+	}
+	http.HandleFunc("/", stats.trackHandler("index", welcome.guard(getIndexClosure(indexOptions{
+		MaxChatLifeHours:    *maxChatLifeHours,
+		TopicRefreshSeconds: *topicRefreshSeconds,
+		MaxTopicListNum:     *maxTopicListNum,
+		OnScreen:            onScreen,
+		Limits:              limits,
+		Firehose:            firehose,
+		Uploads:             storage != nil,
+		VoiceNotes:          storage != nil && *maxVoiceSec > 0,
+		Attachments:         attachmentTypes,
+		Presence:            *presenceOn,
+		Rooms:               rooms,
+		Identity:            identity,
+		RestrictNewTopics:   *restrictNewTopics,
+		Manager:             manager,
+		PublicURL:           *publicURL,
+		Snapshot:            *crawlerSnapshot,
+		Bans:                bans,
+		AppIcon:             len(*appIcon) > 0,
+		Extensions:          extensions,
+		Themes:              themes,
+		Renderer:            renderer,
+	}))))
+	http.HandleFunc("/themes/", stats.trackHandler("theme_css", getThemeCSSClosure(themes)))
+	webhookClient := newSafeHTTPClient(5 * time.Second)
+	if *webhookPrivateURLs {
+		webhookClient = &http.Client{Timeout: 5 * time.Second}
+	}
+	deliveries := newDeliveryQueue(*deadLetterFile)
+	webhooks, err := newTopicWebhooks(*webhooksFile, webhookClient, deliveries)
+	if err != nil {
+		log.Fatalf("Invalid webhooksFile cmdline arg: %v\n", err)
+	}
+	manager.onPublish(webhooks.published)
+	if len(*notifyKind) > 0 {
+		if *notifyKind != notifyNtfy && *notifyKind != notifyGotify {
+			log.Fatalf("notify cmdline arg must be one of: ntfy, gotify\n")
+		}
+		if !validWebhookURL(*notifyURL) {
+			log.Fatalf("notifyURL cmdline arg must be an http(s) url\n")
+		}
+		if *notifyKind == notifyGotify && len(*notifyToken) == 0 {
+			log.Fatalf("notifyToken cmdline arg is required with gotify\n")
+		}
+		notifyOpts := notifierOptions{Kind: *notifyKind, URL: *notifyURL, Token: *notifyToken,
+			Mentions: splitCommaList(*notifyMentions), Keywords: splitCommaList(*notifyKeywords), Topics: make(map[string]bool)}
+		if len(notifyOpts.Mentions) == 0 && len(notifyOpts.Keywords) == 0 {
+			log.Fatalf("notify needs notifyMentions and/or notifyKeywords\n")
+		}
+		for _, topic := range splitCommaList(*notifyTopics) {
+			notifyOpts.Topics[topic] = true
+		}
+		manager.onPublish(newPushNotifier(notifyOpts, *publicURL, deliveries).published)
+	}
+	if len(*autoRespondFile) > 0 {
+		responders, err := loadAutoResponders(*autoRespondFile, *autoRespondBotName, manager, stats, renderer,
+			time.Duration(*maxChatLifeHours)*time.Hour)
+		if err != nil {
+			log.Fatalf("Invalid autoRespondFile cmdline arg: %v\n", err)
+		}
+		checks = append(checks, responders)
+	}
+	// removes burn-after-reading and per chat expiry chats, publishing
+	// tombstones in their place
+	newChatBurner(manager)
+	scheduled := newScheduledPosts(1000, publishLater(manager, stats, checks))
+	if space != nil {
+		space.reapWith(liveUploadLinks(manager, spill, stored, held, scheduled))
+	}
+	postOpts := postOptions{
+		Manager:   manager,
+		Stats:     stats,
+		Renderer:  renderer,
+		Firehose:  firehose,
+		Checks:    checks,
+		Held:      held,
+		Access:    access,
+		Announce:  announce,
+		Scheduled: scheduled,
+		Retention: time.Duration(*maxChatLifeHours) * time.Hour,
+		Rooms:     rooms,
+		Signers:   signers,
+		Identity:  identity,
+		Names:     names,
+		ChatOps:   ops,
+		Bridges:   bridges,
+	}
+	http.HandleFunc("/post", stats.trackHandler("post", getChatPostClosure(postOpts)))
+	http.HandleFunc("/api/v1/chats:batch", stats.trackHandler("batch_post",
+		access.requireScope(scopeBatch, rolePoster, getBatchPostClosure(postOpts))))
+	mutes := newMuteList(renderer)
+	http.HandleFunc("/api/v1/mute", stats.trackHandler("mute", getMuteClosure(mutes)))
+	http.HandleFunc("/api/v1/names", stats.trackHandler("names", subscribeGuard(getNamesClosure(manager, bans))))
+	subscribe := mutes.filter(stats.trackSubscribers(manager.SubscriptionHandler))
+	if *presenceOn {
+		// viewers count as present from either poll, whichever is open
+		presence := newPresenceTracker(15 * time.Second)
+		subscribe = presence.track(subscribe)
+		http.HandleFunc("/presence", stats.trackHandler("presence",
+			subscribeGuard(presence.track(presence.SubscriptionHandler))))
+	}
+	http.HandleFunc("/subscribe", stats.trackHandler("subscribe",
+		subscribeGuard(firehose.guard(bans.guard(subscribe)))))
+	likes := newChatLikes(manager)
+	http.HandleFunc("/history", stats.trackHandler("history",
+		subscribeGuard(firehose.guard(bans.guard(mutes.filter(getHistoryClosure(manager, spill, stored, likes)))))))
+	if origins := splitCommaList(*embedOrigins); len(origins) > 0 {
+		http.HandleFunc("/embed/", stats.trackHandler("embed", getEmbedClosure(embedOptions{Origins: origins,
+			OnScreen: onScreen, Limits: limits, Rooms: rooms, Bans: bans})))
+	}
+	var robots []byte
+	if len(*robotsFile) > 0 {
+		if robots, err = ioutil.ReadFile(*robotsFile); err != nil {
+			log.Fatalf("Failed to read robotsFile: %v\n", err)
+		}
+	}
+	faviconIcon := defaultFavicon
+	if len(*favicon) > 0 {
+		if faviconIcon, err = loadIcon(*favicon); err != nil {
+			log.Fatalf("Failed to read favicon: %v\n", err)
+		}
+	}
+	http.HandleFunc("/favicon.ico", getIconClosure(faviconIcon))
+	if len(*appIcon) > 0 {
+		icon, err := loadIcon(*appIcon)
+		if err != nil {
+			log.Fatalf("Failed to read appIcon: %v\n", err)
+		}
+		http.HandleFunc("/apple-touch-icon.png", getIconClosure(icon))
+	}
+	http.HandleFunc("/robots.txt", stats.trackHandler("robots", getRobotsClosure(robots, *publicURL)))
+	http.HandleFunc("/sitemap.xml", stats.trackHandler("sitemap", getSitemapClosure(manager, rooms, *publicURL)))
+	http.HandleFunc("/qr/", stats.trackHandler("qr", getQRClosure(*publicURL, limits)))
+	shortlinks, err := newShortLinks(*shortLinksFile, 100000)
+	if err != nil {
+		log.Fatalf("Failed to open shortLinksFile: %q\n", err)
+	}
+	http.HandleFunc("/t/", stats.trackHandler("short_link", getShortLinkClosure(shortlinks)))
+	http.HandleFunc("/api/v1/shortlinks", stats.trackHandler("short_link_mint",
+		getMintShortLinkClosure(shortlinks, manager, rooms, *publicURL)))
+	http.HandleFunc("/preview", stats.trackHandler("preview", getPreviewClosure(renderer)))
+	http.Handle("/avatar/", &avatarHandler{})
+	userPosts := userPostsOptions{Manager: manager, Spill: spill, Renderer: renderer, Firehose: firehose, Bans: bans}
+	http.HandleFunc("/user/", stats.trackHandler("user", getUserPageClosure(userPosts)))
+	http.HandleFunc("/api/v1/user/", stats.trackHandler("user_api", getUserAPIClosure(userPosts)))
+	if *leaderboardHours > 0 {
+		if *leaderboardHours > *maxChatLifeHours {
+			log.Fatalf("Invalid leaderboardHours cmdline arg, can't be more than maxChatLifeHours.\n")
+		}
+		board := newLeaderboard(manager, time.Duration(*leaderboardHours)*time.Hour, firehose)
+		http.HandleFunc("/leaderboard", stats.trackHandler("leaderboard", getLeaderboardPageClosure(board)))
+		http.HandleFunc("/api/v1/leaderboard", stats.trackHandler("leaderboard_api", getLeaderboardAPIClosure(board)))
+	}
+	if archive != nil {
+		http.HandleFunc("/archive/", stats.trackHandler("archive", getArchiveClosure(archive, bans)))
+	}
+	http.HandleFunc("/chat/", stats.trackHandler("chat_page", getChatPageClosure(chatPageOptions{Manager: manager,
+		Spill: spill, Rooms: rooms, Bans: bans})))
+	markers := newReadMarkers(time.Duration(*maxChatLifeHours) * time.Hour)
+	if challenge != nil {
+		http.HandleFunc("/challenge", stats.trackHandler("challenge", getChallengeClosure(challenge)))
+	}
+	http.HandleFunc("/api/v1/sessions", stats.trackHandler("sessions", getSessionsClosure(sessions)))
+	http.HandleFunc("/api/v1/sessions/revoke", stats.trackHandler("sessions_revoke", getSessionsClosure(sessions)))
+	http.HandleFunc("/admin/sessions", stats.trackHandler("admin_sessions",
+		access.require(roleAdmin, getAdminSessionsClosure(sessions))))
+	http.HandleFunc("/api/v1/read", stats.trackHandler("read", getReadMarkerClosure(markers)))
+	http.HandleFunc("/api/v1/unread", stats.trackHandler("unread", getUnreadClosure(markers, manager, bans)))
+	http.HandleFunc("/topics", stats.trackHandler("topics", getTopicsClosure(manager, *maxTopicListNum)))
+	http.HandleFunc("/api/v1/topics", stats.trackHandler("topic_search", getTopicSearchClosure(manager)))
+	summaries := newTopicSummaryStream(manager, time.Duration(*maxChatLifeHours)*time.Hour)
+	http.HandleFunc("/subscribe/topics", stats.trackHandler("subscribe_topics",
+		subscribeGuard(bans.guard(getTopicSummariesSubscribeClosure(summaries, firehose)))))
+	http.HandleFunc("/admin/stats", stats.trackHandler("admin_stats",
+		access.requireScope(scopeRead, roleReadOnly, getStatsClosure(stats, manager))))
+	analytics := analyticsOptions{Manager: manager, Spill: spill, Retention: time.Duration(*maxChatLifeHours) * time.Hour}
+	http.HandleFunc("/admin/analytics", stats.trackHandler("admin_analytics",
+		access.requireScope(scopeRead, roleReadOnly, getAnalyticsClosure(analytics))))
+	http.HandleFunc("/api/v1/stats", stats.trackHandler("stats_api", getPublicStatsClosure(analytics, stats)))
+	publishApproved := publishLater(manager, stats, checks)
+	http.HandleFunc("/admin/scheduled", stats.trackHandler("admin_scheduled",
+		access.requireScope(scopeRead, roleReadOnly, getScheduledListClosure(scheduled))))
+	http.HandleFunc("/admin/scheduled.ics", stats.trackHandler("admin_scheduled_calendar",
+		access.requireScope(scopeRead, roleReadOnly, getScheduledCalendarClosure(scheduled, *publicURL))))
+	http.HandleFunc("/admin/scheduled/cancel", stats.trackHandler("admin_scheduled_cancel",
+		access.require(roleModerator, getScheduledCancelClosure(scheduled))))
+	http.HandleFunc("/admin/held", stats.trackHandler("admin_held",
+		access.requireScope(scopeRead, roleReadOnly, getHeldListClosure(held))))
+	http.HandleFunc("/admin/held/approve", stats.trackHandler("admin_held_approve",
+		access.require(roleModerator, getHeldDecisionClosure(held, true, publishApproved))))
+	http.HandleFunc("/admin/held/reject", stats.trackHandler("admin_held_reject",
+		access.require(roleModerator, getHeldDecisionClosure(held, false, publishApproved))))
+	http.HandleFunc("/like/", stats.trackHandler("like",
+		getLikeClosure(likes, manager, bans, time.Duration(*maxChatLifeHours)*time.Hour)))
+	reports := newChatReports(manager, int(*flagHideThreshold))
+	http.HandleFunc("/report", stats.trackHandler("report",
+		getReportClosure(reports, manager, time.Duration(*maxChatLifeHours)*time.Hour)))
+	http.HandleFunc("/admin/reports", stats.trackHandler("admin_reports",
+		access.requireScope(scopeRead, roleReadOnly, getReportsClosure(reports))))
+	http.HandleFunc("/admin/reports/clear", stats.trackHandler("admin_reports_clear",
+		access.require(roleModerator, getReportsClearClosure(reports))))
+	http.HandleFunc("/admin/topic-bans", stats.trackHandler("admin_topic_bans",
+		access.require(roleModerator, getTopicBansClosure(bans, access))))
+	http.HandleFunc("/admin/topic-bans/lift", stats.trackHandler("admin_topic_bans_lift",
+		access.require(roleModerator, getTopicBanLiftClosure(bans))))
+	http.HandleFunc("/admin/topic-invites", stats.trackHandler("admin_topic_invites",
+		access.require(roleModerator, getTopicInvitesClosure(creation))))
+	http.HandleFunc("/admin/deliveries", stats.trackHandler("admin_deliveries",
+		access.requireScope(scopeRead, roleReadOnly, getDeliveriesClosure(deliveries))))
+	http.HandleFunc("/admin/webhooks", stats.trackHandler("admin_webhooks",
+		access.require(roleModerator, getTopicWebhooksClosure(webhooks, access))))
+	http.HandleFunc("/admin/topic-render", stats.trackHandler("admin_topic_render",
+		access.require(roleModerator, getTopicRenderClosure(topicRules, access))))
+	http.HandleFunc("/admin/snippets", stats.trackHandler("admin_snippets",
+		access.require(roleModerator, getSnippetsClosure(snippets, access))))
+	http.HandleFunc("/admin/users", stats.trackHandler("admin_users",
+		access.require(roleAdmin, getUsersClosure(access))))
+	http.HandleFunc("/admin/tokens", stats.trackHandler("admin_tokens",
+		access.require(roleAdmin, getTokensClosure(tokens))))
+	http.HandleFunc("/admin/erase", stats.trackHandler("admin_erase",
+		access.require(roleAdmin, getEraseClosure(eraseOptions{Manager: manager, Spill: spill, Held: held, Posters: posters,
+			Archive: archive, Stored: stored}))))
+	http.HandleFunc("/admin/replication", stats.trackHandler("admin_replication",
+		access.require(roleAdmin, getReplicationClosure(manager))))
+	if cluster != nil {
+		http.HandleFunc("/raft/", stats.trackHandler("raft", getRaftClosure(cluster)))
+		http.HandleFunc("/admin/cluster", stats.trackHandler("admin_cluster",
+			access.requireScope(scopeRead, roleReadOnly, getClusterClosure(cluster))))
+	}
+	if standby != nil {
+		http.HandleFunc("/admin/standby", stats.trackHandler("admin_standby",
+			access.require(roleAdmin, getStandbyClosure(standby))))
 	}
 
-	http.HandleFunc("/", getIndexClosure(*maxChatLifeHours,
-		*topicRefreshSeconds, *maxTopicListNum, *numChatsOnScreen))
-	http.HandleFunc("/post", getChatPostClosure(manager))
-	http.HandleFunc("/subscribe", manager.SubscriptionHandler)
-
-	log.Printf("addr:%v, maxChatHrs:%v, topicRefreshSec:%v, maxTopicLists:%v chatsOnScreen:%v\n",
-		*listenAddress, *maxChatLifeHours, *topicRefreshSeconds, *maxTopicListNum, *numChatsOnScreen)
+	log.Printf("addr:%v, maxChatHrs:%v, topicRefreshSec:%v, maxTopicLists:%v chatsOnScreen:%v maxBufferMB:%v limits:%+v firehose:%v\n",
+		*listenAddress, *maxChatLifeHours, *topicRefreshSeconds, *maxTopicListNum, *numChatsOnScreen, *maxBufferMB, limits, *firehoseMode)
 	log.Printf("Launching chat server on %s\n", *listenAddress)
-	http.ListenAndServe(*listenAddress, nil)
+	var handler http.Handler = sessions.track(http.DefaultServeMux)
+	if len(allowedNets) > 0 {
+		handler = restrictToCIDRs(allowedNets, handler)
+	}
+	http.ListenAndServe(*listenAddress, resolveClientIP(proxies, newIPAnonymizer(*privacyMode, *privacySalt), handler))
+}
+
+// Max lengths (in runes) for the fields of a chat post.
+type inputLimits struct {
+	TopicLen   uint
+	NameLen    uint
+	MessageLen uint
 }
 
 type ChatPost struct {
-	DisplayName string `json:"display_name"`
-	Message     string `json:"message"`
-	Topic       string `json:"topic"`
+	ID          string       `json:"id,omitempty"`
+	DisplayName string       `json:"display_name"`
+	Message     string       `json:"message"`
+	Topic       string       `json:"topic"`
+	Preview     *linkPreview `json:"preview,omitempty"`
+	Action      bool         `json:"action,omitempty"` // posted with /me
+	NameColor   string       `json:"name_color,omitempty"`
+	Burn        bool         `json:"burn,omitempty"`       // removed once delivered
+	ExpiresAt   int64        `json:"expires_at,omitempty"` // epoch ms, removed after
+	Encrypted   bool         `json:"encrypted,omitempty"`  // message is an e2e blob
+	Verified    string       `json:"verified,omitempty"`   // name of the key that signed it
+	// rendered translations by language code
+	Translations map[string]string `json:"translations,omitempty"`
+	Toxicity     float64           `json:"toxicity,omitempty"` // 0-1, when -toxicity is set
+	System       bool              `json:"system,omitempty"`   // what an /admin command did
+	// the other topics a cross-posted chat went to
+	AlsoPostedIn []string `json:"also_posted_in,omitempty"`
+	// where a chat relayed by a -bridgesFile bridge came from
+	Bridge *chatOrigin `json:"bridge,omitempty"`
+}
+
+// splitCommaList splits a comma separated cmdline arg, dropping blanks.
+func splitCommaList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// siteURL is the scheme and host links we hand out point at, -publicURL or
+// else worked out from the request.
+func siteURL(publicURL string, r *http.Request) string {
+	if len(publicURL) > 0 {
+		return strings.TrimSuffix(publicURL, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// randomID returns a random hex string made from n random bytes.
+func randomID(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("Failed to read random bytes: %q\n", err)
+	}
+	return hex.EncodeToString(b)
 }
 
 func truncateInput(input string, maxlen int) string {
@@ -71,8 +908,18 @@ func truncateInput(input string, maxlen int) string {
 	return string(output)
 }
 
+// newChatPolicy is bluemonday's user content policy plus our own markup.
+func newChatPolicy() *bluemonday.Policy {
+	policy := bluemonday.UGCPolicy()
+	policy.AllowAttrs("class").Matching(regexp.MustCompile(`^spoiler$`)).OnElements("span")
+	policy.AllowAttrs("title").OnElements("span")
+	return policy
+}
+
+var chatPolicy = newChatPolicy()
+
 func sanitizeInput(input string) string {
-	return bluemonday.UGCPolicy().Sanitize(input)
+	return chatPolicy.Sanitize(input)
 }
 
 func toMarkdown(input string) string {
@@ -80,10 +927,60 @@ func toMarkdown(input string) string {
 	return string(html[:])
 }
 
+// publishChat publishes to the chat's topic, the all chats firehose is a view
+// over every topic so it shows up there too.
+func publishChat(manager *chatStore, stats *chatStats, chat ChatPost) error {
+	if err := manager.Publish(chat.Topic, chat); err != nil {
+		return err
+	}
+	stats.recordPost(chat)
+	return nil
+}
+
+// publishLater is publishChat for chats published after their request, by
+// the scheduler or a moderator, where all there is to do with an error is
+// log it.  The checks hear about them with the request they were posted by.
+func publishLater(manager *chatStore, stats *chatStats, checks []postCheck) func(r *http.Request, chat ChatPost) {
+	return func(r *http.Request, chat ChatPost) {
+		if err := publishChat(manager, stats, chat); err != nil {
+			log.Printf("Failed to publish chat %s: %v\n", chat.ID, err)
+			return
+		}
+		notifyPublished(checks, r, chat)
+	}
+}
+
+// What the post handler needs to check, render and publish chats.
+type postOptions struct {
+	Manager   *chatStore
+	Stats     *chatStats
+	Renderer  *chatRenderer
+	Firehose  firehosePolicy
+	Checks    []postCheck
+	Held      *holdQueue
+	Access    *accessControl
+	Announce  map[string]bool // topics only posters and up can post to
+	Scheduled *scheduledPosts
+	// how long chats are kept, per chat expire_after has to be shorter
+	Retention time.Duration
+	// nil when encrypted rooms are disabled
+	Rooms *encryptedRooms
+	// keys signed chats are verified against, nil when disabled
+	Signers *signingKeys
+	// binds display names to sessions
+	Identity identitySigner
+	// keeps names to one session per topic, nil when disabled
+	Names *nameReservations
+	// runs /admin commands
+	ChatOps *chatOps
+	// how bridged chats are shown, nil when there are none
+	Bridges *bridgeMappings
+}
+
 // Create a closure that contains a ref to our longpoll manager so we can
 // call Publish() from within web handler
-// NOTE: the manager is safe to call this way because it relies on channels
-func getChatPostClosure(manager *golongpoll.LongpollManager) func(w http.ResponseWriter, r *http.Request) {
+// NOTE: the manager is safe to call this way because it does its own locking
+func getChatPostClosure(opts postOptions) func(w http.ResponseWriter, r *http.Request) {
 	reg, err := regexp.Compile("[^A-Za-z0-9]+")
 	if err != nil {
 		log.Fatal("Error compiling regexp: ", err)
@@ -91,32 +988,264 @@ func getChatPostClosure(manager *golongpoll.LongpollManager) func(w http.Respons
 	return func(w http.ResponseWriter, r *http.Request) {
 		logRequest(r)
 		if r.Method != "POST" {
+			opts.Stats.recordRejection("", "bad_method")
 			http.Error(w, "Invalid request method.", 405)
 			return
 		}
 		err := r.ParseForm()
 		if err != nil {
+			opts.Stats.recordRejection("", "bad_form")
 			http.Error(w, "Invalid form data.", 405)
 			return
 		}
-		topic := r.PostFormValue("topic")
-		topic = normalizeTopic(topic, reg)
+		// a comma separated list cross-posts to each of them
+		topics := splitTopics(r.PostFormValue("topic"), reg, int(opts.Renderer.limits.TopicLen))
+		topic, alsoTopics := "", []string(nil)
+		if len(topics) > 0 {
+			topic, alsoTopics = topics[0], topics[1:]
+		}
 		display_name := r.PostFormValue("display_name")
+		// the name bound to this session is used when none is given
+		session := ensureSession(w, r)
+		ensureDevice(w, r)
+		boundName := opts.Identity.name(r)
+		if len(strings.TrimSpace(display_name)) == 0 {
+			display_name = boundName
+		}
 		message := r.PostFormValue("message")
 		if len(strings.TrimSpace(topic)) == 0 || len(strings.TrimSpace(display_name)) == 0 ||
 			len(strings.TrimSpace(message)) == 0 {
-			http.Error(w, "Invalid request.  Blank/Invalid topic (must be A-Za-z0-9), display_name, or message.", 400)
+			opts.Stats.recordRejection(topic, "blank_field")
+			http.Error(w, fmt.Sprintf("Invalid request.  Blank/Invalid topic (must be A-Za-z0-9, up to %d characters), display_name (up to %d characters), or message (up to %d characters).",
+				opts.Renderer.limits.TopicLen, opts.Renderer.limits.NameLen, opts.Renderer.limits.MessageLen), 400)
 			return
 		}
+		if len(topics) > maxCrossPostTopics {
+			opts.Stats.recordRejection(topic, "too_many_topics")
+			http.Error(w, fmt.Sprintf("Too many topics, a chat can be posted to at most %d.", maxCrossPostTopics), 400)
+			return
+		}
+		// switching names has to be asked for, not slipped in by a link
+		if display_name != boundName && len(boundName) > 0 && r.PostFormValue("rename") != "yes" {
+			opts.Stats.recordRejection(topic, "name_mismatch")
+			http.Error(w, "You're posting as "+html.EscapeString(boundName)+", use [Change] to post under a different name.", 409)
+			return
+		}
+		typedName := display_name
+		postedBy, postedRole := opts.Access.identify(r)
+		if !opts.Access.scoped(r, scopePost) {
+			opts.Stats.recordRejection(topic, "token_scope")
+			http.Error(w, "Token doesn't have the post scope.", 403)
+			return
+		}
+		if len(alsoTopics) > 0 {
+			if isAdminCommand(message) || len(r.PostFormValue("publish_at")) > 0 {
+				opts.Stats.recordRejection(topic, "bad_cross_post")
+				http.Error(w, "Commands and scheduled chats can't be cross-posted.", 400)
+				return
+			}
+			for _, other := range topics {
+				if opts.Rooms.has(other) {
+					opts.Stats.recordRejection(topic, "bad_cross_post")
+					http.Error(w, "Encrypted rooms can't be cross-posted to.", 400)
+					return
+				}
+			}
+		}
+		if isAdminCommand(message) && !opts.Rooms.has(topic) {
+			if postedRole < roleModerator {
+				opts.Stats.recordRejection(topic, "unauthorized_command")
+				http.Error(w, "Only moderators and admins can use /admin.", 403)
+				return
+			}
+			if err := opts.ChatOps.run(postedBy, opts.Renderer, truncateInput(topic, int(opts.Renderer.limits.TopicLen)), message); err != nil {
+				opts.Stats.recordRejection(topic, "bad_command")
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			if r.PostFormValue("doAjax") == "yes" {
+				w.Write([]byte("ok"))
+			} else {
+				http.Redirect(w, r, "/?topic="+topic, http.StatusSeeOther)
+			}
+			return
+		}
+		for _, announced := range topics {
+			if opts.Announce[announced] && postedRole < rolePoster {
+				opts.Stats.recordRejection(announced, "announce_only")
+				http.Error(w, "Only announcers can post to "+announced+".", 403)
+				return
+			}
+		}
+		// scheduled chats are for announcements by bots and admins
+		publishAtString := r.PostFormValue("publish_at")
+		var publishAt time.Time
+		if len(publishAtString) > 0 {
+			if postedRole < rolePoster || !opts.Access.scoped(r, scopeSchedule) {
+				opts.Stats.recordRejection(topic, "unauthorized_schedule")
+				http.Error(w, "Only bots and admins can schedule chats.", 403)
+				return
+			}
+			var ok bool
+			publishAt, ok = parsePublishAt(publishAtString)
+			if !ok || publishAt.Before(time.Now()) || publishAt.After(time.Now().Add(maxScheduleAhead)) {
+				opts.Stats.recordRejection(topic, "bad_publish_at")
+				http.Error(w, "Invalid publish_at, must be epoch milliseconds or RFC 3339 within the next 30 days.", 400)
+				return
+			}
+		}
 		// enforce max lengths--note strings could be non-ascii so treat as runes
-		topic = truncateInput(topic, 48) // topic sanitized by normalization func that only allows A-Za-z0-9space
-		display_name = sanitizeInput(truncateInput(display_name, 28))
-		message = sanitizeInput(toMarkdown(truncateInput(message, 512)))
-		chat := ChatPost{DisplayName: display_name, Message: message, Topic: topic}
-		manager.Publish(topic, chat)
-		// show on the all-chats channel as well that shows on the homepage when you
-		// haven't filtered to a specific topic.
-		manager.Publish(ALL_CHATS, chat)
+		topic = truncateInput(topic, int(opts.Renderer.limits.TopicLen)) // topic sanitized by normalization func that only allows A-Za-z0-9space
+		chat := ChatPost{ID: randomID(8), Topic: topic}
+		var expireAfter time.Duration
+		if burnString := r.PostFormValue("burn"); len(burnString) > 0 {
+			afterRead, after, ok := parseBurn(burnString)
+			if !ok {
+				opts.Stats.recordRejection(topic, "bad_burn")
+				http.Error(w, fmt.Sprintf("Invalid burn, must be read or 1-%d minutes.", maxBurnMinutes), 400)
+				return
+			}
+			chat.Burn = afterRead
+			expireAfter = after
+		}
+		if expireString := r.PostFormValue("expire_after"); len(expireString) > 0 {
+			after, ok := parseExpireAfter(expireString, opts.Retention)
+			if !ok {
+				opts.Stats.recordRejection(topic, "bad_expire_after")
+				http.Error(w, "Invalid expire_after, must be a duration like 1h or 30m, at least a minute and shorter than "+
+					opts.Retention.String()+".", 400)
+				return
+			}
+			if expireAfter == 0 || after < expireAfter {
+				expireAfter = after
+			}
+		}
+		if expireAfter > 0 {
+			// counted from when the chat is published
+			publishedAt := time.Now()
+			if len(publishAtString) > 0 {
+				publishedAt = publishAt
+			}
+			chat.ExpiresAt = timeToEpochMilliseconds(publishedAt.Add(expireAfter))
+		}
+		// a detached signature covers the message exactly as it was posted
+		if signature := r.PostFormValue("signature"); len(signature) > 0 {
+			if opts.Signers == nil {
+				opts.Stats.recordRejection(topic, "bad_signature")
+				http.Error(w, "Signed chats aren't enabled here.", 400)
+				return
+			}
+			if chat.Verified, err = opts.Signers.verify([]byte(message), signature); err != nil {
+				opts.Stats.recordRejection(topic, "bad_signature")
+				http.Error(w, "Invalid signature, "+err.Error()+".", 400)
+				return
+			}
+		}
+		// encrypted rooms relay the message untouched, it's opaque to us
+		chat.Encrypted = opts.Rooms.has(topic)
+		rawMessage := message
+		if chat.Encrypted {
+			if len(message) > maxEncryptedLen(opts.Renderer.limits) || !encryptedMessageRegex.MatchString(message) {
+				opts.Stats.recordRejection(topic, "not_encrypted")
+				http.Error(w, "This room is end-to-end encrypted, chats have to be encrypted by the room's page.", 400)
+				return
+			}
+		} else if rawMessage, err = opts.Renderer.applySlashCommand(message, &chat); err != nil {
+			opts.Stats.recordRejection(topic, "bad_command")
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if bridge := opts.Bridges.lookup(postedBy); bridge != nil {
+			display_name = bridge.displayName(display_name)
+			chat.Bridge = opts.Bridges.origin(bridge, r.PostFormValue("avatar_url"))
+		}
+		display_name = opts.Renderer.renderName(display_name)
+		chat.DisplayName = display_name
+		chat.NameColor = nameColor(display_name)
+		if chat.Encrypted {
+			chat.Message = message
+		} else {
+			chat.Message = opts.Renderer.renderMessage(topic, rawMessage)
+		}
+		// every copy of a cross-post has to pass, each counts as a post
+		chats := crossPosts(chat, alsoTopics)
+		for i := range chats {
+			if i > 0 {
+				chats[i].Message = opts.Renderer.renderMessage(chats[i].Topic, rawMessage)
+			}
+			if rejection := runPostChecks(opts.Checks, r, &chats[i]); rejection != nil {
+				opts.Stats.recordRejection(chats[i].Topic, rejection.Reason)
+				for _, passed := range chats[:i] {
+					notifyReleased(opts.Checks, r, passed)
+				}
+				if rejection.Hold {
+					for _, held := range chats {
+						opts.Held.hold(r, held, rejection.Reason)
+					}
+					w.WriteHeader(rejection.Status)
+					w.Write([]byte(rejection.Message))
+					return
+				}
+				writeRejection(w, r, opts.Checks, rejection)
+				return
+			}
+		}
+		// only chats that passed reserve their name, so posts that were
+		// always going to be turned away can't squat one
+		claims := make([]nameClaim, len(topics))
+		for i, claimed := range topics {
+			claims[i] = nameClaim{claimed, display_name}
+		}
+		// bots don't keep cookies, their account is their session
+		holder := session
+		if len(postedBy) > 0 {
+			holder = "user:" + postedBy
+		}
+		if taken := opts.Names.claim(claims, holder); taken >= 0 {
+			for _, passed := range chats {
+				notifyReleased(opts.Checks, r, passed)
+			}
+			opts.Stats.recordRejection(topics[taken], "name_in_use")
+			http.Error(w, "Name in use, someone else is posting as "+display_name+" in "+topics[taken]+" right now.  Pick another name.", 409)
+			return
+		}
+		// only bound once it's theirs to use
+		if typedName != boundName {
+			opts.Identity.bind(w, r, session, typedName)
+		}
+		// only fetched for chats that made it, so rejected spam costs nothing
+		if !chat.Encrypted {
+			preview := opts.Renderer.renderPreview(rawMessage)
+			for i := range chats {
+				chats[i].Preview = preview
+				chats[i].Translations = opts.Renderer.renderTranslations(chats[i].Topic, rawMessage)
+			}
+		}
+		chat = chats[0]
+		if len(publishAtString) > 0 {
+			post, ok := opts.Scheduled.schedule(r, chat, postedBy, publishAt)
+			// the checks hear about it again once it's published
+			notifyReleased(opts.Checks, r, chat)
+			if !ok {
+				http.Error(w, "Too many scheduled chats, try again later.", 503)
+				return
+			}
+			writeRateLimitHeaders(w, opts.Checks, r)
+			writeJSON(w, 202, post)
+			return
+		}
+		for i, posted := range chats {
+			if err := publishChat(opts.Manager, opts.Stats, posted); err != nil {
+				for _, unpublished := range chats[i:] {
+					notifyReleased(opts.Checks, r, unpublished)
+				}
+				log.Printf("Failed to publish chat: %v\n", err)
+				http.Error(w, "Failed to publish chat, try again.", 503)
+				return
+			}
+			notifyPublished(opts.Checks, r, posted)
+		}
+		writeRateLimitHeaders(w, opts.Checks, r)
 		// redirect to the chat page for the given topic
 		if r.PostFormValue("doAjax") == "yes" {
 			// ajax post, return ok
@@ -124,12 +1253,49 @@ func getChatPostClosure(manager *golongpoll.LongpollManager) func(w http.Respons
 			return
 		} else {
 			// form post, do Redirect
-			http.Redirect(w, r, "/?topic="+topic+"&display_name="+display_name, http.StatusSeeOther)
+			http.Redirect(w, r, "/?topic="+topic, http.StatusSeeOther)
 		}
 	}
 }
 
-func getIndexClosure(maxChatLifeHours, topicRefreshSeconds, maxTopicListNum, numChatsOnScreen uint) func(w http.ResponseWriter, r *http.Request) {
+// Settings that shape the chat page.
+type indexOptions struct {
+	MaxChatLifeHours    uint
+	TopicRefreshSeconds uint
+	MaxTopicListNum     uint
+	OnScreen            chatsOnScreen
+	Limits              inputLimits
+	Firehose            firehosePolicy
+	// whether the composer offers image uploads and voice recording
+	Uploads    bool
+	VoiceNotes bool
+	// non-image files the composer lets you attach
+	Attachments attachmentPolicy
+	// whether topic pages show how many people are watching
+	Presence bool
+	// nil when encrypted rooms are disabled
+	Rooms *encryptedRooms
+	// reads the name bound to the visitor's session
+	Identity identitySigner
+	// whether new topics need an invite code
+	RestrictNewTopics bool
+	// where link unfurl tags and snapshots get chats from
+	Manager *chatStore
+	// keeps banned readers out of snapshots and unfurl tags
+	Bans      *topicBans
+	PublicURL string
+	// snapshotOff, snapshotCrawlers or snapshotAlways
+	Snapshot string
+	// whether there's an /apple-touch-icon.png
+	AppIcon bool
+	// site specific blocks, functions and data
+	Extensions pageExtensions
+	Themes     *pageThemes
+	// whether topics render markdown, for the composer's help
+	Renderer *chatRenderer
+}
+
+func getIndexClosure(opts indexOptions) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		logRequest(r)
 		if r.Method != "GET" {
@@ -137,9 +1303,18 @@ func getIndexClosure(maxChatLifeHours, topicRefreshSeconds, maxTopicListNum, num
 			return
 		}
 		topic := r.URL.Query().Get("topic")
-		displayName := r.URL.Query().Get("display_name")
-		t := template.New("chat_homepage")
-		t, _ = t.Parse(getIndexTemplateString())
+		displayName := opts.Identity.name(r)
+		showFirehose := opts.Firehose.visibleTo(r)
+		category := topic
+		if len(category) == 0 {
+			category = ALL_CHATS
+		}
+		numChatsOnScreen := opts.OnScreen.forRequest(category, r)
+		// admins watching a restricted firehose pass their token along
+		adminParam := ""
+		if showFirehose && opts.Firehose.Mode == firehoseAdmin && len(r.URL.Query().Get("admin_token")) > 0 {
+			adminParam = "&admin_token=" + url.QueryEscape(r.URL.Query().Get("admin_token"))
+		}
 		templateData := struct {
 			Topic               string
 			DisplayName         string
@@ -148,9 +1323,48 @@ func getIndexClosure(maxChatLifeHours, topicRefreshSeconds, maxTopicListNum, num
 			TopicRefreshSeconds uint
 			MaxTopicListNum     uint
 			NumChatsOnScreen    uint
-		}{topic, displayName, ALL_CHATS, maxChatLifeHours, topicRefreshSeconds,
-			maxTopicListNum, numChatsOnScreen}
-		t.Execute(w, templateData)
+			Limits              inputLimits
+			ShowFirehose        bool
+			AdminParam          string
+			Uploads             bool
+			VoiceNotes          bool
+			AttachmentAccept    string
+			Presence            bool
+			EncryptedRooms      bool
+			Encrypted           bool
+			RestrictNewTopics   bool
+			InviteCode          string
+			Meta                pageMeta
+			Snapshot            []snapshotChat
+			AppIcon             bool
+			Extra               map[string]interface{}
+			Theme               string
+			Themes              []string
+			ThemeCSS            string
+			PlainText           bool
+			Highlight           bool
+		}{topic, displayName, ALL_CHATS, opts.MaxChatLifeHours, opts.TopicRefreshSeconds,
+			opts.MaxTopicListNum, numChatsOnScreen, opts.Limits, showFirehose, adminParam, opts.Uploads,
+			opts.VoiceNotes, opts.Attachments.accept(), opts.Presence, opts.Rooms != nil, opts.Rooms.has(topic),
+			opts.RestrictNewTopics, r.URL.Query().Get("invite"), topicPageMeta(opts, r, topic), nil, opts.AppIcon,
+			opts.Extensions.data(r), "", opts.Themes.names, "", opts.Renderer.isPlain(topic),
+			opts.Renderer.topics.get(topic).Highlight}
+		theme := opts.Themes.forRequest(w, r)
+		templateData.Theme, templateData.ThemeCSS = theme.name, theme.cssPath()
+		if len(topic) > 0 || showFirehose {
+			templateData.Snapshot = topicSnapshot(opts, r, category, numChatsOnScreen)
+		}
+		// rendered first so a failure doesn't leave half a page
+		var rendered bytes.Buffer
+		if err := theme.page.Execute(&rendered, templateData); err != nil {
+			log.Printf("Failed to render chat page: %q\n", err)
+			http.Error(w, "Failed to render page.", 500)
+			return
+		}
+		// only /embed/ pages are meant to be framed by other sites
+		w.Header().Set("X-Frame-Options", "SAMEORIGIN")
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		rendered.WriteTo(w)
 	}
 }
 
@@ -170,15 +1384,30 @@ func logRequest(r *http.Request) {
 		topic = r.PostFormValue("topic")
 		displayName = r.PostFormValue("display_name")
 	}
-	log.Printf("HTTP %s %s  topic: %s, display_name: %s src_ip: %s x_forwarded_for: %s\n",
-		r.Method, r.URL.Path, topic, displayName, r.RemoteAddr, r.Header.Get("X-FORWARDED-FOR"))
+	if privateIPs(r) {
+		log.Printf("HTTP %s %s  topic: %s, display_name: %s client_ip: %s\n", r.Method, r.URL.Path, topic, displayName, clientIP(r))
+		return
+	}
+	log.Printf("HTTP %s %s  topic: %s, display_name: %s client_ip: %s src_ip: %s x_forwarded_for: %s\n",
+		r.Method, r.URL.Path, topic, displayName, clientIP(r), r.RemoteAddr, r.Header.Get("X-FORWARDED-FOR"))
 }
 
 func getIndexTemplateString() string {
 	return `<html>
     <head>
-      <title>micro-chat</title>
+      <title>{{ .Meta.Title }}</title>
 			<meta name="viewport" content="width=device-width, initial-scale=1.0">
+			<meta name="description" content="{{ .Meta.Description }}">
+			<meta property="og:type" content="website">
+			<meta property="og:site_name" content="micro-chat">
+			<meta property="og:title" content="{{ .Meta.Title }}">
+			<meta property="og:description" content="{{ .Meta.Description }}">
+			<meta property="og:url" content="{{ .Meta.URL }}">
+			<meta name="twitter:card" content="summary">
+			<meta name="twitter:title" content="{{ .Meta.Title }}">
+			<meta name="twitter:description" content="{{ .Meta.Description }}">
+			<link rel="icon" href="/favicon.ico">
+			{{ if .AppIcon }}<link rel="apple-touch-icon" href="/apple-touch-icon.png">{{ end }}
 			<link rel="stylesheet" type="text/css" href="https://cdnjs.cloudflare.com/ajax/libs/skeleton/2.0.4/skeleton.min.css">
 			<style>
 				body {
@@ -190,6 +1419,91 @@ func getIndexTemplateString() string {
 					color: #00AA00;
 				}
 
+				div.msg.system {
+					color: #888888;
+					font-style: italic;
+				}
+				div.msg.action {
+					font-style: italic;
+				}
+				div.msg.action span.actor {
+					font-weight: bold;
+					float: left;
+					margin-right: 0.5rem;
+				}
+				img.avatar {
+					width: 2.4rem;
+					height: 2.4rem;
+					border-radius: 0.3rem;
+					vertical-align: middle;
+				}
+				span.bridge {
+					font-size: 0.75rem;
+					padding: 0 0.3rem;
+					border-radius: 0.2rem;
+					background: #e8eaf6;
+					color: #3949ab;
+				}
+				span.mute {
+					color: #ccc;
+					cursor: pointer;
+					font-size: 1.2rem;
+				}
+				span.like {
+					color: #ccc;
+					cursor: pointer;
+					margin-left: 0.6rem;
+				}
+				span.like.liked {
+					color: #337ab7;
+				}
+				span.report {
+					color: #ccc;
+					cursor: pointer;
+					margin-left: 0.6rem;
+				}
+				div.flagShield {
+					color: #999;
+					font-style: italic;
+					cursor: pointer;
+					padding: 0.6rem 0;
+				}
+				div.chat.flagged div.msg, div.chat.flagged div.translation, div.chat.flagged div.preview {
+					display: none;
+				}
+				a.userLink {
+					color: inherit;
+					text-decoration: none;
+				}
+				span.unread {
+					font-size: 1.2rem;
+					color: #fff;
+					background: #d9534f;
+					border-radius: 1rem;
+					padding: 0 0.6rem;
+				}
+				span#viewerCount {
+					font-size: 1.4rem;
+					color: #999999;
+				}
+				ul#mentionList {
+					list-style: none;
+					margin: 0;
+					padding: 0.3rem 0;
+					border: 1px solid #CCCCCC;
+					max-width: 30rem;
+				}
+				ul#mentionList li {
+					cursor: pointer;
+					padding: 0 0.8rem;
+				}
+				ul#mentionList li:hover {
+					background-color: #EEEEEE;
+				}
+				div#previewPane {
+					margin-top: 1rem;
+					border-style: dashed;
+				}
 				div#feedback {
 				  color: red;
 					font-style: italic;
@@ -201,6 +1515,9 @@ func getIndexTemplateString() string {
 						font-size: 1.4rem;
 						color: #999999
   			}
+				a.permalink {
+					text-decoration: none;
+				}
 				div.displayName {
 					font-size: 1.5rem;
 					color: #FF8888;
@@ -216,6 +1533,10 @@ func getIndexTemplateString() string {
 					border-radius: 1.0rem;
 					box-shadow: 0 0.2rem 0.4rem 0 rgba(0, 0, 0, 0.2), 0 0.2rem 0.8rem 0 rgba(0, 0, 0, 0.19);
   			}
+				div.chat.linked {
+					border-color: #1EAEDB;
+					border-width: 2px;
+				}
 				div.msg p {
 					margin: 0 0 0.5rem 0;
 					padding: 0;
@@ -225,6 +1546,84 @@ func getIndexTemplateString() string {
 		  		width: 100%;
     	    height: auto;
   			}
+				div.chat a.preview {
+					display: block;
+					margin: 0 0 0.5rem 0;
+					padding: 0.5rem;
+					border-left: 0.3rem solid #ccc;
+					color: inherit;
+					text-decoration: none;
+				}
+				div.chat a.preview img {
+					max-height: 12rem;
+					width: auto;
+					max-width: 100%;
+				}
+				div.previewSite {
+					font-size: 1.2rem;
+					color: #888;
+				}
+				div.previewTitle {
+					font-weight: bold;
+				}
+				div.translation {
+					color: #666;
+					font-style: italic;
+				}
+				div.alsoPosted {
+					color: #999;
+					font-size: 1.3rem;
+				}
+				span.spoiler {
+					background: #333;
+					color: transparent;
+					border-radius: 0.3rem;
+					cursor: pointer;
+				}
+				span.spoiler img, span.spoiler a {
+					visibility: hidden;
+				}
+				span.spoiler.revealed {
+					background: #eee;
+					color: inherit;
+					cursor: auto;
+				}
+				span.spoiler.revealed img, span.spoiler.revealed a {
+					visibility: visible;
+				}
+				div.chat iframe.rich-embed {
+					display: block;
+					width: 100%;
+					max-width: 48rem;
+					aspect-ratio: 16 / 9;
+					border: 0;
+					margin: 0.5rem 0;
+				}
+				div.chat audio.voice-note {
+					width: 100%;
+				}
+				#recordVoice.recording {
+					color: #d9534f;
+				}
+				#burn, #expireAfter {
+					width: auto;
+					height: 2.8rem;
+					padding: 0 0.5rem;
+					margin: 0 0 0 0.5rem;
+				}
+				div.msg span.encrypted {
+					white-space: pre-wrap;
+				}
+				#e2eNotice {
+					margin-top: 0.5rem;
+					color: #555;
+				}
+				div.chat i.verified {
+					color: #1e88e5;
+				}
+				div.chat i.burning {
+					color: #d9534f;
+				}
 				h1 {
 				   font-size: 3.0rem;
 			  }
@@ -318,6 +1717,12 @@ func getIndexTemplateString() string {
 					display: block;
 					text-align: center;
   			}
+				#themePicker {
+					text-align: center;
+				}
+				#themePicker select {
+					width: auto;
+				}
 				@media only screen and (max-width: 760px) {
 				  #mobileCanary { display: none; }
 				}
@@ -374,9 +1779,15 @@ func getIndexTemplateString() string {
 			<link rel="stylesheet" href="https://cdnjs.cloudflare.com/ajax/libs/font-awesome/4.6.3/css/font-awesome.css">
     	<script src="http://code.jquery.com/jquery-1.11.3.min.js"></script>
 			<script src="https://cdnjs.cloudflare.com/ajax/libs/jquery-timeago/1.5.3/jquery.timeago.min.js"></script>
-
+			<script src="/static/microchat.js"></script>
+			{{ if .EncryptedRooms }}<script src="/e2e.js"></script>{{ end }}
+			{{ if .Highlight }}<link rel="stylesheet" href="https://cdnjs.cloudflare.com/ajax/libs/highlight.js/11.9.0/styles/github.min.css">
+			<script src="https://cdnjs.cloudflare.com/ajax/libs/highlight.js/11.9.0/highlight.min.js"></script>{{ end }}
+			{{ if .ThemeCSS }}<link rel="stylesheet" href="{{ .ThemeCSS }}">{{ end }}
+			{{ block "head" . }}{{ end }}
     </head>
     <body>
+			{{ block "nav" . }}{{ end }}
 
 			<div id="content-container" class="container">
 			<!-- just use a number and class 'column' or 'columns' -->
@@ -386,32 +1797,48 @@ func getIndexTemplateString() string {
 		    <div class="six columns chat-stream">
 					{{ if .Topic }}
 		        <h2 id="chat-topic-hdr"><i class="fa fa-comments"></i> {{ .Topic}}
+						{{ if .Presence }}<span id="viewerCount"></span>{{ end }}
 						<span id="jumpToBottomOfChats" class="jumpNav fa fa-chevron-down"></span>
 						<span id="jumpToBottomOfPage" class="jumpNav fa fa-arrow-down"></span>
 						</h2>
 						<a class="other-topic" href="/">Select other topic.</a>
+						{{ if not .Encrypted }}<a class="other-topic" href="/qr/{{ .Topic }}.png" target="_blank" title="Show a QR code for this topic"><i class="fa fa-qrcode"></i></a>
+						<a id="shortLink" class="other-topic" href="#" title="Get a short link to this topic"><i class="fa fa-link"></i></a>{{ end }}
+						{{ if .Encrypted }}
+						<div id="e2eNotice"><i class="fa fa-lock"></i> End-to-end encrypted, only people with the <a id="inviteLink" href="">invite link</a> can read this room.</div>
+						{{ end }}
 		      {{ else }}
-		        <h2 id="chat-topic-hdr"><i class="fa fa-comments"></i> Latest chats
+		        <h2 id="chat-topic-hdr"><i class="fa fa-comments"></i> {{ if .ShowFirehose }}Latest chats{{ else }}Start a topic{{ end }}
 						<span id="jumpToBottomOfChats" class="jumpNav fa fa-chevron-down"></span>
 						<span id="jumpToBottomOfPage" class="jumpNav fa fa-arrow-down"></span>
 						</h2>
+						{{ if .EncryptedRooms }}<a id="newEncryptedRoom" class="other-topic" href="#"><i class="fa fa-lock"></i> New encrypted room</a>{{ end }}
 		      {{ end }}
 					<hr />
 					<form id="chatForm" method="POST" action="/post">
 						{{ if .Topic }}
 						  <input type="hidden" id="topic" name="topic" value="{{ .Topic }}">
 						{{ else }}
-						  <label for="topic">Topic:</label><input type="text" maxlength="48" id="topic" name="topic">
+						  <label for="topic">Topic: <small>(or a few, comma separated)</small></label><input type="text" maxlength="{{ .Limits.TopicFieldLen }}" id="topic" name="topic" list="topicSuggestions" autocomplete="off">
+						  <datalist id="topicSuggestions"></datalist>
+						{{ end }}
+						{{ if .RestrictNewTopics }}
+						{{ if .Topic }}
+						<input type="hidden" id="invite" name="invite" value="{{ .InviteCode }}">
+						{{ else }}
+						<label for="invite">Invite code <small>(only needed to start a new topic)</small></label><input type="text" id="invite" name="invite" value="{{ .InviteCode }}">
+						{{ end }}
 						{{ end }}
 						<label id="nameLbl" for="display_name">Post as</label>
 						{{ if .DisplayName }}
 						<span id="displayNameAlready"><i class="fa fa-user"></i> {{.DisplayName}}</span><span id="changeDisplayName">[Change]</span>
 						<input id="displayName" type="hidden" name="display_name" value="{{.DisplayName}}">
 						{{ else }}
-						<input id="displayName" type="text" maxlength="28" name="display_name" value="">
+						<input id="displayName" type="text" maxlength="{{ .Limits.NameLen }}" name="display_name" value="">
 						<label id="lblForMsg" for="message">Message</label>
 						{{ end }}
-						<textarea id="msgArea" name="message" maxlength="512"></textarea>
+						<textarea id="msgArea" name="message" maxlength="{{ .Limits.MessageLen }}"></textarea>
+						{{ if .Topic }}<ul id="mentionList" style="display: none;"></ul>{{ end }}
 						{{ if .Topic }}
 						  <!-- dynamic page instead of form post/redirect -->
 							<button id="chat-btn" type="button">Post</button>
@@ -422,13 +1849,53 @@ func getIndexTemplateString() string {
 						<span id="addLink" title="Add Link" class="txtMarkup"><i class="fa fa-link"></i></span>
 						<span id="addHeader" title="Add Header" class="txtMarkup"><i class="fa fa-header"></i></span>
 						<span id="addList" title="Add List" class="txtMarkup"><i class="fa fa-list-ul"></i></span>
-						<span id="markdownHelp" title="How to use Markdown" class="txtMarkup"><i class="fa fa-question"></i></span>
+						{{ if and .Uploads (not .Encrypted) }}
+						<span id="uploadPicture" title="Upload Picture" class="txtMarkup"><i class="fa fa-upload"></i></span>
+						<input id="uploadFile" type="file" accept="image/*" style="display: none;">
+						{{ end }}
+						{{ if and .Uploads .AttachmentAccept (not .Encrypted) }}
+						<span id="attachFile" title="Attach File" class="txtMarkup"><i class="fa fa-paperclip"></i></span>
+						<input id="attachmentFile" type="file" accept="{{ .AttachmentAccept }}" style="display: none;">
+						{{ end }}
+						{{ if and .VoiceNotes (not .Encrypted) }}
+						<span id="recordVoice" title="Record Voice Note" class="txtMarkup"><i class="fa fa-microphone"></i></span>
+						{{ end }}
+						{{ if not .Encrypted }}
+						<span id="showPreview" title="Preview" class="txtMarkup"><i class="fa fa-eye"></i></span>
+						{{ end }}
+						<select id="burn" name="burn" title="Burn after reading">
+							<option value="">Keep</option>
+							<option value="read">Burn after reading</option>
+							<option value="5">Burn in 5 minutes</option>
+						</select>
+						<select id="expireAfter" name="expire_after" title="Delete after">
+							<option value="">Delete after {{ .MaxChatLifeHours }}h</option>
+							{{ if ge .MaxChatLifeHours 2 }}<option value="1h">Delete after 1h</option>{{ end }}
+							{{ if ge .MaxChatLifeHours 7 }}<option value="6h">Delete after 6h</option>{{ end }}
+						</select>
+						{{ if not .PlainText }}<span id="markdownHelp" title="How to use Markdown" class="txtMarkup"><i class="fa fa-question"></i></span>{{ end }}
 
 						<div id="feedback"></div>
+						<div id="previewPane" class="chat" style="display: none;"><div class="msg"></div></div>
 					</form>
 
 		      <div id="chats_list">
+						{{ if .Snapshot }}
+						<div id="snapshot">
+							{{ range .Snapshot }}
+							<div class="chat" id="chat-{{ .ID }}">
+								{{ if ne .Topic $.Topic }}<div class="topic"><a class="topic" href="/?topic={{ .Topic }}"><i class="fa fa-comments"></i> {{ .Topic }}</a></div>{{ end }}
+								<div class="msg">{{ .Message }}</div>
+								<div class="displayName"><a class="userLink" href="{{ .UserPath }}">{{ .DisplayName }}</a></div>
+								<div class="postTime"><time datetime="{{ .Time }}">{{ .Clock }}</time></div>
+							</div>
+							{{ end }}
+						</div>
+						{{ else if or .Topic .ShowFirehose }}
 						<div id="noChatsYet"><i class="fa fa-refresh fa-spin" aria-hidden="true"></i> Waiting for first chat.</div>
+						{{ else }}
+						<div id="noChatsYet">Pick a topic from the boards, or post to start a new one.</div>
+						{{ end }}
 		      </div>
 				</div>
 
@@ -470,208 +1937,521 @@ func getIndexTemplateString() string {
 			</div>
 
 			</div>
-			<div id="footer">
-			&copy; Urmom Lol 2016</div>
+			{{ block "footer" . }}<div id="footer">
+			&copy; Urmom Lol 2016</div>{{ end }}
+			{{ if gt (len .Themes) 1 }}
+			<div id="themePicker">
+				<select onchange="var u = new URL(window.location); u.searchParams.set('theme', this.value); window.location = u;">
+					{{ range .Themes }}<option value="{{ . }}"{{ if eq . $.Theme }} selected{{ end }}>{{ . }}</option>{{ end }}
+				</select>
+			</div>
+			{{ end }}
 			<div id="mobileCanary"></div>
 
       <script>
           // for browsers that don't have console
           if(typeof window.console == 'undefined') { window.console = {log: function (msg) {} }; }
 
+					// names link to their recent chats, within this topic unless we can
+					// see every topic
+					function userLink(displayName, nameColor, bridge) {
+						var href = "/user/" + encodeURIComponent($("<div>").html(displayName).text());
+						if (!{{ .ShowFirehose }} && {{ .Topic }}) {
+							href += "?topic=" + encodeURIComponent({{ .Topic }});
+						}
+						var avatar = "/avatar/" + encodeURIComponent($("<div>").html(displayName).text()) + "?s=48";
+						var badge = "";
+						if (bridge) {
+							// the server only passes plain https urls
+							avatar = bridge.avatar || avatar;
+							badge = " <span class=\"bridge\" title=\"Bridged from " + $("<div>").text(bridge.network).html() + "\">" + $("<div>").text(bridge.badge).html() + "</span>";
+						}
+						var style = /^#[0-9a-f]{6}$/.test(nameColor || "") ? " style=\"color: " + nameColor + "\"" : "";
+						var mute = "<span class=\"mute\" title=\"Mute\" data-name=\"" + encodeURIComponent($("<div>").html(displayName).text()) + "\"><i class=\"fa fa-ban\"></i></span>";
+						return "<a class=\"userLink\" href=\"" + href + "\"" + style + "><img class=\"avatar\" src=\"" + avatar + "\" alt=\"\"> " + displayName + "</a>" + badge + " " + mute;
+					}
+
+					// a chat's message, plus its link preview when it has one
+					function msgHtml(data) {
+						var badges = "";
+						if (data.verified) {
+							// key names are plain A-Za-z0-9_.-
+							badges += "<i class=\"fa fa-check-circle verified\" title=\"Signed by " + data.verified + "\"></i> ";
+						}
+						if (data.burn) {
+							badges += "<i class=\"fa fa-fire burning\" title=\"Burns after reading\"></i> ";
+						} else if (data.expires_at) {
+							badges += "<i class=\"fa fa-clock-o\" title=\"Deleted at " + new Date(data.expires_at).toLocaleTimeString() + "\"></i> ";
+						}
+						if (data.encrypted) {
+							// filled in by decryptChats, blobs are only base64url and colons
+							return "<div class=\"msg\">" + badges + "<span class=\"encrypted\" data-blob=\"" + data.message + "\"><i>Decrypting...</i></span></div>";
+						}
+						if (data.system) {
+							return "<div class=\"msg system\"><i class=\"fa fa-cog\"></i> " + data.message + "</div>";
+						}
+						if (data.action) {
+							return "<div class=\"msg action\">" + badges + "<span class=\"actor\" style=\"color: " + (data.name_color || "inherit") + "\">" + data.display_name + "</span> " + data.message + "</div>" + translationHtml(data) + alsoPostedHtml(data) + previewHtml(data.preview);
+						}
+						return "<div class=\"msg\">" + badges + data.message + "</div>" + translationHtml(data) + alsoPostedHtml(data) + previewHtml(data.preview);
+					}
+
+					// colors code blocks in topics a moderator turned highlighting on for
+					function highlightCode() {
+						if (typeof hljs === "undefined") {
+							return;
+						}
+						$("div.msg pre code:not(.hljs)").each(function() {
+							hljs.highlightElement(this);
+						});
+					}
+
+					// decrypts encrypted chats msgHtml added, as plain text
+					function decryptChats() {
+						$("div.msg span.encrypted[data-blob]").each(function() {
+							var msg = $(this);
+							var blob = msg.attr("data-blob");
+							msg.removeAttr("data-blob");
+							if (typeof microchatE2E === "undefined") {
+								msg.html("<i>Encrypted chat.</i>");
+								return;
+							}
+							microchatE2E.decrypt(blob).then(function(text) {
+								msg.text(text);
+							}, function() {
+								msg.html("<i>Unable to decrypt, is the room key in your link?</i>");
+							});
+						});
+					}
+
+					// link preview card, fields arrive already html escaped
+					function previewHtml(preview) {
+						if (!preview) {
+							return "";
+						}
+						var card = "<a class=\"preview\" href=\"" + preview.url + "\" rel=\"nofollow noopener\" target=\"_blank\">";
+						if (preview.image) {
+							card += "<img src=\"" + preview.image + "\" alt=\"\">";
+						}
+						if (preview.site_name) {
+							card += "<div class=\"previewSite\">" + preview.site_name + "</div>";
+						}
+						card += "<div class=\"previewTitle\">" + preview.title + "</div>";
+						if (preview.description) {
+							card += "<div class=\"previewDesc\">" + preview.description + "</div>";
+						}
+						return card + "</a>";
+					}
+
+					// the chat in the reader's own language, when the server translated it
+					// topics are only A-Za-z0-9-
+					function alsoPostedHtml(data) {
+						if (!data.also_posted_in) {
+							return "";
+						}
+						var links = $.map(data.also_posted_in, function(topic) {
+							return "<a class=\"topic\" href=\"/?topic=" + topic + "\">" + topic + "</a>";
+						});
+						return "<div class=\"alsoPosted\"><i class=\"fa fa-share\"></i> Also posted in " + links.join(", ") + "</div>";
+					}
+
+					function translationHtml(data) {
+						var translations = data.translations || {};
+						var lang = (navigator.language || "").toLowerCase();
+						var text = translations[lang] || translations[lang.split("-")[0]];
+						if (!text) {
+							return "";
+						}
+						return "<div class=\"translation\" title=\"Translated\"><i class=\"fa fa-language\"></i> " + text + "</div>";
+					}
+
           // Start checking for any events that occurred within 24 hours minutes prior to page load
           // so we display recent chats:
           var sinceTime = (new Date(Date.now() - ({{.MaxChatLifeHours}} * 60 * 60 * 1000))).getTime();
           // subscribe to a specific topic or all chats
-					var category = "{{ if .Topic }}{{ .Topic }}{{ else }}{{ .AllChats }}{{ end }}";
+					var category = "{{ if .Topic }}{{ .Topic }}{{ else if .ShowFirehose }}{{ .AllChats }}{{ end }}";
+					// chats here are end-to-end encrypted with the key in our #fragment
+					var e2eRoom = {{ .Encrypted }};
+					if (e2eRoom) {
+						$("#inviteLink").attr("href", location.href);
+						if (!microchatE2E.hasKey()) {
+							$("#chat-btn").attr("disabled", "disabled");
+							$("#feedback").html("<span>This room's key is missing, open it with the full invite link.</span>");
+						}
+					}
+					// only set for admins watching a restricted all chats stream
+					var adminParam = {{ .AdminParam }};
+
+					// a chat in the current page's list
+					function chatHtml(event) {
+						var msgDate = new Date(event.timestamp);
+						var timestamp = "<time class=\"timeago\" datetime=\"" + msgDate.toISOString() + "\">"+msgDate.toLocaleTimeString()+"</time>";
+						// each chat's own page, for citing it
+						if (event.data.id && !event.data.encrypted && !event.data.burn) {
+							timestamp = "<a class=\"permalink\" href=\"/chat/" + event.data.topic + "/" + event.data.id + "\">" + timestamp + "</a>";
+						}
+						var topicPart = ""
+						// only show topic link if its not our current topic
+						if (event.data.topic !== "{{.Topic}}") {
+							topicPart = "<div class=\"topic\"><a class=\"topic\" href='/?topic=" + event.data.topic + "'><i class=\"fa fa-comments\"></i> " + event.data.topic + "</a></div>"
+						}
+						var report = "";
+						if (event.data.id && !event.data.system) {
+							report = likeHtml(event.data.id) + "<span class=\"report\" title=\"Report\"><i class=\"fa fa-flag\"></i></span>";
+						}
+						var flagged = flaggedChats[event.data.id];
+						return "<div class=\"chat" + (flagged ? " flagged" : "") + "\" data-id=\"" + (event.data.id || "") + "\" data-ts=\"" + event.timestamp + "\">" + topicPart + (flagged ? flagShieldHtml(flagged) : "") + msgHtml(event.data) + "<div class=\"displayName\">" + userLink(event.data.display_name, event.data.name_color, event.data.bridge) + "</div><div class=\"postTime\">"  + timestamp + report + "</div></div>";
+					}
+
+					// chat id -> likes, from like events and /history
+					var likeCounts = {};
+					function likeHtml(chatID) {
+						var count = likeCounts[chatID] || 0;
+						return "<span class=\"like\" title=\"Like\"><i class=\"fa fa-thumbs-up\"></i> <span class=\"likes\">" + (count > 0 ? count : "") + "</span></span>";
+					}
+					function showLikes(chatID, likes) {
+						if (likes > (likeCounts[chatID] || 0)) {
+							likeCounts[chatID] = likes;
+						}
+						$("#chats_list div.chat[data-id='" + chatID + "'] span.likes").text(likeCounts[chatID]);
+					}
+
+					// chats enough people reported to hide, by id -> how many did
+					var flaggedChats = {};
+					function flagShieldHtml(reports) {
+						return "<div class=\"flagShield\"><i class=\"fa fa-flag\"></i> Flagged by " + reports + " " + (reports == 1 ? "person" : "people") + " &mdash; click to view</div>";
+					}
+					function flagChat(chatID, hidden, reports) {
+						var chat = $("#chats_list div.chat[data-id='" + chatID + "']");
+						chat.removeClass("flagged").children("div.flagShield").remove();
+						if (hidden) {
+							flaggedChats[chatID] = reports;
+							chat.addClass("flagged");
+							chat.children("div.msg").first().before(flagShieldHtml(reports));
+						} else {
+							delete flaggedChats[chatID];
+						}
+					}
+
+					// older chats, from /history as the reader scrolls past the bottom of
+					// the list, aren't trimmed to chatsOnScreen
+					var olderLoaded = 0;
+					var loadingOlder = false;
+					var noOlderChats = false;
+					function loadOlderChats() {
+						var oldest = $("#chats_list > div.chat").last().attr("data-ts");
+						if (loadingOlder || noOlderChats || !oldest || category.length == 0) {
+							return;
+						}
+						loadingOlder = true;
+						$.getJSON("/history?category=" + category + "&before=" + oldest + "&limit=50" + adminParam, function(data) {
+							var events = (data && data.events) || [];
+							if (events.length == 0) {
+								noOlderChats = true;
+							}
+							for (var i = 0; i < events.length; i++) {
+								if (events[i].type == "flag") {
+									if (events[i].data.hidden) {
+										flaggedChats[events[i].data.flagged] = events[i].data.reports;
+									} else {
+										delete flaggedChats[events[i].data.flagged];
+									}
+								}
+							}
+							$.each(data.likes || {}, function(chatID, likes) {
+								likeCounts[chatID] = Math.max(likeCounts[chatID] || 0, likes);
+							});
+							// oldest first, the list is newest first
+							for (var i = events.length - 1; i >= 0; i--) {
+								if (events[i].type != "chat" && events[i].type != "system") {
+									continue;
+								}
+								$("#chats_list").append(chatHtml(events[i]));
+								olderLoaded++;
+							}
+							jQuery("time.timeago").timeago();
+							decryptChats();
+							highlightCode();
+						}).always(function() {
+							loadingOlder = false;
+						});
+					}
+					$(window).scroll(function() {
+						if ($(window).scrollTop() + $(window).height() > $(document).height() - 200) {
+							loadOlderChats();
+						}
+					});
 
 					// for current page of chats--could be either specific category or all
 					// chats
-          (function poll() {
-              var timeout = 50;  // in seconds
-              var optionalSince = "";
-              if (sinceTime) {
-                  optionalSince = "&since_time=" + sinceTime;
-              }
-              var pollUrl = "/subscribe?timeout=" + timeout + "&category=" + category + optionalSince;
-              // how long to wait before starting next longpoll request in each case:
-              var successDelay = 10;  // 10 ms
-              var errorDelay = 3000;  // 3 sec
-							var maxChats = {{.NumChatsOnScreen}};
-              $.ajax({ url: pollUrl,
-                  success: function(data) {
-											$("#noChatsYet").remove();
-											if (data && data.events && data.events.length > 0) {
-                          // got events, process them
-                          // NOTE: these events are in chronological order (oldest first)
-													var startIndex = 0;
-													// don't load more than max number of chats per screen:
-													if (data.events.length > maxChats) {
-														startIndex = data.events.length - maxChats;
-													}
-                          for (var i = startIndex; i < data.events.length; i++) {
-                              // Display event
-                              var event = data.events[i];
-															var msgDate = new Date(event.timestamp);
-															var timestamp = "<time class=\"timeago\" datetime=\"" + msgDate.toISOString() + "\">"+msgDate.toLocaleTimeString()+"</time>";
-															var topicPart = ""
-															// only show topic link if its not our current topic
-															if (event.data.topic !== "{{.Topic}}") {
-																topicPart = "<div class=\"topic\"><a class=\"topic\" href='/?topic=" + event.data.topic + "'><i class=\"fa fa-comments\"></i> " + event.data.topic + "</a></div>"
-															}
-															$("#chats_list").prepend(
-																	"<div class=\"chat\">" + topicPart + "<div class=\"msg\">" + event.data.message + "</div><div class=\"displayName\"><i class=\"fa fa-user\"></i> " + event.data.display_name + "</div><div class=\"postTime\">"  + timestamp +  "</div></div>"
-															)
-															jQuery("time.timeago").timeago();
-                              // Update sinceTime to only request events that occurred after this one.
-                              sinceTime = event.timestamp;
-                          }
-													// make sure our displayed chats doesn't exceed our
-													// max on screen
-													var excessChats = $("#chats_list > div").length - maxChats;
-													if (excessChats > 0) {
-														// remove excess
-														$('#chats_list > div').slice(-1 * excessChats).remove();
-													}
-													// success!  start next longpoll
-                          setTimeout(poll, successDelay);
-                          return;
-                      }
-                      if (data && data.timeout) {
-                          console.log("No events, checking again.");
-                          // no events within timeout window, start another longpoll:
-                          setTimeout(poll, successDelay);
-                          return;
-                      }
-                      if (data && data.error) {
-                          console.log("Error response: " + data.error);
-                          console.log("Trying again shortly...")
-                          setTimeout(poll, errorDelay);
-                          return;
-                      }
-                      // We should have gotten one of the above 3 cases:
-                      // either nonempty event data, a timeout, or an error.
-                      console.log("Didn't get expected event data, try again shortly...");
-                      setTimeout(poll, errorDelay);
-                  }, dataType: "json",
-              error: function (data) {
-                  console.log("Error in ajax request--trying again shortly...");
-                  setTimeout(poll, errorDelay);  // 3s
-              }
-              });
-          })();
-
-					// less frequent longpoll for all chats so we can populate the widgets
-					// showing recent topics and most popular topics
+					if (category.length > 0) {
+						// the server rendered chats for crawlers, polling brings them back
+						$("#snapshot").remove();
+						var maxChats = {{.NumChatsOnScreen}};
+						MicroChat.connect(category, function(chat, event) {
+							$("#noChatsYet").remove();
+							$("#chats_list").prepend(chatHtml(event));
+						}, {
+							sinceTime: sinceTime,
+							maxBatch: maxChats,
+							query: adminParam,
+							onTombstone: function(chatID) {
+								// chat was burned, take it off the screen
+								$("#chats_list div.chat[data-id='" + chatID + "']").remove();
+							},
+							onLike: function(chatID, likes) {
+								showLikes(chatID, likes);
+							},
+							onFlag: function(chatID, hidden, reports) {
+								flagChat(chatID, hidden, reports);
+							},
+							onBatch: function(events) {
+								jQuery("time.timeago").timeago();
+								decryptChats();
+								highlightCode();
+								highlightLinkedChat();
+								markRead(events[events.length - 1].timestamp);
+								// make sure our displayed chats doesn't exceed our
+								// max on screen
+								var excessChats = $("#chats_list > div").length - maxChats - olderLoaded;
+								if (excessChats > 0) {
+									// remove excess
+									$('#chats_list > div').slice(-1 * excessChats).remove();
+								}
+							},
+							onError: function(message) {
+								console.log("Error response: " + message + " Trying again shortly...");
+							}
+						});
+					}
+
+					// links to a single chat land on #chat-<id>
+					function highlightLinkedChat() {
+						var match = /^#chat-([0-9a-f]{16})$/.exec(window.location.hash);
+						if (!match) {
+							return;
+						}
+						var linked = $("#chats_list div.chat[data-id='" + match[1] + "']");
+						if (linked.length > 0 && !linked.hasClass("linked")) {
+							linked.addClass("linked");
+							linked[0].scrollIntoView();
+						}
+					}
+
+					// remember what we've seen so topic boards can show unread counts
+					var markReadTimer = null;
+					function markRead(timestamp) {
+						if (!{{ .Topic }}) {
+							return;
+						}
+						clearTimeout(markReadTimer);
+						markReadTimer = setTimeout(function() {
+							$.post("/api/v1/read", { topic: {{ .Topic }}, timestamp: timestamp });
+						}, 1000);
+					}
+
+					function refreshUnread() {
+						var topics = [];
+						$("#recent_topics_list a.topic, #popular_topics_list a.topic").each(function() {
+							var topic = $(this).attr("href").replace("/?topic=", "");
+							if (topics.indexOf(topic) < 0) {
+								topics.push(topic);
+							}
+						});
+						if (topics.length == 0) {
+							return;
+						}
+						$.ajax({ url: "/api/v1/unread?topics=" + encodeURIComponent(topics.join(",")),
+							success: function(data) {
+								$("span.unread").remove();
+								$.each(data.unread || {}, function(topic, count) {
+									if (count > 0) {
+										$("#recent_topics_list a.topic, #popular_topics_list a.topic").filter(function() {
+											return $(this).attr("href") == "/?topic=" + topic;
+										}).append(" <span class=\"unread\">" + count + " new</span>");
+									}
+								});
+							}, dataType: "json"
+						});
+					}
+
+					{{ if and .Topic .Presence }}
+					// how many people are watching this topic, updates as they come and go
+					(function pollPresence() {
+						var presenceSince = 1;
+						(function next() {
+							$.ajax({ url: "/presence?timeout=50&category=" + category + "&since_time=" + presenceSince,
+								success: function(data) {
+									if (data && data.events && data.events.length > 0) {
+										var summary = data.events[data.events.length - 1];
+										presenceSince = summary.timestamp;
+										var viewers = summary.data.viewers;
+										$("#viewerCount").text(viewers == 1 ? "1 person here now" : viewers + " people here now");
+									}
+									setTimeout(next, 10);
+								}, dataType: "json",
+								error: function() {
+									setTimeout(next, 3000);
+								}
+							});
+						})();
+					})();
+					{{ end }}
+
+					// when the all chats stream isn't visible to us, the boards are fed
+					// by a server side summary that only lists topic names and counts.
+					function checkTopicSummaries() {
+						$.ajax({ url: "/topics?limit=" + {{.MaxTopicListNum}},
+								success: function(data) {
+										if (data && data.recent && data.recent.length > 0) {
+												$("#recent_topics_list").empty();
+												$("#popular_topics_list").empty();
+												for (var i = 0; i < data.recent.length; i++) {
+													$("#recent_topics_list").append(topicSummaryHtml(data.recent[i]));
+												}
+												for (var i = 0; i < data.popular.length; i++) {
+													$("#popular_topics_list").append(topicSummaryHtml(data.popular[i]));
+												}
+												refreshUnread();
+												jQuery("time.timeago").timeago();
+										}
+										setTimeout(checkTopicSummaries, ({{.TopicRefreshSeconds}} * 1000));
+								}, dataType: "json",
+						error: function (data) {
+								console.log("Error in ajax request--trying again shortly...");
+								setTimeout(checkTopicSummaries, 60000);
+						}
+						});
+					}
+					function topicSummaryHtml(summary) {
+						var msgDate = new Date(summary.last_post_ms);
+						var timestamp = "<time class=\"timeago\" datetime=\"" + msgDate.toISOString() + "\">"+msgDate.toLocaleTimeString()+"</time>";
+						return "<div class=\"topic-item\"><div class=\"chat\"><div class=\"topic\">(" + summary.count + ") <a class=\"topic\" href=\"/?topic=" + summary.topic + "\"><i class=\"fa fa-comments\"></i> " + summary.topic + "</a></div><div class=\"postTime\">" + timestamp + "</div></div></div>";
+					}
+
+					// the boards follow a stream of per topic summaries, only topics that
+					// changed since the last poll come back
+					var boardTopics = {};
+					function boardItemHtml(summary, showCount) {
+						var msgDate = new Date(summary.last_post_ms);
+						var timestamp = "<time class=\"timeago\" datetime=\"" + msgDate.toISOString() + "\">"+msgDate.toLocaleTimeString()+"</time>";
+						var preview = summary.preview ? "<div class=\"msg\">" + $("<div>").text(summary.preview.text).html() + "</div><div class=\"displayName\">" + userLink(summary.preview.display_name, summary.preview.name_color) + "</div>" : "";
+						return "<div class=\"topic-item\"><div class=\"chat\" data-id=\"" + (summary.preview ? summary.preview.id : "") + "\"><div class=\"topic\">" + (showCount ? "(" + summary.count + ") " : "") + "<a class=\"topic\" href=\"/?topic=" + summary.topic + "\"><i class=\"fa fa-comments\"></i> " + summary.topic + "</a></div>" + preview + "<div class=\"postTime\">" + timestamp + "</div></div></div>";
+					}
+					function renderBoards() {
+						var oldest = Date.now() - ({{.MaxChatLifeHours}} * 60 * 60 * 1000);
+						var summaries = [];
+						for (var topic in boardTopics) {
+							if (boardTopics[topic].count == 0 || boardTopics[topic].last_post_ms < oldest) {
+								delete boardTopics[topic];
+								continue;
+							}
+							summaries.push(boardTopics[topic]);
+						}
+						if (summaries.length == 0) {
+							return;
+						}
+						var maxNumTopics = {{.MaxTopicListNum}};
+						$("#recent_topics_list").empty();
+						summaries.sort(function(a, b) { return b.last_post_ms - a.last_post_ms; });
+						for (var i = 0; i < summaries.length && i < maxNumTopics; i++) {
+							$("#recent_topics_list").append(boardItemHtml(summaries[i], false));
+						}
+						$("#popular_topics_list").empty();
+						summaries.sort(function(a, b) { return b.count - a.count; });
+						for (var i = 0; i < summaries.length && i < maxNumTopics; i++) {
+							$("#popular_topics_list").append(boardItemHtml(summaries[i], true));
+						}
+						jQuery("time.timeago").timeago();
+						refreshUnread();
+					}
+
 					(function checkTopics() {
-              var timeout = 50;  // in seconds
-							// always fetch all chats during last N seconds
-							// we don't update subsequent calls to timestamp of most
-							// recent event because we're always fetching list of
-							// recent, and not only ones since last call...
-							var topicSinceTime = (new Date(Date.now() - ({{.MaxChatLifeHours}} * 60 * 60 * 1000))).getTime();
-              var topicsSince = "&since_time=" + topicSinceTime;
-              var pollUrl = "/subscribe?timeout=" + timeout + "&category=" + {{ .AllChats }} + topicsSince;
-              // how long to wait before starting next longpoll request in each case:
-							// these are spread out more than regular chat poll since this is
-							// just show show pretty features like recent topics/popular topics
-            	var successDelay = ({{.TopicRefreshSeconds}} * 1000);
-              var errorDelay = 60000;  // 30 sec
-							// number of topics in our Top Recent/Top Active iists
-							var maxNumTopics = {{.MaxTopicListNum}};
-              $.ajax({ url: pollUrl,
-                  success: function(data) {
-                      if (data && data.events && data.events.length > 0) {
-                          // got events, process them
-                          // NOTE: these events are in chronological order (oldest first)
-													// let's inspect recent chats to determine popular
-													// and recent topics
-													var numChatsPerTopic = { };
-													var lastTimestampPerTopic = { };
-	                        for (var i = 0; i < data.events.length; i++) {
-                              var event = data.events[i];
-															if (numChatsPerTopic[event.data.topic]) {
- 													      numChatsPerTopic[event.data.topic][0]++;
- 													      numChatsPerTopic[event.data.topic][1] = event;
-	 												    }
-	 													  else {
-	 													    numChatsPerTopic[event.data.topic] = [1, event];
-	 													  }
-															// since chats are oldest first, just keep track of last seen timestamp
-															// and when we get to the end we'll have most recent timestamp for each topic
-	 													  lastTimestampPerTopic[event.data.topic] = [event.timestamp, event];
-															// NOTE: we don't update since time here based on
-															// event time stamps. we always fetch all chats within last N seconds
-                          }
-													// Populate our panels showing recent/popular topics
-													var sortableTopicCounts = [];
-													var sortableTopicTimes = [];
-													for (var topic in numChatsPerTopic) {
-												      sortableTopicCounts.push([topic, numChatsPerTopic[topic]])
-													}
-													for (var topic in lastTimestampPerTopic) {
-												      sortableTopicTimes.push([topic, lastTimestampPerTopic[topic]])
-													}
-													sortableTopicTimes.sort(
-													    function(a, b) {
-																return b[1][0] - a[1][0];
-													    }
-													)
-													sortableTopicCounts.sort(
-													    function(a, b) {
-													        return b[1][0] - a[1][0];
-													    }
-													)
-													// update topic letterboards
-													if (sortableTopicTimes.length > 0) {
-														$("#recent_topics_list").empty();
-														for (var i = 0; i < sortableTopicTimes.length && i < maxNumTopics; i++) {
-															var event = sortableTopicTimes[i][1][1];
-															var msgDate = new Date(event.timestamp);
-															var timestamp = "<time class=\"timeago\" datetime=\"" + msgDate.toISOString() + "\">"+msgDate.toLocaleTimeString()+"</time>";
-															var chatHtml = "<div class=\"chat\"><div class=\"topic\"><a class=\"topic\" href=\"/?topic=" + sortableTopicTimes[i][0] + "\"><i class=\"fa fa-comments\"></i> " + sortableTopicTimes[i][0]  + "</a></div><div class=\"msg\">" + event.data.message + "</div><div class=\"displayName\"><i class=\"fa fa-user\"></i> " + event.data.display_name + "</div><div class=\"postTime\">"  + timestamp +  "</div></div>"
-															$("#recent_topics_list").append("<div class=\"topic-item\">" + chatHtml + "</div>");
-														}
-													}
-													if (sortableTopicCounts.length > 0) {
-														$("#popular_topics_list").empty();
-														for (var i = 0; i < sortableTopicCounts.length && i < maxNumTopics; i++) {
-															var event = sortableTopicCounts[i][1][1];
-															var msgDate = new Date(event.timestamp);
-															var timestamp = "<time class=\"timeago\" datetime=\"" + msgDate.toISOString() + "\">"+msgDate.toLocaleTimeString()+"</time>";
-															var chatHtml = "<div class=\"chat\"><div class=\"topic\">(" + sortableTopicCounts[i][1][0] + ") <a class=\"topic\" href=\"/?topic=" + sortableTopicCounts[i][0]  + "\"><i class=\"fa fa-comments\"></i> " + sortableTopicCounts[i][0]  + "</a></div><div class=\"msg\">" + event.data.message + "</div><div class=\"displayName\"><i class=\"fa fa-user\"></i> " + event.data.display_name + "</div><div class=\"postTime\">"  + timestamp +  "</div></div>"
-															$("#popular_topics_list").append("<div class=\"topic-item\">" + chatHtml + "</div>");
-														}
-													}
-													// update timestamps:
-													jQuery("time.timeago").timeago();
-
-													// success!  start next longpoll
-                          setTimeout(checkTopics, successDelay);
-                          return;
-                      }
-                      if (data && data.timeout) {
-                          console.log("No events, checking again.");
-                          // no events within timeout window, start another longpoll:
-                          setTimeout(checkTopics, successDelay);
-                          return;
-                      }
-                      if (data && data.error) {
-                          console.log("Error response: " + data.error);
-                          console.log("Trying again shortly...")
-                          setTimeout(checkTopics, errorDelay);
-                          return;
-                      }
-                      // We should have gotten one of the above 3 cases:
-                      // either nonempty event data, a timeout, or an error.
-                      console.log("Didn't get expected event data, try again shortly...");
-                      setTimeout(checkTopics, errorDelay);
-                  }, dataType: "json",
-              error: function (data) {
-                  console.log("Error in ajax request--trying again shortly...");
-                  setTimeout(checkTopics, errorDelay);  // 3s
-              }
-              });
-          })();
+							if (!{{ .ShowFirehose }}) {
+									checkTopicSummaries();
+									return;
+							}
+							var boardLastID = 0;
+							// updates are spread out more than the regular chat poll since
+							// the boards are just a pretty feature, nothing is missed in between
+							var successDelay = ({{.TopicRefreshSeconds}} * 1000);
+							var errorDelay = 60000;
+							(function next() {
+								var since = boardLastID ? "&last_id=" + boardLastID : "&since_time=1";
+								$.ajax({ url: "/subscribe/topics?timeout=50" + since + adminParam,
+									success: function(data) {
+										if (data && data.events && data.events.length > 0) {
+											for (var i = 0; i < data.events.length; i++) {
+												boardTopics[data.events[i].data.topic] = data.events[i].data;
+												boardLastID = data.events[i].id;
+											}
+											renderBoards();
+											setTimeout(next, successDelay);
+											return;
+										}
+										if (data && data.timeout) {
+											// drops topics that aged out of the window
+											renderBoards();
+											setTimeout(next, 10);
+											return;
+										}
+										console.log("Error response: " + (data && data.error));
+										setTimeout(next, errorDelay);
+									}, dataType: "json",
+									error: function() {
+										console.log("Error in ajax request--trying again shortly...");
+										setTimeout(next, errorDelay);
+									}
+								});
+							})();
+					})();
+
+					// posters that look automated have to solve a proof of work
+					// from /challenge before their chat is accepted
+					var challengeRetried = false;
+					function zeroBits(sum) {
+						var zeros = 0;
+						for (var i = 0; i < sum.length; i++) {
+							if (sum[i] == 0) {
+								zeros += 8;
+								continue;
+							}
+							for (var b = 0x80; (sum[i] & b) == 0; b >>= 1) {
+								zeros++;
+							}
+							break;
+						}
+						return zeros;
+					}
+					function passChallenge() {
+						if (!window.crypto || !window.crypto.subtle) {
+							return Promise.reject("Confirming you're not a bot needs this chat served over https.");
+						}
+						var encoder = new TextEncoder();
+						return Promise.resolve($.getJSON("/challenge")).then(function(challenge) {
+							return new Promise(function(resolve) {
+								var n = 0;
+								(function next() {
+									var tries = [];
+									for (var i = 0; i < 500; i++) {
+										tries.push(crypto.subtle.digest("SHA-256", encoder.encode(challenge.token + ":" + (n + i))));
+									}
+									Promise.all(tries).then(function(sums) {
+										for (var i = 0; i < sums.length; i++) {
+											if (zeroBits(new Uint8Array(sums[i])) >= challenge.bits) {
+												resolve({ token: challenge.token, answer: String(n + i) });
+												return;
+											}
+										}
+										n += tries.length;
+										next();
+									});
+								})();
+							});
+						}).then(function(solved) {
+							return Promise.resolve($.post("/challenge", solved));
+						});
+					}
 
 					$("#chat-btn").click(function() {
 						$("#chat-btn").attr("disabled", "disabled");
@@ -682,35 +2462,92 @@ func getIndexTemplateString() string {
 						var dname = $("#displayName").val();
 						var msg = $("#msgArea").val();
 						var t = $("#topic").val();
-						$.ajax({
-						  type: 'POST',
-						  url: "/post",
-						  data: {
- 								doAjax: "yes", topic: t, display_name: dname, message: msg
-						  },
-						  success: function(data){
-								$("#chatForm").removeClass("sending");
-								$("#displayName").removeAttr('disabled');
-								$("#msgArea").removeAttr('disabled');
-								$("#msgArea").val('');
-								$("#msgArea").focus();
-								$("#chat-btn").removeAttr('disabled');
-								$("#lblForMsg").hide();
-								if ($("#displayName").is(':visible')) {
-									$("#displayName").hide();
-									$("#displayName").before("<span id=\"displayNameAlready\"><i class=\"fa fa-user\"></i> " + dname + "</span><span id=\"changeDisplayName\">[Change]</span>");
-									// re-bind click handler to new reset name button
-									$("#changeDisplayName").click(clickToChangeNameFunc)
-								}
-						  },
-						  error: function(xhr, textStatus, error){
-								$("#chatForm").removeClass("sending");
-								$("#displayName").removeAttr('disabled');
-								$("#msgArea").removeAttr('disabled');
-								$("#msgArea").focus();
-								$("#chat-btn").removeAttr('disabled');
-								$("#feedback").html("<span>" + xhr.responseText + "</span>");
-						  }
+						// encrypted rooms only ever send ciphertext
+						var encrypting = e2eRoom ? microchatE2E.encrypt(msg) : Promise.resolve(msg);
+						encrypting.then(function(message) {
+							$.ajax({
+							  type: 'POST',
+							  url: "/post",
+							  data: {
+	 								doAjax: "yes", topic: t, display_name: dname, message: message, burn: $("#burn").val(), expire_after: $("#expireAfter").val(), rename: $("#rename").val() || "", invite: $("#invite").val() || ""
+							  },
+							  success: function(data){
+									challengeRetried = false;
+									$("#chatForm").removeClass("sending");
+									if (data !== "ok") {
+										// accepted but not published yet, ex: held for review
+										$("#feedback").html($("<span>").text(data));
+									}
+									$("#displayName").removeAttr('disabled');
+									$("#msgArea").removeAttr('disabled');
+									$("#msgArea").val('');
+									$("#burn").val('');
+									$("#expireAfter").val('');
+									$("#previewPane .msg").empty();
+									$("#msgArea").focus();
+									$("#chat-btn").removeAttr('disabled');
+									$("#lblForMsg").hide();
+									if ($("#displayName").is(':visible')) {
+										$("#rename").remove();
+										$("#displayName").hide();
+										$("#displayName").before($("<span id=\"displayNameAlready\"><i class=\"fa fa-user\"></i> </span>").append(document.createTextNode(dname)), "<span id=\"changeDisplayName\">[Change]</span>");
+										// re-bind click handler to new reset name button
+										$("#changeDisplayName").click(clickToChangeNameFunc)
+									}
+							  },
+							  error: function(xhr, textStatus, error){
+									if (xhr.status == 428 && !challengeRetried) {
+										challengeRetried = true;
+										$("#feedback").html("<span>Checking you're not a bot...</span>");
+										passChallenge().then(function() {
+											$("#feedback").empty();
+											$("#chat-btn").removeAttr('disabled').click();
+										}, function(err) {
+											challengeRetried = false;
+											$("#chatForm").removeClass("sending");
+											$("#displayName").removeAttr('disabled');
+											$("#msgArea").removeAttr('disabled');
+											$("#chat-btn").removeAttr('disabled');
+											$("#feedback").html($("<span>").text(typeof err == "string" ? err : "Couldn't confirm you're not a bot, try again."));
+										});
+										return;
+									}
+									challengeRetried = false;
+									$("#chatForm").removeClass("sending");
+									$("#displayName").removeAttr('disabled');
+									$("#msgArea").removeAttr('disabled');
+									$("#msgArea").focus();
+									$("#chat-btn").removeAttr('disabled');
+									$("#feedback").html($("<span>").text(xhr.responseText));
+							  }
+							});
+						}, function() {
+							$("#chatForm").removeClass("sending");
+							$("#displayName").removeAttr('disabled');
+							$("#msgArea").removeAttr('disabled');
+							$("#chat-btn").removeAttr('disabled');
+							$("#feedback").html("<span>Unable to encrypt your chat.</span>");
+						});
+					});
+
+					$("#shortLink").click(function(event) {
+						event.preventDefault();
+						$.post("/api/v1/shortlinks", { topic: {{ .Topic }} }, function(data) {
+							window.prompt("Short link to this topic:", data.url);
+						}, "json").fail(function(xhr) {
+							var error = (xhr.responseJSON && xhr.responseJSON.error) || "Unable to make a short link right now.";
+							$("#feedback").html($("<span>").text(error));
+						});
+					});
+
+					$("#newEncryptedRoom").click(function(event) {
+						event.preventDefault();
+						$.post("/api/v1/rooms", { invite: $("#invite").val() || "" }, function(data) {
+							// the key never leaves the browser, it only lives in the link
+							window.location = "/?topic=" + data.topic + "#key=" + microchatE2E.newKey();
+						}, "json").fail(function(xhr) {
+							var error = (xhr.responseJSON && xhr.responseJSON.error) || "Unable to create an encrypted room right now.";
+							$("#feedback").html($("<span>").text(error));
 						});
 					});
 
@@ -742,6 +2579,8 @@ func getIndexTemplateString() string {
 					var clickToChangeNameFunc = function(){
 						$("#displayNameAlready").remove();
 						$("#changeDisplayName").remove();
+						// tells the server we meant to switch names
+						$("#displayName").after("<input id=\"rename\" type=\"hidden\" name=\"rename\" value=\"yes\">");
 						// normally you cant change the input type on the fly, but see:
 						// http://stackoverflow.com/questions/3541514/jquery-change-input-type
 						// for why this works
@@ -793,6 +2632,204 @@ func getIndexTemplateString() string {
 							$("#msgArea").focus().val("").val(text);
 						}, 80);
 					});
+					// rendered by the server so it always matches what gets posted
+					var previewTimer = null;
+					function updatePreview() {
+						if (!$("#previewPane").is(":visible")) {
+							return;
+						}
+						$.ajax({
+							type: 'POST',
+							url: "/preview",
+							data: { message: $("#msgArea").val(), topic: $("#topic").val() },
+							dataType: "json",
+							success: function(data) {
+								$("#previewPane .msg").toggleClass("action", !!data.action);
+								$("#previewPane .msg").html(data.error ? "<i>" + $("<span>").text(data.error).html() + "</i>" : data.message);
+							}
+						});
+					}
+					$("#showPreview").click(function() {
+						$("#previewPane").toggle();
+						updatePreview();
+					});
+					$("#msgArea").on("input", function() {
+						clearTimeout(previewTimer);
+						previewTimer = setTimeout(updatePreview, 300);
+					});
+					// suggests topics already going, so people join them instead of
+					// starting a near duplicate
+					var topicTimer = null;
+					$("input#topic[list]").on("input", function() {
+						clearTimeout(topicTimer);
+						// the last of a cross-post's topics is the one being typed
+						var topics = $(this).val().split(",");
+						var q = topics.pop();
+						var before = topics.length > 0 ? topics.join(",") + "," : "";
+						topicTimer = setTimeout(function() {
+							$.getJSON("/api/v1/topics", { q: q, limit: 8 }, function(data) {
+								var list = $("#topicSuggestions").empty();
+								$.each(data.topics || [], function(i, topic) {
+									$("<option>").attr("value", before + topic.topic).text(topic.count + " chats").appendTo(list);
+								});
+							});
+						}, 150);
+					});
+					// @mention autocomplete from whoever's been posting here lately
+					var mentionTimer = null;
+					$("#msgArea").on("input", function() {
+						clearTimeout(mentionTimer);
+						var mention = /(?:^|\s)@([^\s@]{1,32})$/.exec(this.value.slice(0, this.selectionStart));
+						if (!mention || !{{ .Topic }}) {
+							$("#mentionList").hide();
+							return;
+						}
+						mentionTimer = setTimeout(function() {
+							$.getJSON("/api/v1/names", { topic: {{ .Topic }}, prefix: mention[1], limit: 8 }, function(data) {
+								var list = $("#mentionList").empty();
+								$.each(data.names || [], function(i, name) {
+									$("<li>").text(name.display_name).css("color", /^#[0-9a-f]{6}$/.test(name.name_color || "") ? name.name_color : "").appendTo(list);
+								});
+								list.toggle(list.children().length > 0);
+							});
+						}, 150);
+					});
+					$("#mentionList").on("mousedown", "li", function(e) {
+						// keeps the textarea focused
+						e.preventDefault();
+						var area = $("#msgArea")[0];
+						var before = area.value.slice(0, area.selectionStart).replace(/@[^\s@]*$/, "@" + $(this).text() + " ");
+						area.value = before + area.value.slice(area.selectionStart);
+						area.selectionStart = area.selectionEnd = before.length;
+						$("#mentionList").hide();
+					});
+					$("#msgArea").on("blur", function() {
+						$("#mentionList").hide();
+					});
+					// muting is enforced by the server, this just clears what's on screen
+					$(document).on("click", "span.mute", function() {
+						var encodedName = $(this).attr("data-name");
+						var name = decodeURIComponent(encodedName);
+						if (!confirm("Mute " + name + "?  You won't see their chats anymore.")) {
+							return;
+						}
+						$.post("/api/v1/mute", { display_name: name }, function() {
+							$("span.mute").filter(function() {
+								return $(this).attr("data-name") == encodedName;
+							}).closest("div.chat").remove();
+						});
+					});
+					$(document).on("click", "span.like", function() {
+						var like = $(this);
+						var chatID = like.closest("div.chat").attr("data-id");
+						$.post("/like/" + chatID, function(data) {
+							like.addClass("liked");
+							showLikes(chatID, data.likes);
+						}).fail(function(xhr) {
+							var data = xhr.responseJSON || {};
+							if (xhr.status == 409) {
+								like.addClass("liked");
+								return;
+							}
+							$("#feedback").html($("<span>").text(data.error || "Unable to like that chat."));
+						});
+					});
+					$(document).on("click", "span.report", function() {
+						var chat = $(this).closest("div.chat");
+						var reason = prompt("Report this chat to the moderators?  Why (optional):");
+						if (reason === null) {
+							return;
+						}
+						$.post("/report", { chat_id: chat.attr("data-id"), reason: reason }, function() {
+							$("#feedback").html("<span>Thanks, the moderators will take a look.</span>");
+						}).fail(function(xhr) {
+							var data = xhr.responseJSON || {};
+							$("#feedback").html($("<span>").text(data.error || "Unable to report that chat."));
+						});
+					});
+					$(document).on("click", "div.flagShield", function() {
+						$(this).closest("div.chat").removeClass("flagged");
+						$(this).remove();
+					});
+					$(document).on("click", "span.spoiler", function() {
+						$(this).addClass("revealed");
+					});
+					$("#uploadPicture").click(function() {
+						$("#uploadFile").click();
+					});
+					$("#uploadFile").change(function() {
+						if (this.files.length == 0) {
+							return;
+						}
+						uploadToComposer(this.files[0], "upload");
+						// allow picking the same file again
+						$(this).val("");
+					});
+					$("#attachFile").click(function() {
+						$("#attachmentFile").click();
+					});
+					$("#attachmentFile").change(function() {
+						if (this.files.length == 0) {
+							return;
+						}
+						uploadToComposer(this.files[0], this.files[0].name);
+						$(this).val("");
+					});
+					function uploadToComposer(file, fileName) {
+						var formData = new FormData();
+						formData.append("file", file, fileName);
+						$("#feedback").html("<span><i class=\"fa fa-refresh fa-spin\"></i> Uploading...</span>");
+						$.ajax({
+							type: 'POST',
+							url: "/upload?topic=" + encodeURIComponent(category),
+							data: formData,
+							processData: false,
+							contentType: false,
+							dataType: "json",
+							success: function(data) {
+								$("#feedback").empty();
+								$('#msgArea').val( $('#msgArea').val() + '\n' + data.markdown + '\n' );
+								var text = $("#msgArea").val();
+								$("#msgArea").focus().val("").val(text);
+							},
+							error: function(xhr, textStatus, error) {
+								var msg = "Upload failed.";
+								if (xhr.responseJSON && xhr.responseJSON.error) {
+									msg = xhr.responseJSON.error;
+								}
+								$("#feedback").html($("<span>").text(msg));
+							}
+						});
+					}
+					var voiceRecorder = null;
+					$("#recordVoice").click(function() {
+						if (voiceRecorder) {
+							voiceRecorder.stop();
+							return;
+						}
+						if (!navigator.mediaDevices || !window.MediaRecorder) {
+							$("#feedback").html("<span>Your browser can't record voice notes.</span>");
+							return;
+						}
+						navigator.mediaDevices.getUserMedia({audio: true}).then(function(stream) {
+							var chunks = [];
+							voiceRecorder = new MediaRecorder(stream);
+							voiceRecorder.ondataavailable = function(e) {
+								chunks.push(e.data);
+							};
+							voiceRecorder.onstop = function() {
+								stream.getTracks().forEach(function(track) { track.stop(); });
+								voiceRecorder = null;
+								$("#recordVoice").removeClass("recording");
+								uploadToComposer(new Blob(chunks), "voice-note");
+							};
+							voiceRecorder.start();
+							$("#recordVoice").addClass("recording");
+							$("#feedback").html("<span><i class=\"fa fa-microphone\"></i> Recording, click the microphone again to stop.</span>");
+						}, function() {
+							$("#feedback").html("<span>Unable to use your microphone.</span>");
+						});
+					});
 					$("#markdownHelp").click(function() {
 						var win = window.open('https://duckduckgo.com/?q=markdown+cheat+sheet&ia=answer&iax=1', '_blank');
 						if (win) {
@@ -835,6 +2872,7 @@ func getIndexTemplateString() string {
             scrollToId("chat-topic-hdr");
           });
       </script>
+			{{ block "scripts" . }}{{ end }}
     </bodY>
   </html>`
 }
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// moderationHook asks an external service (a Perspective API proxy, a
+// custom classifier, ...) what to do with every chat before it's published.
+// The service gets a json POST of the chat and answers with
+//
+//	{"action": "allow"|"reject"|"hold", "reason": "optional explanation"}
+type moderationHook struct {
+	url      string
+	client   *http.Client
+	failOpen bool
+}
+
+type moderationRequest struct {
+	Topic       string `json:"topic"`
+	DisplayName string `json:"display_name"`
+	Message     string `json:"message"`
+	ClientIP    string `json:"client_ip"`
+}
+
+type moderationResponse struct {
+	Action string `json:"action"`
+	Reason string `json:"reason"`
+}
+
+func newModerationHook(url string, timeout time.Duration, failOpen bool) *moderationHook {
+	return &moderationHook{url: url, client: &http.Client{Timeout: timeout}, failOpen: failOpen}
+}
+
+func (hook *moderationHook) check(r *http.Request, chat *ChatPost) *postRejection {
+	verdict, err := hook.ask(moderationRequest{chat.Topic, chat.DisplayName, chat.Message, clientIP(r)})
+	if err != nil {
+		log.Printf("Moderation hook failed: %v\n", err)
+		if hook.failOpen {
+			return nil
+		}
+		return &postRejection{Reason: "moderation_unavailable", Status: 503,
+			Message: "Unable to check your chat right now, try again shortly."}
+	}
+	switch verdict.Action {
+	case "allow":
+		return nil
+	case "hold":
+		return &postRejection{Reason: "moderation_hold", Status: 202, Hold: true,
+			Message: "Your chat is being held for moderator review."}
+	case "reject":
+		message := "Your chat was rejected by moderation."
+		if len(verdict.Reason) > 0 {
+			message = "Your chat was rejected by moderation: " + verdict.Reason
+		}
+		return &postRejection{Reason: "moderation_reject", Status: 403, Message: message}
+	}
+	log.Printf("Moderation hook returned unknown action: %q\n", verdict.Action)
+	if hook.failOpen {
+		return nil
+	}
+	return &postRejection{Reason: "moderation_unavailable", Status: 503,
+		Message: "Unable to check your chat right now, try again shortly."}
+}
+
+func (hook *moderationHook) ask(req moderationRequest) (*moderationResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := hook.client.Post(hook.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	var verdict moderationResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&verdict); err != nil {
+		return nil, err
+	}
+	return &verdict, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"html"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// muteList holds the display names each session has muted.  Chats from
+// muted names are dropped from that session's subscribe and history
+// responses, so someone being harassed doesn't have to wait for a
+// moderator to stop seeing it.
+type muteList struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	sessions map[string]*sessionMutes
+	renderer *chatRenderer
+}
+
+type sessionMutes struct {
+	names    map[string]bool // rendered display names
+	lastSeen time.Time
+}
+
+const (
+	maxMutesPerSession = 200
+	muteSessionTTL     = 30 * 24 * time.Hour
+)
+
+func newMuteList(renderer *chatRenderer) *muteList {
+	mutes := &muteList{ttl: muteSessionTTL, sessions: make(map[string]*sessionMutes), renderer: renderer}
+	go mutes.cleanup()
+	return mutes
+}
+
+func (mutes *muteList) set(session, name string, muted bool) bool {
+	rendered := mutes.renderer.renderName(name)
+	mutes.mu.Lock()
+	defer mutes.mu.Unlock()
+	sm, found := mutes.sessions[session]
+	if !found {
+		sm = &sessionMutes{names: make(map[string]bool)}
+		mutes.sessions[session] = sm
+	}
+	sm.lastSeen = time.Now()
+	if !muted {
+		delete(sm.names, rendered)
+		return true
+	}
+	if len(sm.names) >= maxMutesPerSession {
+		return false
+	}
+	sm.names[rendered] = true
+	return true
+}
+
+// muted returns a copy of the session's muted names, nil when there are none.
+func (mutes *muteList) muted(session string) map[string]bool {
+	mutes.mu.Lock()
+	defer mutes.mu.Unlock()
+	sm, found := mutes.sessions[session]
+	if !found || len(sm.names) == 0 {
+		return nil
+	}
+	sm.lastSeen = time.Now()
+	names := make(map[string]bool, len(sm.names))
+	for name := range sm.names {
+		names[name] = true
+	}
+	return names
+}
+
+func (mutes *muteList) cleanup() {
+	for range time.Tick(time.Hour) {
+		mutes.mu.Lock()
+		for session, sm := range mutes.sessions {
+			if time.Since(sm.lastSeen) >= mutes.ttl {
+				delete(mutes.sessions, session)
+			}
+		}
+		mutes.mu.Unlock()
+	}
+}
+
+// filter wraps subscribe/history handlers so they skip chats from names the
+// requesting session muted.
+func (mutes *muteList) filter(handler func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := sessionID(r)
+		if len(session) > 0 {
+			if names := mutes.muted(session); names != nil {
+				r = withEventFilter(r, func(event *chatEvent) bool {
+					chat, ok := event.Data.(ChatPost)
+					return !ok || !names[chat.DisplayName]
+				})
+			}
+		}
+		handler(w, r)
+	}
+}
+
+// getMuteClosure serves /api/v1/mute.  GET lists the session's muted names,
+// POST with display_name (and muted=false to unmute) changes the list.
+func getMuteClosure(mutes *muteList) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			names := []string{}
+			for name := range mutes.muted(sessionID(r)) {
+				names = append(names, html.UnescapeString(name))
+			}
+			sort.Strings(names)
+			writeJSON(w, 200, map[string][]string{"muted": names})
+		case "POST":
+			name := r.PostFormValue("display_name")
+			if len(name) == 0 {
+				writeJSON(w, 400, map[string]string{"error": "Missing display_name arg."})
+				return
+			}
+			if !mutes.set(ensureSession(w, r), name, r.PostFormValue("muted") != "false") {
+				writeJSON(w, 400, map[string]string{"error": "Too many muted names."})
+				return
+			}
+			writeJSON(w, 200, map[string]string{"status": "ok"})
+		default:
+			http.Error(w, "Invalid request method.", 405)
+		}
+	}
+}
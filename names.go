@@ -0,0 +1,78 @@
+package main
+
+import (
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// most names /api/v1/names answers with
+	maxNameSuggestions = 20
+	// how far back through a topic's chats names are looked for
+	nameSuggestionScan = 500
+)
+
+type activeName struct {
+	DisplayName  string `json:"display_name"` // as typed, not html escaped
+	NameColor    string `json:"name_color,omitempty"`
+	LastActiveMs int64  `json:"last_active_ms"`
+}
+
+// recentNames returns who posted topic's latest buffered chats, most
+// recently active first, whose names start with prefix (case insensitive).
+func recentNames(manager *chatStore, topic, prefix string, limit int) []activeName {
+	prefix = strings.ToLower(prefix)
+	events := manager.eventsBefore(topic, timeToEpochMilliseconds(time.Now())+1, nameSuggestionScan)
+	names := []activeName{}
+	seen := make(map[string]bool)
+	for i := len(events) - 1; i >= 0 && len(names) < limit; i-- {
+		chat, ok := events[i].Data.(ChatPost)
+		if !ok || chat.System {
+			continue
+		}
+		name := html.UnescapeString(chat.DisplayName)
+		key := strings.ToLower(name)
+		if seen[key] || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		seen[key] = true
+		names = append(names, activeName{DisplayName: name, NameColor: chat.NameColor, LastActiveMs: events[i].Timestamp})
+	}
+	return names
+}
+
+// getNamesClosure serves GET /api/v1/names?topic=X[&prefix=jo][&limit=N],
+// the names recently posting in a topic for @mention autocomplete:
+//
+//	{"names": [{"display_name": "joe", "name_color": "#...", "last_active_ms": ...}]}
+func getNamesClosure(manager *chatStore, bans *topicBans) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		topic := r.URL.Query().Get("topic")
+		if len(topic) == 0 || topic == ALL_CHATS {
+			writeJSON(w, 400, map[string]string{"error": "Missing topic arg."})
+			return
+		}
+		limit := maxNameSuggestions
+		if limitString := r.URL.Query().Get("limit"); len(limitString) > 0 {
+			parsed, err := strconv.Atoi(limitString)
+			if err != nil || parsed < 1 || parsed > maxNameSuggestions {
+				writeJSON(w, 400, map[string]string{"error": "Invalid limit arg, must be 1-" + strconv.Itoa(maxNameSuggestions) + "."})
+				return
+			}
+			limit = parsed
+		}
+		// nobody removed from a topic gets to see who's in it
+		if bans.banned(r, topic, true) != nil {
+			writeJSON(w, 403, map[string]string{"error": "You've been removed from this topic."})
+			return
+		}
+		writeJSON(w, 200, map[string][]activeName{"names": recentNames(manager, topic, r.URL.Query().Get("prefix"), limit)})
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Push notification services the notifier can send to.
+const (
+	notifyNtfy   = "ntfy"
+	notifyGotify = "gotify"
+)
+
+// pushNotifier sends an alert to an ntfy topic or a Gotify server when a
+// chat @mentions one of the watched names or has one of the watched
+// keywords, so self hosters get pushes on their phones without Apple or
+// Google in the middle.  Burn after reading and encrypted chats are skipped.
+type pushNotifier struct {
+	opts       notifierOptions
+	mentions   *regexp.Regexp // nil when no names are watched
+	keywords   *regexp.Regexp // nil when no keywords are watched
+	client     *http.Client
+	deliveries *deliveryQueue
+	publicURL  string
+}
+
+type notifierOptions struct {
+	Kind string
+	// the ntfy topic url (https://ntfy.sh/mytopic) or the Gotify server url
+	URL string
+	// ntfy access token or Gotify application token
+	Token    string
+	Mentions []string
+	Keywords []string
+	// topics to watch, all of them when empty
+	Topics map[string]bool
+}
+
+type pushAlert struct {
+	title   string
+	message string
+	click   string
+}
+
+// wordsRegex matches any of the words as whole words, ignoring case,
+// prefixed by prefix.
+func wordsRegex(prefix string, words []string) *regexp.Regexp {
+	if len(words) == 0 {
+		return nil
+	}
+	quoted := make([]string, len(words))
+	for i, word := range words {
+		quoted[i] = regexp.QuoteMeta(word)
+	}
+	return regexp.MustCompile(`(?i)(^|[^\w@])` + prefix + `(` + strings.Join(quoted, "|") + `)\b`)
+}
+
+func newPushNotifier(opts notifierOptions, publicURL string, deliveries *deliveryQueue) *pushNotifier {
+	return &pushNotifier{
+		opts:       opts,
+		mentions:   wordsRegex("@", opts.Mentions),
+		keywords:   wordsRegex("", opts.Keywords),
+		client:     &http.Client{Timeout: 10 * time.Second},
+		deliveries: deliveries,
+		publicURL:  strings.TrimRight(publicURL, "/"),
+	}
+}
+
+// published queues an alert for chats that match.  Registered with
+// chatStore.onPublish.
+func (notifier *pushNotifier) published(event *chatEvent) {
+	chat, ok := event.Data.(ChatPost)
+	if !ok || chat.Burn || chat.Encrypted || (len(notifier.opts.Topics) > 0 && !notifier.opts.Topics[chat.Topic]) {
+		return
+	}
+	text := previewText(chat.Message)
+	var why string
+	if notifier.mentions != nil {
+		if match := notifier.mentions.FindStringSubmatch(text); match != nil {
+			why = "@" + match[2] + " mentioned"
+		}
+	}
+	if len(why) == 0 && notifier.keywords != nil {
+		if match := notifier.keywords.FindStringSubmatch(text); match != nil {
+			why = "\"" + match[2] + "\" said"
+		}
+	}
+	if len(why) == 0 {
+		return
+	}
+	alert := pushAlert{title: fmt.Sprintf("%s in %s", why, chat.Topic),
+		message: previewText(chat.DisplayName) + ": " + text}
+	// without a public url there's nothing to link back to
+	if len(notifier.publicURL) > 0 {
+		alert.click = notifier.publicURL + "/?topic=" + chat.Topic + "#chat-" + chat.ID
+	}
+	notifier.deliveries.send(notifier.delivery(alert))
+}
+
+func (notifier *pushNotifier) delivery(alert pushAlert) outboundDelivery {
+	if notifier.opts.Kind == notifyGotify {
+		message := map[string]interface{}{"title": alert.title, "message": alert.message, "priority": 5}
+		if len(alert.click) > 0 {
+			message["extras"] = map[string]interface{}{"client::notification": map[string]interface{}{
+				"click": map[string]string{"url": alert.click}}}
+		}
+		body, _ := json.Marshal(message)
+		return outboundDelivery{Kind: notifyGotify, Client: notifier.client,
+			URL: strings.TrimRight(notifier.opts.URL, "/") + "/message", Body: body,
+			Header: http.Header{"Content-Type": {"application/json"}, "X-Gotify-Key": {notifier.opts.Token}}}
+	}
+	header := http.Header{}
+	header.Set("Title", alert.title)
+	header.Set("Tags", "speech_balloon")
+	if len(alert.click) > 0 {
+		header.Set("Click", alert.click)
+	}
+	if len(notifier.opts.Token) > 0 {
+		header.Set("Authorization", "Bearer "+notifier.opts.Token)
+	}
+	return outboundDelivery{Kind: notifyNtfy, Client: notifier.client, URL: notifier.opts.URL,
+		Header: header, Body: []byte(alert.message)}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// presenceTracker counts who's currently watching each topic.  Every long
+// poll doubles as a heartbeat: a viewer is present while one of their polls
+// is open and for a short while after it returns.  Viewers are told apart
+// by their session, or their IP without one, so a few tabs are one viewer
+// and nobody can make up more of them.
+//
+// Counts are published as {"topic": "...", "viewers": 12} events to their
+// own store, served at /presence with the same long poll api as /subscribe,
+// so they never mix with chats, history or topic stats.
+type presenceTracker struct {
+	mu      sync.Mutex
+	linger  time.Duration
+	viewers map[string]map[string]*viewerState
+	counts  map[string]int // last published count by topic
+	store   *chatStore
+}
+
+type viewerState struct {
+	open     int
+	lastSeen time.Time
+}
+
+type presenceSummary struct {
+	Topic   string `json:"topic"`
+	Viewers int    `json:"viewers"`
+}
+
+const (
+	presencePublishInterval = 5 * time.Second
+	// past this a topic's count stops going up
+	maxViewersPerTopic = 10000
+)
+
+func newPresenceTracker(linger time.Duration) *presenceTracker {
+	presence := &presenceTracker{
+		linger:  linger,
+		viewers: make(map[string]map[string]*viewerState),
+		counts:  make(map[string]int),
+		// only the latest count per topic is ever worth sending
+		store: newChatStore(storeOptions{
+			MaxEventsPerCategory: func(string) int { return 1 },
+			MaxBytes:             16 * 1024 * 1024,
+			EventTTL:             time.Hour,
+			MaxTimeout:           120 * time.Second,
+		}),
+	}
+	go presence.publishLoop()
+	return presence
+}
+
+// track wraps long poll handlers, counting the poller as present on the
+// category they poll for the duration of the request.
+func (presence *presenceTracker) track(handler func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		topic := r.URL.Query().Get("category")
+		// lists of topics aren't anyone's presence in any one of them
+		if len(topic) == 0 || topic == ALL_CHATS || strings.Contains(topic, ",") {
+			handler(w, r)
+			return
+		}
+		viewer := sessionID(r)
+		if len(viewer) == 0 {
+			viewer = "ip:" + networkKey(r)
+		}
+		if presence.delta(topic, viewer, 1) {
+			defer presence.delta(topic, viewer, -1)
+		}
+		handler(w, r)
+	}
+}
+
+// delta returns false for viewers a full topic has no room for.
+func (presence *presenceTracker) delta(topic, viewer string, delta int) bool {
+	presence.mu.Lock()
+	defer presence.mu.Unlock()
+	viewers, found := presence.viewers[topic]
+	if !found {
+		viewers = make(map[string]*viewerState)
+		presence.viewers[topic] = viewers
+	}
+	state, found := viewers[viewer]
+	if !found {
+		if len(viewers) >= maxViewersPerTopic {
+			return false
+		}
+		state = &viewerState{}
+		viewers[viewer] = state
+	}
+	state.open += delta
+	state.lastSeen = time.Now()
+	return true
+}
+
+// publishLoop drops viewers that went away and publishes counts that
+// changed since last time.
+func (presence *presenceTracker) publishLoop() {
+	for range time.Tick(presencePublishInterval) {
+		var changed []presenceSummary
+		presence.mu.Lock()
+		for topic, viewers := range presence.viewers {
+			for viewer, state := range viewers {
+				if state.open <= 0 && time.Since(state.lastSeen) > presence.linger {
+					delete(viewers, viewer)
+				}
+			}
+			if len(viewers) != presence.counts[topic] {
+				changed = append(changed, presenceSummary{topic, len(viewers)})
+				presence.counts[topic] = len(viewers)
+			}
+			if len(viewers) == 0 {
+				delete(presence.viewers, topic)
+				delete(presence.counts, topic)
+			}
+		}
+		presence.mu.Unlock()
+		for _, summary := range changed {
+			presence.store.Publish(summary.Topic, summary)
+		}
+	}
+}
+
+// SubscriptionHandler serves /presence?category=<topic>&timeout=&since_time=
+func (presence *presenceTracker) SubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	if strings.TrimSpace(r.URL.Query().Get("category")) == ALL_CHATS {
+		writeJSON(w, 400, map[string]string{"error": "Presence is tracked per topic."})
+		return
+	}
+	presence.store.SubscriptionHandler(w, r)
+}
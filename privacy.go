@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+)
+
+// Ways -privacyMode can anonymize client IPs.
+const (
+	privacyOff      = "off"
+	privacyTruncate = "truncate"
+	privacyHash     = "hash"
+)
+
+// ipAnonymizer is what clientIP reports instead of the real address in
+// privacy mode, so logs, rate limit keys, bans and everything else only see
+// a truncated (/24 or /48) or hashed IP.  A nil ipAnonymizer leaves IPs
+// alone.
+type ipAnonymizer struct {
+	mode string
+	key  []byte
+}
+
+// newIPAnonymizer returns nil when mode is off.  Hashes are keyed by salt,
+// or by a random key when it's blank, in which case bans and quotas by IP
+// don't survive a restart.
+func newIPAnonymizer(mode, salt string) *ipAnonymizer {
+	if mode == privacyOff {
+		return nil
+	}
+	key := []byte(salt)
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		rand.Read(key)
+	}
+	return &ipAnonymizer{mode: mode, key: key}
+}
+
+// anonymize returns ip as clientIP would report it.  Anything that isn't an
+// IP (already anonymized) is returned as is.
+func (anon *ipAnonymizer) anonymize(ip string) string {
+	parsed := net.ParseIP(ip)
+	if anon == nil || parsed == nil {
+		return ip
+	}
+	if anon.mode == privacyTruncate {
+		return truncatedIP(parsed)
+	}
+	mac := hmac.New(sha256.New, anon.key)
+	mac.Write(parsed.To16())
+	return "anon-" + hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// truncatedIP is the /24 or /48 the IP is in.
+func truncatedIP(parsed net.IP) string {
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return parsed.Mask(net.CIDRMask(48, 128)).String()
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// profanityFilter either rejects chats containing listed words or, in mask
+// mode, replaces them with asterisks while rendering so the conversation
+// keeps flowing but the board stays family friendly.
+type profanityFilter struct {
+	words *regexp.Regexp
+}
+
+// loadProfanityFilter reads one word (or phrase) per line, ignoring blank
+// lines and # comments.
+func loadProfanityFilter(path string) (*profanityFilter, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var words []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		word := strings.TrimSpace(scanner.Text())
+		if len(word) == 0 || strings.HasPrefix(word, "#") {
+			continue
+		}
+		words = append(words, regexp.QuoteMeta(word))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(words) == 0 {
+		// matches nothing
+		return &profanityFilter{words: regexp.MustCompile(`[^\s\S]`)}, nil
+	}
+	return &profanityFilter{words: regexp.MustCompile(`(?i)\b(?:` + strings.Join(words, "|") + `)\b`)}, nil
+}
+
+// mask replaces each listed word with one star per character.  Pass `\*`
+// as the star for input that's about to go through markdown.
+func (filter *profanityFilter) mask(input, star string) string {
+	return filter.words.ReplaceAllStringFunc(input, func(word string) string {
+		return strings.Repeat(star, utf8.RuneCountInString(word))
+	})
+}
+
+func (filter *profanityFilter) check(r *http.Request, chat *ChatPost) *postRejection {
+	if !filter.words.MatchString(chat.Message) && !filter.words.MatchString(chat.DisplayName) {
+		return nil
+	}
+	return &postRejection{Reason: "profanity", Status: 403,
+		Message: "Please keep it family friendly, your chat contains words that aren't allowed here."}
+}
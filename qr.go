@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// A small QR code encoder, just enough for topic links: byte mode, medium
+// error correction (15% of the code can be damaged) and versions 1-20,
+// which holds a bit over 600 bytes.
+
+var errQRTooLong = errors.New("too long for a qr code")
+
+// qrBlocks is the medium error correction layout of each version: ecc
+// codewords per block, then the number of blocks and data codewords in
+// each of the (up to) two block groups.
+var qrBlocks = [21][5]int{
+	{},
+	{10, 1, 16, 0, 0}, {16, 1, 28, 0, 0}, {26, 1, 44, 0, 0}, {18, 2, 32, 0, 0}, {24, 2, 43, 0, 0},
+	{16, 4, 27, 0, 0}, {18, 4, 31, 0, 0}, {22, 2, 38, 2, 39}, {22, 3, 36, 2, 37}, {26, 4, 43, 1, 44},
+	{30, 1, 50, 4, 51}, {22, 6, 36, 2, 37}, {22, 8, 37, 1, 38}, {24, 4, 40, 5, 41}, {24, 5, 41, 5, 42},
+	{28, 7, 45, 3, 46}, {28, 10, 46, 1, 47}, {26, 9, 43, 4, 44}, {26, 3, 44, 11, 45}, {26, 3, 41, 13, 42},
+}
+
+type qrCode struct {
+	size     int
+	modules  [][]bool // [y][x], true is dark
+	function [][]bool // finder, timing, alignment and format modules
+}
+
+func qrDataCodewords(version int) int {
+	blocks := qrBlocks[version]
+	return blocks[1]*blocks[2] + blocks[3]*blocks[4]
+}
+
+// encodeQR picks the smallest version that fits data.
+func encodeQR(data []byte) (*qrCode, error) {
+	for version := 1; version <= 20; version++ {
+		countBits := 8
+		if version >= 10 {
+			countBits = 16
+		}
+		capacity := qrDataCodewords(version)
+		if 4+countBits+len(data)*8 > capacity*8 {
+			continue
+		}
+		var bits qrBits
+		bits.append(0x4, 4) // byte mode
+		bits.append(len(data), countBits)
+		for _, b := range data {
+			bits.append(int(b), 8)
+		}
+		// terminator, then pad to a whole byte and with the alternating pad bytes
+		for i := 0; i < 4 && len(bits) < capacity*8; i++ {
+			bits = append(bits, false)
+		}
+		for len(bits)%8 != 0 {
+			bits = append(bits, false)
+		}
+		for pad := 0xEC; len(bits) < capacity*8; pad ^= 0xEC ^ 0x11 {
+			bits.append(pad, 8)
+		}
+		return newQRCode(version, qrAddECC(version, bits.bytes())), nil
+	}
+	return nil, errQRTooLong
+}
+
+type qrBits []bool
+
+func (bits *qrBits) append(value, length int) {
+	for i := length - 1; i >= 0; i-- {
+		*bits = append(*bits, (value>>uint(i))&1 != 0)
+	}
+}
+
+func (bits qrBits) bytes() []byte {
+	out := make([]byte, len(bits)/8)
+	for i, bit := range bits {
+		if bit {
+			out[i/8] |= 1 << uint(7-i%8)
+		}
+	}
+	return out
+}
+
+// qrAddECC splits the data into blocks, adds each block's Reed-Solomon
+// codewords and interleaves them all the way the spec lays them out.
+func qrAddECC(version int, data []byte) []byte {
+	layout := qrBlocks[version]
+	divisor := qrRSDivisor(layout[0])
+	var blocks, eccs [][]byte
+	for group := 0; group < 2; group++ {
+		for i := 0; i < layout[1+group*2]; i++ {
+			block := data[:layout[2+group*2]]
+			data = data[len(block):]
+			blocks = append(blocks, block)
+			eccs = append(eccs, qrRSRemainder(block, divisor))
+		}
+	}
+	var out []byte
+	for i := 0; i < layout[4] || i < layout[2]; i++ {
+		for _, block := range blocks {
+			if i < len(block) {
+				out = append(out, block[i])
+			}
+		}
+	}
+	for i := 0; i < layout[0]; i++ {
+		for _, ecc := range eccs {
+			out = append(out, ecc[i])
+		}
+	}
+	return out
+}
+
+// qrMultiply multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1.
+func qrMultiply(x, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>uint(i))&1) * int(x)
+	}
+	return byte(z)
+}
+
+func qrRSDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = qrMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = qrMultiply(root, 0x02)
+	}
+	return result
+}
+
+func qrRSRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, coefficient := range divisor {
+			result[i] ^= qrMultiply(coefficient, factor)
+		}
+	}
+	return result
+}
+
+func newQRCode(version int, codewords []byte) *qrCode {
+	size := version*4 + 17
+	qr := &qrCode{size: size, modules: make([][]bool, size), function: make([][]bool, size)}
+	for y := range qr.modules {
+		qr.modules[y] = make([]bool, size)
+		qr.function[y] = make([]bool, size)
+	}
+	qr.drawFunctionPatterns(version)
+	qr.drawCodewords(codewords)
+	// keep the mask that's easiest to scan
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		qr.applyMask(mask)
+		qr.drawFormatBits(mask)
+		if penalty := qr.penalty(); bestPenalty < 0 || penalty < bestPenalty {
+			best, bestPenalty = mask, penalty
+		}
+		qr.applyMask(mask)
+	}
+	qr.applyMask(best)
+	qr.drawFormatBits(best)
+	return qr
+}
+
+func (qr *qrCode) set(x, y int, dark bool) {
+	qr.modules[y][x] = dark
+	qr.function[y][x] = true
+}
+
+func (qr *qrCode) drawFunctionPatterns(version int) {
+	for i := 0; i < qr.size; i++ {
+		qr.set(6, i, i%2 == 0)
+		qr.set(i, 6, i%2 == 0)
+	}
+	for _, corner := range [][2]int{{3, 3}, {qr.size - 4, 3}, {3, qr.size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := corner[0]+dx, corner[1]+dy
+				if x >= 0 && x < qr.size && y >= 0 && y < qr.size {
+					distance := qrMax(qrAbs(dx), qrAbs(dy))
+					qr.set(x, y, distance != 2 && distance != 4)
+				}
+			}
+		}
+	}
+	positions := qrAlignmentPositions(version)
+	last := len(positions) - 1
+	for i, x := range positions {
+		for j, y := range positions {
+			// the three corners with finder patterns
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					qr.set(x+dx, y+dy, qrMax(qrAbs(dx), qrAbs(dy)) != 1)
+				}
+			}
+		}
+	}
+	// reserve the format areas, drawn for real once the mask is picked
+	qr.drawFormatBits(0)
+	if version >= 7 {
+		remainder := version
+		for i := 0; i < 12; i++ {
+			remainder = (remainder << 1) ^ ((remainder >> 11) * 0x1F25)
+		}
+		bits := version<<12 | remainder
+		for i := 0; i < 18; i++ {
+			dark := (bits>>uint(i))&1 != 0
+			a, b := qr.size-11+i%3, i/3
+			qr.set(a, b, dark)
+			qr.set(b, a, dark)
+		}
+	}
+}
+
+func qrAlignmentPositions(version int) []int {
+	if version == 1 {
+		return nil
+	}
+	count := version/7 + 2
+	step := (version*4 + count*2 + 1) / (count*2 - 2) * 2
+	positions := make([]int, count)
+	positions[0] = 6
+	for i, position := count-1, version*4+17-7; i >= 1; i, position = i-1, position-step {
+		positions[i] = position
+	}
+	return positions
+}
+
+// drawFormatBits writes the error correction level (medium) and mask.
+func (qr *qrCode) drawFormatBits(mask int) {
+	data := 0<<3 | mask // medium is 00
+	remainder := data
+	for i := 0; i < 10; i++ {
+		remainder = (remainder << 1) ^ ((remainder >> 9) * 0x537)
+	}
+	bits := (data<<10 | remainder) ^ 0x5412
+	bit := func(i int) bool { return (bits>>uint(i))&1 != 0 }
+	for i := 0; i <= 5; i++ {
+		qr.set(8, i, bit(i))
+	}
+	qr.set(8, 7, bit(6))
+	qr.set(8, 8, bit(7))
+	qr.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		qr.set(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		qr.set(qr.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		qr.set(8, qr.size-15+i, bit(i))
+	}
+	qr.set(8, qr.size-8, true)
+}
+
+// drawCodewords fills the non function modules two columns at a time,
+// zig-zagging up and down from the bottom right.
+func (qr *qrCode) drawCodewords(codewords []byte) {
+	i := 0
+	for right := qr.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			// skip the vertical timing pattern
+			right = 5
+		}
+		for vertical := 0; vertical < qr.size; vertical++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vertical
+				if (right+1)&2 == 0 {
+					y = qr.size - 1 - vertical
+				}
+				if !qr.function[y][x] && i < len(codewords)*8 {
+					qr.modules[y][x] = (codewords[i/8]>>uint(7-i%8))&1 != 0
+					i++
+				}
+			}
+		}
+	}
+}
+
+// applyMask flips data modules by one of the eight mask patterns.  Applying
+// the same mask twice undoes it.
+func (qr *qrCode) applyMask(mask int) {
+	for y := 0; y < qr.size; y++ {
+		for x := 0; x < qr.size; x++ {
+			var flip bool
+			switch mask {
+			case 0:
+				flip = (x+y)%2 == 0
+			case 1:
+				flip = y%2 == 0
+			case 2:
+				flip = x%3 == 0
+			case 3:
+				flip = (x+y)%3 == 0
+			case 4:
+				flip = (x/3+y/2)%2 == 0
+			case 5:
+				flip = x*y%2+x*y%3 == 0
+			case 6:
+				flip = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				flip = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if flip && !qr.function[y][x] {
+				qr.modules[y][x] = !qr.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores how hard the code would be to scan, using the spec's rules
+// for long runs, 2x2 blocks, finder look-alikes and dark/light balance.
+func (qr *qrCode) penalty() int {
+	penalty, dark := 0, 0
+	at := func(x, y int, vertical bool) bool {
+		if vertical {
+			return qr.modules[x][y]
+		}
+		return qr.modules[y][x]
+	}
+	finderLike := []bool{true, false, true, true, true, false, true}
+	for _, vertical := range []bool{false, true} {
+		for y := 0; y < qr.size; y++ {
+			run := 1
+			for x := 1; x <= qr.size; x++ {
+				if x < qr.size && at(x, y, vertical) == at(x-1, y, vertical) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					penalty += run - 2
+				}
+				run = 1
+			}
+			for x := 0; x+7 <= qr.size; x++ {
+				matches := true
+				for i, want := range finderLike {
+					if at(x+i, y, vertical) != want {
+						matches = false
+						break
+					}
+				}
+				if !matches {
+					continue
+				}
+				// needs four light modules (or the edge) on one side
+				light := func(from, to int) bool {
+					for i := from; i < to; i++ {
+						if i >= 0 && i < qr.size && at(i, y, vertical) {
+							return false
+						}
+					}
+					return true
+				}
+				if light(x-4, x) || light(x+7, x+11) {
+					penalty += 40
+				}
+			}
+		}
+	}
+	for y := 0; y < qr.size; y++ {
+		for x := 0; x < qr.size; x++ {
+			if qr.modules[y][x] {
+				dark++
+			}
+			if x > 0 && y > 0 && qr.modules[y][x] == qr.modules[y-1][x] &&
+				qr.modules[y][x] == qr.modules[y][x-1] && qr.modules[y][x] == qr.modules[y-1][x-1] {
+				penalty += 3
+			}
+		}
+	}
+	total := qr.size * qr.size
+	k := (qrAbs(dark*20-total*10)+total-1)/total - 1
+	return penalty + k*10
+}
+
+func qrAbs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func qrMax(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// png draws the code scale pixels per module with the four module quiet
+// zone scanners expect around it.
+func (qr *qrCode) png(scale int) ([]byte, error) {
+	width := (qr.size + 8) * scale
+	img := image.NewPaletted(image.Rect(0, 0, width, width), color.Palette{color.White, color.Black})
+	for y := 0; y < qr.size; y++ {
+		for x := 0; x < qr.size; x++ {
+			if !qr.modules[y][x] {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					img.SetColorIndex((x+4)*scale+dx, (y+4)*scale+dy, 1)
+				}
+			}
+		}
+	}
+	var out bytes.Buffer
+	if err := png.Encode(&out, img); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// topics as normalizeTopic leaves them
+var topicNameRegex = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+// getQRClosure serves GET /qr/<topic>.png, a QR code of the topic's link,
+// so a topic can be put up on a projector for people to join from phones.
+func getQRClosure(publicURL string, limits inputLimits) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		topic := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/qr/"), ".png")
+		if !strings.HasSuffix(r.URL.Path, ".png") || !topicNameRegex.MatchString(topic) || len(topic) > int(limits.TopicLen) {
+			http.Error(w, "Not found.", 404)
+			return
+		}
+		qr, err := encodeQR([]byte(siteURL(publicURL, r) + "/?topic=" + url.QueryEscape(topic)))
+		if err != nil {
+			http.Error(w, "Topic link too long for a QR code.", 400)
+			return
+		}
+		image, err := qr.png(8)
+		if err != nil {
+			http.Error(w, "Failed to draw QR code.", 500)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		w.Write(image)
+	}
+}
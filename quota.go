@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// dailyQuota caps how many chats a client IP can post in any rolling 24 hour
+// window.  This catches persistent low-rate spammers that never trip a burst
+// limit.  A chat takes its place in the quota when it's checked, so
+// concurrent posts can't all get in at the limit.
+type dailyQuota struct {
+	mu      sync.Mutex
+	max     int
+	window  time.Duration
+	posts   map[string][]time.Time // oldest first
+	pending map[string]int         // checked but not yet published
+}
+
+func newDailyQuota(max uint) *dailyQuota {
+	quota := &dailyQuota{max: int(max), window: 24 * time.Hour, posts: make(map[string][]time.Time),
+		pending: make(map[string]int)}
+	go quota.cleanup()
+	return quota
+}
+
+// NOTE: callers must hold quota.mu
+func (quota *dailyQuota) recent(key string, now time.Time) []time.Time {
+	posts := quota.posts[key]
+	cutoff := now.Add(-quota.window)
+	for len(posts) > 0 && posts[0].Before(cutoff) {
+		posts = posts[1:]
+	}
+	quota.posts[key] = posts
+	return posts
+}
+
+func (quota *dailyQuota) check(r *http.Request, chat *ChatPost) *postRejection {
+	key := clientIP(r)
+	now := time.Now()
+	quota.mu.Lock()
+	defer quota.mu.Unlock()
+	posts := quota.recent(key, now)
+	if len(posts)+quota.pending[key] < quota.max {
+		quota.pending[key]++
+		return nil
+	}
+	// with only pending chats, a minute is as good a guess as any
+	retryIn := time.Duration(0)
+	if len(posts) > 0 {
+		retryIn = posts[0].Add(quota.window).Sub(now)
+	}
+	return &postRejection{Reason: "daily_quota", Status: 429,
+		Message: fmt.Sprintf("Daily post limit reached (%d posts per 24 hours).  Try again in %v.",
+			quota.max, retryIn.Truncate(time.Minute)+time.Minute)}
+}
+
+func (quota *dailyQuota) limitFor(r *http.Request) (rateLimit, bool) {
+	now := time.Now()
+	quota.mu.Lock()
+	defer quota.mu.Unlock()
+	key := clientIP(r)
+	posts := quota.recent(key, now)
+	limit := rateLimit{Limit: quota.max, Remaining: quota.max - len(posts) - quota.pending[key], Reset: now}
+	if limit.Remaining < 0 {
+		limit.Remaining = 0
+	}
+	if len(posts) > 0 {
+		limit.Reset = posts[0].Add(quota.window)
+	}
+	return limit, true
+}
+
+func (quota *dailyQuota) published(r *http.Request, chat ChatPost) {
+	key := clientIP(r)
+	quota.mu.Lock()
+	defer quota.mu.Unlock()
+	quota.unreserve(key)
+	quota.posts[key] = append(quota.posts[key], time.Now())
+}
+
+func (quota *dailyQuota) released(r *http.Request, chat ChatPost) {
+	quota.mu.Lock()
+	defer quota.mu.Unlock()
+	quota.unreserve(clientIP(r))
+}
+
+// unreserve gives back a checked chat's place.  Chats published without
+// being checked now (approved after being held) never took one.
+// NOTE: callers must hold quota.mu
+func (quota *dailyQuota) unreserve(key string) {
+	if quota.pending[key] > 1 {
+		quota.pending[key]--
+	} else {
+		delete(quota.pending, key)
+	}
+}
+
+// cleanup forgets clients that haven't posted within the window.
+func (quota *dailyQuota) cleanup() {
+	for range time.Tick(time.Hour) {
+		now := time.Now()
+		quota.mu.Lock()
+		for key := range quota.posts {
+			if len(quota.recent(key, now)) == 0 && quota.pending[key] == 0 {
+				delete(quota.posts, key)
+			}
+		}
+		quota.mu.Unlock()
+	}
+}
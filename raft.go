@@ -0,0 +1,964 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A cluster of servers shares one publish log with Raft, so every server
+// buffers the same chats with the same ids and any of them can take posts
+// and subscribes.  Posts to a follower are handed to the leader, which
+// appends them to the log and buffers them (everywhere) once a majority
+// has them.  A snapshot of the log is just the chat buffer, since buffering
+// chats is all applying the log does.
+//
+// Peers talk over the chat's own http server under /raft/, authenticated
+// with a shared token.
+const (
+	raftFollower  = "follower"
+	raftCandidate = "candidate"
+	raftLeader    = "leader"
+
+	raftHeartbeat = 300 * time.Millisecond
+	// followers start an election after between one and two of these
+	// without hearing from a leader
+	raftElectionTimeout = 1500 * time.Millisecond
+	// how long a post waits for the cluster to commit it
+	raftCommitTimeout = 5 * time.Second
+	// most entries sent in one append
+	raftMaxAppend = 500
+	// applied entries kept before the log is compacted into a snapshot
+	raftMaxLog = 10000
+)
+
+var errNoLeader = errors.New("the cluster has no leader right now")
+
+type raftEntry struct {
+	Index  int64          `json:"index"`
+	Term   int64          `json:"term"`
+	Events []encodedEvent `json:"events"` // none for a new leader's first entry
+}
+
+// raftSnapshot is the applied log up to Index, as the buffered events.
+type raftSnapshot struct {
+	Index  int64          `json:"index"`
+	Term   int64          `json:"term"`
+	Events []encodedEvent `json:"events"`
+}
+
+type raftNode struct {
+	id      string   // this server's base url, as its peers reach it
+	peers   []string // the other servers' base urls
+	token   string
+	dir     string
+	manager *chatStore
+	client  *http.Client
+
+	mu        sync.Mutex
+	state     string
+	term      int64
+	votedFor  string
+	leader    string
+	log       []raftEntry // after the snapshot
+	snapIndex int64
+	snapTerm  int64
+	commit    int64
+	applied   int64
+	// newest event id in the log, so a new leader's ids go on from there
+	lastEventID int64
+	nextIndex   map[string]int64
+	matchIndex  map[string]int64
+	sending     map[string]bool
+	heard       time.Time
+	timeout     time.Duration
+	progress    *sync.Cond // broadcast whenever applied or the term moves
+}
+
+// newRaftNode loads the node's state from dir (and starts from scratch
+// when there's none), buffers its snapshot, and makes manager publish
+// through the cluster.
+func newRaftNode(manager *chatStore, id string, peers []string, token, dir string) (*raftNode, error) {
+	node := &raftNode{id: strings.TrimSuffix(id, "/"), token: token, dir: dir, manager: manager,
+		client: &http.Client{Timeout: 10 * time.Second}, state: raftFollower,
+		nextIndex: make(map[string]int64), matchIndex: make(map[string]int64), sending: make(map[string]bool),
+		heard: time.Now()}
+	for _, peer := range peers {
+		node.peers = append(node.peers, strings.TrimSuffix(peer, "/"))
+	}
+	node.progress = sync.NewCond(&node.mu)
+	node.timeout = node.randomTimeout()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	var state struct {
+		Term     int64  `json:"term"`
+		VotedFor string `json:"voted_for"`
+	}
+	if err := loadJSONFile(filepath.Join(dir, "raft-state.json"), &state); err != nil {
+		return nil, err
+	}
+	node.term, node.votedFor = state.Term, state.VotedFor
+	var snapshot raftSnapshot
+	if err := loadJSONFile(filepath.Join(dir, "raft-snapshot.json"), &snapshot); err != nil {
+		return nil, err
+	}
+	if err := node.restore(snapshot); err != nil {
+		return nil, err
+	}
+	if err := node.loadLog(); err != nil {
+		return nil, err
+	}
+	manager.replicateThrough(node)
+	go node.run()
+	return node, nil
+}
+
+// loadJSONFile decodes a file, leaving data alone when there's no such file.
+func loadJSONFile(path string, data interface{}) error {
+	encoded, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(encoded, data)
+}
+
+func (node *raftNode) randomTimeout() time.Duration {
+	return raftElectionTimeout + time.Duration(rand.Int63n(int64(raftElectionTimeout)))
+}
+
+// NOTE: callers must hold node.mu
+func (node *raftNode) lastIndexTerm() (int64, int64) {
+	if len(node.log) == 0 {
+		return node.snapIndex, node.snapTerm
+	}
+	last := node.log[len(node.log)-1]
+	return last.Index, last.Term
+}
+
+// termAt returns the term of the entry at index, false when it's neither in
+// the log nor the snapshot's last one.
+// NOTE: callers must hold node.mu
+func (node *raftNode) termAt(index int64) (int64, bool) {
+	if index == node.snapIndex {
+		return node.snapTerm, true
+	}
+	offset := index - node.snapIndex - 1
+	if offset < 0 || offset >= int64(len(node.log)) {
+		return 0, false
+	}
+	return node.log[offset].Term, true
+}
+
+// NOTE: callers must hold node.mu
+func (node *raftNode) saveState() error {
+	return saveJSONFile(filepath.Join(node.dir, "raft-state.json"), map[string]interface{}{
+		"term": node.term, "voted_for": node.votedFor})
+}
+
+func (node *raftNode) loadLog() error {
+	file, err := os.Open(filepath.Join(node.dir, "raft-log.jsonl"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		var entry raftEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// a torn last line from a crash mid write
+			log.Printf("Dropping unreadable raft log entry: %v\n", err)
+			break
+		}
+		if last, _ := node.lastIndexTerm(); entry.Index == last+1 {
+			node.log = append(node.log, entry)
+			node.noteEvents(entry)
+		}
+	}
+	return scanner.Err()
+}
+
+// appendLogFile persists entries just added to the end of the log.
+// NOTE: callers must hold node.mu
+func (node *raftNode) appendLogFile(entries []raftEntry) error {
+	file, err := os.OpenFile(filepath.Join(node.dir, "raft-log.jsonl"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var lines bytes.Buffer
+	for _, entry := range entries {
+		encoded, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		lines.Write(encoded)
+		lines.WriteByte('\n')
+	}
+	if _, err := file.Write(lines.Bytes()); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// rewriteLogFile persists the whole log, after it was truncated or compacted.
+// NOTE: callers must hold node.mu
+func (node *raftNode) rewriteLogFile() error {
+	path := filepath.Join(node.dir, "raft-log.jsonl")
+	tmp, err := ioutil.TempFile(node.dir, ".raft-log-")
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tmp)
+	for _, entry := range node.log {
+		encoded, err := json.Marshal(entry)
+		if err == nil {
+			writer.Write(encoded)
+			err = writer.WriteByte('\n')
+		}
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	tmp.Close()
+	return os.Rename(tmp.Name(), path)
+}
+
+// NOTE: callers must hold node.mu
+func (node *raftNode) noteEvents(entry raftEntry) {
+	for _, event := range entry.Events {
+		if event.ID > node.lastEventID {
+			node.lastEventID = event.ID
+		}
+	}
+}
+
+// restore buffers a snapshot and starts the log after it.
+// NOTE: callers must hold node.mu (or not have started the node yet)
+func (node *raftNode) restore(snapshot raftSnapshot) error {
+	events := make([]*chatEvent, len(snapshot.Events))
+	for i, event := range snapshot.Events {
+		events[i] = event.decode()
+	}
+	if err := node.manager.replicate(events); err != nil {
+		return err
+	}
+	node.snapIndex, node.snapTerm = snapshot.Index, snapshot.Term
+	node.commit, node.applied = snapshot.Index, snapshot.Index
+	node.noteEvents(raftEntry{Events: snapshot.Events})
+	return nil
+}
+
+// snapshot is the buffer as of the last applied entry.
+// NOTE: callers must hold node.mu
+func (node *raftNode) snapshot() (raftSnapshot, error) {
+	term, _ := node.termAt(node.applied)
+	buffered, _ := node.manager.eventsAfter(0, math.MaxInt32)
+	snapshot := raftSnapshot{Index: node.applied, Term: term, Events: make([]encodedEvent, len(buffered))}
+	for i, event := range buffered {
+		encoded, err := encodeEvent(event)
+		if err != nil {
+			return snapshot, err
+		}
+		snapshot.Events[i] = encoded
+	}
+	return snapshot, nil
+}
+
+func encodeEvent(event *chatEvent) (encodedEvent, error) {
+	data, err := json.Marshal(event.Data)
+	return encodedEvent{Timestamp: event.Timestamp, ID: event.ID, Category: event.Category, Data: data}, err
+}
+
+// apply buffers the entries committed since the last call, and compacts
+// the log once it holds more than raftMaxLog applied entries.
+// NOTE: callers must hold node.mu
+func (node *raftNode) apply() {
+	for node.applied < node.commit {
+		entry := node.log[node.applied-node.snapIndex]
+		events := make([]*chatEvent, len(entry.Events))
+		for i, event := range entry.Events {
+			events[i] = event.decode()
+		}
+		if err := node.manager.replicate(events); err != nil {
+			log.Printf("Failed to apply raft entry %d: %v\n", entry.Index, err)
+		}
+		node.applied++
+	}
+	node.progress.Broadcast()
+	if node.applied-node.snapIndex <= raftMaxLog {
+		return
+	}
+	snapshot, err := node.snapshot()
+	if err == nil {
+		err = saveJSONFile(filepath.Join(node.dir, "raft-snapshot.json"), snapshot)
+	}
+	if err != nil {
+		log.Printf("Failed to snapshot the raft log: %v\n", err)
+		return
+	}
+	node.log = append([]raftEntry(nil), node.log[snapshot.Index-node.snapIndex:]...)
+	node.snapIndex, node.snapTerm = snapshot.Index, snapshot.Term
+	if err := node.rewriteLogFile(); err != nil {
+		log.Printf("Failed to compact the raft log: %v\n", err)
+	}
+}
+
+// NOTE: callers must hold node.mu
+func (node *raftNode) majority() int {
+	return (len(node.peers)+1)/2 + 1
+}
+
+// stepDown follows a newer term.
+// NOTE: callers must hold node.mu
+func (node *raftNode) stepDown(term int64) {
+	if term > node.term {
+		node.term, node.votedFor = term, ""
+		if err := node.saveState(); err != nil {
+			log.Printf("Failed to save raft state: %v\n", err)
+		}
+	}
+	if node.state != raftFollower {
+		log.Printf("Raft: following term %d as a follower.\n", node.term)
+	}
+	node.state = raftFollower
+	node.progress.Broadcast()
+}
+
+func (node *raftNode) run() {
+	lastBeat := time.Time{}
+	for range time.Tick(50 * time.Millisecond) {
+		node.mu.Lock()
+		switch {
+		case node.state == raftLeader && time.Since(lastBeat) >= raftHeartbeat:
+			lastBeat = time.Now()
+			for _, peer := range node.peers {
+				node.sendAppend(peer)
+			}
+		case node.state != raftLeader && time.Since(node.heard) >= node.timeout:
+			node.startElection()
+		}
+		node.mu.Unlock()
+	}
+}
+
+// NOTE: callers must hold node.mu
+func (node *raftNode) startElection() {
+	node.state = raftCandidate
+	node.term++
+	node.votedFor = node.id
+	node.leader = ""
+	node.heard = time.Now()
+	node.timeout = node.randomTimeout()
+	if err := node.saveState(); err != nil {
+		log.Printf("Failed to save raft state: %v\n", err)
+		return
+	}
+	term := node.term
+	lastIndex, lastTerm := node.lastIndexTerm()
+	votes := 1
+	for _, peer := range node.peers {
+		go func(peer string) {
+			var reply struct {
+				Term    int64 `json:"term"`
+				Granted bool  `json:"granted"`
+			}
+			err := node.call(peer, "vote", map[string]interface{}{"term": term, "candidate": node.id,
+				"last_index": lastIndex, "last_term": lastTerm}, &reply, 2*time.Second)
+			if err != nil {
+				return
+			}
+			node.mu.Lock()
+			defer node.mu.Unlock()
+			if reply.Term > node.term {
+				node.stepDown(reply.Term)
+				return
+			}
+			if !reply.Granted || node.state != raftCandidate || node.term != term {
+				return
+			}
+			if votes++; votes >= node.majority() {
+				node.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+// NOTE: callers must hold node.mu
+func (node *raftNode) becomeLeader() {
+	log.Printf("Raft: leading term %d.\n", node.term)
+	node.state = raftLeader
+	node.leader = node.id
+	last, _ := node.lastIndexTerm()
+	for _, peer := range node.peers {
+		node.nextIndex[peer] = last + 1
+		node.matchIndex[peer] = 0
+	}
+	// entries from earlier terms only commit along with one from this term
+	if err := node.appendLocal([]raftEntry{{Index: last + 1, Term: node.term}}); err != nil {
+		log.Printf("Failed to append to the raft log: %v\n", err)
+	}
+	for _, peer := range node.peers {
+		node.sendAppend(peer)
+	}
+}
+
+// NOTE: callers must hold node.mu
+func (node *raftNode) appendLocal(entries []raftEntry) error {
+	if err := node.appendLogFile(entries); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		node.log = append(node.log, entry)
+		node.noteEvents(entry)
+	}
+	return nil
+}
+
+// sendAppend sends the peer the entries it's missing (or a heartbeat), or
+// the snapshot when it's missing entries compacted away.  One request per
+// peer is in flight at a time.
+// NOTE: callers must hold node.mu
+func (node *raftNode) sendAppend(peer string) {
+	if node.sending[peer] {
+		return
+	}
+	node.sending[peer] = true
+	term := node.term
+	next := node.nextIndex[peer]
+	if next <= node.snapIndex {
+		snapshot, err := node.snapshot()
+		if err != nil {
+			node.sending[peer] = false
+			log.Printf("Failed to snapshot for %s: %v\n", peer, err)
+			return
+		}
+		go func() {
+			var reply struct {
+				Term int64 `json:"term"`
+			}
+			err := node.call(peer, "snapshot", map[string]interface{}{"term": term, "leader": node.id,
+				"snapshot": snapshot}, &reply, 60*time.Second)
+			node.mu.Lock()
+			defer node.mu.Unlock()
+			node.sending[peer] = false
+			if err != nil {
+				return
+			}
+			if reply.Term > node.term {
+				node.stepDown(reply.Term)
+				return
+			}
+			if node.state == raftLeader && node.term == term && snapshot.Index > node.matchIndex[peer] {
+				node.matchIndex[peer] = snapshot.Index
+				node.nextIndex[peer] = snapshot.Index + 1
+			}
+		}()
+		return
+	}
+	prevIndex := next - 1
+	prevTerm, _ := node.termAt(prevIndex)
+	start := next - node.snapIndex - 1
+	end := start + raftMaxAppend
+	if end > int64(len(node.log)) {
+		end = int64(len(node.log))
+	}
+	entries := append([]raftEntry(nil), node.log[start:end]...)
+	commit := node.commit
+	go func() {
+		var reply struct {
+			Term    int64 `json:"term"`
+			Success bool  `json:"success"`
+			Next    int64 `json:"next"`
+		}
+		err := node.call(peer, "append", map[string]interface{}{"term": term, "leader": node.id,
+			"prev_index": prevIndex, "prev_term": prevTerm, "entries": entries, "commit": commit}, &reply, 5*time.Second)
+		node.mu.Lock()
+		defer node.mu.Unlock()
+		node.sending[peer] = false
+		if err != nil {
+			return
+		}
+		if reply.Term > node.term {
+			node.stepDown(reply.Term)
+			return
+		}
+		if node.state != raftLeader || node.term != term {
+			return
+		}
+		if !reply.Success {
+			// back up to where the peer's log could agree with ours
+			if reply.Next > 0 && reply.Next < node.nextIndex[peer] {
+				node.nextIndex[peer] = reply.Next
+			} else if node.nextIndex[peer] > 1 {
+				node.nextIndex[peer]--
+			}
+			node.sendAppend(peer)
+			return
+		}
+		if match := prevIndex + int64(len(entries)); match > node.matchIndex[peer] {
+			node.matchIndex[peer] = match
+			node.nextIndex[peer] = match + 1
+		}
+		node.advanceCommit()
+		if last, _ := node.lastIndexTerm(); node.nextIndex[peer] <= last {
+			node.sendAppend(peer)
+		}
+	}()
+}
+
+// advanceCommit commits up to the newest entry of this term a majority has.
+// NOTE: callers must hold node.mu
+func (node *raftNode) advanceCommit() {
+	last, _ := node.lastIndexTerm()
+	for index := last; index > node.commit; index-- {
+		if term, _ := node.termAt(index); term != node.term {
+			break
+		}
+		count := 1
+		for _, peer := range node.peers {
+			if node.matchIndex[peer] >= index {
+				count++
+			}
+		}
+		if count >= node.majority() {
+			node.commit = index
+			node.apply()
+			return
+		}
+	}
+}
+
+// call posts a raft request to a peer and decodes its reply.
+func (node *raftNode) call(peer, method string, request, reply interface{}, timeout time.Duration) error {
+	encoded, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", peer+"/raft/"+method, bytes.NewReader(encoded))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+node.token)
+	req.Header.Set("Content-Type", "application/json")
+	client := *node.client
+	client.Timeout = timeout
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s answered %s: %s", peer, resp.Status, strings.TrimSpace(string(message)))
+	}
+	return json.NewDecoder(resp.Body).Decode(reply)
+}
+
+// append is the chatStore's publishLog.  The leader appends the events to
+// the log, a follower hands them to the leader; either way it returns
+// once this server has buffered them.
+func (node *raftNode) append(events []*chatEvent) ([]*chatEvent, error) {
+	node.mu.Lock()
+	leader := node.leader
+	isLeader := node.state == raftLeader
+	node.mu.Unlock()
+	if isLeader {
+		index, err := node.propose(events)
+		if err != nil {
+			return nil, err
+		}
+		return events, node.waitApplied(index)
+	}
+	if len(leader) == 0 {
+		return nil, errNoLeader
+	}
+	encoded := make([]encodedEvent, len(events))
+	for i, event := range events {
+		var err error
+		if encoded[i], err = encodeEvent(event); err != nil {
+			return nil, err
+		}
+	}
+	var reply struct {
+		Index int64   `json:"index"`
+		IDs   []int64 `json:"ids"`
+	}
+	if err := node.call(leader, "propose", map[string]interface{}{"events": encoded}, &reply, 2*raftCommitTimeout); err != nil {
+		return nil, err
+	}
+	if len(reply.IDs) != len(events) {
+		return nil, errors.New("the leader committed a different number of events")
+	}
+	for i, event := range events {
+		event.ID = reply.IDs[i]
+	}
+	// committed already, this server just may not have it yet
+	if err := node.waitApplied(reply.Index); err != nil {
+		log.Printf("Raft: committed entry %d isn't buffered here yet.\n", reply.Index)
+	}
+	return events, nil
+}
+
+// propose appends events to the leader's log with ids and returns the
+// index of their entry once it's committed.
+func (node *raftNode) propose(events []*chatEvent) (int64, error) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if node.state != raftLeader {
+		return 0, errNoLeader
+	}
+	term := node.term
+	last, _ := node.lastIndexTerm()
+	entry := raftEntry{Index: last + 1, Term: term, Events: make([]encodedEvent, len(events))}
+	after := node.lastEventID
+	for i, event := range events {
+		event.ID = node.manager.nextID(after)
+		after = event.ID
+		encoded, err := encodeEvent(event)
+		if err != nil {
+			return 0, err
+		}
+		entry.Events[i] = encoded
+	}
+	if err := node.appendLocal([]raftEntry{entry}); err != nil {
+		return 0, err
+	}
+	for _, peer := range node.peers {
+		node.sendAppend(peer)
+	}
+	deadline := time.AfterFunc(raftCommitTimeout, func() {
+		node.mu.Lock()
+		node.progress.Broadcast()
+		node.mu.Unlock()
+	})
+	defer deadline.Stop()
+	start := time.Now()
+	for node.commit < entry.Index {
+		if node.term != term || node.state != raftLeader {
+			return 0, errNoLeader
+		}
+		if time.Since(start) >= raftCommitTimeout {
+			return 0, errors.New("timed out waiting for the cluster to commit")
+		}
+		node.progress.Wait()
+	}
+	// a newer leader can have replaced it before it committed
+	if got, _ := node.termAt(entry.Index); got != term && entry.Index > node.snapIndex {
+		return 0, errNoLeader
+	}
+	return entry.Index, nil
+}
+
+// waitApplied waits for this server to buffer the entry at index.
+func (node *raftNode) waitApplied(index int64) error {
+	deadline := time.AfterFunc(raftCommitTimeout, func() {
+		node.mu.Lock()
+		node.progress.Broadcast()
+		node.mu.Unlock()
+	})
+	defer deadline.Stop()
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	start := time.Now()
+	for node.applied < index {
+		if time.Since(start) >= raftCommitTimeout {
+			return errors.New("timed out waiting to apply")
+		}
+		node.progress.Wait()
+	}
+	return nil
+}
+
+// check turns posts away while there's no leader to commit them.
+func (node *raftNode) check(r *http.Request, chat *ChatPost) *postRejection {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if len(node.leader) > 0 && (node.state == raftLeader || node.state == raftFollower) {
+		return nil
+	}
+	return &postRejection{Reason: "no_leader", Status: 503, Message: "The chat cluster is electing a leader, try again in a few seconds."}
+}
+
+// getRaftClosure serves the peer requests under /raft/: vote, append,
+// snapshot and propose.
+func getRaftClosure(node *raftNode) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(presentedToken(r)), []byte(node.token)) != 1 {
+			http.Error(w, "Forbidden.", 403)
+			return
+		}
+		body := http.MaxBytesReader(w, r.Body, 256*1024*1024)
+		switch strings.TrimPrefix(r.URL.Path, "/raft/") {
+		case "vote":
+			var request struct {
+				Term      int64  `json:"term"`
+				Candidate string `json:"candidate"`
+				LastIndex int64  `json:"last_index"`
+				LastTerm  int64  `json:"last_term"`
+			}
+			if err := json.NewDecoder(body).Decode(&request); err != nil {
+				http.Error(w, "Invalid vote request.", 400)
+				return
+			}
+			term, granted, err := node.vote(request.Term, request.Candidate, request.LastIndex, request.LastTerm)
+			if err != nil {
+				http.Error(w, "Failed to save raft state.", 500)
+				return
+			}
+			writeJSON(w, 200, map[string]interface{}{"term": term, "granted": granted})
+		case "append":
+			var request struct {
+				Term      int64       `json:"term"`
+				Leader    string      `json:"leader"`
+				PrevIndex int64       `json:"prev_index"`
+				PrevTerm  int64       `json:"prev_term"`
+				Entries   []raftEntry `json:"entries"`
+				Commit    int64       `json:"commit"`
+			}
+			if err := json.NewDecoder(body).Decode(&request); err != nil {
+				http.Error(w, "Invalid append request.", 400)
+				return
+			}
+			term, success, next, err := node.appendEntries(request.Term, request.Leader, request.PrevIndex,
+				request.PrevTerm, request.Entries, request.Commit)
+			if err != nil {
+				http.Error(w, "Failed to save raft log.", 500)
+				return
+			}
+			writeJSON(w, 200, map[string]interface{}{"term": term, "success": success, "next": next})
+		case "snapshot":
+			var request struct {
+				Term     int64        `json:"term"`
+				Leader   string       `json:"leader"`
+				Snapshot raftSnapshot `json:"snapshot"`
+			}
+			if err := json.NewDecoder(body).Decode(&request); err != nil {
+				http.Error(w, "Invalid snapshot request.", 400)
+				return
+			}
+			term, err := node.installSnapshot(request.Term, request.Leader, request.Snapshot)
+			if err != nil {
+				http.Error(w, "Failed to install snapshot.", 500)
+				return
+			}
+			writeJSON(w, 200, map[string]interface{}{"term": term})
+		case "propose":
+			var request struct {
+				Events []encodedEvent `json:"events"`
+			}
+			if err := json.NewDecoder(body).Decode(&request); err != nil {
+				http.Error(w, "Invalid propose request.", 400)
+				return
+			}
+			events := make([]*chatEvent, len(request.Events))
+			for i, event := range request.Events {
+				events[i] = event.decode()
+			}
+			index, err := node.propose(events)
+			if err != nil {
+				http.Error(w, err.Error(), 503)
+				return
+			}
+			ids := make([]int64, len(events))
+			for i, event := range events {
+				ids[i] = event.ID
+			}
+			writeJSON(w, 200, map[string]interface{}{"index": index, "ids": ids})
+		default:
+			http.Error(w, "No such raft request.", 404)
+		}
+	}
+}
+
+func (node *raftNode) vote(term int64, candidate string, lastIndex, lastTerm int64) (int64, bool, error) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if term > node.term {
+		node.stepDown(term)
+	}
+	if term < node.term || (len(node.votedFor) > 0 && node.votedFor != candidate) {
+		return node.term, false, nil
+	}
+	myIndex, myTerm := node.lastIndexTerm()
+	if lastTerm < myTerm || (lastTerm == myTerm && lastIndex < myIndex) {
+		return node.term, false, nil
+	}
+	node.votedFor = candidate
+	if err := node.saveState(); err != nil {
+		return node.term, false, err
+	}
+	node.heard = time.Now()
+	return node.term, true, nil
+}
+
+// follow takes the sender of a current request as leader.
+// NOTE: callers must hold node.mu
+func (node *raftNode) follow(term int64, leader string) {
+	if term > node.term || node.state != raftFollower {
+		node.stepDown(term)
+	}
+	if node.leader != leader {
+		log.Printf("Raft: %s leads term %d.\n", leader, term)
+	}
+	node.leader = leader
+	node.heard = time.Now()
+}
+
+// appendEntries returns the term, whether the entries were appended and,
+// when they weren't, the index the leader should try from next.
+func (node *raftNode) appendEntries(term int64, leader string, prevIndex, prevTerm int64, entries []raftEntry, commit int64) (int64, bool, int64, error) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if term < node.term {
+		return node.term, false, 0, nil
+	}
+	node.follow(term, leader)
+	last, _ := node.lastIndexTerm()
+	if prevIndex > last {
+		return node.term, false, last + 1, nil
+	}
+	if prevIndex >= node.snapIndex {
+		if got, _ := node.termAt(prevIndex); got != prevTerm {
+			// the whole conflicting term is retried from its start
+			next := prevIndex
+			for next > node.snapIndex+1 {
+				if earlier, _ := node.termAt(next - 1); earlier != got {
+					break
+				}
+				next--
+			}
+			return node.term, false, next, nil
+		}
+	}
+	var added []raftEntry
+	truncated := false
+	for _, entry := range entries {
+		if entry.Index <= node.snapIndex {
+			continue
+		}
+		if got, ok := node.termAt(entry.Index); ok {
+			if got == entry.Term {
+				continue
+			}
+			node.log = node.log[:entry.Index-node.snapIndex-1]
+			truncated = true
+		}
+		node.log = append(node.log, entry)
+		node.noteEvents(entry)
+		added = append(added, entry)
+	}
+	var err error
+	if truncated {
+		err = node.rewriteLogFile()
+	} else if len(added) > 0 {
+		err = node.appendLogFile(added)
+	}
+	if err != nil {
+		return node.term, false, 0, err
+	}
+	lastNew := prevIndex + int64(len(entries))
+	if commit > node.commit {
+		if commit > lastNew {
+			commit = lastNew
+		}
+		if commit > node.commit {
+			node.commit = commit
+			node.apply()
+		}
+	}
+	return node.term, true, 0, nil
+}
+
+func (node *raftNode) installSnapshot(term int64, leader string, snapshot raftSnapshot) (int64, error) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if term < node.term {
+		return node.term, nil
+	}
+	node.follow(term, leader)
+	if snapshot.Index <= node.commit {
+		return node.term, nil
+	}
+	if err := saveJSONFile(filepath.Join(node.dir, "raft-snapshot.json"), snapshot); err != nil {
+		return node.term, err
+	}
+	// keep any of the log that goes on from the snapshot
+	if got, ok := node.termAt(snapshot.Index); ok && got == snapshot.Term && snapshot.Index > node.snapIndex {
+		node.log = append([]raftEntry(nil), node.log[snapshot.Index-node.snapIndex:]...)
+	} else {
+		node.log = nil
+	}
+	if err := node.restore(snapshot); err != nil {
+		return node.term, err
+	}
+	node.progress.Broadcast()
+	return node.term, node.rewriteLogFile()
+}
+
+// getClusterClosure serves GET /admin/cluster, this server's view of the
+// cluster.
+func getClusterClosure(node *raftNode) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		node.mu.Lock()
+		defer node.mu.Unlock()
+		last, _ := node.lastIndexTerm()
+		peers := make(map[string]int64)
+		if node.state == raftLeader {
+			for _, peer := range node.peers {
+				peers[peer] = node.matchIndex[peer]
+			}
+		}
+		writeJSON(w, 200, map[string]interface{}{
+			"id":         node.id,
+			"state":      node.state,
+			"term":       node.term,
+			"leader":     node.leader,
+			"last_index": last,
+			"commit":     node.commit,
+			"applied":    node.applied,
+			"snapshot":   node.snapIndex,
+			"peer_match": peers,
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// readMarkers remembers, per session, the timestamp of the newest chat
+// seen in each topic so topic boards can show unread counts.  Markers are
+// only kept as long as chats are, since there's nothing left to count once
+// a topic's chats have expired.
+type readMarkers struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	sessions map[string]*sessionMarkers
+}
+
+type sessionMarkers struct {
+	topics   map[string]int64
+	lastSeen time.Time
+}
+
+const maxReadMarkersPerSession = 500
+
+func newReadMarkers(ttl time.Duration) *readMarkers {
+	markers := &readMarkers{ttl: ttl, sessions: make(map[string]*sessionMarkers)}
+	go markers.cleanup()
+	return markers
+}
+
+func (markers *readMarkers) mark(session, topic string, timestamp int64) {
+	markers.mu.Lock()
+	defer markers.mu.Unlock()
+	sm, found := markers.sessions[session]
+	if !found {
+		sm = &sessionMarkers{topics: make(map[string]int64)}
+		markers.sessions[session] = sm
+	}
+	sm.lastSeen = time.Now()
+	if _, found := sm.topics[topic]; !found && len(sm.topics) >= maxReadMarkersPerSession {
+		return
+	}
+	if timestamp > sm.topics[topic] {
+		sm.topics[topic] = timestamp
+	}
+}
+
+// get returns a copy of the session's markers.
+func (markers *readMarkers) get(session string) map[string]int64 {
+	markers.mu.Lock()
+	defer markers.mu.Unlock()
+	topics := make(map[string]int64)
+	if sm, found := markers.sessions[session]; found {
+		sm.lastSeen = time.Now()
+		for topic, timestamp := range sm.topics {
+			topics[topic] = timestamp
+		}
+	}
+	return topics
+}
+
+func (markers *readMarkers) cleanup() {
+	for range time.Tick(time.Minute) {
+		markers.mu.Lock()
+		for session, sm := range markers.sessions {
+			if time.Since(sm.lastSeen) >= markers.ttl {
+				delete(markers.sessions, session)
+			}
+		}
+		markers.mu.Unlock()
+	}
+}
+
+// getReadMarkerClosure serves POST /api/v1/read with topic and timestamp
+// (of the newest chat shown) form values.
+func getReadMarkerClosure(markers *readMarkers) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		topic := r.PostFormValue("topic")
+		timestamp, err := strconv.ParseInt(r.PostFormValue("timestamp"), 10, 64)
+		if len(topic) == 0 || topic == ALL_CHATS || err != nil || timestamp < 0 {
+			writeJSON(w, 400, map[string]string{"error": "Invalid topic or timestamp arg."})
+			return
+		}
+		markers.mark(ensureSession(w, r), topic, timestamp)
+		writeJSON(w, 200, map[string]string{"status": "ok"})
+	}
+}
+
+// getUnreadClosure serves GET /api/v1/unread?topics=a,b with how many
+// buffered chats in each topic are newer than the session's read marker:
+//
+//	{"unread": {"a": 3, "b": 0}}
+//
+// Topics never read are left out, as are all topics when the session has
+// no markers at all, and topics the session was removed from reading.
+// Without a topics arg every marked topic is counted.
+func getUnreadClosure(markers *readMarkers, manager *chatStore, bans *topicBans) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		unread := make(map[string]int)
+		session := sessionID(r)
+		if len(session) > 0 {
+			read := markers.get(session)
+			hidden := bans.unreadable(r)
+			topics := splitCommaList(r.URL.Query().Get("topics"))
+			if len(topics) == 0 {
+				for topic := range read {
+					topics = append(topics, topic)
+				}
+			}
+			for _, topic := range topics {
+				topic = strings.TrimSpace(topic)
+				if since, found := read[topic]; found && !hidden[topic] {
+					unread[topic] = manager.countSince(topic, since)
+				}
+			}
+		}
+		writeJSON(w, 200, map[string]map[string]int{"unread": unread})
+	}
+}
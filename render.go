@@ -0,0 +1,147 @@
+package main
+
+import (
+	"html"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// chatRenderer turns raw user input into the sanitized html that gets
+// published.  Everything that changes how a chat looks hooks in here so all
+// the ways of posting render the same.
+type chatRenderer struct {
+	limits     inputLimits
+	profanity  *profanityFilter // only set when masking
+	camo       *camoProxy       // only set when proxying images
+	unfurler   *linkUnfurler    // only set when previewing links
+	translator *chatTranslator  // only set when translating chats
+	embeds     *richEmbeds      // only set when embedding players and maps
+	// skip markdown, everywhere or in just these topics
+	plain       bool
+	plainTopics map[string]bool
+	// what moderators changed for single topics
+	topics *topicRenderRules
+}
+
+// isPlain is true when topic's chats are rendered as plain text.
+func (renderer *chatRenderer) isPlain(topic string) bool {
+	return renderer.plain || renderer.plainTopics[topic] || renderer.topics.get(topic).PlainText
+}
+
+func (renderer *chatRenderer) renderName(displayName string) string {
+	displayName = truncateInput(displayName, int(renderer.limits.NameLen))
+	if renderer.profanity != nil {
+		displayName = renderer.profanity.mask(displayName, "*")
+	}
+	return sanitizeInput(displayName)
+}
+
+// renderMessage renders a chat's markdown, or its plain text in topics
+// that skip markdown, following the topic's render rules.
+func (renderer *chatRenderer) renderMessage(topic, message string) string {
+	rules := renderer.topics.get(topic)
+	message = truncateInput(message, int(renderer.limits.MessageLen))
+	if renderer.isPlain(topic) {
+		if renderer.profanity != nil {
+			message = renderer.profanity.mask(message, "*")
+		}
+		return sanitizeInput(renderPlainText(message))
+	}
+	if renderer.profanity != nil {
+		// escaped so the stars don't turn into markdown emphasis
+		message = renderer.profanity.mask(message, `\*`)
+	}
+	if rendered := renderSpoilers(toMarkdown(message)); renderer.embeds != nil && !rules.NoEmbeds {
+		message = renderer.embeds.sanitize(renderer.embeds.render(rendered))
+	} else {
+		message = sanitizeInput(rendered)
+	}
+	if rules.NoImages {
+		message = linkImages(message)
+	}
+	message = renderVoiceNotes(message)
+	if renderer.camo != nil {
+		message = renderer.camo.rewrite(message)
+	}
+	return message
+}
+
+var plainLinkRegex = regexp.MustCompile(`\bhttps?://[^\s<>"']*[^\s<>"'.,;:!?)\]]`)
+
+// renderPlainText escapes the message, keeping its line breaks and linking
+// its urls, and nothing else.
+func renderPlainText(message string) string {
+	var paragraphs []string
+	for _, paragraph := range strings.Split(strings.TrimSpace(strings.Replace(message, "\r\n", "\n", -1)), "\n\n") {
+		var out strings.Builder
+		last := 0
+		for _, link := range plainLinkRegex.FindAllStringIndex(paragraph, -1) {
+			out.WriteString(html.EscapeString(paragraph[last:link[0]]))
+			url := html.EscapeString(paragraph[link[0]:link[1]])
+			out.WriteString(`<a href="` + url + `">` + url + `</a>`)
+			last = link[1]
+		}
+		out.WriteString(html.EscapeString(paragraph[last:]))
+		paragraphs = append(paragraphs, "<p>"+strings.Replace(out.String(), "\n", "<br>\n", -1)+"</p>")
+	}
+	return strings.Join(paragraphs, "\n") + "\n"
+}
+
+// renderPreview returns the card for the first link in the raw message, if
+// link previews are on and the link has anything worth showing.
+func (renderer *chatRenderer) renderPreview(message string) *linkPreview {
+	if renderer.unfurler == nil {
+		return nil
+	}
+	return renderer.unfurler.unfurl(message)
+}
+
+// renderTranslations returns the raw message rendered in each language the
+// translator was set up with, nil when translation is off.
+func (renderer *chatRenderer) renderTranslations(topic, message string) map[string]string {
+	if renderer.translator == nil {
+		return nil
+	}
+	var rendered map[string]string
+	for lang, text := range renderer.translator.translate(message) {
+		if rendered == nil {
+			rendered = make(map[string]string)
+		}
+		rendered[lang] = renderer.renderMessage(topic, text)
+	}
+	return rendered
+}
+
+// getPreviewClosure serves POST /preview so the composer can show what a
+// message will look like, using the very same rendering as /post:
+//
+//	{"message": "<p>rendered html</p>", "action": false}
+//
+// Bad slash commands come back as an "error" rather than failing.
+func getPreviewClosure(renderer *chatRenderer) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		// same slack as the longest message could need once form encoded
+		r.Body = http.MaxBytesReader(w, r.Body, int64(renderer.limits.MessageLen)*12+1024)
+		if err := r.ParseForm(); err != nil {
+			writeJSON(w, 400, map[string]string{"error": "Invalid form data."})
+			return
+		}
+		message := r.PostFormValue("message")
+		if len(strings.TrimSpace(message)) == 0 {
+			writeJSON(w, 200, map[string]interface{}{"message": ""})
+			return
+		}
+		var chat ChatPost
+		message, err := renderer.applySlashCommand(message, &chat)
+		if err != nil {
+			writeJSON(w, 200, map[string]interface{}{"message": "", "error": err.Error()})
+			return
+		}
+		writeJSON(w, 200, map[string]interface{}{"message": renderer.renderMessage(r.PostFormValue("topic"), message), "action": chat.Action})
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// most events a single /admin/replication response carries
+	maxReplicationBatch = 1000
+	// longest a replication poll waits for new events
+	maxReplicationWaitSec = 60
+)
+
+// getReplicationClosure serves GET /admin/replication?after_id=N[&timeout=S],
+// the buffered events of every topic (encrypted rooms too) after event id N,
+// oldest first.  With timeout it waits up to S seconds for an event when
+// there are none yet.  A standby starts from after_id=0 to get a snapshot
+// of the whole buffer, then follows on from the last_id it was sent.
+func getReplicationClosure(manager *chatStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		var afterID int64
+		if afterString := r.URL.Query().Get("after_id"); len(afterString) > 0 {
+			parsed, err := strconv.ParseInt(afterString, 10, 64)
+			if err != nil || parsed < 0 {
+				writeJSON(w, 400, map[string]string{"error": "Invalid after_id arg."})
+				return
+			}
+			afterID = parsed
+		}
+		wait := 0
+		if timeoutString := r.URL.Query().Get("timeout"); len(timeoutString) > 0 {
+			parsed, err := strconv.Atoi(timeoutString)
+			if err != nil || parsed < 0 || parsed > maxReplicationWaitSec {
+				writeJSON(w, 400, map[string]string{"error": "Invalid timeout arg, must be 0-" + strconv.Itoa(maxReplicationWaitSec) + "."})
+				return
+			}
+			wait = parsed
+		}
+		deadline := time.NewTimer(time.Duration(wait) * time.Second)
+		defer deadline.Stop()
+		for {
+			events, notify := manager.eventsAfter(afterID, maxReplicationBatch)
+			if len(events) > 0 || wait == 0 {
+				lastID := afterID
+				if len(events) > 0 {
+					lastID = events[len(events)-1].ID
+				}
+				if events == nil {
+					events = []*chatEvent{}
+				}
+				writeJSON(w, 200, map[string]interface{}{"events": events, "last_id": lastID,
+					"more": len(events) == maxReplicationBatch})
+				return
+			}
+			select {
+			case <-notify:
+			case <-deadline.C:
+				writeJSON(w, 200, map[string]interface{}{"events": []*chatEvent{}, "last_id": afterID, "more": false})
+				return
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
+
+// standbyReplica keeps a warm copy of a primary's buffer by following its
+// /admin/replication feed, so failing over to it loses at most the last
+// poll's worth of chat.  It turns posting away until it's promoted, by an
+// admin or after the primary has been unreachable for promoteAfter.
+type standbyReplica struct {
+	manager      *chatStore
+	primary      string // base url
+	token        string // admin token on the primary
+	client       *http.Client
+	promoteAfter time.Duration // 0 for only promoting by hand
+	readOnly     bool          // a read replica, never promoted
+
+	mu         sync.Mutex
+	promoted   bool
+	lastID     int64
+	lastSyncMs int64
+	replicated uint64
+	failures   uint64
+	lastError  string
+	since      time.Time // last successful poll, or start
+}
+
+func newStandbyReplica(manager *chatStore, primary, token string, promoteAfter time.Duration) (*standbyReplica, error) {
+	return followPrimary(manager, primary, token, promoteAfter, false)
+}
+
+// newReadReplica follows a primary like a standby that's never promoted,
+// to take its /subscribe traffic off it.
+func newReadReplica(manager *chatStore, primary, token string) (*standbyReplica, error) {
+	return followPrimary(manager, primary, token, 0, true)
+}
+
+func followPrimary(manager *chatStore, primary, token string, promoteAfter time.Duration, readOnly bool) (*standbyReplica, error) {
+	parsed, err := url.Parse(primary)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || len(parsed.Host) == 0 {
+		return nil, errors.New("expected the primary's http(s) base url")
+	}
+	standby := &standbyReplica{manager: manager, primary: strings.TrimSuffix(primary, "/"), token: token,
+		// longer than the poll's own wait
+		client: &http.Client{Timeout: 40 * time.Second}, promoteAfter: promoteAfter, readOnly: readOnly, since: time.Now()}
+	go standby.follow()
+	return standby, nil
+}
+
+// encodedEvent is a chatEvent as another server sent it.
+type encodedEvent struct {
+	Timestamp int64           `json:"timestamp"`
+	ID        int64           `json:"id"`
+	Category  string          `json:"category"`
+	Data      json.RawMessage `json:"data"`
+}
+
+func (event encodedEvent) decode() *chatEvent {
+	return &chatEvent{Timestamp: event.Timestamp, ID: event.ID, Category: event.Category, Data: decodeEventData(event.Data)}
+}
+
+// getPrimaryRedirectClosure sends everything a read replica doesn't serve
+// to the primary, keeping the method so posts still work.
+func getPrimaryRedirectClosure(primary string) func(w http.ResponseWriter, r *http.Request) {
+	primary = strings.TrimSuffix(primary, "/")
+	return func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, primary+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	}
+}
+
+// replicationResponse is an /admin/replication body as the standby sees it.
+type replicationResponse struct {
+	Events []encodedEvent `json:"events"`
+	LastID int64          `json:"last_id"`
+	More   bool           `json:"more"`
+}
+
+// decodeEventData turns replicated event data back into what the primary
+// published, chats, tombstones, flags and likes.
+func decodeEventData(raw json.RawMessage) interface{} {
+	var tombstone chatTombstone
+	if json.Unmarshal(raw, &tombstone) == nil && len(tombstone.Tombstone) > 0 {
+		return tombstone
+	}
+	var flag chatFlag
+	if json.Unmarshal(raw, &flag) == nil && len(flag.Flagged) > 0 {
+		return flag
+	}
+	var like chatLike
+	if json.Unmarshal(raw, &like) == nil && len(like.Liked) > 0 {
+		return like
+	}
+	var chat ChatPost
+	if json.Unmarshal(raw, &chat) == nil {
+		return chat
+	}
+	return raw
+}
+
+func (standby *standbyReplica) isPromoted() bool {
+	standby.mu.Lock()
+	defer standby.mu.Unlock()
+	return standby.promoted
+}
+
+// promote stops following the primary and starts taking posts.
+func (standby *standbyReplica) promote(why string) {
+	standby.mu.Lock()
+	defer standby.mu.Unlock()
+	if !standby.promoted {
+		standby.promoted = true
+		log.Printf("Promoted from standby of %s (%s), taking posts from now on.\n", standby.primary, why)
+	}
+}
+
+func (standby *standbyReplica) follow() {
+	backoff := time.Second
+	for !standby.isPromoted() {
+		err := standby.poll()
+		standby.mu.Lock()
+		if err != nil {
+			standby.failures++
+			standby.lastError = err.Error()
+			down := time.Since(standby.since)
+			standby.mu.Unlock()
+			log.Printf("Failed to replicate from %s: %v\n", standby.primary, err)
+			if standby.promoteAfter > 0 && down >= standby.promoteAfter {
+				standby.promote("primary unreachable for " + down.Round(time.Second).String())
+				return
+			}
+			sleep := backoff
+			if left := standby.promoteAfter - down; standby.promoteAfter > 0 && left < sleep {
+				sleep = left
+			}
+			time.Sleep(sleep)
+			if backoff < 5*time.Second {
+				backoff *= 2
+			}
+			continue
+		}
+		standby.since = time.Now()
+		standby.lastError = ""
+		standby.mu.Unlock()
+		backoff = time.Second
+	}
+}
+
+// poll fetches and buffers the next batch of the primary's events.
+func (standby *standbyReplica) poll() error {
+	standby.mu.Lock()
+	afterID := standby.lastID
+	standby.mu.Unlock()
+	// short waits so a promoteAfter of a few seconds works
+	wait := 25
+	if standby.promoteAfter > 0 && standby.promoteAfter < 50*time.Second {
+		wait = int(standby.promoteAfter/time.Second) / 2
+		if wait < 1 {
+			wait = 1
+		}
+	}
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/admin/replication?after_id=%d&timeout=%d", standby.primary, afterID, wait), nil)
+	if err != nil {
+		return err
+	}
+	if len(standby.token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+standby.token)
+	}
+	resp, err := standby.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("primary answered %s", resp.Status)
+	}
+	var batch replicationResponse
+	if err := json.NewDecoder(resp.Body).Decode(&batch); err != nil {
+		return err
+	}
+	events := make([]*chatEvent, len(batch.Events))
+	for i, event := range batch.Events {
+		events[i] = event.decode()
+	}
+	if err := standby.manager.replicate(events); err != nil {
+		return err
+	}
+	standby.mu.Lock()
+	if batch.LastID > standby.lastID {
+		standby.lastID = batch.LastID
+	}
+	standby.replicated += uint64(len(events))
+	standby.lastSyncMs = timeToEpochMilliseconds(time.Now())
+	standby.mu.Unlock()
+	return nil
+}
+
+// check turns posts away until the standby is promoted.
+func (standby *standbyReplica) check(r *http.Request, chat *ChatPost) *postRejection {
+	if standby.isPromoted() {
+		return nil
+	}
+	return &postRejection{Reason: "standby", Status: 503,
+		Message: "This is a standby server, post to the primary."}
+}
+
+// getStandbyClosure serves /admin/standby, GET for how far behind the
+// primary the standby is and POST action=promote to fail over to it.  Read
+// replicas serve the GET as /admin/replica.
+func getStandbyClosure(standby *standbyReplica) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+		case "POST":
+			if standby.readOnly {
+				http.Error(w, "Read replicas can't be promoted.", 405)
+				return
+			}
+			if r.PostFormValue("action") != "promote" {
+				writeJSON(w, 400, map[string]string{"error": "Invalid action arg, must be promote."})
+				return
+			}
+			standby.promote("promoted by an admin")
+		default:
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		standby.mu.Lock()
+		defer standby.mu.Unlock()
+		writeJSON(w, 200, map[string]interface{}{
+			"primary":      standby.primary,
+			"promoted":     standby.promoted,
+			"last_id":      standby.lastID,
+			"last_sync_ms": standby.lastSyncMs,
+			"replicated":   standby.replicated,
+			"failures":     standby.failures,
+			"last_error":   standby.lastError,
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// nameReservations keeps a display name to one session per topic while
+// that session is active there, so nobody can pick up someone's name
+// mid-conversation.  Names are compared rendered and case insensitively.
+type nameReservations struct {
+	mu     sync.Mutex
+	active time.Duration
+	topics map[string]map[string]*reservation // topic -> name -> holder
+}
+
+type reservation struct {
+	session  string
+	lastSeen time.Time
+}
+
+func newNameReservations(active time.Duration) *nameReservations {
+	reservations := &nameReservations{active: active, topics: make(map[string]map[string]*reservation)}
+	go reservations.cleanup()
+	return reservations
+}
+
+// nameClaim is a name to reserve in a topic.
+type nameClaim struct {
+	topic, name string
+}
+
+// claim reserves each name in its topic for session, or refreshes their
+// reservations.  When a different, still active, session holds one of them
+// nothing is reserved and it returns that one's index, otherwise -1.  Safe
+// to call on a nil *nameReservations, which reserves nothing.
+func (reservations *nameReservations) claim(claims []nameClaim, session string) int {
+	if reservations == nil {
+		return -1
+	}
+	now := time.Now()
+	reservations.mu.Lock()
+	defer reservations.mu.Unlock()
+	for i, claim := range claims {
+		held, found := reservations.topics[claim.topic][strings.ToLower(claim.name)]
+		if found && held.session != session && now.Sub(held.lastSeen) < reservations.active {
+			return i
+		}
+	}
+	for _, claim := range claims {
+		names, found := reservations.topics[claim.topic]
+		if !found {
+			names = make(map[string]*reservation)
+			reservations.topics[claim.topic] = names
+		}
+		names[strings.ToLower(claim.name)] = &reservation{session: session, lastSeen: now}
+	}
+	return -1
+}
+
+// cleanup drops reservations that are no longer active.
+func (reservations *nameReservations) cleanup() {
+	for range time.Tick(time.Minute) {
+		cutoff := time.Now().Add(-reservations.active)
+		reservations.mu.Lock()
+		for topic, names := range reservations.topics {
+			for name, held := range names {
+				if held.lastSeen.Before(cutoff) {
+					delete(names, name)
+				}
+			}
+			if len(names) == 0 {
+				delete(reservations.topics, topic)
+			}
+		}
+		reservations.mu.Unlock()
+	}
+}
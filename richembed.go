@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/microcosm-cc/bluemonday"
+)
+
+// embedProvider turns links to one site into the site's own embeddable
+// player or map, framed in a sandbox.
+type embedProvider struct {
+	title string // for the frame, read out by screen readers
+	link  *regexp.Regexp
+	// src is the frame's url for a link match, blank to leave the link be
+	src func(match []string) string
+	// every src it makes, for the sanitizer
+	srcPattern string
+}
+
+var embedProviders = map[string]*embedProvider{
+	"youtube": {
+		title: "YouTube video",
+		link:  regexp.MustCompile(`^https?://(?:www\.|m\.)?(?:youtube\.com/(?:watch\?(?:[^#]*&)?v=|shorts/|embed/)|youtu\.be/)([A-Za-z0-9_-]{11})`),
+		src: func(match []string) string {
+			return "https://www.youtube-nocookie.com/embed/" + match[1]
+		},
+		srcPattern: `https://www\.youtube-nocookie\.com/embed/[A-Za-z0-9_-]{11}`,
+	},
+	"vimeo": {
+		title: "Vimeo video",
+		link:  regexp.MustCompile(`^https?://(?:www\.)?vimeo\.com/(\d{1,12})(?:[/?#]|$)`),
+		src: func(match []string) string {
+			return "https://player.vimeo.com/video/" + match[1]
+		},
+		srcPattern: `https://player\.vimeo\.com/video/\d{1,12}`,
+	},
+	"openstreetmap": {
+		title: "OpenStreetMap map",
+		link:  regexp.MustCompile(`^https?://(?:www\.)?openstreetmap\.org/[^#]*#map=(\d{1,2})/(-?\d{1,2}(?:\.\d+)?)/(-?\d{1,3}(?:\.\d+)?)$`),
+		src:   openStreetMapSrc,
+		// the embed page only takes a bbox and marker
+		srcPattern: `https://www\.openstreetmap\.org/export/embed\.html\?bbox=[-0-9.,]+&layer=mapnik&marker=[-0-9.,]+`,
+	},
+}
+
+// openStreetMapSrc frames about what the map link shows, a #map=zoom/lat/lon.
+func openStreetMapSrc(match []string) string {
+	zoom, _ := strconv.Atoi(match[1])
+	lat, _ := strconv.ParseFloat(match[2], 64)
+	lon, _ := strconv.ParseFloat(match[3], 64)
+	if zoom < 1 || zoom > 19 || math.Abs(lat) > 85 || math.Abs(lon) > 180 {
+		return ""
+	}
+	// a frame is roughly 600x340 pixels of 256 pixel tiles
+	span := 360 / math.Pow(2, float64(zoom)) * 600 / 256
+	return fmt.Sprintf("https://www.openstreetmap.org/export/embed.html?bbox=%.5f,%.5f,%.5f,%.5f&layer=mapnik&marker=%.5f,%.5f",
+		lon-span/2, lat-span/4, lon+span/2, lat+span/4, lat, lon)
+}
+
+func embedProviderNames() string {
+	var names []string
+	for name := range embedProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// richEmbeds adds an embed after each link (up to maxRichEmbeds per chat)
+// to one of the providers the operator allowed with -richEmbeds.  Framed
+// pages get a sandbox that lets them play but not navigate the chat page,
+// and the sanitizer only lets through frames of those providers' embeds.
+type richEmbeds struct {
+	providers []*embedProvider
+	policy    *bluemonday.Policy
+}
+
+const maxRichEmbeds = 3
+
+// links in rendered markdown, and bare urls outside any tag
+var embedLinkRegex = regexp.MustCompile(`<a href="([^"]+)"[^>]*>.*?</a>|<[^>]*>|https?://[^\s<>"]+`)
+
+func newRichEmbeds(names []string) (*richEmbeds, error) {
+	embeds := &richEmbeds{}
+	var patterns []string
+	for _, name := range names {
+		provider, found := embedProviders[strings.ToLower(name)]
+		if !found {
+			return nil, fmt.Errorf("unknown embed %q, expected some of %s", name, embedProviderNames())
+		}
+		embeds.providers = append(embeds.providers, provider)
+		patterns = append(patterns, provider.srcPattern)
+	}
+	policy := newChatPolicy()
+	policy.AllowElements("iframe")
+	policy.AllowAttrs("src").Matching(regexp.MustCompile(`^(?:` + strings.Join(patterns, "|") + `)$`)).OnElements("iframe")
+	policy.AllowAttrs("class").Matching(regexp.MustCompile(`^rich-embed$`)).OnElements("iframe")
+	policy.AllowAttrs("title").OnElements("iframe")
+	policy.AllowAttrs("loading").Matching(regexp.MustCompile(`^lazy$`)).OnElements("iframe")
+	policy.AllowAttrs("allowfullscreen").OnElements("iframe")
+	policy.AllowAttrs("referrerpolicy").Matching(regexp.MustCompile(`^strict-origin-when-cross-origin$`)).OnElements("iframe")
+	// frames typed in as html without a sandbox get an empty, strictest one
+	policy.AllowAttrs("sandbox").OnElements("iframe")
+	policy.RequireSandboxOnIFrame(bluemonday.SandboxAllowScripts, bluemonday.SandboxAllowSameOrigin,
+		bluemonday.SandboxAllowPopups, bluemonday.SandboxAllowPresentation)
+	embeds.policy = policy
+	return embeds, nil
+}
+
+// render adds embeds to blackfriday's html, before it's sanitized.  Code is
+// left alone.
+func (embeds *richEmbeds) render(rendered string) string {
+	count := 0
+	embed := func(link string) string {
+		if count >= maxRichEmbeds {
+			return ""
+		}
+		link = html.UnescapeString(link)
+		for _, provider := range embeds.providers {
+			if match := provider.link.FindStringSubmatch(link); match != nil {
+				if src := provider.src(match); len(src) > 0 {
+					count++
+					return `<iframe class="rich-embed" src="` + html.EscapeString(src) + `" title="` + provider.title +
+						`" loading="lazy" allowfullscreen referrerpolicy="strict-origin-when-cross-origin"` +
+						` sandbox="allow-scripts allow-same-origin allow-popups allow-presentation"></iframe>`
+				}
+			}
+		}
+		return ""
+	}
+	replace := func(part string) string {
+		return embedLinkRegex.ReplaceAllStringFunc(part, func(found string) string {
+			if strings.HasPrefix(found, "<a ") {
+				return found + embed(embedLinkRegex.FindStringSubmatch(found)[1])
+			}
+			if strings.HasPrefix(found, "<") {
+				return found
+			}
+			return found + embed(found)
+		})
+	}
+	var out strings.Builder
+	last := 0
+	for _, code := range htmlCodeRegex.FindAllStringIndex(rendered, -1) {
+		out.WriteString(replace(rendered[last:code[0]]))
+		out.WriteString(rendered[code[0]:code[1]])
+		last = code[1]
+	}
+	out.WriteString(replace(rendered[last:]))
+	return out.String()
+}
+
+func (embeds *richEmbeds) sanitize(rendered string) string {
+	return embeds.policy.Sanitize(rendered)
+}
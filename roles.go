@@ -0,0 +1,298 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Roles, each allowed everything the ones before it are.
+type role int
+
+const (
+	roleNone role = iota
+	// sees the admin dashboard and lists, changes nothing
+	roleReadOnly
+	// bots and announcers, may post to announcement topics and schedule chats
+	rolePoster
+	// acts on held chats and scheduled posts
+	roleModerator
+	// everything, including managing accounts
+	roleAdmin
+)
+
+var roleNames = map[role]string{
+	roleReadOnly:  "read-only",
+	rolePoster:    "poster",
+	roleModerator: "moderator",
+	roleAdmin:     "admin",
+}
+
+func (r role) String() string {
+	return roleNames[r]
+}
+
+func parseRole(name string) (role, bool) {
+	for r, roleName := range roleNames {
+		if roleName == name {
+			return r, true
+		}
+	}
+	return roleNone, false
+}
+
+// account is a named token with a role.  Only the token's hash is kept.
+type account struct {
+	Name        string `json:"name"`
+	Role        string `json:"role"`
+	Token       string `json:"token,omitempty"` // only read from hand written files
+	TokenSHA256 string `json:"token_sha256,omitempty"`
+}
+
+// accessControl decides what role, if any, a request has.  The -adminToken
+// is always admin (loopback is read-only when it's blank) and -botTokens are
+// posters; accounts from the -usersFile, or added through /admin/users, can
+// be any role.
+type accessControl struct {
+	AdminToken string
+	Bots       *apiTokens
+	mu         sync.Mutex
+	path       string // where accounts are saved, blank to keep them in memory
+	accounts   map[string]*account
+}
+
+func newAccessControl(adminToken string, bots *apiTokens, path string) (*accessControl, error) {
+	access := &accessControl{AdminToken: adminToken, Bots: bots, path: path, accounts: make(map[string]*account)}
+	if len(path) == 0 {
+		return access, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return access, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Users []*account `json:"users"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	for _, user := range file.Users {
+		if _, ok := parseRole(user.Role); !ok || len(user.Name) == 0 {
+			return nil, fmt.Errorf("user %q needs a name and a role of read-only, poster, moderator or admin", user.Name)
+		}
+		if len(user.Token) > 0 {
+			if len(user.Token) < 16 {
+				return nil, fmt.Errorf("user %q token must be at least 16 characters long", user.Name)
+			}
+			user.TokenSHA256, user.Token = hashToken(user.Token), ""
+		}
+		if len(user.TokenSHA256) != sha256.Size*2 {
+			return nil, fmt.Errorf("user %q needs a token or token_sha256", user.Name)
+		}
+		access.accounts[user.Name] = user
+	}
+	return access, nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// presentedToken is the request's bearer token, or its admin_token param.
+func presentedToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimPrefix(header, "Bearer ")
+	}
+	return r.URL.Query().Get("admin_token")
+}
+
+// identify returns who the request is authenticated as and their role.
+func (access *accessControl) identify(r *http.Request) (string, role) {
+	if token := presentedToken(r); len(token) > 0 {
+		hashed := hashToken(token)
+		access.mu.Lock()
+		for _, user := range access.accounts {
+			if subtle.ConstantTimeCompare([]byte(user.TokenSHA256), []byte(hashed)) == 1 {
+				userRole, _ := parseRole(user.Role)
+				access.mu.Unlock()
+				return user.Name, userRole
+			}
+		}
+		access.mu.Unlock()
+		if name, tokenRole, found := access.Bots.lookup(token); found {
+			return name, tokenRole
+		}
+	}
+	if isAdminRequest(access.AdminToken, r) {
+		return "admin", roleAdmin
+	}
+	if len(access.AdminToken) == 0 && isLocalRequest(r) {
+		return "", roleReadOnly
+	}
+	return "", roleNone
+}
+
+func (access *accessControl) allows(r *http.Request, min role) bool {
+	_, has := access.identify(r)
+	return has >= min
+}
+
+// scoped is false for requests made with an api token that wasn't given
+// scope.  Accounts and the admin token aren't limited by scopes.
+func (access *accessControl) scoped(r *http.Request, scope string) bool {
+	return access.Bots.scoped(r, scope)
+}
+
+// requireScope is require that also needs api tokens to have scope.
+func (access *accessControl) requireScope(scope string, min role, handler func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return access.require(min, func(w http.ResponseWriter, r *http.Request) {
+		if !access.scoped(r, scope) {
+			http.Error(w, "Forbidden, token doesn't have the "+scope+" scope.", 403)
+			return
+		}
+		handler(w, r)
+	})
+}
+
+// require guards handlers that need at least the given role.  Changes
+// have to come from this site's pages, or from tools that don't say where
+// they're from.
+func (access *accessControl) require(min role, handler func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !access.allows(r, min) {
+			http.Error(w, "Forbidden.", 403)
+			return
+		}
+		if r.Method != "GET" && r.Method != "HEAD" && !isSameSite(r) {
+			http.Error(w, "Forbidden, cross-site request.", 403)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// save writes the accounts out, with only token hashes, when there's a
+// usersFile.
+// NOTE: callers must hold access.mu
+func (access *accessControl) save() error {
+	if len(access.path) == 0 {
+		return nil
+	}
+	var file struct {
+		Users []*account `json:"users"`
+	}
+	for _, user := range access.accounts {
+		file.Users = append(file.Users, user)
+	}
+	sort.Slice(file.Users, func(i, j int) bool { return file.Users[i].Name < file.Users[j].Name })
+	return saveJSONFile(access.path, file)
+}
+
+// saveJSONFile writes data to path as indented json, through a temp file
+// so a crash never leaves it half written.
+func saveJSONFile(path string, data interface{}) error {
+	encoded, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+	return replaceFile(path, encoded)
+}
+
+// replaceFile writes a new version of the file so readers only ever see
+// the old one or all of the new one.
+func replaceFile(path string, encoded []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+"-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(encoded); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	// so a crash can't leave a renamed but empty file
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	tmp.Close()
+	return os.Rename(tmp.Name(), path)
+}
+
+// getUsersClosure serves /admin/users:
+//
+//	GET lists accounts (names and roles)
+//	POST name, role[, new_token=yes] adds or updates an account, the
+//	response has the token for new accounts (and when asked for a new one)
+//	POST name, delete=yes removes one
+func getUsersClosure(access *accessControl) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			access.mu.Lock()
+			users := []map[string]string{}
+			for _, user := range access.accounts {
+				users = append(users, map[string]string{"name": user.Name, "role": user.Role})
+			}
+			access.mu.Unlock()
+			sort.Slice(users, func(i, j int) bool { return users[i]["name"] < users[j]["name"] })
+			writeJSON(w, 200, map[string]interface{}{"users": users})
+		case "POST":
+			name := strings.TrimSpace(r.PostFormValue("name"))
+			if len(name) == 0 || len(name) > 64 {
+				writeJSON(w, 400, map[string]string{"error": "Missing or too long name arg."})
+				return
+			}
+			access.mu.Lock()
+			defer access.mu.Unlock()
+			if r.PostFormValue("delete") == "yes" {
+				delete(access.accounts, name)
+				if err := access.save(); err != nil {
+					writeJSON(w, 500, map[string]string{"error": "Failed to save users: " + err.Error()})
+					return
+				}
+				writeJSON(w, 200, map[string]string{"name": name, "deleted": "yes"})
+				return
+			}
+			userRole, ok := parseRole(r.PostFormValue("role"))
+			if !ok {
+				writeJSON(w, 400, map[string]string{"error": "Invalid role arg, must be read-only, poster, moderator or admin."})
+				return
+			}
+			response := map[string]string{"name": name, "role": userRole.String()}
+			user, found := access.accounts[name]
+			if !found {
+				user = &account{Name: name}
+				access.accounts[name] = user
+			}
+			user.Role = userRole.String()
+			if !found || r.PostFormValue("new_token") == "yes" {
+				token := randomID(24)
+				user.TokenSHA256 = hashToken(token)
+				// shown this once, only the hash is kept
+				response["token"] = token
+			}
+			if err := access.save(); err != nil {
+				writeJSON(w, 500, map[string]string{"error": "Failed to save users: " + err.Error()})
+				return
+			}
+			writeJSON(w, 200, response)
+		default:
+			http.Error(w, "Invalid request method.", 405)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// uploadScanner checks uploads for malware before they're stored.  A clean
+// upload gives ok true, an infected one ok false with what was found.  An
+// error means the scanner couldn't give an answer.
+type uploadScanner interface {
+	scan(name, contentType string, data []byte) (ok bool, found string, err error)
+}
+
+// clamdScanner streams uploads to a clamd daemon using its INSTREAM command.
+type clamdScanner struct {
+	network string
+	address string
+	timeout time.Duration
+}
+
+const clamdChunkSize = 64 * 1024
+
+// newClamdScanner takes "unix:/path/to/clamd.sock" or "tcp:host:port".
+func newClamdScanner(target string, timeout time.Duration) (*clamdScanner, error) {
+	parts := strings.SplitN(target, ":", 2)
+	if len(parts) != 2 || (parts[0] != "unix" && parts[0] != "tcp") || len(parts[1]) == 0 {
+		return nil, fmt.Errorf("expected unix:/path or tcp:host:port, got %q", target)
+	}
+	return &clamdScanner{network: parts[0], address: parts[1], timeout: timeout}, nil
+}
+
+func (clamd *clamdScanner) scan(name, contentType string, data []byte) (bool, string, error) {
+	conn, err := net.DialTimeout(clamd.network, clamd.address, clamd.timeout)
+	if err != nil {
+		return false, "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(clamd.timeout))
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return false, "", err
+	}
+	size := make([]byte, 4)
+	for start := 0; start < len(data); start += clamdChunkSize {
+		end := start + clamdChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		binary.BigEndian.PutUint32(size, uint32(end-start))
+		if _, err := conn.Write(size); err != nil {
+			return false, "", err
+		}
+		if _, err := conn.Write(data[start:end]); err != nil {
+			return false, "", err
+		}
+	}
+	binary.BigEndian.PutUint32(size, 0)
+	if _, err := conn.Write(size); err != nil {
+		return false, "", err
+	}
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return false, "", err
+	}
+	// replies look like "stream: OK" or "stream: Eicar-Signature FOUND"
+	reply = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(reply, "stream:"), "\x00"))
+	switch {
+	case reply == "OK":
+		return true, "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return false, strings.TrimSuffix(reply, " FOUND"), nil
+	}
+	return false, "", fmt.Errorf("unexpected clamd reply: %q", reply)
+}
+
+// webhookScanner POSTs the raw upload to an external scanning service,
+// which answers with
+//
+//	{"clean": true|false, "reason": "what was found"}
+type webhookScanner struct {
+	url    string
+	client *http.Client
+}
+
+type webhookScanResponse struct {
+	Clean  bool   `json:"clean"`
+	Reason string `json:"reason"`
+}
+
+func newWebhookScanner(url string, timeout time.Duration) *webhookScanner {
+	return &webhookScanner{url: url, client: &http.Client{Timeout: timeout}}
+}
+
+func (hook *webhookScanner) scan(name, contentType string, data []byte) (bool, string, error) {
+	req, err := http.NewRequest("POST", hook.url, bytes.NewReader(data))
+	if err != nil {
+		return false, "", err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Upload-Name", name)
+	resp, err := hook.client.Do(req)
+	if err != nil {
+		return false, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return false, "", fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	var verdict webhookScanResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&verdict); err != nil {
+		return false, "", err
+	}
+	return verdict.Clean, verdict.Reason, nil
+}
+
+// quarantineUpload keeps a copy of a rejected upload (and why) out of the
+// served storage so admins can look into it.
+func quarantineUpload(dir, name, found, ip string, data []byte) {
+	if len(dir) == 0 {
+		return
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+		log.Printf("Failed to quarantine upload %s: %q\n", name, err)
+		return
+	}
+	note := fmt.Sprintf("found: %s\nclient_ip: %s\ntime: %s\n", found, ip, time.Now().UTC().Format(time.RFC3339))
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".txt"), []byte(note), 0600); err != nil {
+		log.Printf("Failed to quarantine upload %s: %q\n", name, err)
+	}
+}
+
+func newQuarantineDir(dir string) error {
+	if len(dir) == 0 {
+		return nil
+	}
+	return os.MkdirAll(dir, 0700)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// scheduledPosts holds chats submitted with a publish_at time until it
+// comes around.  They only live in memory, so a restart drops them.
+type scheduledPosts struct {
+	mu      sync.Mutex
+	max     int
+	posts   map[string]*scheduledChat
+	publish func(r *http.Request, chat ChatPost)
+}
+
+type scheduledChat struct {
+	ID          string   `json:"id"`
+	Chat        ChatPost `json:"chat"`
+	By          string   `json:"by"`
+	PublishAtMs int64    `json:"publish_at_ms"`
+	// what the post checks hear about it with once it's published
+	request *http.Request
+}
+
+const maxScheduleAhead = 30 * 24 * time.Hour
+
+func newScheduledPosts(max int, publish func(r *http.Request, chat ChatPost)) *scheduledPosts {
+	scheduled := &scheduledPosts{max: max, posts: make(map[string]*scheduledChat), publish: publish}
+	go scheduled.run()
+	return scheduled
+}
+
+// parsePublishAt takes epoch milliseconds or an RFC 3339 time.
+func parsePublishAt(value string) (time.Time, bool) {
+	if ms, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(0, ms*int64(time.Millisecond)), true
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+func (scheduled *scheduledPosts) schedule(r *http.Request, chat ChatPost, by string, at time.Time) (*scheduledChat, bool) {
+	scheduled.mu.Lock()
+	defer scheduled.mu.Unlock()
+	if len(scheduled.posts) >= scheduled.max {
+		return nil, false
+	}
+	post := &scheduledChat{ID: randomID(8), Chat: chat, By: by, PublishAtMs: timeToEpochMilliseconds(at),
+		request: r.Clone(r.Context())}
+	scheduled.posts[post.ID] = post
+	return post, true
+}
+
+func (scheduled *scheduledPosts) cancel(id string) bool {
+	scheduled.mu.Lock()
+	defer scheduled.mu.Unlock()
+	_, found := scheduled.posts[id]
+	delete(scheduled.posts, id)
+	return found
+}
+
+func (scheduled *scheduledPosts) list() []*scheduledChat {
+	scheduled.mu.Lock()
+	defer scheduled.mu.Unlock()
+	posts := make([]*scheduledChat, 0, len(scheduled.posts))
+	for _, post := range scheduled.posts {
+		posts = append(posts, post)
+	}
+	sort.Slice(posts, func(i, j int) bool { return posts[i].PublishAtMs < posts[j].PublishAtMs })
+	return posts
+}
+
+func (scheduled *scheduledPosts) run() {
+	for range time.Tick(time.Second) {
+		now := timeToEpochMilliseconds(time.Now())
+		var due []*scheduledChat
+		scheduled.mu.Lock()
+		for id, post := range scheduled.posts {
+			if post.PublishAtMs <= now {
+				due = append(due, post)
+				delete(scheduled.posts, id)
+			}
+		}
+		scheduled.mu.Unlock()
+		sort.Slice(due, func(i, j int) bool { return due[i].PublishAtMs < due[j].PublishAtMs })
+		for _, post := range due {
+			log.Printf("Publishing scheduled chat %s by %s to topic: %s\n", post.ID, post.By, post.Chat.Topic)
+			scheduled.publish(post.request, post.Chat)
+		}
+	}
+}
+
+// getScheduledListClosure serves GET /admin/scheduled, soonest first.
+func getScheduledListClosure(scheduled *scheduledPosts) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		writeJSON(w, 200, map[string][]*scheduledChat{"scheduled": scheduled.list()})
+	}
+}
+
+// getScheduledCancelClosure serves POST /admin/scheduled/cancel?id=ID
+func getScheduledCancelClosure(scheduled *scheduledPosts) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		if !scheduled.cancel(r.FormValue("id")) {
+			writeJSON(w, 404, map[string]string{"error": "No such scheduled chat."})
+			return
+		}
+		writeJSON(w, 200, map[string]string{"status": "ok"})
+	}
+}
+
+// icsText escapes a TEXT value for an iCalendar feed.
+func icsText(text string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r", "", "\n", `\n`).Replace(text)
+}
+
+// icsLine folds a content line to 75 octets, never splitting a character.
+func icsLine(line string) string {
+	var folded strings.Builder
+	width := 0
+	for _, c := range line {
+		if size := utf8.RuneLen(c); width+size > 75 {
+			folded.WriteString("\r\n ")
+			width = 1
+		}
+		folded.WriteRune(c)
+		width += utf8.RuneLen(c)
+	}
+	folded.WriteString("\r\n")
+	return folded.String()
+}
+
+const icsTimeLayout = "20060102T150405Z"
+
+// getScheduledCalendarClosure serves GET /admin/scheduled.ics[?topic=T], the
+// upcoming scheduled chats as an iCalendar feed for calendar apps, which
+// can subscribe with the admin_token param.  Encrypted rooms' chats are
+// left out, there's nothing to show but ciphertext.
+func getScheduledCalendarClosure(scheduled *scheduledPosts, publicURL string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		topic := r.URL.Query().Get("topic")
+		if len(topic) > 0 && !topicNameRegex.MatchString(topic) {
+			http.Error(w, "Invalid topic arg, must be A-Za-z0-9-.", 400)
+			return
+		}
+		name := "micro-chat announcements"
+		if len(topic) > 0 {
+			name += " in " + topic
+		}
+		site := siteURL(publicURL, r)
+		host := r.Host
+		if parsed, err := url.Parse(site); err == nil && len(parsed.Host) > 0 {
+			host = parsed.Host
+		}
+		stamp := time.Now().UTC().Format(icsTimeLayout)
+		var feed strings.Builder
+		for _, line := range []string{"BEGIN:VCALENDAR", "VERSION:2.0", "PRODID:-//micro-chat//scheduled chats//EN",
+			"CALSCALE:GREGORIAN", "METHOD:PUBLISH", "X-WR-CALNAME:" + icsText(name)} {
+			feed.WriteString(icsLine(line))
+		}
+		for _, post := range scheduled.list() {
+			if (len(topic) > 0 && post.Chat.Topic != topic) || post.Chat.Encrypted {
+				continue
+			}
+			message := plainText(post.Chat.Message)
+			summary := strings.SplitN(message, "\n", 2)[0]
+			if runes := []rune(summary); len(runes) > 80 {
+				summary = string(runes[:80]) + "..."
+			}
+			at := time.Unix(0, post.PublishAtMs*int64(time.Millisecond)).UTC().Format(icsTimeLayout)
+			for _, line := range []string{
+				"BEGIN:VEVENT",
+				"UID:" + post.ID + "@" + host,
+				"DTSTAMP:" + stamp,
+				"DTSTART:" + at,
+				"SUMMARY:" + icsText("#"+post.Chat.Topic+": "+summary),
+				"DESCRIPTION:" + icsText(message+"\n\nScheduled by "+post.By),
+				"URL:" + site + "/?topic=" + url.QueryEscape(post.Chat.Topic),
+				"END:VEVENT",
+			} {
+				feed.WriteString(icsLine(line))
+			}
+		}
+		feed.WriteString(icsLine("END:VCALENDAR"))
+		w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+		w.Write([]byte(feed.String()))
+	}
+}
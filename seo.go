@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// the most urls a single sitemap may list
+const maxSitemapURLs = 50000
+
+// getRobotsClosure serves /robots.txt, the -robotsFile when there is one.
+// The default lets crawlers index topic pages, keeps them out of the apis and
+// admin pages, and points them at the sitemap.
+func getRobotsClosure(robots []byte, publicURL string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if robots != nil {
+			w.Write(robots)
+			return
+		}
+		w.Write([]byte("User-agent: *\n" +
+			"Disallow: /admin/\n" +
+			"Disallow: /api/\n" +
+			"Disallow: /post\n" +
+			"Disallow: /subscribe\n" +
+			"Disallow: /history\n" +
+			"Disallow: /presence\n" +
+			"Disallow: /preview\n" +
+			"\n" +
+			"Sitemap: " + siteURL(publicURL, r) + "/sitemap.xml\n"))
+	}
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+// getSitemapClosure serves /sitemap.xml listing the page of every topic
+// with buffered chats, most recently active first.  Encrypted rooms are
+// left out.
+func getSitemapClosure(manager *chatStore, rooms *encryptedRooms, publicURL string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		topics := manager.topicSummaries()
+		sort.Slice(topics, func(i, j int) bool { return topics[i].LastPostMs > topics[j].LastPostMs })
+		site := siteURL(publicURL, r)
+		urls := []sitemapURL{{Loc: site + "/"}}
+		for _, topic := range topics {
+			if rooms.has(topic.Topic) {
+				continue
+			}
+			if len(urls) == maxSitemapURLs {
+				break
+			}
+			urls = append(urls, sitemapURL{Loc: site + "/?topic=" + url.QueryEscape(topic.Topic),
+				LastMod: time.Unix(0, topic.LastPostMs*int64(time.Millisecond)).UTC().Format(time.RFC3339)})
+		}
+		// the index changes whenever any topic does
+		if len(urls) > 1 {
+			urls[0].LastMod = urls[1].LastMod
+		}
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		w.Write([]byte(xml.Header))
+		xml.NewEncoder(w).Encode(struct {
+			XMLName xml.Name     `xml:"urlset"`
+			Xmlns   string       `xml:"xmlns,attr"`
+			URLs    []sitemapURL `xml:"url"`
+		}{Xmlns: "http://www.sitemaps.org/schemas/sitemap/0.9", URLs: urls})
+	}
+}
+
+// pageMeta is what link unfurlers (Slack, Discord, social media) show for a
+// page, from its Open Graph and Twitter Card tags.
+type pageMeta struct {
+	Title       string
+	Description string
+	URL         string
+}
+
+// topicPageMeta describes a topic page with its newest chat, or the front
+// page.  Encrypted rooms only ever get a generic description.
+func topicPageMeta(opts indexOptions, r *http.Request, topic string) pageMeta {
+	site := siteURL(opts.PublicURL, r)
+	if len(topic) == 0 {
+		return pageMeta{Title: "micro-chat", Description: "Chat about anything, no account needed.", URL: site + "/"}
+	}
+	meta := pageMeta{Title: topic + " - micro-chat", Description: "Join the conversation about " + topic + ".",
+		URL: site + "/?topic=" + url.QueryEscape(topic)}
+	if opts.Rooms.has(topic) {
+		meta.Description = "An end to end encrypted room."
+		return meta
+	}
+	if opts.Bans.banned(r, topic, true) != nil {
+		return meta
+	}
+	if update, ok := opts.Manager.topicUpdate(topic); ok && update.Preview != nil {
+		meta.Description = previewText(update.Preview.DisplayName) + ": " + update.Preview.Text
+	}
+	return meta
+}
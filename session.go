@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// Anonymous sessions are just a random id in a cookie, enough to remember
+// things per browser (like read markers) without any accounts.
+const sessionCookieName = "microchat_session"
+
+var sessionIDRegex = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// sessionID returns the request's session id, blank when it has none.
+func sessionID(r *http.Request) string {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil || !sessionIDRegex.MatchString(cookie.Value) {
+		return ""
+	}
+	return cookie.Value
+}
+
+// ensureSession returns the request's session id, starting a new session
+// when it doesn't have one yet.
+func ensureSession(w http.ResponseWriter, r *http.Request) string {
+	if id := sessionID(r); len(id) > 0 {
+		return id
+	}
+	id := randomID(16)
+	// so later lookups while handling this request see it too
+	r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: id})
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    id,
+		Path:     "/",
+		Expires:  time.Now().Add(365 * 24 * time.Hour),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Secure:   r.TLS != nil,
+	})
+	return id
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sessionRegistry remembers the sessions that posted lately, so people can
+// see where else they're signed in and log those devices out, and admins can
+// kill hijacked sessions.  A revoked session's cookies are ignored from then
+// on, and its browser gets a new session the next time it needs one.
+//
+// Anyone can see and revoke their own session.  Only accounts (a token on
+// the request) can see the others they posted from, a display name proves
+// nothing since anyone can post under it.  Sessions are listed by a handle,
+// never by the cookie's value, which would let whoever lists them take them
+// over.
+type sessionRegistry struct {
+	mu       sync.Mutex
+	path     string // where revocations are saved, blank to keep them in memory
+	access   *accessControl
+	sessions map[string]*sessionInfo
+	revoked  map[string]int64 // session id -> revoked at (epoch ms)
+}
+
+type sessionInfo struct {
+	Handle      string `json:"id"`
+	FirstSeenMs int64  `json:"first_seen_ms"` // since this server started
+	LastSeenMs  int64  `json:"last_seen_ms"`
+	UserAgent   string `json:"user_agent,omitempty"`
+	DisplayName string `json:"display_name,omitempty"` // of the last chat
+	Account     string `json:"account,omitempty"`      // posted with a token
+	IP          string `json:"ip,omitempty"`           // admins only
+	Current     bool   `json:"current,omitempty"`      // the session asking
+	session     string
+}
+
+const (
+	// sessions unseen this long are forgotten, revoking them again isn't
+	// needed since they'll start over anyway
+	sessionListTTL = 30 * 24 * time.Hour
+	// as long as the session cookie lasts
+	sessionRevokedTTL = 365 * 24 * time.Hour
+	maxUserAgentLen   = 256
+	// most sessions remembered, the least recently seen go first
+	maxListedSessions = 10000
+)
+
+func sessionHandle(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:8])
+}
+
+func loadSessionRegistry(path string, access *accessControl) (*sessionRegistry, error) {
+	sessions := &sessionRegistry{path: path, access: access, sessions: make(map[string]*sessionInfo),
+		revoked: make(map[string]int64)}
+	if len(path) > 0 {
+		data, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			var file struct {
+				Revoked map[string]int64 `json:"revoked"`
+			}
+			if err := json.Unmarshal(data, &file); err != nil {
+				return nil, err
+			}
+			for id, at := range file.Revoked {
+				sessions.revoked[id] = at
+			}
+		}
+	}
+	go sessions.cleanup()
+	return sessions, nil
+}
+
+// NOTE: callers must hold sessions.mu
+func (sessions *sessionRegistry) save() error {
+	if len(sessions.path) == 0 {
+		return nil
+	}
+	return saveJSONFile(sessions.path, map[string]map[string]int64{"revoked": sessions.revoked})
+}
+
+func (sessions *sessionRegistry) cleanup() {
+	for range time.Tick(time.Hour) {
+		now := time.Now()
+		sessions.mu.Lock()
+		for id, info := range sessions.sessions {
+			if now.Sub(time.Unix(0, info.LastSeenMs*int64(time.Millisecond))) >= sessionListTTL {
+				delete(sessions.sessions, id)
+			}
+		}
+		for id, at := range sessions.revoked {
+			if now.Sub(time.Unix(0, at*int64(time.Millisecond))) >= sessionRevokedTTL {
+				delete(sessions.revoked, id)
+			}
+		}
+		sessions.mu.Unlock()
+	}
+}
+
+// account is who the request is authenticated as with a token, blank
+// without one.
+func (sessions *sessionRegistry) account(r *http.Request) string {
+	if len(presentedToken(r)) == 0 {
+		return ""
+	}
+	name, _ := sessions.access.identify(r)
+	return name
+}
+
+// check lets everything through, sessionRegistry is a check to hear about
+// published chats.
+func (sessions *sessionRegistry) check(r *http.Request, chat *ChatPost) *postRejection {
+	return nil
+}
+
+// published starts remembering the poster's session.
+func (sessions *sessionRegistry) published(r *http.Request, chat ChatPost) {
+	id := sessionID(r)
+	if len(id) == 0 {
+		return
+	}
+	now := timeToEpochMilliseconds(time.Now())
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+	if _, revoked := sessions.revoked[id]; revoked {
+		return
+	}
+	info, found := sessions.sessions[id]
+	if !found {
+		if len(sessions.sessions) >= maxListedSessions {
+			sessions.evictOldest()
+		}
+		info = &sessionInfo{Handle: sessionHandle(id), FirstSeenMs: now, session: id}
+		sessions.sessions[id] = info
+	}
+	sessions.seen(info, r, now)
+	info.DisplayName = html.UnescapeString(chat.DisplayName)
+	if account := sessions.account(r); len(account) > 0 {
+		info.Account = account
+	}
+}
+
+// NOTE: callers must hold sessions.mu
+func (sessions *sessionRegistry) seen(info *sessionInfo, r *http.Request, now int64) {
+	info.LastSeenMs = now
+	info.UserAgent = truncateInput(r.UserAgent(), maxUserAgentLen)
+	info.IP = clientIP(r)
+}
+
+// NOTE: callers must hold sessions.mu
+func (sessions *sessionRegistry) evictOldest() {
+	oldest := ""
+	for id, info := range sessions.sessions {
+		if len(oldest) == 0 || info.LastSeenMs < sessions.sessions[oldest].LastSeenMs {
+			oldest = id
+		}
+	}
+	delete(sessions.sessions, oldest)
+}
+
+// track wraps the whole server, keeping the sessions that posted up to date
+// and dropping the cookies of revoked ones before any handler sees them.
+func (sessions *sessionRegistry) track(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := sessionID(r)
+		if len(id) == 0 {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		sessions.mu.Lock()
+		_, revoked := sessions.revoked[id]
+		if info, found := sessions.sessions[id]; found {
+			sessions.seen(info, r, timeToEpochMilliseconds(time.Now()))
+		}
+		sessions.mu.Unlock()
+		if revoked {
+			r = withoutCookies(r, sessionCookieName, identityCookieName)
+			for _, name := range []string{sessionCookieName, identityCookieName} {
+				http.SetCookie(w, &http.Cookie{Name: name, Value: "", Path: "/", MaxAge: -1})
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// withoutCookies returns a copy of the request without the named cookies.
+func withoutCookies(r *http.Request, names ...string) *http.Request {
+	r = r.Clone(r.Context())
+	var kept []string
+	for _, cookie := range r.Cookies() {
+		drop := false
+		for _, name := range names {
+			drop = drop || cookie.Name == name
+		}
+		if !drop {
+			kept = append(kept, cookie.String())
+		}
+	}
+	r.Header.Del("Cookie")
+	if len(kept) > 0 {
+		r.Header.Set("Cookie", strings.Join(kept, "; "))
+	}
+	return r
+}
+
+// list returns copies of the sessions pick chooses, most recently seen
+// first, marking the one with id current.
+func (sessions *sessionRegistry) list(id string, pick func(*sessionInfo) bool) []sessionInfo {
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+	list := []sessionInfo{}
+	for _, info := range sessions.sessions {
+		if pick(info) {
+			listed := *info
+			listed.Current = info.session == id
+			list = append(list, listed)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].LastSeenMs > list[j].LastSeenMs })
+	return list
+}
+
+// revoke revokes the sessions pick chooses, returning how many.
+func (sessions *sessionRegistry) revoke(pick func(*sessionInfo) bool) (int, error) {
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+	now := timeToEpochMilliseconds(time.Now())
+	revoked := 0
+	for id, info := range sessions.sessions {
+		if pick(info) {
+			sessions.revoked[id] = now
+			delete(sessions.sessions, id)
+			revoked++
+		}
+	}
+	if revoked == 0 {
+		return 0, nil
+	}
+	return revoked, sessions.save()
+}
+
+// mine picks the caller's own session, and for accounts the others they
+// posted from.
+func (sessions *sessionRegistry) mine(r *http.Request) func(*sessionInfo) bool {
+	id := sessionID(r)
+	account := sessions.account(r)
+	return func(info *sessionInfo) bool {
+		return (len(id) > 0 && info.session == id) || (len(account) > 0 && info.Account == account)
+	}
+}
+
+// getSessionsClosure serves GET /api/v1/sessions, the caller's sessions,
+// and POST /api/v1/sessions/revoke with id (one of them) or others=yes (all
+// but the caller's own) to log them out.
+func getSessionsClosure(sessions *sessionRegistry) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mine := sessions.mine(r)
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/api/v1/sessions":
+			list := sessions.list(sessionID(r), mine)
+			// where they are is only for admins
+			for i := range list {
+				list[i].IP = ""
+			}
+			writeJSON(w, 200, map[string][]sessionInfo{"sessions": list})
+		case r.Method == "POST" && r.URL.Path == "/api/v1/sessions/revoke":
+			handle := r.PostFormValue("id")
+			others := r.PostFormValue("others") == "yes"
+			if len(handle) == 0 && !others {
+				writeJSON(w, 400, map[string]string{"error": "Missing id or others arg."})
+				return
+			}
+			id := sessionID(r)
+			revoked, err := sessions.revoke(func(info *sessionInfo) bool {
+				if !mine(info) {
+					return false
+				}
+				if others {
+					return info.session != id
+				}
+				return info.Handle == handle
+			})
+			if err != nil {
+				writeJSON(w, 500, map[string]string{"error": "Failed to save revoked sessions: " + err.Error()})
+				return
+			}
+			if revoked == 0 && !others {
+				writeJSON(w, 404, map[string]string{"error": "No session of yours with that id."})
+				return
+			}
+			writeJSON(w, 200, map[string]int{"revoked": revoked})
+		default:
+			http.Error(w, "Invalid request method.", 405)
+		}
+	}
+}
+
+// getAdminSessionsClosure serves /admin/sessions:
+//
+//	GET lists every session, or those of display_name and/or ip
+//	POST revoke=yes with id, or display_name for all of a name's sessions
+func getAdminSessionsClosure(sessions *sessionRegistry) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			query := r.URL.Query()
+			name := strings.TrimSpace(query.Get("display_name"))
+			ip := strings.TrimSpace(query.Get("ip"))
+			if len(ip) > 0 {
+				ip = anonymizedIP(r, ip)
+			}
+			list := sessions.list("", func(info *sessionInfo) bool {
+				return (len(name) == 0 || strings.EqualFold(info.DisplayName, name)) && (len(ip) == 0 || info.IP == ip)
+			})
+			writeJSON(w, 200, map[string][]sessionInfo{"sessions": list})
+		case "POST":
+			handle := r.PostFormValue("id")
+			name := strings.TrimSpace(r.PostFormValue("display_name"))
+			if r.PostFormValue("revoke") != "yes" || (len(handle) == 0 && len(name) == 0) {
+				writeJSON(w, 400, map[string]string{"error": "Needs revoke=yes and an id or display_name arg."})
+				return
+			}
+			revoked, err := sessions.revoke(func(info *sessionInfo) bool {
+				if len(handle) > 0 {
+					return info.Handle == handle
+				}
+				return strings.EqualFold(info.DisplayName, name)
+			})
+			if err != nil {
+				writeJSON(w, 500, map[string]string{"error": "Failed to save revoked sessions: " + err.Error()})
+				return
+			}
+			if revoked == 0 {
+				writeJSON(w, 404, map[string]string{"error": "No sessions matched."})
+				return
+			}
+			writeJSON(w, 200, map[string]int{"revoked": revoked})
+		default:
+			http.Error(w, "Invalid request method.", 405)
+		}
+	}
+}
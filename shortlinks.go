@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// shortLinks hands out /t/<code> links to topics and single chats, minted on
+// demand and kept server side, for places a full topic url looks ugly.
+// Links are appended to a json lines file when there is one, so they
+// survive restarts, and the file is compacted each start.  Links last
+// shortLinkTTL, and when there are max of them the oldest go first.
+type shortLinks struct {
+	mu       sync.Mutex
+	file     *os.File // nil to keep links in memory
+	max      int
+	links    map[string]*shortLink
+	byTarget map[string]string // topic + chat id -> code, so each is minted once
+	order    []string          // codes oldest first, some may be gone already
+	minted   map[string]*mintWindow
+}
+
+// mintWindow counts an IP's new links in the current hour.
+type mintWindow struct {
+	startMs int64
+	count   int
+}
+
+type shortLink struct {
+	Code      string `json:"code"`
+	Topic     string `json:"topic"`
+	ChatID    string `json:"chat_id,omitempty"`
+	CreatedMs int64  `json:"created_ms"`
+}
+
+const shortCodeAlphabet = "abcdefghijkmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+const (
+	shortLinkTTL = 180 * 24 * time.Hour
+	// new links an IP can mint an hour
+	maxMintsPerHour = 20
+)
+
+var chatIDRegex = regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+func newShortLinks(path string, max int) (*shortLinks, error) {
+	links := &shortLinks{max: max, links: make(map[string]*shortLink), byTarget: make(map[string]string),
+		minted: make(map[string]*mintWindow)}
+	go links.cleanup()
+	if len(path) == 0 {
+		return links, nil
+	}
+	f, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		cutoff := timeToEpochMilliseconds(time.Now().Add(-shortLinkTTL))
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var link shortLink
+			if err := json.Unmarshal(scanner.Bytes(), &link); err != nil {
+				// most likely a partial line from a crash, skip it
+				continue
+			}
+			if link.CreatedMs >= cutoff {
+				links.add(&link)
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	// drop the expired and evicted links from the file
+	var kept []byte
+	for _, code := range links.order {
+		line, _ := json.Marshal(links.links[code])
+		kept = append(append(kept, line...), '\n')
+	}
+	if err := replaceFile(path, kept); err != nil {
+		return nil, err
+	}
+	if links.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600); err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+func (link *shortLink) target() string {
+	return link.Topic + "\x00" + link.ChatID
+}
+
+// where the link sends people, chats are picked out by the page's fragment
+func (link *shortLink) location() string {
+	location := "/?topic=" + link.Topic
+	if len(link.ChatID) > 0 {
+		location += "#chat-" + link.ChatID
+	}
+	return location
+}
+
+// add adds the link, the newest, making room for it when there are max.
+// NOTE: callers must hold links.mu, unless nothing else has a ref yet
+func (links *shortLinks) add(link *shortLink) {
+	for len(links.links) >= links.max && len(links.order) > 0 {
+		links.dropOldest()
+	}
+	links.links[link.Code] = link
+	links.byTarget[link.target()] = link.Code
+	links.order = append(links.order, link.Code)
+}
+
+// NOTE: callers must hold links.mu
+func (links *shortLinks) dropOldest() {
+	if oldest, found := links.links[links.order[0]]; found {
+		delete(links.links, oldest.Code)
+		delete(links.byTarget, oldest.target())
+	}
+	links.order = links.order[1:]
+}
+
+// cleanup expires links and forgets who minted them each hour.
+func (links *shortLinks) cleanup() {
+	for range time.Tick(time.Hour) {
+		now := timeToEpochMilliseconds(time.Now())
+		cutoff := now - int64(shortLinkTTL/time.Millisecond)
+		links.mu.Lock()
+		for len(links.order) > 0 {
+			if oldest, found := links.links[links.order[0]]; found && oldest.CreatedMs >= cutoff {
+				break
+			}
+			links.dropOldest()
+		}
+		for key, window := range links.minted {
+			if now-window.startMs >= int64(time.Hour/time.Millisecond) {
+				delete(links.minted, key)
+			}
+		}
+		links.mu.Unlock()
+	}
+}
+
+func shortCode(n int) string {
+	code := make([]byte, 0, n)
+	b := make([]byte, 1)
+	for len(code) < n {
+		if _, err := rand.Read(b); err != nil {
+			log.Fatalf("Failed to read random bytes: %q\n", err)
+		}
+		// keep only bytes that map evenly onto the alphabet
+		if int(b[0]) < 256/len(shortCodeAlphabet)*len(shortCodeAlphabet) {
+			code = append(code, shortCodeAlphabet[int(b[0])%len(shortCodeAlphabet)])
+		}
+	}
+	return string(code)
+}
+
+// mint returns the code for topic (and chatID, when not blank), making one
+// the first time, false when the IP with key made too many this hour.
+func (links *shortLinks) mint(topic, chatID, key string) (*shortLink, bool) {
+	now := timeToEpochMilliseconds(time.Now())
+	links.mu.Lock()
+	defer links.mu.Unlock()
+	link := &shortLink{Topic: topic, ChatID: chatID}
+	if code, found := links.byTarget[link.target()]; found {
+		return links.links[code], true
+	}
+	window, found := links.minted[key]
+	if !found || now-window.startMs >= int64(time.Hour/time.Millisecond) {
+		window = &mintWindow{startMs: now}
+		links.minted[key] = window
+	}
+	if window.count >= maxMintsPerHour {
+		return nil, false
+	}
+	window.count++
+	for {
+		link.Code = shortCode(7)
+		if _, taken := links.links[link.Code]; !taken {
+			break
+		}
+	}
+	link.CreatedMs = now
+	links.add(link)
+	if links.file != nil {
+		line, _ := json.Marshal(link)
+		if _, err := links.file.Write(append(line, '\n')); err != nil {
+			log.Printf("Failed to save short link %s: %q\n", link.Code, err)
+		}
+	}
+	return link, true
+}
+
+func (links *shortLinks) lookup(code string) (*shortLink, bool) {
+	links.mu.Lock()
+	defer links.mu.Unlock()
+	link, found := links.links[code]
+	return link, found
+}
+
+// getShortLinkClosure serves GET /t/<code>, redirecting to what it links to.
+func getShortLinkClosure(links *shortLinks) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		link, found := links.lookup(strings.TrimPrefix(r.URL.Path, "/t/"))
+		if !found {
+			http.Error(w, "No such link.", 404)
+			return
+		}
+		http.Redirect(w, r, link.location(), http.StatusFound)
+	}
+}
+
+// getMintShortLinkClosure serves POST /api/v1/shortlinks topic=T[&chat_id=ID]
+//
+//	{"code": "...", "url": "https://.../t/<code>"}
+//
+// Only topics and chats that are still here can be linked to, and encrypted
+// rooms never, their links have to carry the room key.
+func getMintShortLinkClosure(links *shortLinks, manager *chatStore, rooms *encryptedRooms, publicURL string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		topic, chatID := r.PostFormValue("topic"), r.PostFormValue("chat_id")
+		if !topicNameRegex.MatchString(topic) || !manager.hasTopic(topic) || rooms.has(topic) {
+			writeJSON(w, 404, map[string]string{"error": "No such topic."})
+			return
+		}
+		if len(chatID) > 0 {
+			if !chatIDRegex.MatchString(chatID) {
+				writeJSON(w, 400, map[string]string{"error": "Invalid chat_id arg."})
+				return
+			}
+			found := manager.eventsMatching(func(event *chatEvent) bool {
+				chat, ok := event.Data.(ChatPost)
+				return ok && event.Category == topic && chat.ID == chatID
+			}, 1)
+			if len(found) == 0 {
+				writeJSON(w, 404, map[string]string{"error": "No such chat, it may have been removed."})
+				return
+			}
+		}
+		link, ok := links.mint(topic, chatID, networkKey(r))
+		if !ok {
+			writeJSON(w, 429, map[string]string{"error": "Too many short links, try again later."})
+			return
+		}
+		writeJSON(w, 200, map[string]string{"code": link.Code, "url": siteURL(publicURL, r) + "/t/" + link.Code})
+	}
+}
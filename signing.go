@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/openpgp"
+	pgperrors "golang.org/x/crypto/openpgp/errors"
+)
+
+// signingKeys are the public keys chats can be signed with, loaded from the
+// -signingKeys directory: <name>.pub minisign keys and <name>.asc armored
+// PGP keys.  A chat posted with a valid detached signature over its message
+// is marked verified with the key's name.
+type signingKeys struct {
+	minisign map[[8]byte]minisignKey // by key id
+	pgp      openpgp.EntityList
+	pgpNames map[uint64]string // primary key id -> name
+}
+
+type minisignKey struct {
+	name string
+	key  ed25519.PublicKey
+}
+
+// key names end up in the verified badge, keep them plain
+var signingKeyNameRegex = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+var (
+	errUnknownSigningKey = errors.New("signed with an unknown key")
+	errBadSignature      = errors.New("signature doesn't match the message")
+)
+
+func loadSigningKeys(dir string) (*signingKeys, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	keys := &signingKeys{minisign: make(map[[8]byte]minisignKey), pgpNames: make(map[uint64]string)}
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || (ext != ".pub" && ext != ".asc") {
+			continue
+		}
+		name := strings.TrimSuffix(entry.Name(), ext)
+		if !signingKeyNameRegex.MatchString(name) {
+			return nil, fmt.Errorf("%s: key names must be A-Za-z0-9_.- up to 64 characters", entry.Name())
+		}
+		path := filepath.Join(dir, entry.Name())
+		if ext == ".pub" {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			id, key, err := parseMinisignKey(string(data))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", entry.Name(), err)
+			}
+			keys.minisign[id] = minisignKey{name: name, key: key}
+			continue
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		entities, err := openpgp.ReadArmoredKeyRing(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", entry.Name(), err)
+		}
+		for _, entity := range entities {
+			keys.pgp = append(keys.pgp, entity)
+			keys.pgpNames[entity.PrimaryKey.KeyId] = name
+		}
+	}
+	if len(keys.minisign) == 0 && len(keys.pgp) == 0 {
+		return nil, fmt.Errorf("no .pub or .asc keys in %s", dir)
+	}
+	return keys, nil
+}
+
+// minisignLines returns the lines of a minisign key or signature file that
+// matter, so either the whole file or just its base64 line can be given.
+func minisignLines(text string) []string {
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "untrusted comment:") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// parseMinisignKey decodes a minisign public key: "Ed", an 8 byte key id
+// and the 32 byte ed25519 key, base64 encoded.
+func parseMinisignKey(text string) ([8]byte, ed25519.PublicKey, error) {
+	var id [8]byte
+	lines := minisignLines(text)
+	if len(lines) != 1 {
+		return id, nil, errors.New("expected a single base64 key line")
+	}
+	raw, err := base64.StdEncoding.DecodeString(lines[0])
+	if err != nil || len(raw) != 2+8+ed25519.PublicKeySize || string(raw[:2]) != "Ed" {
+		return id, nil, errors.New("not a minisign public key")
+	}
+	copy(id[:], raw[2:10])
+	return id, ed25519.PublicKey(raw[10:]), nil
+}
+
+// verify checks a detached signature (armored PGP, or minisign) over
+// message and returns the name of the key that made it.
+func (keys *signingKeys) verify(message []byte, signature string) (string, error) {
+	if strings.Contains(signature, "-----BEGIN PGP SIGNATURE-----") {
+		signer, err := openpgp.CheckArmoredDetachedSignature(keys.pgp, bytes.NewReader(message), strings.NewReader(signature))
+		if err == pgperrors.ErrUnknownIssuer {
+			return "", errUnknownSigningKey
+		}
+		if err != nil {
+			return "", errBadSignature
+		}
+		return keys.pgpNames[signer.PrimaryKey.KeyId], nil
+	}
+	return keys.verifyMinisign(message, signature)
+}
+
+// verifyMinisign checks a minisign signature: "Ed" (or "ED" when the
+// message was prehashed with blake2b, minisign's default), the key id and
+// the ed25519 signature.  When the trusted comment is included its global
+// signature has to check out too.
+func (keys *signingKeys) verifyMinisign(message []byte, signature string) (string, error) {
+	lines := minisignLines(signature)
+	if len(lines) == 0 {
+		return "", errBadSignature
+	}
+	raw, err := base64.StdEncoding.DecodeString(lines[0])
+	if err != nil || len(raw) != 2+8+ed25519.SignatureSize {
+		return "", errBadSignature
+	}
+	var id [8]byte
+	copy(id[:], raw[2:10])
+	key, found := keys.minisign[id]
+	if !found {
+		return "", errUnknownSigningKey
+	}
+	signed := message
+	switch string(raw[:2]) {
+	case "ED":
+		hash := blake2b.Sum512(message)
+		signed = hash[:]
+	case "Ed":
+	default:
+		return "", errBadSignature
+	}
+	sig := raw[10:]
+	if !ed25519.Verify(key.key, signed, sig) {
+		return "", errBadSignature
+	}
+	if len(lines) >= 3 && strings.HasPrefix(lines[1], "trusted comment: ") {
+		global, err := base64.StdEncoding.DecodeString(lines[2])
+		comment := strings.TrimPrefix(lines[1], "trusted comment: ")
+		if err != nil || !ed25519.Verify(key.key, append(append([]byte{}, sig...), comment...), global) {
+			return "", errBadSignature
+		}
+	}
+	return key.name, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+)
+
+// When topic pages include their latest chats in the html.
+const (
+	snapshotOff      = "off"
+	snapshotCrawlers = "crawlers"
+	snapshotAlways   = "always"
+)
+
+// user agents of search engines and link unfurlers, which mostly don't run
+// the page's javascript
+var crawlerAgents = regexp.MustCompile(`(?i)bot|crawl|spider|slurp|facebookexternalhit|embedly|preview|whatsapp|vkshare|pinterest|outbrain`)
+
+// snapshotChat is a chat rendered into the page for crawlers.  The page's
+// script drops them once it starts polling.
+type snapshotChat struct {
+	ID          string
+	Topic       string
+	DisplayName template.HTML // sanitized when posted
+	UserPath    string
+	Message     template.HTML // sanitized when posted
+	Time        string        // RFC 3339
+	Clock       string        // for people, in -timezone
+}
+
+// topicSnapshot returns the newest chats of category to render into its
+// page, or nothing for visitors that will poll for them anyway.  Burn after
+// reading chats and encrypted rooms are never included.
+func topicSnapshot(opts indexOptions, r *http.Request, category string, limit uint) []snapshotChat {
+	if opts.Snapshot == snapshotOff || (opts.Snapshot == snapshotCrawlers && !crawlerAgents.MatchString(r.UserAgent())) {
+		return nil
+	}
+	hidden := opts.Bans.unreadable(r)
+	if opts.Rooms.has(category) || hidden[category] {
+		return nil
+	}
+	events := opts.Manager.eventsBefore(category, timeToEpochMilliseconds(time.Now())+1, int(limit))
+	var chats []snapshotChat
+	// newest first, like the list the script keeps
+	for i := len(events) - 1; i >= 0; i-- {
+		chat, ok := events[i].Data.(ChatPost)
+		if !ok || len(chat.ID) == 0 || chat.Burn || chat.Encrypted || hidden[events[i].Category] {
+			continue
+		}
+		at := time.Unix(0, events[i].Timestamp*int64(time.Millisecond)).UTC()
+		chats = append(chats, snapshotChat{ID: chat.ID, Topic: chat.Topic,
+			DisplayName: template.HTML(chat.DisplayName), UserPath: "/user/" + url.PathEscape(plainText(chat.DisplayName)),
+			Message: template.HTML(chat.Message), Time: at.Format(time.RFC3339), Clock: serverTimes.clock(events[i].Timestamp)})
+	}
+	return chats
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// cannedSnippets are canned responses posted with /snippet name, so support
+// staff don't retype the same answers.  A snippet belongs to one topic or,
+// with a blank topic, to every topic that has none by that name.
+type cannedSnippets struct {
+	mu       sync.Mutex
+	path     string              // where snippets are saved, blank to keep them in memory
+	snippets map[string]*snippet // by topic and name
+}
+
+type snippet struct {
+	Name  string `json:"name"`
+	Topic string `json:"topic,omitempty"`
+	Text  string `json:"text"` // markdown
+	By    string `json:"by,omitempty"`
+}
+
+const maxSnippetLen = 4000
+
+var snippetNameRegex = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,32}$`)
+
+func snippetKey(topic, name string) string {
+	return topic + "\x00" + strings.ToLower(name)
+}
+
+func loadSnippets(path string) (*cannedSnippets, error) {
+	snippets := &cannedSnippets{path: path, snippets: make(map[string]*snippet)}
+	if len(path) == 0 {
+		return snippets, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return snippets, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Snippets []*snippet `json:"snippets"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	for _, s := range file.Snippets {
+		if !snippetNameRegex.MatchString(s.Name) || len(strings.TrimSpace(s.Text)) == 0 {
+			return nil, fmt.Errorf("snippet %q needs an A-Za-z0-9_- name and some text", s.Name)
+		}
+		snippets.snippets[snippetKey(s.Topic, s.Name)] = s
+	}
+	return snippets, nil
+}
+
+// NOTE: callers must hold snippets.mu
+func (snippets *cannedSnippets) save() error {
+	if len(snippets.path) == 0 {
+		return nil
+	}
+	var file struct {
+		Snippets []*snippet `json:"snippets"`
+	}
+	file.Snippets = snippets.listLocked("", true)
+	return saveJSONFile(snippets.path, file)
+}
+
+// listLocked returns topic's snippets, including the instance wide ones it
+// doesn't override, or every snippet when all.
+// NOTE: callers must hold snippets.mu
+func (snippets *cannedSnippets) listLocked(topic string, all bool) []*snippet {
+	list := []*snippet{}
+	for _, s := range snippets.snippets {
+		if all || s.Topic == topic {
+			list = append(list, s)
+		} else if _, overridden := snippets.snippets[snippetKey(topic, s.Name)]; len(s.Topic) == 0 && !overridden {
+			list = append(list, s)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Topic != list[j].Topic {
+			return list[i].Topic < list[j].Topic
+		}
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// lookup returns topic's snippet by name, falling back on the instance's.
+func (snippets *cannedSnippets) lookup(topic, name string) (*snippet, bool) {
+	snippets.mu.Lock()
+	defer snippets.mu.Unlock()
+	if s, found := snippets.snippets[snippetKey(topic, name)]; found {
+		return s, true
+	}
+	s, found := snippets.snippets[snippetKey("", name)]
+	return s, found
+}
+
+// run is the /snippet slash command, posting the snippet followed by any
+// message after its name.
+func (snippets *cannedSnippets) run(renderer *chatRenderer, args string, chat *ChatPost) (string, error) {
+	fields := strings.SplitN(strings.TrimSpace(args), " ", 2)
+	if len(fields[0]) == 0 {
+		return "", fmt.Errorf("Usage: /snippet name [message].  Snippets here: %s.", snippets.names(chat.Topic))
+	}
+	s, found := snippets.lookup(chat.Topic, fields[0])
+	if !found {
+		return "", fmt.Errorf("No snippet named %s.  Snippets here: %s.", fields[0], snippets.names(chat.Topic))
+	}
+	message := s.Text
+	if len(fields) > 1 {
+		message += "\n\n" + fields[1]
+	}
+	return message, nil
+}
+
+func (snippets *cannedSnippets) names(topic string) string {
+	snippets.mu.Lock()
+	defer snippets.mu.Unlock()
+	var names []string
+	for _, s := range snippets.listLocked(topic, false) {
+		names = append(names, s.Name)
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// getSnippetsClosure serves /admin/snippets:
+//
+//	GET lists every snippet, or with topic those /snippet finds there
+//	POST name, text[, topic] adds or replaces a snippet, blank topic for
+//	the whole instance
+//	POST name[, topic], delete=yes removes one
+func getSnippetsClosure(snippets *cannedSnippets, access *accessControl) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			topic := r.URL.Query().Get("topic")
+			snippets.mu.Lock()
+			list := snippets.listLocked(topic, len(topic) == 0)
+			snippets.mu.Unlock()
+			writeJSON(w, 200, map[string][]*snippet{"snippets": list})
+		case "POST":
+			name, topic := r.PostFormValue("name"), r.PostFormValue("topic")
+			if !snippetNameRegex.MatchString(name) {
+				writeJSON(w, 400, map[string]string{"error": "Invalid name arg, must be 1-32 of A-Za-z0-9_-."})
+				return
+			}
+			snippets.mu.Lock()
+			defer snippets.mu.Unlock()
+			key := snippetKey(topic, name)
+			if r.PostFormValue("delete") == "yes" {
+				if _, found := snippets.snippets[key]; !found {
+					writeJSON(w, 404, map[string]string{"error": "No such snippet."})
+					return
+				}
+				delete(snippets.snippets, key)
+				if err := snippets.save(); err != nil {
+					writeJSON(w, 500, map[string]string{"error": "Failed to save snippets: " + err.Error()})
+					return
+				}
+				writeJSON(w, 200, map[string]string{"name": name, "topic": topic, "deleted": "yes"})
+				return
+			}
+			text := r.PostFormValue("text")
+			if len(strings.TrimSpace(text)) == 0 || len([]rune(text)) > maxSnippetLen {
+				writeJSON(w, 400, map[string]string{"error": fmt.Sprintf("Missing or too long text arg, up to %d characters.", maxSnippetLen)})
+				return
+			}
+			by, _ := access.identify(r)
+			s := &snippet{Name: name, Topic: topic, Text: text, By: by}
+			snippets.snippets[key] = s
+			if err := snippets.save(); err != nil {
+				writeJSON(w, 500, map[string]string{"error": "Failed to save snippets: " + err.Error()})
+				return
+			}
+			writeJSON(w, 200, s)
+		default:
+			http.Error(w, "Invalid request method.", 405)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Well known link shorteners, which drive-by spam loves since they hide
+// where the link really goes.
+var urlShorteners = []string{
+	"bit.ly", "buff.ly", "cutt.ly", "goo.gl", "is.gd", "ow.ly", "rb.gy",
+	"rebrand.ly", "shorturl.at", "t.co", "tiny.cc", "tinyurl.com",
+}
+
+// linkSpamFilter applies simple link density heuristics that catch most
+// drive-by spam on public instances: too many links in one chat, links
+// through url shorteners, and a client's very first chat containing a link.
+type linkSpamFilter struct {
+	mu           sync.Mutex
+	maxLinks     int
+	noShorteners bool
+	noFirstLink  bool
+	hold         bool
+	linkRegex    *regexp.Regexp
+	// clients that have had a chat published recently
+	seenPosters map[string]time.Time
+}
+
+type linkSpamOptions struct {
+	MaxLinks       uint // 0 for no limit
+	BlockShortener bool
+	BlockFirstLink bool
+	// hold matching chats for review rather than rejecting them
+	Hold bool
+}
+
+func newLinkSpamFilter(opts linkSpamOptions) *linkSpamFilter {
+	filter := &linkSpamFilter{
+		maxLinks:     int(opts.MaxLinks),
+		noShorteners: opts.BlockShortener,
+		noFirstLink:  opts.BlockFirstLink,
+		hold:         opts.Hold,
+		linkRegex:    regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s"'<>]+`),
+		seenPosters:  make(map[string]time.Time),
+	}
+	go filter.cleanup()
+	return filter
+}
+
+// links returns the distinct urls in the rendered message.  A markdown
+// link shows up as both an href and its text, so dedupe.
+func (filter *linkSpamFilter) links(message string) []string {
+	seen := make(map[string]bool)
+	var links []string
+	for _, link := range filter.linkRegex.FindAllString(message, -1) {
+		if !seen[link] {
+			seen[link] = true
+			links = append(links, link)
+		}
+	}
+	return links
+}
+
+func isShortener(link string) bool {
+	if !strings.Contains(link, "://") {
+		link = "http://" + link
+	}
+	parsed, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+	host := strings.TrimPrefix(strings.ToLower(parsed.Hostname()), "www.")
+	for _, shortener := range urlShorteners {
+		if host == shortener {
+			return true
+		}
+	}
+	return false
+}
+
+func (filter *linkSpamFilter) check(r *http.Request, chat *ChatPost) *postRejection {
+	links := filter.links(chat.Message)
+	if len(links) == 0 {
+		return nil
+	}
+	if filter.maxLinks > 0 && len(links) > filter.maxLinks {
+		return filter.verdict("too_many_links", fmt.Sprintf("Too many links, at most %d allowed per chat.", filter.maxLinks))
+	}
+	if filter.noShorteners {
+		for _, link := range links {
+			if isShortener(link) {
+				return filter.verdict("url_shortener", "Links through url shorteners are not allowed, please post the full link.")
+			}
+		}
+	}
+	if filter.noFirstLink {
+		filter.mu.Lock()
+		_, seen := filter.seenPosters[clientIP(r)]
+		filter.mu.Unlock()
+		if !seen {
+			return filter.verdict("first_post_link", "Your first chat can't contain links.")
+		}
+	}
+	return nil
+}
+
+func (filter *linkSpamFilter) verdict(reason, message string) *postRejection {
+	if filter.hold {
+		return &postRejection{Reason: reason, Status: 202, Hold: true,
+			Message: "Your chat is being held for moderator review."}
+	}
+	return &postRejection{Reason: reason, Status: 403, Message: message}
+}
+
+func (filter *linkSpamFilter) published(r *http.Request, chat ChatPost) {
+	filter.mu.Lock()
+	defer filter.mu.Unlock()
+	filter.seenPosters[clientIP(r)] = time.Now()
+}
+
+// cleanup forgets posters after a day, after which their first chat with a
+// link gets scrutinized again.
+func (filter *linkSpamFilter) cleanup() {
+	for range time.Tick(time.Hour) {
+		filter.mu.Lock()
+		for ip, seen := range filter.seenPosters {
+			if time.Since(seen) > 24*time.Hour {
+				delete(filter.seenPosters, ip)
+			}
+		}
+		filter.mu.Unlock()
+	}
+}
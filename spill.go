@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// spillStore keeps events that were pushed out of the in-memory buffer (by
+// the count or byte limits) on disk until their TTL runs out, so history
+// requests can still reach them.  Events are appended as json lines to
+// hourly segment files; whole segments are deleted once everything in them
+// has expired.  Evictions are queued for a writer goroutine, publishes and
+// subscribers never wait on the disk.
+type spillStore struct {
+	mu           sync.Mutex
+	dir          string
+	ttl          time.Duration
+	current      *os.File
+	currentStart int64
+	// without a ttl (as the file ChatStore), events before this are expired
+	expiredBefore int64
+	// evicted events waiting to be written, nil for the file ChatStore
+	queue chan spillItem
+	// one remove rewrites segments at a time
+	compacting sync.Mutex
+}
+
+// spillItem is an evicted event for the writer, or with done a marker that
+// everything queued before it was written.
+type spillItem struct {
+	event *chatEvent
+	done  chan struct{}
+}
+
+// spilledEvent is the on-disk form of a chatEvent.
+type spilledEvent struct {
+	Timestamp int64           `json:"timestamp"`
+	ID        int64           `json:"id,omitempty"`
+	Category  string          `json:"category"`
+	Data      json.RawMessage `json:"data"`
+}
+
+const (
+	spillSegmentLength = time.Hour
+	spillSegmentPrefix = "segment-"
+	spillSegmentSuffix = ".jsonl"
+	// evictions past this are dropped rather than holding up the store
+	spillQueueSize = 10000
+)
+
+func newSpillStore(dir string, ttl time.Duration) (*spillStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	spill := &spillStore{dir: dir, ttl: ttl, queue: make(chan spillItem, spillQueueSize)}
+	go spill.reap()
+	go spill.writeQueued()
+	return spill, nil
+}
+
+// spillEvicted is registered as a chatStore eviction callback, it runs with
+// the store locked so it only queues the event.  Events that merely expired
+// are not worth keeping, and burn chats never touch disk.
+func (spill *spillStore) spillEvicted(event *chatEvent, reason string) {
+	if reason == evictedForTTL {
+		return
+	}
+	if chat, ok := event.Data.(ChatPost); ok && (chat.Burn || chat.ExpiresAt > 0) {
+		return
+	}
+	select {
+	case spill.queue <- spillItem{event: event}:
+	default:
+		log.Printf("Spill queue full, dropping evicted event %d\n", event.ID)
+	}
+}
+
+func (spill *spillStore) writeQueued() {
+	for item := range spill.queue {
+		if item.event != nil {
+			if err := spill.write(item.event); err != nil {
+				log.Printf("Failed to spill evicted event: %q\n", err)
+			}
+		}
+		if item.done != nil {
+			close(item.done)
+		}
+	}
+}
+
+// flush waits for the evictions queued so far to be written.
+func (spill *spillStore) flush() {
+	if spill.queue == nil {
+		return
+	}
+	done := make(chan struct{})
+	spill.queue <- spillItem{done: done}
+	<-done
+}
+
+// write appends event to the current segment.
+func (spill *spillStore) write(event *chatEvent) error {
+	data, err := json.Marshal(event.Data)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(spilledEvent{event.Timestamp, event.ID, event.Category, data})
+	if err != nil {
+		return err
+	}
+	spill.mu.Lock()
+	defer spill.mu.Unlock()
+	if err := spill.rotate(timeToEpochMilliseconds(time.Now())); err != nil {
+		return err
+	}
+	_, err = spill.current.Write(append(line, '\n'))
+	return err
+}
+
+// cutoff is the timestamp events older than have expired.
+// NOTE: callers must hold spill.mu
+func (spill *spillStore) cutoff() int64 {
+	if spill.ttl == 0 {
+		return spill.expiredBefore
+	}
+	return timeToEpochMilliseconds(time.Now().Add(-spill.ttl))
+}
+
+// Segments are named after when they were written, not after the events
+// they hold.  Since each category is evicted oldest first, a category's
+// events in newer segments are always newer than those in older segments.
+// NOTE: callers must hold spill.mu
+func (spill *spillStore) rotate(now int64) error {
+	segmentMillis := int64(spillSegmentLength / time.Millisecond)
+	start := now - now%segmentMillis
+	if spill.current != nil && start == spill.currentStart {
+		return nil
+	}
+	if spill.current != nil {
+		spill.current.Close()
+		spill.current = nil
+	}
+	f, err := os.OpenFile(spill.segmentPath(start), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	spill.current = f
+	spill.currentStart = start
+	return nil
+}
+
+// segments returns segment start times, newest first.
+func (spill *spillStore) segments() ([]int64, error) {
+	files, err := ioutil.ReadDir(spill.dir)
+	if err != nil {
+		return nil, err
+	}
+	var starts []int64
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasPrefix(name, spillSegmentPrefix) || !strings.HasSuffix(name, spillSegmentSuffix) {
+			continue
+		}
+		start, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(name, spillSegmentPrefix), spillSegmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] > starts[j] })
+	return starts, nil
+}
+
+func (spill *spillStore) segmentPath(start int64) string {
+	return filepath.Join(spill.dir, fmt.Sprintf("%s%d%s", spillSegmentPrefix, start, spillSegmentSuffix))
+}
+
+func (spill *spillStore) reap() {
+	for range time.Tick(time.Minute) {
+		spill.expire()
+	}
+}
+
+func (spill *spillStore) expire() {
+	spill.mu.Lock()
+	defer spill.mu.Unlock()
+	if err := spill.expireLocked(spill.cutoff()); err != nil {
+		log.Printf("Failed to expire spill segments: %q\n", err)
+	}
+}
+
+// expireLocked deletes the segments holding only events older than before.
+// NOTE: callers must hold spill.mu
+func (spill *spillStore) expireLocked(before int64) error {
+	starts, err := spill.segments()
+	if err != nil {
+		return err
+	}
+	// a segment holds events written up to an hour after it started
+	cutoff := before - int64(spillSegmentLength/time.Millisecond)
+	for _, start := range starts {
+		if start >= cutoff {
+			continue
+		}
+		if spill.current != nil && start == spill.currentStart {
+			spill.current.Close()
+			spill.current = nil
+		}
+		if err := os.Remove(spill.segmentPath(start)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove rewrites every segment without the events match picks, returning
+// what it dropped.  Evictions queued before it are written first, so they
+// can't bring back what it removes.
+func (spill *spillStore) remove(match func(*spilledEvent) bool) ([]*spilledEvent, error) {
+	spill.flush()
+	spill.compacting.Lock()
+	defer spill.compacting.Unlock()
+	spill.mu.Lock()
+	starts, err := spill.segments()
+	spill.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	var removed []*spilledEvent
+	for _, start := range starts {
+		dropped, err := spill.compact(start, match)
+		removed = append(removed, dropped...)
+		if err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// compact rewrites a segment without the events match picks.  The segment
+// is read and rewritten without spill.mu, it's only held to copy over what
+// was spilled meanwhile and rename the rewrite into place.
+func (spill *spillStore) compact(start int64, match func(*spilledEvent) bool) ([]*spilledEvent, error) {
+	path := spill.segmentPath(start)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// a line still being written is left for the tail
+	data = data[:strings.LastIndex(string(data), "\n")+1]
+	kept, removed := filterSpilled(data, match)
+	if len(removed) == 0 {
+		return nil, nil
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, kept, 0600); err != nil {
+		return nil, err
+	}
+	spill.mu.Lock()
+	defer spill.mu.Unlock()
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		// expired while it was being rewritten
+		os.Remove(tmp)
+		return removed, nil
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	f.Seek(int64(len(data)), io.SeekStart)
+	tail, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	if len(tail) > 0 {
+		tailKept, tailRemoved := filterSpilled(tail, match)
+		removed = append(removed, tailRemoved...)
+		out, err := os.OpenFile(tmp, os.O_APPEND|os.O_WRONLY, 0600)
+		if err == nil {
+			_, err = out.Write(tailKept)
+			out.Close()
+		}
+		if err != nil {
+			os.Remove(tmp)
+			return nil, err
+		}
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, err
+	}
+	// the next spill reopens it
+	if spill.current != nil && start == spill.currentStart {
+		spill.current.Close()
+		spill.current = nil
+	}
+	return removed, nil
+}
+
+// filterSpilled splits json lines into the ones match doesn't pick and the
+// events it does.
+func filterSpilled(data []byte, match func(*spilledEvent) bool) ([]byte, []*spilledEvent) {
+	var kept []byte
+	var removed []*spilledEvent
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		var spilled spilledEvent
+		if json.Unmarshal([]byte(line), &spilled) == nil && match(&spilled) {
+			removed = append(removed, &spilled)
+			continue
+		}
+		kept = append(kept, line...)
+	}
+	return kept, removed
+}
+
+// eventsBefore returns up to limit of the newest spilled events for the
+// category that are older than before, oldest first.  ALL_CHATS gets the
+// chats spilled from every topic, bar encrypted ones.
+func (spill *spillStore) eventsBefore(category string, before int64, limit int) ([]*chatEvent, error) {
+	spill.mu.Lock()
+	defer spill.mu.Unlock()
+	starts, err := spill.segments()
+	if err != nil {
+		return nil, err
+	}
+	cutoff := spill.cutoff()
+	match := func(spilled *spilledEvent) bool {
+		if spilled.Timestamp >= before {
+			return false
+		}
+		if category != ALL_CHATS {
+			return spilled.Category == category
+		}
+		// segments from before the firehose was a view hold copies of its chats
+		if spilled.Category == ALL_CHATS {
+			return false
+		}
+		var chat struct {
+			Tombstone string `json:"tombstone"`
+			Topic     string `json:"topic"`
+			Encrypted bool   `json:"encrypted"`
+		}
+		return json.Unmarshal(spilled.Data, &chat) == nil && len(chat.Tombstone) == 0 && len(chat.Topic) > 0 && !chat.Encrypted
+	}
+	var found []*chatEvent
+	for _, start := range starts {
+		segmentEvents, err := spill.readSegment(start, cutoff, match)
+		if err != nil {
+			return nil, err
+		}
+		// segments are visited newest first, so older segments go in front
+		found = append(segmentEvents, found...)
+		if len(found) >= limit {
+			break
+		}
+	}
+	if len(found) > limit {
+		found = found[len(found)-limit:]
+	}
+	return found, nil
+}
+
+// eventsMatching returns up to limit spilled events the match func picks,
+// from the newest segments first, in no particular order.
+func (spill *spillStore) eventsMatching(match func(*spilledEvent) bool, limit int) ([]*chatEvent, error) {
+	spill.mu.Lock()
+	defer spill.mu.Unlock()
+	starts, err := spill.segments()
+	if err != nil {
+		return nil, err
+	}
+	cutoff := spill.cutoff()
+	var found []*chatEvent
+	for _, start := range starts {
+		segmentEvents, err := spill.readSegment(start, cutoff, match)
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, segmentEvents...)
+		if len(found) >= limit {
+			break
+		}
+	}
+	return found, nil
+}
+
+// NOTE: callers must hold spill.mu
+func (spill *spillStore) readSegment(start, cutoff int64, match func(*spilledEvent) bool) ([]*chatEvent, error) {
+	f, err := os.Open(spill.segmentPath(start))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var events []*chatEvent
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var spilled spilledEvent
+		if err := json.Unmarshal(scanner.Bytes(), &spilled); err != nil {
+			// most likely a partial line from a crash, skip it
+			continue
+		}
+		if spilled.Timestamp < cutoff || !match(&spilled) {
+			continue
+		}
+		events = append(events, &chatEvent{Timestamp: spilled.Timestamp, ID: spilled.ID, Category: spilled.Category,
+			Data: spilled.Data, size: int64(len(spilled.Data))})
+	}
+	return events, scanner.Err()
+}
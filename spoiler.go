@@ -0,0 +1,33 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// ||text|| marks a spoiler.  Blackfriday has no extension hook for this so
+// it's done on its html output, leaving code alone.  Spoilers can hold
+// inline markup (emphasis, links, images) but not span paragraphs.
+var (
+	spoilerRegex  = regexp.MustCompile(`\|\|((?:[^|<\n]|</?(?:em|strong|a|del|img|code)\b[^>]*>)+?)\|\|`)
+	htmlCodeRegex = regexp.MustCompile(`(?s)<pre>.*?</pre>|<code>.*?</code>`)
+)
+
+func renderSpoilers(html string) string {
+	if !strings.Contains(html, "||") {
+		return html
+	}
+	var out strings.Builder
+	last := 0
+	for _, code := range htmlCodeRegex.FindAllStringIndex(html, -1) {
+		out.WriteString(replaceSpoilers(html[last:code[0]]))
+		out.WriteString(html[code[0]:code[1]])
+		last = code[1]
+	}
+	out.WriteString(replaceSpoilers(html[last:]))
+	return out.String()
+}
+
+func replaceSpoilers(html string) string {
+	return spoilerRegex.ReplaceAllString(html, `<span class="spoiler" title="Click to reveal">$1</span>`)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// chatStats keeps simple in-memory counters per topic and per http handler.
+// It is intentionally independent of any external metrics system so small
+// instances can be inspected with nothing more than curl.
+type chatStats struct {
+	mu       sync.Mutex
+	started  time.Time
+	topics   map[string]*topicStats
+	handlers map[string]*handlerStats
+	// what topics are checked against before they get an entry
+	manager *chatStore
+}
+
+type topicStats struct {
+	Posts       uint64            `json:"posts"`
+	Bytes       uint64            `json:"bytes"`
+	Subscribers int               `json:"subscribers"`
+	LastPostMs  int64             `json:"last_post_ms,omitempty"`
+	Rejections  map[string]uint64 `json:"rejections,omitempty"`
+	// events dropped from the buffer, by eviction reason
+	Evictions    map[string]uint64 `json:"evictions,omitempty"`
+	EvictedBytes uint64            `json:"evicted_bytes,omitempty"`
+	lastActive   time.Time
+}
+
+type handlerStats struct {
+	Requests    uint64         `json:"requests"`
+	InFlight    int            `json:"in_flight"`
+	TotalMillis int64          `json:"total_ms"`
+	MaxMillis   int64          `json:"max_ms"`
+	Statuses    map[int]uint64 `json:"statuses"`
+}
+
+// Used as the topic key for rejected posts that never had a valid topic.
+const noTopic = "(none)"
+
+const (
+	// past this many topics new ones are counted under noTopic
+	maxStatsTopics = 10000
+	// topics nobody's watching drop out of the stats after being quiet this long
+	statsTopicTTL = 24 * time.Hour
+)
+
+func newChatStats(manager *chatStore) *chatStats {
+	stats := &chatStats{
+		started:  time.Now(),
+		topics:   make(map[string]*topicStats),
+		handlers: make(map[string]*handlerStats),
+		manager:  manager,
+	}
+	go stats.cleanup()
+	return stats
+}
+
+// statsKey is what a topic from a request is counted under, noTopic unless
+// it's a topic with chats.
+// NOTE: callers must not hold s.mu, the store calls into stats with its own
+// lock held when evicting.
+func (s *chatStats) statsKey(topic string) string {
+	if topic == ALL_CHATS || (topicNameRegex.MatchString(topic) && s.manager.hasTopic(topic)) {
+		return topic
+	}
+	return noTopic
+}
+
+// NOTE: callers must hold s.mu
+func (s *chatStats) topic(topic string) *topicStats {
+	if len(topic) == 0 {
+		topic = noTopic
+	}
+	ts, found := s.topics[topic]
+	if !found {
+		if len(s.topics) >= maxStatsTopics {
+			topic = noTopic
+			ts = s.topics[noTopic]
+		}
+		if ts == nil {
+			ts = &topicStats{}
+			s.topics[topic] = ts
+		}
+	}
+	ts.lastActive = time.Now()
+	return ts
+}
+
+// cleanup drops topics with no subscribers that have been quiet a while.
+func (s *chatStats) cleanup() {
+	for range time.Tick(10 * time.Minute) {
+		s.mu.Lock()
+		for topic, ts := range s.topics {
+			if ts.Subscribers <= 0 && time.Since(ts.lastActive) >= statsTopicTTL {
+				delete(s.topics, topic)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *chatStats) recordPost(chat ChatPost) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ts := s.topic(chat.Topic)
+	ts.Posts++
+	ts.Bytes += uint64(len(chat.DisplayName) + len(chat.Message))
+	ts.LastPostMs = time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+func (s *chatStats) recordRejection(topic, reason string) {
+	topic = s.statsKey(topic)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ts := s.topic(topic)
+	if ts.Rejections == nil {
+		ts.Rejections = make(map[string]uint64)
+	}
+	ts.Rejections[reason]++
+}
+
+func (s *chatStats) recordEviction(event *chatEvent, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ts := s.topic(event.Category)
+	if ts.Evictions == nil {
+		ts.Evictions = make(map[string]uint64)
+	}
+	ts.Evictions[reason]++
+	ts.EvictedBytes += uint64(event.size)
+}
+
+// trackHandler wraps an http handler so its request count, latency and
+// response statuses show up under the given name in /admin/stats.
+func (s *chatStats) trackHandler(name string, handler func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		hs, found := s.handlers[name]
+		if !found {
+			hs = &handlerStats{Statuses: make(map[int]uint64)}
+			s.handlers[name] = hs
+		}
+		hs.Requests++
+		hs.InFlight++
+		s.mu.Unlock()
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		handler(rec, r)
+		elapsed := int64(time.Since(start) / time.Millisecond)
+
+		s.mu.Lock()
+		hs.InFlight--
+		hs.TotalMillis += elapsed
+		if elapsed > hs.MaxMillis {
+			hs.MaxMillis = elapsed
+		}
+		hs.Statuses[rec.status]++
+		s.mu.Unlock()
+	}
+}
+
+// trackSubscribers wraps a subscription handler so the number of clients
+// currently waiting on each topic is visible in the topic stats.  Only
+// topics with chats are counted, not whatever a request names.
+func (s *chatStats) trackSubscribers(handler func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var keys []string
+		for _, topic := range strings.SplitN(r.URL.Query().Get("category"), ",", maxSubscribeCategories+1) {
+			if key := s.statsKey(topic); key != noTopic {
+				keys = append(keys, key)
+			}
+		}
+		tracked := make([]*topicStats, len(keys))
+		s.mu.Lock()
+		for i, key := range keys {
+			tracked[i] = s.topic(key)
+			tracked[i].Subscribers++
+		}
+		s.mu.Unlock()
+		defer func() {
+			s.mu.Lock()
+			for _, ts := range tracked {
+				ts.Subscribers--
+				ts.lastActive = time.Now()
+			}
+			s.mu.Unlock()
+		}()
+		handler(w, r)
+	}
+}
+
+// statusRecorder remembers the status code written by a wrapped handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// Flush passes through so long polls can stream heartbeats.
+func (rec *statusRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func getStatsClosure(stats *chatStats, store *chatStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		// NOTE: fetch usage before locking stats since the store calls into
+		// stats with its own lock held when evicting.
+		usage := store.usage()
+		stats.mu.Lock()
+		data, err := json.MarshalIndent(struct {
+			UptimeSeconds int64                    `json:"uptime_seconds"`
+			Buffer        storeUsage               `json:"buffer"`
+			Topics        map[string]*topicStats   `json:"topics"`
+			Handlers      map[string]*handlerStats `json:"handlers"`
+		}{int64(time.Since(stats.started) / time.Second), usage, stats.topics, stats.handlers}, "", "  ")
+		stats.mu.Unlock()
+		if err != nil {
+			http.Error(w, "Failed to encode stats.", 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	}
+}
@@ -0,0 +1,880 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// chatStore is the in-memory event buffer behind /subscribe.  It speaks the
+// same longpoll protocol the client has always used (timeout, category and
+// since_time query params; events/timeout/error json responses) but, unlike
+// an opaque pub-sub library, it knows how many bytes it is holding and can
+// evict by topic when it goes over budget.
+//
+// Every event is stored once, in its own category.  ALL_CHATS isn't a
+// category of its own but a view over all of them, and a comma separated
+// category subscribes to several at once.
+type chatStore struct {
+	mu         sync.Mutex
+	opts       storeOptions
+	categories map[string]*categoryBuffer
+	totalBytes int64
+	evicted    []func(event *chatEvent, reason string)
+	delivered  []func(events []*chatEvent)
+	published  []func(event *chatEvent)
+	buffered   []func(event *chatEvent)
+	// replicates publishes to other servers before they're buffered, nil
+	// when this server is on its own
+	log publishLog
+	// last event id handed out, ids only ever go up
+	lastID int64
+	// closed and replaced whenever an event is published to any category,
+	// for ALL_CHATS and multi category subscribers
+	anyNotify chan struct{}
+	reaped    reapStats
+	// newest event id replicated from a primary
+	replicatedID int64
+}
+
+// reapStats is what the reaper has been doing, for /admin/stats.
+type reapStats struct {
+	IntervalSeconds float64 `json:"interval_seconds"`
+	Sweeps          uint64  `json:"sweeps"`
+	// events expired over all sweeps
+	Removed      uint64         `json:"removed"`
+	LastSweepMs  int64          `json:"last_sweep_ms,omitempty"`
+	LastSweepUs  int64          `json:"last_sweep_us"`
+	LastRemoved  int            `json:"last_removed"`
+	LastByTopic  map[string]int `json:"last_removed_by_topic,omitempty"`
+	BuffersFreed uint64         `json:"buffers_freed"`
+}
+
+type storeOptions struct {
+	// Max events kept for a category, regardless of their size.
+	MaxEventsPerCategory func(category string) int
+	// Max bytes kept for a category, so one busy category can only ever
+	// push out its own history.  Optional, nil for no per category limit.
+	MaxBytesPerCategory func(category string) int64
+	// Max bytes kept across all categories.  When exceeded, the oldest events
+	// of the category holding the most bytes are dropped first.
+	MaxBytes int64
+	// How long an event is kept before the reaper expires it.
+	EventTTL time.Duration
+	// How often the reaper sweeps for expired events, 30s when zero.
+	ReapInterval time.Duration
+	// Longest a single /subscribe request may wait for new events.
+	MaxTimeout time.Duration
+}
+
+type chatEvent struct {
+	Timestamp int64       `json:"timestamp"`
+	ID        int64       `json:"id"` // goes up with every publish, for resuming
+	Category  string      `json:"category"`
+	Data      interface{} `json:"data"`
+	// encoded size of Data, used for the memory budget
+	size int64
+}
+
+type categoryBuffer struct {
+	events      []*chatEvent // oldest first
+	bytes       int64
+	lastPublish int64
+	// closed and replaced whenever an event is published to this category
+	notify chan struct{}
+	// left out of the ALL_CHATS view, set once an encrypted chat is posted
+	private bool
+}
+
+// Eviction reasons passed to eviction callbacks and shown in stats.
+const (
+	evictedForCount      = "count"
+	evictedForBytes      = "bytes"
+	evictedForTopicBytes = "topic_bytes"
+	evictedForTTL        = "ttl"
+)
+
+func newChatStore(opts storeOptions) *chatStore {
+	if opts.ReapInterval <= 0 {
+		opts.ReapInterval = 30 * time.Second
+	}
+	store := &chatStore{
+		opts:       opts,
+		categories: make(map[string]*categoryBuffer),
+		// start from the clock (in microseconds) so ids keep going up across
+		// restarts and resume tokens from before one still work
+		lastID:    time.Now().UnixNano() / int64(time.Microsecond),
+		anyNotify: make(chan struct{}),
+		reaped:    reapStats{IntervalSeconds: opts.ReapInterval.Seconds()},
+	}
+	go store.reap()
+	return store
+}
+
+func timeToEpochMilliseconds(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// onEvict registers a callback that is invoked (with the store lock held)
+// for every event dropped from memory.
+func (store *chatStore) onEvict(callback func(event *chatEvent, reason string)) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.evicted = append(store.evicted, callback)
+}
+
+// onDeliver registers a callback that is invoked (without the store lock)
+// with the events each /subscribe response delivered.
+func (store *chatStore) onDeliver(callback func(events []*chatEvent)) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.delivered = append(store.delivered, callback)
+}
+
+// onPublish registers a callback that is invoked (without the store lock)
+// for every event published, to any category.
+func (store *chatStore) onPublish(callback func(event *chatEvent)) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.published = append(store.published, callback)
+}
+
+// onBuffer registers a callback that is invoked (without the store lock)
+// for every event buffered, whether published here or on another server.
+func (store *chatStore) onBuffer(callback func(event *chatEvent)) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.buffered = append(store.buffered, callback)
+}
+
+// publishLog is a log shared by a cluster of servers that every publish goes
+// through, so they all buffer the same events with the same ids.
+type publishLog interface {
+	// append returns the events with their ids once the cluster committed
+	// them, by which time this server has buffered them too.
+	append(events []*chatEvent) ([]*chatEvent, error)
+}
+
+// replicateThrough sends every later publish through log.
+func (store *chatStore) replicateThrough(log publishLog) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.log = log
+}
+
+// NOTE: callers must hold store.mu
+func (store *chatStore) buffer(category string) *categoryBuffer {
+	buf, found := store.categories[category]
+	if !found {
+		buf = &categoryBuffer{notify: make(chan struct{})}
+		store.categories[category] = buf
+	}
+	return buf
+}
+
+func (store *chatStore) Publish(category string, data interface{}) error {
+	_, err := store.publishAll([]pendingEvent{{category, data}})
+	return err
+}
+
+type pendingEvent struct {
+	category string
+	data     interface{}
+}
+
+// publishAll publishes the events in order under a single lock, so they get
+// consecutive ids and subscribers see either none or all of them.
+func (store *chatStore) publishAll(pending []pendingEvent) ([]*chatEvent, error) {
+	now := timeToEpochMilliseconds(time.Now())
+	events := make([]*chatEvent, len(pending))
+	for i, p := range pending {
+		encoded, err := json.Marshal(p.data)
+		if err != nil {
+			return nil, err
+		}
+		events[i] = &chatEvent{Timestamp: now, Category: p.category, Data: p.data, size: int64(len(encoded))}
+	}
+
+	store.mu.Lock()
+	if log := store.log; log != nil {
+		published := store.published
+		store.mu.Unlock()
+		committed, err := log.append(events)
+		if err != nil {
+			return nil, err
+		}
+		for _, event := range committed {
+			for _, callback := range published {
+				callback(event)
+			}
+		}
+		return committed, nil
+	}
+	for _, event := range events {
+		store.lastID++
+		event.ID = store.lastID
+		store.insert(event)
+	}
+	store.wake(events)
+	published := store.published
+	buffered := store.buffered
+	store.mu.Unlock()
+	for _, event := range events {
+		for _, callback := range published {
+			callback(event)
+		}
+		for _, callback := range buffered {
+			callback(event)
+		}
+	}
+	return events, nil
+}
+
+// insert buffers an event that already has its id, evicting whatever its
+// category's and the store's limits push out.
+// NOTE: callers must hold store.mu
+func (store *chatStore) insert(event *chatEvent) {
+	category := event.Category
+	buf := store.buffer(category)
+	if chat, ok := event.Data.(ChatPost); ok && chat.Encrypted {
+		buf.private = true
+	}
+	buf.events = append(buf.events, event)
+	buf.bytes += event.size
+	buf.lastPublish = event.Timestamp
+	store.totalBytes += event.size
+	for len(buf.events) > store.opts.MaxEventsPerCategory(category) {
+		store.dropOldest(category, buf, evictedForCount)
+	}
+	if max := store.maxCategoryBytes(category); max > 0 {
+		// never drop the event we just published
+		for len(buf.events) > 1 && buf.bytes > max {
+			store.dropOldest(category, buf, evictedForTopicBytes)
+		}
+	}
+	store.enforceBudget(category)
+}
+
+// wake wakes the subscribers of the events' categories and of ALL_CHATS.
+// NOTE: callers must hold store.mu
+func (store *chatStore) wake(events []*chatEvent) {
+	woken := make(map[string]bool)
+	for _, event := range events {
+		if !woken[event.Category] {
+			woken[event.Category] = true
+			buf := store.buffer(event.Category)
+			close(buf.notify)
+			buf.notify = make(chan struct{})
+		}
+	}
+	close(store.anyNotify)
+	store.anyNotify = make(chan struct{})
+}
+
+// replicate buffers events published on another server, keeping their ids
+// and timestamps, and skipping any it already has.  Chats with a tombstone
+// among the events are dropped, like the publishing server did.  Publish
+// callbacks aren't called, the publishing server already sent the webhooks
+// and notifications.
+func (store *chatStore) replicate(events []*chatEvent) error {
+	for _, event := range events {
+		encoded, err := json.Marshal(event.Data)
+		if err != nil {
+			return err
+		}
+		event.size = int64(len(encoded))
+	}
+	store.mu.Lock()
+	var added []*chatEvent
+	erased := make(map[string]bool)
+	for _, event := range events {
+		if event.ID <= store.replicatedID {
+			continue
+		}
+		store.replicatedID = event.ID
+		if event.ID > store.lastID {
+			store.lastID = event.ID
+		}
+		store.insert(event)
+		added = append(added, event)
+		if tombstone, ok := event.Data.(chatTombstone); ok {
+			erased[tombstone.Tombstone] = true
+		}
+	}
+	if len(erased) > 0 {
+		store.removeLocked(func(event *chatEvent) bool {
+			chat, ok := event.Data.(ChatPost)
+			return ok && erased[chat.ID]
+		})
+	}
+	if len(added) > 0 {
+		store.wake(added)
+	}
+	buffered := store.buffered
+	store.mu.Unlock()
+	for _, event := range added {
+		for _, callback := range buffered {
+			callback(event)
+		}
+	}
+	return nil
+}
+
+// restore buffers events from a ChatStore at startup, keeping their ids and
+// timestamps, returning how many it buffered.  Like replicate it skips any
+// it already has, anything no newer than what's buffered is one of those or
+// would land out of order.  Chats with a tombstone among the events stay
+// gone.  No callbacks are called, not even for evictions,
+// the events were handled when they were first published.
+func (store *chatStore) restore(events []*chatEvent) int {
+	erased := make(map[string]bool)
+	for _, event := range events {
+		if tombstone, ok := event.Data.(chatTombstone); ok {
+			erased[tombstone.Tombstone] = true
+		}
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	evicted := store.evicted
+	store.evicted = nil
+	var newest int64
+	for _, buf := range store.categories {
+		if len(buf.events) > 0 && buf.events[len(buf.events)-1].ID > newest {
+			newest = buf.events[len(buf.events)-1].ID
+		}
+	}
+	restored := 0
+	for _, event := range events {
+		if chat, ok := event.Data.(ChatPost); ok && erased[chat.ID] || event.ID <= newest {
+			continue
+		}
+		encoded, err := json.Marshal(event.Data)
+		if err != nil {
+			continue
+		}
+		event.size = int64(len(encoded))
+		if event.ID > store.lastID {
+			store.lastID = event.ID
+		}
+		store.insert(event)
+		restored++
+	}
+	store.evicted = evicted
+	return restored
+}
+
+// nextID is the id the next event published through a publishLog gets:
+// after any id this server has seen, and no lower than the clock so ids
+// keep going up across restarts.
+func (store *chatStore) nextID(after int64) int64 {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	next := time.Now().UnixNano() / int64(time.Microsecond)
+	if store.lastID >= next {
+		next = store.lastID + 1
+	}
+	if after >= next {
+		next = after + 1
+	}
+	return next
+}
+
+// eventsAfter returns up to limit buffered events of every category, private
+// ones too, with ids after afterID, oldest first.  The channel is closed
+// when the next event is published.
+func (store *chatStore) eventsAfter(afterID int64, limit int) ([]*chatEvent, chan struct{}) {
+	cutoff := timeToEpochMilliseconds(time.Now().Add(-store.opts.EventTTL))
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	var events []*chatEvent
+	for _, buf := range store.categories {
+		for _, event := range buf.events {
+			if event.ID > afterID && event.Timestamp >= cutoff {
+				events = append(events, event)
+			}
+		}
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].ID < events[j].ID })
+	if len(events) > limit {
+		events = events[:limit]
+	}
+	return events, store.anyNotify
+}
+
+// maxCategoryBytes is the category's own byte budget, 0 when it has none.
+func (store *chatStore) maxCategoryBytes(category string) int64 {
+	if store.opts.MaxBytesPerCategory == nil {
+		return 0
+	}
+	return store.opts.MaxBytesPerCategory(category)
+}
+
+// enforceBudget evicts events until the store fits in its byte budget,
+// always from the category holding the most bytes (the least recently
+// published-to one on ties), so a runaway topic eats into its own history
+// before anyone else's.
+// NOTE: callers must hold store.mu
+func (store *chatStore) enforceBudget(justPublished string) {
+	for store.opts.MaxBytes > 0 && store.totalBytes > store.opts.MaxBytes {
+		victim := ""
+		var victimBuf *categoryBuffer
+		for category, buf := range store.categories {
+			// never drop the event we just published
+			if len(buf.events) == 0 || (category == justPublished && len(buf.events) == 1) {
+				continue
+			}
+			if victimBuf == nil || buf.bytes > victimBuf.bytes ||
+				(buf.bytes == victimBuf.bytes && buf.lastPublish < victimBuf.lastPublish) {
+				victim, victimBuf = category, buf
+			}
+		}
+		if victimBuf == nil {
+			return
+		}
+		store.dropOldest(victim, victimBuf, evictedForBytes)
+	}
+}
+
+// NOTE: callers must hold store.mu
+func (store *chatStore) dropOldest(category string, buf *categoryBuffer, reason string) {
+	event := buf.events[0]
+	buf.events[0] = nil
+	buf.events = buf.events[1:]
+	buf.bytes -= event.size
+	store.totalBytes -= event.size
+	for _, callback := range store.evicted {
+		callback(event, reason)
+	}
+	if len(buf.events) == 0 {
+		// keep the buffer around while anyone may be waiting on notify;
+		// the reaper removes idle empty buffers.
+		buf.events = nil
+	}
+}
+
+// remove drops the buffered events match picks from every category without
+// calling the eviction callbacks, returning what it dropped.
+func (store *chatStore) remove(match func(*chatEvent) bool) []*chatEvent {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.removeLocked(match)
+}
+
+// NOTE: callers must hold store.mu
+func (store *chatStore) removeLocked(match func(*chatEvent) bool) []*chatEvent {
+	var removed []*chatEvent
+	for _, buf := range store.categories {
+		kept := buf.events[:0]
+		for _, event := range buf.events {
+			if !match(event) {
+				kept = append(kept, event)
+				continue
+			}
+			removed = append(removed, event)
+			buf.bytes -= event.size
+			store.totalBytes -= event.size
+		}
+		for i := len(kept); i < len(buf.events); i++ {
+			buf.events[i] = nil
+		}
+		buf.events = kept
+	}
+	return removed
+}
+
+// reap periodically expires events that outlived the configured TTL.
+func (store *chatStore) reap() {
+	for range time.Tick(store.opts.ReapInterval) {
+		store.expire()
+	}
+}
+
+func (store *chatStore) expire() {
+	start := time.Now()
+	cutoff := timeToEpochMilliseconds(start.Add(-store.opts.EventTTL))
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	removed := 0
+	byTopic := make(map[string]int)
+	for category, buf := range store.categories {
+		for len(buf.events) > 0 && buf.events[0].Timestamp < cutoff {
+			store.dropOldest(category, buf, evictedForTTL)
+			removed++
+			byTopic[category]++
+		}
+		if len(buf.events) == 0 && buf.lastPublish < cutoff {
+			// wake any waiting subscribers so they move to a fresh buffer
+			close(buf.notify)
+			delete(store.categories, category)
+			store.reaped.BuffersFreed++
+		}
+	}
+	store.reaped.Sweeps++
+	store.reaped.Removed += uint64(removed)
+	store.reaped.LastSweepMs = timeToEpochMilliseconds(start)
+	store.reaped.LastSweepUs = int64(time.Since(start) / time.Microsecond)
+	store.reaped.LastRemoved = removed
+	store.reaped.LastByTopic = byTopic
+}
+
+// eventsSince returns the category's events newer than sinceTime, or with
+// ids after afterID when it's set, along with a channel that is closed when
+// the next event is published to it.
+func (store *chatStore) eventsSince(category string, sinceTime, afterID int64) ([]*chatEvent, chan struct{}) {
+	cutoff := timeToEpochMilliseconds(time.Now().Add(-store.opts.EventTTL))
+	keep := func(event *chatEvent) bool {
+		newer := event.Timestamp > sinceTime
+		if afterID > 0 {
+			newer = event.ID > afterID
+		}
+		return newer && event.Timestamp >= cutoff
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if category == ALL_CHATS || strings.Contains(category, ",") {
+		events := store.viewEvents(category, keep)
+		// the view holds as many events as an ALL_CHATS buffer would have
+		if max := store.opts.MaxEventsPerCategory(ALL_CHATS); category == ALL_CHATS && len(events) > max {
+			events = events[len(events)-max:]
+		}
+		return events, store.anyNotify
+	}
+	buf := store.buffer(category)
+	var events []*chatEvent
+	for _, event := range buf.events {
+		if keep(event) {
+			events = append(events, event)
+		}
+	}
+	return events, buf.notify
+}
+
+// viewEvents returns the events keep picks from every non private category
+// for ALL_CHATS, or from each of a comma separated list of categories, in
+// the order they were published.
+// NOTE: callers must hold store.mu
+func (store *chatStore) viewEvents(category string, keep func(*chatEvent) bool) []*chatEvent {
+	var buffers []*categoryBuffer
+	if category == ALL_CHATS {
+		for _, buf := range store.categories {
+			if !buf.private {
+				buffers = append(buffers, buf)
+			}
+		}
+	} else {
+		for _, name := range strings.Split(category, ",") {
+			if buf, found := store.categories[name]; found {
+				buffers = append(buffers, buf)
+			}
+		}
+	}
+	var events []*chatEvent
+	for _, buf := range buffers {
+		for _, event := range buf.events {
+			if keep(event) {
+				events = append(events, event)
+			}
+		}
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].ID < events[j].ID })
+	return events
+}
+
+type eventFilterKey struct{}
+
+// withEventFilter returns the request with a filter attached, events it
+// returns false for are left out of subscribe and history responses.
+// Filters attached before it still apply.
+func withEventFilter(r *http.Request, keep func(*chatEvent) bool) *http.Request {
+	if earlier, ok := r.Context().Value(eventFilterKey{}).(func(*chatEvent) bool); ok {
+		later := keep
+		keep = func(event *chatEvent) bool { return earlier(event) && later(event) }
+	}
+	return r.WithContext(context.WithValue(r.Context(), eventFilterKey{}, keep))
+}
+
+func filterEvents(r *http.Request, events []*chatEvent) []*chatEvent {
+	keep, ok := r.Context().Value(eventFilterKey{}).(func(*chatEvent) bool)
+	if !ok {
+		return events
+	}
+	var kept []*chatEvent
+	for _, event := range events {
+		if keep(event) {
+			kept = append(kept, event)
+		}
+	}
+	return kept
+}
+
+// hasTopic reports whether the category has any buffered events.
+func (store *chatStore) hasTopic(category string) bool {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	buf, found := store.categories[category]
+	return found && len(buf.events) > 0
+}
+
+// countSince returns how many of the category's buffered events are newer
+// than sinceTime.
+func (store *chatStore) countSince(category string, sinceTime int64) int {
+	cutoff := timeToEpochMilliseconds(time.Now().Add(-store.opts.EventTTL))
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	buf, found := store.categories[category]
+	if !found {
+		return 0
+	}
+	count := 0
+	for i := len(buf.events) - 1; i >= 0; i-- {
+		if buf.events[i].Timestamp <= sinceTime || buf.events[i].Timestamp < cutoff {
+			break
+		}
+		// tombstones and flags aren't chats
+		if _, chat := buf.events[i].Data.(ChatPost); !chat {
+			continue
+		}
+		count++
+	}
+	return count
+}
+
+// eventsMatching returns up to limit of the newest buffered events, across
+// all categories, that the match func picks.  Newest first.
+func (store *chatStore) eventsMatching(match func(*chatEvent) bool, limit int) []*chatEvent {
+	cutoff := timeToEpochMilliseconds(time.Now().Add(-store.opts.EventTTL))
+	store.mu.Lock()
+	var events []*chatEvent
+	for _, buf := range store.categories {
+		for _, event := range buf.events {
+			if event.Timestamp >= cutoff && match(event) {
+				events = append(events, event)
+			}
+		}
+	}
+	store.mu.Unlock()
+	sort.Slice(events, func(i, j int) bool { return events[i].Timestamp > events[j].Timestamp })
+	if len(events) > limit {
+		events = events[:limit]
+	}
+	return events
+}
+
+// eventsBefore returns up to limit of the category's newest buffered events
+// older than before, oldest first.
+func (store *chatStore) eventsBefore(category string, before int64, limit int) []*chatEvent {
+	cutoff := timeToEpochMilliseconds(time.Now().Add(-store.opts.EventTTL))
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if category == ALL_CHATS {
+		events := store.viewEvents(category, func(event *chatEvent) bool {
+			return event.Timestamp < before && event.Timestamp >= cutoff
+		})
+		if len(events) > limit {
+			events = events[len(events)-limit:]
+		}
+		return events
+	}
+	buf, found := store.categories[category]
+	if !found {
+		return nil
+	}
+	var events []*chatEvent
+	for i := len(buf.events) - 1; i >= 0 && len(events) < limit; i-- {
+		event := buf.events[i]
+		if event.Timestamp < before && event.Timestamp >= cutoff {
+			events = append(events, event)
+		}
+	}
+	// collected newest first, flip back to chronological order
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	return events
+}
+
+type storeUsage struct {
+	Events     int                          `json:"events"`
+	Bytes      int64                        `json:"bytes"`
+	MaxBytes   int64                        `json:"max_bytes"`
+	Categories map[string]int64             `json:"bytes_per_category"`
+	Buffers    map[string]categoryOccupancy `json:"per_category"`
+	Reaper     reapStats                    `json:"reaper"`
+}
+
+// categoryOccupancy is how full one category's buffer is, against both of
+// its limits.
+type categoryOccupancy struct {
+	Events    int   `json:"events"`
+	MaxEvents int   `json:"max_events"`
+	Bytes     int64 `json:"bytes"`
+	MaxBytes  int64 `json:"max_bytes,omitempty"`
+	OldestMs  int64 `json:"oldest_ms,omitempty"`
+	// whichever limit is closer to being hit
+	PercentFull int `json:"percent_full"`
+}
+
+func (store *chatStore) usage() storeUsage {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	usage := storeUsage{Bytes: store.totalBytes, MaxBytes: store.opts.MaxBytes,
+		Categories: make(map[string]int64), Buffers: make(map[string]categoryOccupancy), Reaper: store.reaped}
+	for category, buf := range store.categories {
+		usage.Events += len(buf.events)
+		usage.Categories[category] = buf.bytes
+		occupancy := categoryOccupancy{Events: len(buf.events), MaxEvents: store.opts.MaxEventsPerCategory(category),
+			Bytes: buf.bytes, MaxBytes: store.maxCategoryBytes(category)}
+		if len(buf.events) > 0 {
+			occupancy.OldestMs = buf.events[0].Timestamp
+		}
+		if occupancy.MaxEvents > 0 {
+			occupancy.PercentFull = 100 * occupancy.Events / occupancy.MaxEvents
+		}
+		if occupancy.MaxBytes > 0 && int(100*occupancy.Bytes/occupancy.MaxBytes) > occupancy.PercentFull {
+			occupancy.PercentFull = int(100 * occupancy.Bytes / occupancy.MaxBytes)
+		}
+		usage.Buffers[category] = occupancy
+	}
+	return usage
+}
+
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+// heartbeatWriter sends the response headers with the first heartbeat,
+// after that the status can't change.
+type heartbeatWriter struct {
+	http.ResponseWriter
+	flusher     http.Flusher
+	wroteHeader bool
+}
+
+func (hw *heartbeatWriter) WriteHeader(status int) {
+	if !hw.wroteHeader {
+		hw.wroteHeader = true
+		hw.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (hw *heartbeatWriter) beat() {
+	if !hw.wroteHeader {
+		hw.Header().Set("Content-Type", "application/json")
+		hw.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+		hw.WriteHeader(200)
+	}
+	hw.Write([]byte("\n"))
+	hw.flusher.Flush()
+}
+
+// most categories one /subscribe can watch at once
+const maxSubscribeCategories = 20
+
+// SubscriptionHandler serves longpoll requests:
+//
+//	/subscribe?timeout=N&category=C[,C2...][&since_time=MS | &last_id=ID][&encoding=E]
+//
+// Buffered events newer than since_time (or after the event last_id) are
+// returned immediately, otherwise the request waits up to timeout seconds
+// for the next one.  Resuming by last_id never skips or repeats events that
+// were published in the same millisecond.  encoding picks json (the
+// default), compact or msgpack responses, see encoding.go.
+//
+// With heartbeat=S a newline is written every S seconds while the request
+// waits, so proxies don't cut idle polls and clients watching the response
+// come in can tell a quiet topic from a dead connection.  The body is still
+// a single json document, parsers skip the leading whitespace.
+func (store *chatStore) SubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	timeout, err := strconv.Atoi(query.Get("timeout"))
+	if err != nil || timeout < 1 || time.Duration(timeout)*time.Second > store.opts.MaxTimeout {
+		writeJSON(w, 400, map[string]string{"error": "Invalid timeout arg."})
+		return
+	}
+	category := query.Get("category")
+	if len(category) == 0 || len(category) > 1024 {
+		writeJSON(w, 400, map[string]string{"error": "Invalid subscription category, must be 1-1024 characters long."})
+		return
+	}
+	if parts := strings.Split(category, ","); len(parts) > 1 {
+		for _, part := range parts {
+			if len(part) == 0 || part == ALL_CHATS || len(parts) > maxSubscribeCategories {
+				writeJSON(w, 400, map[string]string{"error": "Invalid subscription category list."})
+				return
+			}
+		}
+	}
+	sinceTime := timeToEpochMilliseconds(time.Now())
+	if sinceString := query.Get("since_time"); len(sinceString) > 0 {
+		sinceTime, err = strconv.ParseInt(sinceString, 10, 64)
+		if err != nil {
+			writeJSON(w, 400, map[string]string{"error": "Invalid since_time arg."})
+			return
+		}
+	}
+	if !validEncoding(query.Get("encoding")) {
+		writeJSON(w, 400, map[string]string{"error": "Invalid encoding arg, must be json, compact or msgpack."})
+		return
+	}
+	var heartbeat <-chan time.Time
+	if heartbeatString := query.Get("heartbeat"); len(heartbeatString) > 0 {
+		seconds, err := strconv.Atoi(heartbeatString)
+		flusher, canFlush := w.(http.Flusher)
+		// msgpack has no whitespace to pad with
+		if err != nil || seconds < 1 || seconds >= timeout || !canFlush || query.Get("encoding") == encodingMsgpack {
+			writeJSON(w, 400, map[string]string{"error": "Invalid heartbeat arg, must be 1 up to timeout-1 seconds, and not with msgpack."})
+			return
+		}
+		ticker := time.NewTicker(time.Duration(seconds) * time.Second)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+		w = &heartbeatWriter{ResponseWriter: w, flusher: flusher}
+	}
+	var lastID int64
+	if lastIDString := query.Get("last_id"); len(lastIDString) > 0 {
+		lastID, err = strconv.ParseInt(lastIDString, 10, 64)
+		if err != nil || lastID < 1 {
+			writeJSON(w, 400, map[string]string{"error": "Invalid last_id arg."})
+			return
+		}
+	}
+
+	deadline := time.NewTimer(time.Duration(timeout) * time.Second)
+	defer deadline.Stop()
+	for {
+		events, notify := store.eventsSince(category, sinceTime, lastID)
+		// events filtered out for this request don't end the long poll, it
+		// just waits for the next publish
+		events = filterEvents(r, events)
+		if len(events) > 0 {
+			writeEncoded(w, r, map[string][]*chatEvent{"events": events})
+			store.mu.Lock()
+			delivered := store.delivered
+			store.mu.Unlock()
+			for _, callback := range delivered {
+				callback(events)
+			}
+			return
+		}
+		select {
+		case <-notify:
+			// new event published, loop around to fetch it
+		case <-heartbeat:
+			w.(*heartbeatWriter).beat()
+		case <-deadline.C:
+			writeEncoded(w, r, map[string]interface{}{"timeout": "no events before timeout",
+				"timestamp": timeToEpochMilliseconds(time.Now())})
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
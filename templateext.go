@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+)
+
+// pageExtensions fit the chat page into a site's own layout.  The page has
+// blocks that are empty (or the default footer) unless redefined:
+//
+//	{{ define "head" }}     end of <head>, for stylesheets and meta tags
+//	{{ define "nav" }}      top of <body>, for a site header and nav links
+//	{{ define "footer" }}   replaces the footer
+//	{{ define "scripts" }}   end of <body>
+//
+// Blocks get the page's data, with Data's result as .Extra.
+type pageExtensions struct {
+	// functions blocks can call, added before anything is parsed
+	Funcs template.FuncMap
+	// template sources with the block definitions
+	Blocks []string
+	// per request data for blocks (the signed in user, ...), may be nil
+	Data func(r *http.Request) map[string]interface{}
+}
+
+// parse returns the page's template with the extensions applied.
+func (ext pageExtensions) parse(name, source string) (*template.Template, error) {
+	page, err := template.New(name).Funcs(ext.Funcs).Parse(source)
+	if err != nil {
+		return nil, err
+	}
+	for _, blocks := range ext.Blocks {
+		if page, err = page.Parse(blocks); err != nil {
+			return nil, err
+		}
+	}
+	return page, nil
+}
+
+func (ext pageExtensions) data(r *http.Request) map[string]interface{} {
+	if ext.Data == nil {
+		return nil
+	}
+	return ext.Data(r)
+}
+
+// loadPageExtensions reads the -templateBlocks file of block definitions and
+// the -templateData json object handed to every block as .Extra, when set.
+func loadPageExtensions(blocksPath, dataPath string) (pageExtensions, error) {
+	var ext pageExtensions
+	if len(blocksPath) > 0 {
+		blocks, err := ioutil.ReadFile(blocksPath)
+		if err != nil {
+			return ext, err
+		}
+		ext.Blocks = append(ext.Blocks, string(blocks))
+	}
+	if len(dataPath) > 0 {
+		encoded, err := ioutil.ReadFile(dataPath)
+		if err != nil {
+			return ext, err
+		}
+		var data map[string]interface{}
+		if err := json.Unmarshal(encoded, &data); err != nil {
+			return ext, err
+		}
+		ext.Data = func(r *http.Request) map[string]interface{} { return data }
+	}
+	return ext, nil
+}
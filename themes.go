@@ -0,0 +1,167 @@
+package main
+
+import (
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Themes are alternative layouts of the chat page.  Each directory in
+// -themesDir is a theme named after it, with any of:
+//
+//	index.html   a complete page template used instead of the built in one
+//	blocks.html  block definitions (see pageExtensions) for its page
+//	theme.css    a stylesheet linked after the page's own styles
+//
+// Visitors pick one with ?theme=<name>, which a cookie remembers.
+const (
+	themeCookieName = "microchat_theme"
+	// the built in page, unless -themesDir has a theme by that name
+	defaultThemeName = "default"
+)
+
+var themeNameRegex = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,32}$`)
+
+type pageTheme struct {
+	name string
+	page *template.Template
+	css  []byte
+}
+
+type pageThemes struct {
+	byName   map[string]*pageTheme
+	names    []string // sorted, for the picker
+	fallback string   // -theme
+}
+
+// readOptional returns the file's contents, nil when there's no such file.
+func readOptional(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// parseTheme parses a theme's page, the built in one when it has no
+// index.html, with ext and then its own blocks applied.
+func parseTheme(name, dir string, ext pageExtensions) (*pageTheme, error) {
+	source := getIndexTemplateString()
+	theme := &pageTheme{name: name}
+	if len(dir) > 0 {
+		index, err := readOptional(filepath.Join(dir, "index.html"))
+		if err != nil {
+			return nil, err
+		}
+		if index != nil {
+			source = string(index)
+		}
+		blocks, err := readOptional(filepath.Join(dir, "blocks.html"))
+		if err != nil {
+			return nil, err
+		}
+		if blocks != nil {
+			// themes don't share blocks with each other
+			ext.Blocks = append(append([]string(nil), ext.Blocks...), string(blocks))
+		}
+		if theme.css, err = readOptional(filepath.Join(dir, "theme.css")); err != nil {
+			return nil, err
+		}
+	}
+	page, err := ext.parse("chat_homepage", source)
+	if err != nil {
+		return nil, err
+	}
+	theme.page = page
+	return theme, nil
+}
+
+// loadThemes parses the built in page and every theme in dir (if any).
+// fallback is the theme of visitors that haven't picked one.
+func loadThemes(dir, fallback string, ext pageExtensions) (*pageThemes, error) {
+	builtin, err := parseTheme(defaultThemeName, "", ext)
+	if err != nil {
+		return nil, err
+	}
+	themes := &pageThemes{byName: map[string]*pageTheme{defaultThemeName: builtin}, fallback: fallback}
+	if len(dir) > 0 {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() || !themeNameRegex.MatchString(entry.Name()) {
+				continue
+			}
+			theme, err := parseTheme(entry.Name(), filepath.Join(dir, entry.Name()), ext)
+			if err != nil {
+				return nil, &os.PathError{Op: "parse theme", Path: entry.Name(), Err: err}
+			}
+			themes.byName[theme.name] = theme
+		}
+	}
+	for name := range themes.byName {
+		themes.names = append(themes.names, name)
+	}
+	sort.Strings(themes.names)
+	if _, ok := themes.byName[fallback]; !ok {
+		return nil, &os.PathError{Op: "find theme", Path: fallback, Err: os.ErrNotExist}
+	}
+	return themes, nil
+}
+
+// forRequest returns the request's theme, remembering one picked with
+// ?theme= for next time.
+func (themes *pageThemes) forRequest(w http.ResponseWriter, r *http.Request) *pageTheme {
+	if picked, ok := themes.byName[r.URL.Query().Get("theme")]; ok {
+		http.SetCookie(w, &http.Cookie{
+			Name:     themeCookieName,
+			Value:    picked.name,
+			Path:     "/",
+			Expires:  time.Now().Add(365 * 24 * time.Hour),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+			Secure:   r.TLS != nil,
+		})
+		return picked
+	}
+	if cookie, err := r.Cookie(themeCookieName); err == nil {
+		if theme, ok := themes.byName[cookie.Value]; ok {
+			return theme
+		}
+	}
+	return themes.byName[themes.fallback]
+}
+
+// cssPath is where the theme's stylesheet is served, blank without one.
+func (theme *pageTheme) cssPath() string {
+	if theme.css == nil {
+		return ""
+	}
+	return "/themes/" + theme.name + "/theme.css"
+}
+
+// getThemeCSSClosure serves GET /themes/<name>/theme.css.
+func getThemeCSSClosure(themes *pageThemes) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/themes/"), "/theme.css")
+		theme, ok := themes.byName[name]
+		if !ok || theme.css == nil || !strings.HasSuffix(r.URL.Path, "/theme.css") {
+			http.Error(w, "No such theme stylesheet.", 404)
+			return
+		}
+		w.Header().Set("Content-Type", "text/css; charset=utf-8")
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		w.Write(theme.css)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+)
+
+// Refuse to decode anything bigger than this, no matter how small the
+// compressed file is (decompression bombs).
+const maxThumbnailSourcePixels = 40 * 1000 * 1000
+
+// makeThumbnail scales the image down so neither side exceeds maxPx.  It
+// returns ok=false when the image is already small enough to show as is.
+// Jpeg sources stay jpeg, everything else becomes png to keep transparency.
+func makeThumbnail(data []byte, maxPx int) (thumb []byte, contentType string, ok bool, err error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", false, err
+	}
+	if config.Width <= maxPx && config.Height <= maxPx {
+		return nil, "", false, nil
+	}
+	if config.Width*config.Height > maxThumbnailSourcePixels {
+		return nil, "", false, fmt.Errorf("image too large to thumbnail: %dx%d", config.Width, config.Height)
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", false, err
+	}
+	width, height := maxPx, maxPx
+	if config.Width > config.Height {
+		height = config.Height * maxPx / config.Width
+	} else {
+		width = config.Width * maxPx / config.Height
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Over, nil)
+
+	var out bytes.Buffer
+	if format == "jpeg" {
+		err = jpeg.Encode(&out, dst, &jpeg.Options{Quality: 85})
+		contentType = "image/jpeg"
+	} else {
+		err = png.Encode(&out, dst)
+		contentType = "image/png"
+	}
+	if err != nil {
+		return nil, "", false, err
+	}
+	return out.Bytes(), contentType, true, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// timeLayouts are how one locale writes times for people.
+type timeLayouts struct {
+	minutes string // date and time
+	seconds string // date and time to the second
+	clock   string // just the time of day
+}
+
+// layouts by -locale, the date order and 12 or 24 hour clock people there
+// expect (month names are always English)
+var localeLayouts = map[string]timeLayouts{
+	"iso":   {"2006-01-02 15:04 MST", "2006-01-02 15:04:05 MST", "15:04 MST"},
+	"en-US": {"Jan 2, 2006 3:04 PM MST", "Jan 2, 2006 3:04:05 PM MST", "3:04 PM MST"},
+	"en-GB": {"2 Jan 2006 15:04 MST", "2 Jan 2006 15:04:05 MST", "15:04 MST"},
+	"de":    {"02.01.2006 15:04 MST", "02.01.2006 15:04:05 MST", "15:04 MST"},
+	"fr":    {"02/01/2006 15:04 MST", "02/01/2006 15:04:05 MST", "15:04 MST"},
+	"es":    {"02/01/2006 15:04 MST", "02/01/2006 15:04:05 MST", "15:04 MST"},
+	"it":    {"02/01/2006 15:04 MST", "02/01/2006 15:04:05 MST", "15:04 MST"},
+	"ja":    {"2006/01/02 15:04 MST", "2006/01/02 15:04:05 MST", "15:04 MST"},
+	"zh":    {"2006/01/02 15:04 MST", "2006/01/02 15:04:05 MST", "15:04 MST"},
+}
+
+func localeNames() string {
+	var names []string
+	for name := range localeLayouts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// timeFormatter writes times into server rendered pages, for visitors
+// without javascript and for anything read away from the page.  Machine
+// readable times (RFC 3339 attributes, sitemaps) stay in UTC.
+type timeFormatter struct {
+	location *time.Location
+	layouts  timeLayouts
+}
+
+// serverTimes is set from -timezone and -locale at startup.
+var serverTimes = timeFormatter{time.UTC, localeLayouts["iso"]}
+
+// newTimeFormatter formats times in the IANA timezone ("Local" is the
+// server's own) the way locale does.
+func newTimeFormatter(timezone, locale string) (timeFormatter, error) {
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return timeFormatter{}, err
+	}
+	layouts, ok := localeLayouts[locale]
+	if !ok {
+		return timeFormatter{}, fmt.Errorf("unknown locale %q, expected one of %s", locale, localeNames())
+	}
+	return timeFormatter{location, layouts}, nil
+}
+
+func (formatter timeFormatter) at(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond)).In(formatter.location)
+}
+
+// minutes formats epoch milliseconds as a date and time.
+func (formatter timeFormatter) minutes(ms int64) string {
+	return formatter.at(ms).Format(formatter.layouts.minutes)
+}
+
+// seconds formats epoch milliseconds as a date and time to the second.
+func (formatter timeFormatter) seconds(ms int64) string {
+	return formatter.at(ms).Format(formatter.layouts.seconds)
+}
+
+// clock formats epoch milliseconds as a time of day.
+func (formatter timeFormatter) clock(ms int64) string {
+	return formatter.at(ms).Format(formatter.layouts.clock)
+}
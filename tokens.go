@@ -0,0 +1,391 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// What an api token can be used for.  Tokens with any of the posting
+// scopes are posters, tokens with just read are read-only.
+const (
+	scopePost     = "post"     // /post, including announcement topics
+	scopeSchedule = "schedule" // /post with publish_at, needs post too
+	scopeBatch    = "batch"    // /api/v1/chats:batch
+	scopeRead     = "read"     // the read-only admin views
+)
+
+var tokenScopes = []string{scopePost, scopeSchedule, scopeBatch, scopeRead}
+
+// apiToken is a bearer token for a bot or script.  Only its hash is kept.
+type apiToken struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name"` // who it authenticates as
+	TokenSHA256 string   `json:"token_sha256"`
+	Scopes      []string `json:"scopes"`
+	ExpiresAtMs int64    `json:"expires_at_ms,omitempty"`
+	// posting rate limit, 0 for none
+	PostsPerMinute int   `json:"posts_per_minute,omitempty"`
+	CreatedAtMs    int64 `json:"created_at_ms"`
+	LastUsedMs     int64 `json:"last_used_ms,omitempty"`
+	// -botTokens ones live on the command line, not in the tokens file
+	fromFlag bool
+	posts    []time.Time // in the last minute, oldest first
+	pending  int         // checked but not yet published, a batch's so far
+}
+
+func (token *apiToken) has(scope string) bool {
+	for _, s := range token.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (token *apiToken) role() role {
+	if token.has(scopePost) || token.has(scopeSchedule) || token.has(scopeBatch) {
+		return rolePoster
+	}
+	if token.has(scopeRead) {
+		return roleReadOnly
+	}
+	return roleNone
+}
+
+func (token *apiToken) expired(now time.Time) bool {
+	return token.ExpiresAtMs > 0 && now.UnixNano()/int64(time.Millisecond) >= token.ExpiresAtMs
+}
+
+// apiTokens are the bot tokens from -botTokens plus the ones managed through
+// /admin/tokens, which are saved to the -tokensFile so they can be rotated
+// without a restart.  They're also a post check enforcing each token's rate
+// limit.
+type apiTokens struct {
+	mu    sync.Mutex
+	path  string // blank to keep managed tokens in memory
+	byID  map[string]*apiToken
+	dirty bool // last used times changed since the last save
+}
+
+// parseAPITokens parses "name=token,name2=token2" style flag values, tokens
+// that can post and schedule.
+func parseAPITokens(value string) (*apiTokens, error) {
+	tokens := &apiTokens{byID: make(map[string]*apiToken)}
+	for _, pair := range splitCommaList(value) {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || len(strings.TrimSpace(parts[0])) == 0 || len(strings.TrimSpace(parts[1])) < 16 {
+			return nil, fmt.Errorf("expected name=token with tokens at least 16 characters long, got %q", pair)
+		}
+		name := strings.TrimSpace(parts[0])
+		tokens.byID[name] = &apiToken{ID: name, Name: name, TokenSHA256: hashToken(strings.TrimSpace(parts[1])),
+			Scopes: []string{scopePost, scopeSchedule, scopeBatch}, fromFlag: true}
+	}
+	return tokens, nil
+}
+
+// load adds the managed tokens saved in path, which is where changes are
+// saved from now on.
+func (tokens *apiTokens) load(path string) error {
+	tokens.path = path
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var file struct {
+		Tokens []*apiToken `json:"tokens"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return err
+	}
+	for _, token := range file.Tokens {
+		if _, taken := tokens.byID[token.ID]; taken || len(token.ID) == 0 || len(token.TokenSHA256) != 64 {
+			return fmt.Errorf("token %q needs a unique id and a token_sha256", token.ID)
+		}
+		tokens.byID[token.ID] = token
+	}
+	go tokens.saveLastUsed()
+	return nil
+}
+
+// NOTE: callers must hold tokens.mu
+func (tokens *apiTokens) save() error {
+	if len(tokens.path) == 0 {
+		return nil
+	}
+	var file struct {
+		Tokens []*apiToken `json:"tokens"`
+	}
+	for _, token := range tokens.byID {
+		if !token.fromFlag {
+			file.Tokens = append(file.Tokens, token)
+		}
+	}
+	sort.Slice(file.Tokens, func(i, j int) bool { return file.Tokens[i].ID < file.Tokens[j].ID })
+	tokens.dirty = false
+	return saveJSONFile(tokens.path, file)
+}
+
+// saveLastUsed saves the file every so often so last used times survive
+// restarts without a write per request.
+func (tokens *apiTokens) saveLastUsed() {
+	for range time.Tick(time.Minute) {
+		tokens.mu.Lock()
+		if tokens.dirty {
+			if err := tokens.save(); err != nil {
+				log.Printf("Failed to save tokensFile: %v\n", err)
+			}
+		}
+		tokens.mu.Unlock()
+	}
+}
+
+// NOTE: callers must hold tokens.mu
+func (tokens *apiTokens) find(token string) *apiToken {
+	if len(token) == 0 {
+		return nil
+	}
+	hashed := hashToken(token)
+	now := time.Now()
+	for _, known := range tokens.byID {
+		if subtle.ConstantTimeCompare([]byte(known.TokenSHA256), []byte(hashed)) == 1 && !known.expired(now) {
+			return known
+		}
+	}
+	return nil
+}
+
+// lookup returns who an unexpired token authenticates as and its role,
+// noting that it was used.
+func (tokens *apiTokens) lookup(token string) (string, role, bool) {
+	tokens.mu.Lock()
+	defer tokens.mu.Unlock()
+	known := tokens.find(token)
+	if known == nil {
+		return "", roleNone, false
+	}
+	known.LastUsedMs = time.Now().UnixNano() / int64(time.Millisecond)
+	if !known.fromFlag {
+		tokens.dirty = true
+	}
+	return known.Name, known.role(), true
+}
+
+// scoped is false when the request has a token without scope.
+func (tokens *apiTokens) scoped(r *http.Request, scope string) bool {
+	tokens.mu.Lock()
+	defer tokens.mu.Unlock()
+	known := tokens.find(presentedToken(r))
+	return known == nil || known.has(scope)
+}
+
+// NOTE: callers must hold tokens.mu
+func (token *apiToken) recent(now time.Time) []time.Time {
+	cutoff := now.Add(-time.Minute)
+	for len(token.posts) > 0 && token.posts[0].Before(cutoff) {
+		token.posts = token.posts[1:]
+	}
+	return token.posts
+}
+
+func (tokens *apiTokens) check(r *http.Request, chat *ChatPost) *postRejection {
+	tokens.mu.Lock()
+	defer tokens.mu.Unlock()
+	known := tokens.find(presentedToken(r))
+	if known == nil || known.PostsPerMinute == 0 {
+		return nil
+	}
+	if len(known.recent(time.Now()))+known.pending < known.PostsPerMinute {
+		known.pending++
+		return nil
+	}
+	return &postRejection{Reason: "token_rate", Status: 429,
+		Message: fmt.Sprintf("Token rate limit reached (%d posts per minute).", known.PostsPerMinute)}
+}
+
+func (tokens *apiTokens) published(r *http.Request, chat ChatPost) {
+	tokens.mu.Lock()
+	defer tokens.mu.Unlock()
+	if known := tokens.find(presentedToken(r)); known != nil && known.PostsPerMinute > 0 {
+		known.unreserve()
+		known.posts = append(known.recent(time.Now()), time.Now())
+	}
+}
+
+func (tokens *apiTokens) released(r *http.Request, chat ChatPost) {
+	tokens.mu.Lock()
+	defer tokens.mu.Unlock()
+	if known := tokens.find(presentedToken(r)); known != nil {
+		known.unreserve()
+	}
+}
+
+// NOTE: callers must hold tokens.mu
+func (token *apiToken) unreserve() {
+	if token.pending > 0 {
+		token.pending--
+	}
+}
+
+func (tokens *apiTokens) limitFor(r *http.Request) (rateLimit, bool) {
+	now := time.Now()
+	tokens.mu.Lock()
+	defer tokens.mu.Unlock()
+	known := tokens.find(presentedToken(r))
+	if known == nil || known.PostsPerMinute == 0 {
+		return rateLimit{}, false
+	}
+	posts := known.recent(now)
+	limit := rateLimit{Limit: known.PostsPerMinute, Remaining: known.PostsPerMinute - len(posts) - known.pending, Reset: now}
+	if limit.Remaining < 0 {
+		limit.Remaining = 0
+	}
+	if len(posts) > 0 {
+		limit.Reset = posts[0].Add(time.Minute)
+	}
+	return limit, true
+}
+
+// info is what /admin/tokens shows of a token, never its hash.
+func (token *apiToken) info(now time.Time) map[string]interface{} {
+	info := map[string]interface{}{"id": token.ID, "name": token.Name, "scopes": token.Scopes,
+		"created_at_ms": token.CreatedAtMs, "last_used_ms": token.LastUsedMs, "expired": token.expired(now)}
+	if token.ExpiresAtMs > 0 {
+		info["expires_at_ms"] = token.ExpiresAtMs
+	}
+	if token.PostsPerMinute > 0 {
+		info["posts_per_minute"] = token.PostsPerMinute
+	}
+	if token.fromFlag {
+		info["from_flag"] = true
+	}
+	return info
+}
+
+// parseTokenScopes parses a comma separated scope list.
+func parseTokenScopes(value string) ([]string, bool) {
+	scopes := splitCommaList(value)
+	for _, scope := range scopes {
+		known := false
+		for _, s := range tokenScopes {
+			known = known || s == scope
+		}
+		if !known {
+			return nil, false
+		}
+	}
+	return scopes, len(scopes) > 0
+}
+
+// getTokensClosure serves /admin/tokens:
+//
+//	GET lists tokens
+//	POST name, scopes[, expires_at, posts_per_minute] adds a token, the
+//	response has the token, shown this once
+//	POST id[, scopes, expires_at, posts_per_minute, rotate=yes] changes one,
+//	rotate gives it a new token and the old one stops working
+//	POST id, delete=yes revokes one
+//
+// scopes is a comma separated list of post, schedule, batch and read.
+// expires_at is epoch ms, 0 for never.  -botTokens tokens are listed but
+// can only be changed on the command line.
+func getTokensClosure(tokens *apiTokens) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			now := time.Now()
+			tokens.mu.Lock()
+			list := []map[string]interface{}{}
+			for _, token := range tokens.byID {
+				list = append(list, token.info(now))
+			}
+			tokens.mu.Unlock()
+			sort.Slice(list, func(i, j int) bool { return list[i]["id"].(string) < list[j]["id"].(string) })
+			writeJSON(w, 200, map[string]interface{}{"tokens": list})
+		case "POST":
+			tokens.mu.Lock()
+			defer tokens.mu.Unlock()
+			id := r.PostFormValue("id")
+			var token *apiToken
+			if len(id) > 0 {
+				if token = tokens.byID[id]; token == nil {
+					writeJSON(w, 404, map[string]string{"error": "No such token."})
+					return
+				}
+				if token.fromFlag {
+					writeJSON(w, 400, map[string]string{"error": "Token is from the botTokens cmdline arg, change it there."})
+					return
+				}
+			} else {
+				name := strings.TrimSpace(r.PostFormValue("name"))
+				if len(name) == 0 || len(name) > 64 {
+					writeJSON(w, 400, map[string]string{"error": "Missing or too long name arg."})
+					return
+				}
+				token = &apiToken{ID: randomID(8), Name: name, CreatedAtMs: time.Now().UnixNano() / int64(time.Millisecond)}
+			}
+			if len(id) > 0 && r.PostFormValue("delete") == "yes" {
+				delete(tokens.byID, id)
+				if err := tokens.save(); err != nil {
+					writeJSON(w, 500, map[string]string{"error": "Failed to save tokens: " + err.Error()})
+					return
+				}
+				writeJSON(w, 200, map[string]string{"id": id, "deleted": "yes"})
+				return
+			}
+			// validate everything before changing anything
+			scopes := token.Scopes
+			if value, given := r.PostForm["scopes"]; given || len(id) == 0 {
+				var ok bool
+				if scopes, ok = parseTokenScopes(strings.Join(value, ",")); !ok {
+					writeJSON(w, 400, map[string]string{"error": "Invalid scopes arg, must list post, schedule, batch or read."})
+					return
+				}
+			}
+			expiresAt := token.ExpiresAtMs
+			if value := r.PostFormValue("expires_at"); len(value) > 0 {
+				var err error
+				if expiresAt, err = strconv.ParseInt(value, 10, 64); err != nil || expiresAt < 0 {
+					writeJSON(w, 400, map[string]string{"error": "Invalid expires_at arg, must be epoch milliseconds or 0."})
+					return
+				}
+			}
+			perMinute := token.PostsPerMinute
+			if value := r.PostFormValue("posts_per_minute"); len(value) > 0 {
+				var err error
+				if perMinute, err = strconv.Atoi(value); err != nil || perMinute < 0 {
+					writeJSON(w, 400, map[string]string{"error": "Invalid posts_per_minute arg, must be >= 0."})
+					return
+				}
+			}
+			token.Scopes, token.ExpiresAtMs, token.PostsPerMinute = scopes, expiresAt, perMinute
+			tokens.byID[token.ID] = token
+			response := token.info(time.Now())
+			if len(id) == 0 || r.PostFormValue("rotate") == "yes" {
+				secret := randomID(24)
+				token.TokenSHA256 = hashToken(secret)
+				// shown this once, only the hash is kept
+				response["token"] = secret
+			}
+			if err := tokens.save(); err != nil {
+				writeJSON(w, 500, map[string]string{"error": "Failed to save tokens: " + err.Error()})
+				return
+			}
+			writeJSON(w, 200, response)
+		default:
+			http.Error(w, "Invalid request method.", 405)
+		}
+	}
+}
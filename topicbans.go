@@ -0,0 +1,273 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// topicBans lets moderators eject a session and/or address from a single
+// topic for a while, a lighter touch than the instance wide blocklists.
+// It's also a post check (rejecting posts from whoever is banned, holding
+// those from someone with a banned poster's fingerprint) and it remembers
+// who posted recent chats so a ban can target a chat's poster.
+type topicBans struct {
+	mu   sync.Mutex
+	bans map[string]*topicBan
+	// recent chat ids -> who posted them, oldest first in order
+	posters     map[string]chatPoster
+	posterOrder []string
+	maxPosters  int
+}
+
+type topicBan struct {
+	ID        string `json:"id"`
+	Topic     string `json:"topic"`
+	Session   string `json:"session,omitempty"`
+	ClientIP  string `json:"client_ip,omitempty"`
+	UntilMs   int64  `json:"until_ms"`
+	Subscribe bool   `json:"subscribe"` // also stop them from reading the topic
+	By        string `json:"by"`
+	// the banned poster's browser, when banned by chat
+	Fingerprint *fingerprint `json:"fingerprint,omitempty"`
+}
+
+type chatPoster struct {
+	session     string
+	clientIP    string
+	fingerprint fingerprint
+}
+
+const maxTopicBan = 30 * 24 * time.Hour
+
+func newTopicBans(maxPosters int) *topicBans {
+	bans := &topicBans{bans: make(map[string]*topicBan), posters: make(map[string]chatPoster), maxPosters: maxPosters}
+	go bans.cleanup()
+	return bans
+}
+
+// banned returns the request's active ban from topic, if any.  Only bans
+// that cover subscribing count when forSubscribe.
+func (bans *topicBans) banned(r *http.Request, topic string, forSubscribe bool) *topicBan {
+	session, ip := sessionID(r), clientIP(r)
+	now := timeToEpochMilliseconds(time.Now())
+	bans.mu.Lock()
+	defer bans.mu.Unlock()
+	for _, ban := range bans.bans {
+		if ban.Topic != topic || ban.UntilMs <= now || (forSubscribe && !ban.Subscribe) {
+			continue
+		}
+		if ban.covers(session, ip) {
+			return ban
+		}
+	}
+	return nil
+}
+
+// unreadable returns the topics the request was removed from reading, nil
+// when there are none.
+func (bans *topicBans) unreadable(r *http.Request) map[string]bool {
+	session, ip := sessionID(r), clientIP(r)
+	now := timeToEpochMilliseconds(time.Now())
+	bans.mu.Lock()
+	defer bans.mu.Unlock()
+	var topics map[string]bool
+	for _, ban := range bans.bans {
+		if ban.UntilMs > now && ban.Subscribe && ban.covers(session, ip) {
+			if topics == nil {
+				topics = make(map[string]bool)
+			}
+			topics[ban.Topic] = true
+		}
+	}
+	return topics
+}
+
+func (ban *topicBan) covers(session, ip string) bool {
+	return (len(ban.Session) > 0 && ban.Session == session) || (len(ban.ClientIP) > 0 && ban.ClientIP == ip)
+}
+
+// evading returns the active ban from topic whose poster's fingerprint
+// the request has, if any.
+func (bans *topicBans) evading(r *http.Request, topic string) *topicBan {
+	fp := requestFingerprint(r)
+	now := timeToEpochMilliseconds(time.Now())
+	bans.mu.Lock()
+	defer bans.mu.Unlock()
+	for _, ban := range bans.bans {
+		if ban.Topic == topic && ban.UntilMs > now && ban.Fingerprint != nil && ban.Fingerprint.matches(fp) {
+			return ban
+		}
+	}
+	return nil
+}
+
+func (bans *topicBans) check(r *http.Request, chat *ChatPost) *postRejection {
+	ban := bans.banned(r, chat.Topic, false)
+	if ban == nil {
+		if bans.evading(r, chat.Topic) != nil {
+			return &postRejection{Reason: "ban_evasion", Status: 202, Hold: true,
+				Message: "Your chat is being held for moderator review."}
+		}
+		return nil
+	}
+	until := serverTimes.clock(ban.UntilMs)
+	return &postRejection{Reason: "topic_ban", Status: 403,
+		Message: "You've been removed from this topic until " + until + "."}
+}
+
+func (bans *topicBans) published(r *http.Request, chat ChatPost) {
+	bans.mu.Lock()
+	defer bans.mu.Unlock()
+	bans.posters[chat.ID] = chatPoster{session: sessionID(r), clientIP: clientIP(r), fingerprint: requestFingerprint(r)}
+	bans.posterOrder = append(bans.posterOrder, chat.ID)
+	for len(bans.posterOrder) > bans.maxPosters {
+		delete(bans.posters, bans.posterOrder[0])
+		bans.posterOrder = bans.posterOrder[1:]
+	}
+}
+
+// guard wraps handlers that take a category query param so banned readers
+// can't keep watching a topic they were removed from, alone or in a list.
+// The all chats stream and topic summaries leave those topics out instead.
+func (bans *topicBans) guard(handler func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hidden := bans.unreadable(r)
+		if len(hidden) > 0 {
+			for _, topic := range strings.Split(r.URL.Query().Get("category"), ",") {
+				if hidden[topic] {
+					writeJSON(w, 403, map[string]string{"error": "You've been removed from this topic."})
+					return
+				}
+			}
+			r = withEventFilter(r, func(event *chatEvent) bool {
+				return !hidden[event.Category]
+			})
+		}
+		handler(w, r)
+	}
+}
+
+func (bans *topicBans) add(ban *topicBan) {
+	bans.mu.Lock()
+	defer bans.mu.Unlock()
+	bans.bans[ban.ID] = ban
+}
+
+func (bans *topicBans) lift(id string) bool {
+	bans.mu.Lock()
+	defer bans.mu.Unlock()
+	_, found := bans.bans[id]
+	delete(bans.bans, id)
+	return found
+}
+
+func (bans *topicBans) poster(chatID string) (chatPoster, bool) {
+	bans.mu.Lock()
+	defer bans.mu.Unlock()
+	poster, found := bans.posters[chatID]
+	return poster, found
+}
+
+func (bans *topicBans) list() []*topicBan {
+	now := timeToEpochMilliseconds(time.Now())
+	bans.mu.Lock()
+	defer bans.mu.Unlock()
+	list := make([]*topicBan, 0, len(bans.bans))
+	for _, ban := range bans.bans {
+		if ban.UntilMs > now {
+			list = append(list, ban)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].UntilMs < list[j].UntilMs })
+	return list
+}
+
+func (bans *topicBans) cleanup() {
+	for range time.Tick(time.Minute) {
+		now := timeToEpochMilliseconds(time.Now())
+		bans.mu.Lock()
+		for id, ban := range bans.bans {
+			if ban.UntilMs <= now {
+				delete(bans.bans, id)
+			}
+		}
+		bans.mu.Unlock()
+	}
+}
+
+// getTopicBansClosure serves /admin/topic-bans:
+//
+//	GET lists active bans
+//	POST topic, (chat_id | session | ip), minutes (default 10),
+//	scope (session, ip or both, for chat_id bans) and subscribe=yes to
+//	also stop them reading the topic
+func getTopicBansClosure(bans *topicBans, access *accessControl) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			writeJSON(w, 200, map[string][]*topicBan{"bans": bans.list()})
+			return
+		}
+		if r.Method != "POST" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		topic := r.PostFormValue("topic")
+		if len(topic) == 0 {
+			writeJSON(w, 400, map[string]string{"error": "Missing topic arg."})
+			return
+		}
+		duration := 10 * time.Minute
+		if minutesString := r.PostFormValue("minutes"); len(minutesString) > 0 {
+			minutes, err := strconv.Atoi(minutesString)
+			if err != nil || minutes < 1 || time.Duration(minutes)*time.Minute > maxTopicBan {
+				writeJSON(w, 400, map[string]string{"error": "Invalid minutes arg, must be 1 to 30 days worth."})
+				return
+			}
+			duration = time.Duration(minutes) * time.Minute
+		}
+		by, _ := access.identify(r)
+		ban := &topicBan{ID: randomID(8), Topic: topic, Session: r.PostFormValue("session"),
+			ClientIP: anonymizedIP(r, r.PostFormValue("ip")), UntilMs: timeToEpochMilliseconds(time.Now().Add(duration)),
+			Subscribe: r.PostFormValue("subscribe") == "yes", By: by}
+		if chatID := r.PostFormValue("chat_id"); len(chatID) > 0 {
+			poster, found := bans.poster(chatID)
+			if !found {
+				writeJSON(w, 404, map[string]string{"error": "No record of who posted that chat, it may be too old."})
+				return
+			}
+			scope := r.PostFormValue("scope")
+			if scope != "ip" {
+				ban.Session = poster.session
+			}
+			if scope != "session" {
+				ban.ClientIP = poster.clientIP
+			}
+			ban.Fingerprint = &poster.fingerprint
+		}
+		if len(ban.Session) == 0 && len(ban.ClientIP) == 0 {
+			writeJSON(w, 400, map[string]string{"error": "Missing chat_id, session or ip arg."})
+			return
+		}
+		bans.add(ban)
+		writeJSON(w, 200, ban)
+	}
+}
+
+// getTopicBanLiftClosure serves POST /admin/topic-bans/lift?id=
+func getTopicBanLiftClosure(bans *topicBans) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		if !bans.lift(r.FormValue("id")) {
+			http.Error(w, "No such ban.", 404)
+			return
+		}
+		w.Write([]byte("ok"))
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// topicCreation keeps posting to existing topics open while starting a new
+// one needs an account or an invite code, cutting down on junk topics.
+// A topic exists while it has buffered chats.
+type topicCreation struct {
+	Restricted bool
+	Access     *accessControl
+	Manager    *chatStore
+	// encrypted rooms exist from when they're made, they took an invite
+	Rooms   *encryptedRooms
+	invites *topicInvites
+}
+
+type topicInvites struct {
+	mu      sync.Mutex
+	invites map[string]*topicInvite
+}
+
+type topicInvite struct {
+	Code      string `json:"code"`
+	Uses      int    `json:"uses"` // topics it can still start
+	ExpiresMs int64  `json:"expires_ms"`
+	By        string `json:"by"`
+}
+
+func newTopicCreation(restricted bool, access *accessControl, manager *chatStore) *topicCreation {
+	return &topicCreation{Restricted: restricted, Access: access, Manager: manager,
+		invites: &topicInvites{invites: make(map[string]*topicInvite)}}
+}
+
+// mayCreate reports whether the request may start a new topic, using up
+// one of its invite's uses when that's what lets it.
+func (creation *topicCreation) mayCreate(r *http.Request) bool {
+	if !creation.Restricted {
+		return true
+	}
+	if name, _ := creation.Access.identify(r); len(name) > 0 {
+		return true
+	}
+	return creation.invites.use(r.FormValue("invite"))
+}
+
+func (creation *topicCreation) check(r *http.Request, chat *ChatPost) *postRejection {
+	if creation.Manager.hasTopic(chat.Topic) || creation.Rooms.has(chat.Topic) || creation.mayCreate(r) {
+		return nil
+	}
+	return &postRejection{Reason: "new_topic", Status: 403,
+		Message: "Starting a new topic needs an invite code or an account, you can still post to existing topics."}
+}
+
+func (invites *topicInvites) use(code string) bool {
+	if len(code) == 0 {
+		return false
+	}
+	invites.mu.Lock()
+	defer invites.mu.Unlock()
+	invite, found := invites.invites[code]
+	if !found || invite.ExpiresMs <= timeToEpochMilliseconds(time.Now()) {
+		delete(invites.invites, code)
+		return false
+	}
+	invite.Uses--
+	if invite.Uses <= 0 {
+		delete(invites.invites, code)
+	}
+	return true
+}
+
+func (invites *topicInvites) list() []*topicInvite {
+	now := timeToEpochMilliseconds(time.Now())
+	invites.mu.Lock()
+	defer invites.mu.Unlock()
+	list := make([]*topicInvite, 0, len(invites.invites))
+	for code, invite := range invites.invites {
+		if invite.ExpiresMs <= now {
+			delete(invites.invites, code)
+			continue
+		}
+		list = append(list, invite)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ExpiresMs < list[j].ExpiresMs })
+	return list
+}
+
+// getTopicInvitesClosure serves /admin/topic-invites:
+//
+//	GET lists unused invite codes
+//	POST [uses=N (default 1)][&hours=N (default 24)] makes a new one
+func getTopicInvitesClosure(creation *topicCreation) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			writeJSON(w, 200, map[string][]*topicInvite{"invites": creation.invites.list()})
+			return
+		}
+		if r.Method != "POST" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		uses, hours := 1, 24
+		var err error
+		if usesString := r.PostFormValue("uses"); len(usesString) > 0 {
+			if uses, err = strconv.Atoi(usesString); err != nil || uses < 1 || uses > 1000 {
+				writeJSON(w, 400, map[string]string{"error": "Invalid uses arg, must be 1-1000."})
+				return
+			}
+		}
+		if hoursString := r.PostFormValue("hours"); len(hoursString) > 0 {
+			if hours, err = strconv.Atoi(hoursString); err != nil || hours < 1 || hours > 24*30 {
+				writeJSON(w, 400, map[string]string{"error": "Invalid hours arg, must be 1-720."})
+				return
+			}
+		}
+		by, _ := creation.Access.identify(r)
+		invite := &topicInvite{Code: randomID(8), Uses: uses, By: by,
+			ExpiresMs: timeToEpochMilliseconds(time.Now().Add(time.Duration(hours) * time.Hour))}
+		creation.invites.mu.Lock()
+		creation.invites.invites[invite.Code] = invite
+		creation.invites.mu.Unlock()
+		writeJSON(w, 200, invite)
+	}
+}
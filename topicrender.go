@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// topicRenderRules are how moderators change the way one topic's chats are
+// rendered, set through /admin/topic-render and saved to -topicRenderFile.
+// They only apply to chats posted after they're set.
+type topicRenderRules struct {
+	mu    sync.Mutex
+	path  string // blank to keep them in memory
+	rules map[string]*topicRender
+}
+
+type topicRender struct {
+	Topic     string `json:"topic"`
+	PlainText bool   `json:"plain_text,omitempty"` // no markdown, like -plainTextTopics
+	NoImages  bool   `json:"no_images,omitempty"`  // images become links to them
+	NoEmbeds  bool   `json:"no_embeds,omitempty"`  // no -richEmbeds players and maps
+	Highlight bool   `json:"highlight,omitempty"`  // the page colors code blocks
+	By        string `json:"by,omitempty"`
+}
+
+func loadTopicRenderRules(path string) (*topicRenderRules, error) {
+	rules := &topicRenderRules{path: path, rules: make(map[string]*topicRender)}
+	if len(path) == 0 {
+		return rules, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return rules, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Topics []*topicRender `json:"topics"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	for _, rule := range file.Topics {
+		rules.rules[rule.Topic] = rule
+	}
+	return rules, nil
+}
+
+// NOTE: callers must hold rules.mu
+func (rules *topicRenderRules) save() error {
+	if len(rules.path) == 0 {
+		return nil
+	}
+	var file struct {
+		Topics []*topicRender `json:"topics"`
+	}
+	file.Topics = rules.listLocked()
+	return saveJSONFile(rules.path, file)
+}
+
+// NOTE: callers must hold rules.mu
+func (rules *topicRenderRules) listLocked() []*topicRender {
+	list := make([]*topicRender, 0, len(rules.rules))
+	for _, rule := range rules.rules {
+		list = append(list, rule)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Topic < list[j].Topic })
+	return list
+}
+
+// get returns topic's rules, the zero value (render as usual) when it has
+// none or there are no rules at all.
+func (rules *topicRenderRules) get(topic string) topicRender {
+	if rules == nil {
+		return topicRender{}
+	}
+	rules.mu.Lock()
+	defer rules.mu.Unlock()
+	if rule, found := rules.rules[topic]; found {
+		return *rule
+	}
+	return topicRender{}
+}
+
+var (
+	renderedImageRegex = regexp.MustCompile(`<img\b[^>]*>`)
+	imageSrcRegex      = regexp.MustCompile(`\bsrc="([^"]*)"`)
+	imageAltRegex      = regexp.MustCompile(`\balt="([^"]*)"`)
+)
+
+// linkImages turns the images in sanitized html into links to them, so
+// nobody's page loads them unasked.
+func linkImages(rendered string) string {
+	return renderedImageRegex.ReplaceAllStringFunc(rendered, func(img string) string {
+		src := imageSrcRegex.FindStringSubmatch(img)
+		if src == nil {
+			return ""
+		}
+		text := "image"
+		if alt := imageAltRegex.FindStringSubmatch(img); alt != nil && len(strings.TrimSpace(alt[1])) > 0 {
+			text = alt[1]
+		}
+		// both already escaped by the sanitizer
+		return `<a href="` + src[1] + `" rel="nofollow">` + text + `</a>`
+	})
+}
+
+// getTopicRenderClosure serves /admin/topic-render:
+//
+//	GET lists every topic's rules
+//	POST topic, and plain_text, no_images, no_embeds and highlight as yes
+//	or no, sets a topic's rules (anything not given is no), delete=yes
+//	goes back to rendering it as usual
+func getTopicRenderClosure(rules *topicRenderRules, access *accessControl) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			rules.mu.Lock()
+			list := rules.listLocked()
+			rules.mu.Unlock()
+			writeJSON(w, 200, map[string][]*topicRender{"topics": list})
+		case "POST":
+			topic := r.PostFormValue("topic")
+			if !topicNameRegex.MatchString(topic) {
+				writeJSON(w, 400, map[string]string{"error": "Invalid topic arg, must be A-Za-z0-9-."})
+				return
+			}
+			rules.mu.Lock()
+			defer rules.mu.Unlock()
+			if r.PostFormValue("delete") == "yes" {
+				if _, found := rules.rules[topic]; !found {
+					writeJSON(w, 404, map[string]string{"error": "That topic has no render rules."})
+					return
+				}
+				delete(rules.rules, topic)
+				if err := rules.save(); err != nil {
+					writeJSON(w, 500, map[string]string{"error": "Failed to save render rules: " + err.Error()})
+					return
+				}
+				writeJSON(w, 200, map[string]string{"topic": topic, "deleted": "yes"})
+				return
+			}
+			by, _ := access.identify(r)
+			rule := &topicRender{Topic: topic, PlainText: r.PostFormValue("plain_text") == "yes",
+				NoImages: r.PostFormValue("no_images") == "yes", NoEmbeds: r.PostFormValue("no_embeds") == "yes",
+				Highlight: r.PostFormValue("highlight") == "yes", By: by}
+			rules.rules[topic] = rule
+			if err := rules.save(); err != nil {
+				writeJSON(w, 500, map[string]string{"error": "Failed to save render rules: " + err.Error()})
+				return
+			}
+			writeJSON(w, 200, rule)
+		default:
+			http.Error(w, "Invalid request method.", 405)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// How a topic matched a search, best first.  Near misses are there so
+// someone about to start "golnag" sees "golang" is already going.
+const (
+	topicMatchExact = iota
+	topicMatchPrefix
+	topicMatchWord // prefix of a word after a dash
+	topicMatchContains
+	topicMatchFuzzy // the letters in order, or a typo or two away
+)
+
+var topicMatchNames = []string{"exact", "prefix", "word", "contains", "fuzzy"}
+
+const maxTopicSuggestions = 20
+
+type topicSuggestion struct {
+	topicSummary
+	Match string `json:"match"`
+	rank  int
+}
+
+var topicSearchRegex = regexp.MustCompile("[^a-z0-9]+")
+
+// matchTopic ranks how topic matches query (both lowercased), false when
+// it doesn't.
+func matchTopic(topic, query string) (int, bool) {
+	switch {
+	case topic == query:
+		return topicMatchExact, true
+	case strings.HasPrefix(topic, query):
+		return topicMatchPrefix, true
+	case strings.Contains(topic, "-"+query):
+		return topicMatchWord, true
+	case strings.Contains(topic, query):
+		return topicMatchContains, true
+	case isSubsequence(query, topic) && len(query) >= 3:
+		return topicMatchFuzzy, true
+	}
+	// a typo per 4 letters, up to 2, against the topic or its same length prefix
+	allowed := len(query) / 4
+	if allowed > 2 {
+		allowed = 2
+	}
+	if allowed > 0 {
+		candidate := topic
+		if len(candidate) > len(query) {
+			candidate = candidate[:len(query)]
+		}
+		if editDistance(candidate, query) <= allowed || editDistance(topic, query) <= allowed {
+			return topicMatchFuzzy, true
+		}
+	}
+	return 0, false
+}
+
+func isSubsequence(short, long string) bool {
+	i := 0
+	for j := 0; i < len(short) && j < len(long); j++ {
+		if short[i] == long[j] {
+			i++
+		}
+	}
+	return i == len(short)
+}
+
+// editDistance counts the insertions, deletions, substitutions and swaps
+// of neighbouring letters between a and b, topics are ascii.
+func editDistance(a, b string) int {
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d[i][j] = minInt(minInt(d[i-1][j]+1, d[i][j-1]+1), d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				d[i][j] = minInt(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(a)][len(b)]
+}
+
+// searchTopics returns the buffered topics matching query, best matches
+// first and the busiest of those first.  Encrypted rooms aren't listed.
+func (store *chatStore) searchTopics(query string, limit int) []topicSuggestion {
+	query = strings.Trim(topicSearchRegex.ReplaceAllString(strings.ToLower(query), "-"), "-")
+	suggestions := []topicSuggestion{}
+	if len(query) == 0 {
+		return suggestions
+	}
+	store.mu.Lock()
+	for category, buf := range store.categories {
+		if len(buf.events) == 0 || buf.private {
+			continue
+		}
+		if rank, ok := matchTopic(strings.ToLower(category), query); ok {
+			suggestions = append(suggestions, topicSuggestion{topicSummary: topicSummary{category, len(buf.events),
+				buf.events[len(buf.events)-1].Timestamp}, Match: topicMatchNames[rank], rank: rank})
+		}
+	}
+	store.mu.Unlock()
+	sort.Slice(suggestions, func(i, j int) bool {
+		if suggestions[i].rank != suggestions[j].rank {
+			return suggestions[i].rank < suggestions[j].rank
+		}
+		if suggestions[i].Count != suggestions[j].Count {
+			return suggestions[i].Count > suggestions[j].Count
+		}
+		return suggestions[i].Topic < suggestions[j].Topic
+	})
+	if len(suggestions) > limit {
+		suggestions = suggestions[:limit]
+	}
+	return suggestions
+}
+
+// getTopicSearchClosure serves GET /api/v1/topics?q=go[&limit=N], topics
+// for the homepage's topic field to suggest as it's typed:
+//
+//	{"topics": [{"topic": "golang", "count": 12, "last_post_ms": ..., "match": "prefix"}]}
+func getTopicSearchClosure(manager *chatStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		limit := 10
+		if limitString := r.URL.Query().Get("limit"); len(limitString) > 0 {
+			parsed, err := strconv.Atoi(limitString)
+			if err != nil || parsed < 1 || parsed > maxTopicSuggestions {
+				writeJSON(w, 400, map[string]string{"error": "Invalid limit arg, must be 1-" + strconv.Itoa(maxTopicSuggestions) + "."})
+				return
+			}
+			limit = parsed
+		}
+		writeJSON(w, 200, map[string][]topicSuggestion{"topics": manager.searchTopics(r.URL.Query().Get("q"), limit)})
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"html"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/microcosm-cc/bluemonday"
+)
+
+// topicSummaryStream feeds the recent/popular boards with one small summary
+// per topic, republished whenever the topic changes, instead of the boards
+// re-reading every chat in the retention window.  Summaries live in their
+// own store, one event per topic, and are served as its ALL_CHATS view so
+// resuming with last_id only sends the topics that changed.
+type topicSummaryStream struct {
+	manager *chatStore
+	store   *chatStore
+}
+
+type topicSummaryUpdate struct {
+	Topic      string       `json:"topic"`
+	Count      int          `json:"count"`
+	LastPostMs int64        `json:"last_post_ms"`
+	Preview    *chatPreview `json:"preview,omitempty"`
+}
+
+// chatPreview is the topic's newest chat, as plain text.
+type chatPreview struct {
+	ID          string `json:"id"`
+	DisplayName string `json:"display_name"`
+	NameColor   string `json:"name_color,omitempty"`
+	Text        string `json:"text"`
+}
+
+const (
+	maxPreviewRunes = 140
+	// most topics the summary stream hands back at once
+	maxStreamedTopics = 1000
+)
+
+var previewPolicy = bluemonday.StrictPolicy()
+
+func newTopicSummaryStream(manager *chatStore, ttl time.Duration) *topicSummaryStream {
+	stream := &topicSummaryStream{
+		manager: manager,
+		store: newChatStore(storeOptions{
+			MaxEventsPerCategory: func(category string) int {
+				if category == ALL_CHATS {
+					return maxStreamedTopics
+				}
+				return 1
+			},
+			EventTTL:   ttl,
+			MaxTimeout: 120 * time.Second,
+		}),
+	}
+	manager.onBuffer(stream.published)
+	return stream
+}
+
+func previewText(message string) string {
+	text := []rune(plainText(message))
+	if len(text) > maxPreviewRunes {
+		return string(text[:maxPreviewRunes]) + "..."
+	}
+	return string(text)
+}
+
+// plainText strips a rendered message down to the text that's read.
+func plainText(message string) string {
+	return strings.TrimSpace(html.UnescapeString(previewPolicy.Sanitize(message)))
+}
+
+// topicUpdate summarizes a topic's buffered chats.  Encrypted rooms aren't
+// summarized, and burn after reading chats never make the preview.
+func (store *chatStore) topicUpdate(topic string) (topicSummaryUpdate, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	update := topicSummaryUpdate{Topic: topic}
+	buf, found := store.categories[topic]
+	if !found || buf.private {
+		return update, false
+	}
+	var newest *ChatPost
+	for _, event := range buf.events {
+		chat, ok := event.Data.(ChatPost)
+		if !ok {
+			continue
+		}
+		update.Count++
+		update.LastPostMs = event.Timestamp
+		if !chat.Burn {
+			newest = &chat
+		}
+	}
+	if newest != nil {
+		update.Preview = &chatPreview{ID: newest.ID, DisplayName: newest.DisplayName, NameColor: newest.NameColor,
+			Text: previewText(newest.Message)}
+	}
+	return update, true
+}
+
+// published republishes the summary of the topic a chat or tombstone went
+// to.  Registered with chatStore.onBuffer.
+func (stream *topicSummaryStream) published(event *chatEvent) {
+	if chat, ok := event.Data.(ChatPost); ok && chat.Encrypted {
+		return
+	}
+	if update, ok := stream.manager.topicUpdate(event.Category); ok {
+		stream.store.Publish(event.Category, update)
+	}
+}
+
+// getTopicSummariesSubscribeClosure serves the summary stream:
+//
+//	/subscribe/topics?timeout=N[&since_time=MS | &last_id=ID]
+//
+// in the same longpoll format as /subscribe.  Previews are chat content, so
+// only those who can watch the all chats stream get it.
+func getTopicSummariesSubscribeClosure(stream *topicSummaryStream, firehose firehosePolicy) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !firehose.visibleTo(r) {
+			writeJSON(w, 403, map[string]string{"error": "The all chats stream is not available on this server."})
+			return
+		}
+		query := r.URL.Query()
+		query.Set("category", ALL_CHATS)
+		r.URL.RawQuery = query.Encode()
+		stream.store.SubscriptionHandler(w, r)
+	}
+}
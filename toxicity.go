@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Scoring services chats can be run through.
+const (
+	toxicityGeneric     = "generic"
+	toxicityPerspective = "perspective"
+)
+
+const perspectiveURL = "https://commentanalyzer.googleapis.com/v1alpha1/comments:analyze"
+
+// toxicityScorer attaches a 0-1 toxicity score to every chat and holds the
+// ones at or over the threshold for moderator review.  The generic kind is
+// for a locally hosted model (detoxify behind a small server, ...) and gets
+//
+//	{"text": "the chat as plain text"}
+//
+// answering with {"score": 0.93}.  Perspective is Google's Perspective API.
+// A failed or slow scorer lets the chat through unscored.
+type toxicityScorer struct {
+	kind      string
+	url       string
+	key       string
+	threshold float64
+	client    *http.Client
+}
+
+func newToxicityScorer(kind, scoreURL, key string, threshold float64, timeout time.Duration) *toxicityScorer {
+	if kind == toxicityPerspective && len(scoreURL) == 0 {
+		scoreURL = perspectiveURL
+	}
+	return &toxicityScorer{kind: kind, url: scoreURL, key: key, threshold: threshold,
+		client: &http.Client{Timeout: timeout}}
+}
+
+func (scorer *toxicityScorer) check(r *http.Request, chat *ChatPost) *postRejection {
+	// nothing we can read in an encrypted chat
+	if chat.Encrypted {
+		return nil
+	}
+	text := plainText(chat.Message)
+	if len(text) == 0 {
+		return nil
+	}
+	score, err := scorer.score(text)
+	if err != nil {
+		log.Printf("Toxicity scoring failed: %v\n", err)
+		return nil
+	}
+	chat.Toxicity = score
+	if score < scorer.threshold {
+		return nil
+	}
+	return &postRejection{Reason: "toxicity", Status: 202, Hold: true,
+		Message: "Your chat is being held for moderator review."}
+}
+
+func (scorer *toxicityScorer) score(text string) (float64, error) {
+	var body []byte
+	endpoint := scorer.url
+	if scorer.kind == toxicityPerspective {
+		body, _ = json.Marshal(map[string]interface{}{
+			"comment":             map[string]string{"text": text},
+			"requestedAttributes": map[string]interface{}{"TOXICITY": map[string]string{}},
+			"doNotStore":          true,
+		})
+		endpoint += "?key=" + url.QueryEscape(scorer.key)
+	} else {
+		body, _ = json.Marshal(map[string]string{"text": text})
+	}
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if scorer.kind == toxicityGeneric && len(scorer.key) > 0 {
+		req.Header.Set("Authorization", "Bearer "+scorer.key)
+	}
+	resp, err := scorer.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return 0, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var result struct {
+		Score           *float64 `json:"score"`
+		AttributeScores struct {
+			Toxicity struct {
+				SummaryScore struct {
+					Value *float64 `json:"value"`
+				} `json:"summaryScore"`
+			} `json:"TOXICITY"`
+		} `json:"attributeScores"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&result); err != nil {
+		return 0, err
+	}
+	score := result.Score
+	if scorer.kind == toxicityPerspective {
+		score = result.AttributeScores.Toxicity.SummaryScore.Value
+	}
+	if score == nil || *score < 0 || *score > 1 {
+		return 0, fmt.Errorf("unexpected response")
+	}
+	return *score, nil
+}
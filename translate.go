@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Translation services chats can be run through.
+const (
+	translateLibre = "libretranslate"
+	translateDeepL = "deepl"
+)
+
+// chatTranslator attaches translations of each chat to the configured
+// languages, so mixed language communities can read the same topic.  The
+// endpoint is the operator's, so it isn't held to the safe client.
+type chatTranslator struct {
+	kind   string
+	url    string
+	key    string
+	langs  []string
+	client *http.Client
+	mu     sync.Mutex
+	cache  map[string]map[string]string // raw message -> language -> translation
+}
+
+const translateCacheMax = 10000
+
+func newChatTranslator(kind, url, key string, langs []string, timeout time.Duration) *chatTranslator {
+	return &chatTranslator{kind: kind, url: strings.TrimRight(url, "/"), key: key, langs: langs,
+		client: &http.Client{Timeout: timeout}, cache: make(map[string]map[string]string)}
+}
+
+// translate returns the raw (markdown) message in each target language,
+// leaving out the language it was written in and any that failed.
+func (translator *chatTranslator) translate(message string) map[string]string {
+	translator.mu.Lock()
+	cached, found := translator.cache[message]
+	translator.mu.Unlock()
+	if found {
+		return cached
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	translations := make(map[string]string)
+	failed := false
+	for _, lang := range translator.langs {
+		wg.Add(1)
+		go func(lang string) {
+			defer wg.Done()
+			text, source, err := translator.fetch(message, lang)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				log.Printf("Failed to translate chat to %s: %v\n", lang, err)
+				failed = true
+				return
+			}
+			// regional variants (en-us) count as the language they're of
+			if !strings.EqualFold(source, strings.SplitN(lang, "-", 2)[0]) && len(strings.TrimSpace(text)) > 0 {
+				translations[lang] = text
+			}
+		}(lang)
+	}
+	wg.Wait()
+	// a failure might work out next time
+	if !failed {
+		translator.mu.Lock()
+		if len(translator.cache) >= translateCacheMax {
+			translator.cache = make(map[string]map[string]string)
+		}
+		translator.cache[message] = translations
+		translator.mu.Unlock()
+	}
+	return translations
+}
+
+// fetch returns the translation and the language detected in message.
+func (translator *chatTranslator) fetch(message, lang string) (string, string, error) {
+	var body []byte
+	var endpoint string
+	if translator.kind == translateDeepL {
+		endpoint = translator.url + "/v2/translate"
+		body, _ = json.Marshal(map[string]interface{}{"text": []string{message}, "target_lang": strings.ToUpper(lang)})
+	} else {
+		endpoint = translator.url + "/translate"
+		body, _ = json.Marshal(map[string]string{"q": message, "source": "auto", "target": lang, "format": "text",
+			"api_key": translator.key})
+	}
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if translator.kind == translateDeepL {
+		req.Header.Set("Authorization", "DeepL-Auth-Key "+translator.key)
+	}
+	resp, err := translator.client.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", "", fmt.Errorf("status %d", resp.StatusCode)
+	}
+	if translator.kind == translateDeepL {
+		var result struct {
+			Translations []struct {
+				DetectedSourceLanguage string `json:"detected_source_language"`
+				Text                   string `json:"text"`
+			} `json:"translations"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil || len(result.Translations) == 0 {
+			return "", "", fmt.Errorf("unexpected response")
+		}
+		return result.Translations[0].Text, result.Translations[0].DetectedSourceLanguage, nil
+	}
+	var result struct {
+		TranslatedText   string `json:"translatedText"`
+		DetectedLanguage struct {
+			Language string `json:"language"`
+		} `json:"detectedLanguage"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", "", fmt.Errorf("unexpected response")
+	}
+	return result.TranslatedText, result.DetectedLanguage.Language, nil
+}
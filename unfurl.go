@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"golang.org/x/net/html"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// linkPreview is the card shown under a chat that links somewhere.  All of
+// it is html escaped already so clients can drop it straight into the page,
+// same as the chat's message.
+type linkPreview struct {
+	URL         string `json:"url"`
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Image       string `json:"image,omitempty"`
+	SiteName    string `json:"site_name,omitempty"`
+}
+
+// linkUnfurler fetches Open Graph (or failing that oEmbed) metadata for the
+// first link in a chat.  Results, including failures, are cached so a
+// popular link only gets fetched once in a while.
+type linkUnfurler struct {
+	client *http.Client
+	camo   *camoProxy // preview images are proxied too when set
+	mu     sync.Mutex
+	cache  map[string]cachedPreview
+}
+
+type cachedPreview struct {
+	preview *linkPreview
+	fetched time.Time
+}
+
+const (
+	unfurlCacheTime   = time.Hour
+	unfurlCacheMax    = 10000
+	unfurlMaxBodySize = 512 * 1024
+	unfurlTitleLen    = 200
+	unfurlDescLen     = 300
+)
+
+var unfurlURLRegex = regexp.MustCompile(`https?://[^\s<>()\[\]"']+`)
+
+func newLinkUnfurler(timeout time.Duration, camo *camoProxy) *linkUnfurler {
+	unfurler := &linkUnfurler{client: newSafeHTTPClient(timeout), camo: camo, cache: make(map[string]cachedPreview)}
+	go unfurler.cleanup()
+	return unfurler
+}
+
+// unfurl returns the preview for the first link in the raw (markdown)
+// message, or nil when there's no link or nothing useful behind it.
+func (unfurler *linkUnfurler) unfurl(message string) *linkPreview {
+	link := strings.TrimRight(unfurlURLRegex.FindString(message), ".,;:!?")
+	if len(link) == 0 {
+		return nil
+	}
+	unfurler.mu.Lock()
+	cached, found := unfurler.cache[link]
+	unfurler.mu.Unlock()
+	if found && time.Since(cached.fetched) < unfurlCacheTime {
+		return cached.preview
+	}
+	preview, err := unfurler.fetch(link)
+	if err != nil {
+		log.Printf("Failed to unfurl %s: %v\n", link, err)
+	}
+	unfurler.mu.Lock()
+	if len(unfurler.cache) < unfurlCacheMax {
+		unfurler.cache[link] = cachedPreview{preview, time.Now()}
+	}
+	unfurler.mu.Unlock()
+	return preview
+}
+
+func (unfurler *linkUnfurler) cleanup() {
+	for range time.Tick(unfurlCacheTime) {
+		unfurler.mu.Lock()
+		for link, cached := range unfurler.cache {
+			if time.Since(cached.fetched) >= unfurlCacheTime {
+				delete(unfurler.cache, link)
+			}
+		}
+		unfurler.mu.Unlock()
+	}
+}
+
+func (unfurler *linkUnfurler) get(link string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", link, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "micro-chat link preview")
+	return unfurler.client.Do(req)
+}
+
+func (unfurler *linkUnfurler) fetch(link string) (*linkPreview, error) {
+	resp, err := unfurler.get(link)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); resp.StatusCode != 200 || mediaType != "text/html" {
+		return nil, nil
+	}
+	meta := readHeadMeta(io.LimitReader(resp.Body, unfurlMaxBodySize))
+	title := firstNonBlank(meta["og:title"], meta["twitter:title"], meta["title"])
+	description := firstNonBlank(meta["og:description"], meta["twitter:description"], meta["description"])
+	image := firstNonBlank(meta["og:image"], meta["twitter:image"])
+	siteName := meta["og:site_name"]
+	if len(title) == 0 && len(meta["oembed"]) > 0 {
+		if embed, err := unfurler.fetchOEmbed(resp.Request.URL, meta["oembed"]); err == nil {
+			title, image, siteName = embed.Title, firstNonBlank(image, embed.ThumbnailURL), firstNonBlank(siteName, embed.ProviderName)
+		}
+	}
+	if len(title) == 0 {
+		return nil, nil
+	}
+	preview := &linkPreview{
+		URL:         html.EscapeString(link),
+		Title:       html.EscapeString(truncateInput(strings.TrimSpace(title), unfurlTitleLen)),
+		Description: html.EscapeString(truncateInput(strings.TrimSpace(description), unfurlDescLen)),
+		SiteName:    html.EscapeString(truncateInput(strings.TrimSpace(siteName), unfurlTitleLen)),
+	}
+	if imageURL := resolveHTTPURL(resp.Request.URL, image); len(imageURL) > 0 {
+		if unfurler.camo != nil {
+			imageURL = unfurler.camo.proxiedURL(imageURL)
+		}
+		preview.Image = html.EscapeString(imageURL)
+	}
+	return preview, nil
+}
+
+type oEmbedResponse struct {
+	Title        string `json:"title"`
+	ProviderName string `json:"provider_name"`
+	ThumbnailURL string `json:"thumbnail_url"`
+}
+
+func (unfurler *linkUnfurler) fetchOEmbed(page *url.URL, href string) (*oEmbedResponse, error) {
+	embedURL := resolveHTTPURL(page, href)
+	if len(embedURL) == 0 {
+		return nil, errUnknownOEmbed
+	}
+	resp, err := unfurler.get(embedURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, errUnknownOEmbed
+	}
+	var embed oEmbedResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, unfurlMaxBodySize)).Decode(&embed); err != nil {
+		return nil, err
+	}
+	return &embed, nil
+}
+
+var errUnknownOEmbed = errors.New("no usable oembed response")
+
+// readHeadMeta collects the metadata we care about from a page's <head>:
+// og:/twitter: meta properties, the description, the <title> and the
+// json oEmbed discovery link.
+func readHeadMeta(body io.Reader) map[string]string {
+	meta := make(map[string]string)
+	tokenizer := html.NewTokenizer(body)
+	inTitle := false
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return meta
+		case html.TextToken:
+			if inTitle && len(meta["title"]) == 0 {
+				meta["title"] = string(tokenizer.Text())
+			}
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			switch string(name) {
+			case "title":
+				inTitle = false
+			case "head":
+				return meta
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			attrs := make(map[string]string)
+			for _, attr := range token.Attr {
+				attrs[attr.Key] = attr.Val
+			}
+			switch token.Data {
+			case "title":
+				inTitle = true
+			case "body":
+				return meta
+			case "meta":
+				key := firstNonBlank(attrs["property"], attrs["name"])
+				if (strings.HasPrefix(key, "og:") || strings.HasPrefix(key, "twitter:") || key == "description") &&
+					len(meta[key]) == 0 {
+					meta[key] = attrs["content"]
+				}
+			case "link":
+				if attrs["rel"] == "alternate" && attrs["type"] == "application/json+oembed" {
+					meta["oembed"] = attrs["href"]
+				}
+			}
+		}
+	}
+}
+
+// resolveHTTPURL resolves ref against base, returning blank unless the
+// result is an http(s) url.
+func resolveHTTPURL(base *url.URL, ref string) string {
+	if len(ref) == 0 {
+		return ""
+	}
+	resolved, err := base.Parse(strings.TrimSpace(ref))
+	if err != nil || (resolved.Scheme != "http" && resolved.Scheme != "https") {
+		return ""
+	}
+	return resolved.String()
+}
+
+func firstNonBlank(values ...string) string {
+	for _, value := range values {
+		if len(strings.TrimSpace(value)) > 0 {
+			return value
+		}
+	}
+	return ""
+}
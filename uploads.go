@@ -0,0 +1,267 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Image types we accept, by sniffed content type, and the extension the
+// stored file gets.
+var uploadImageTypes = map[string]string{
+	"image/gif":  ".gif",
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/webp": ".webp",
+}
+
+// Stored uploads are always named by randomID plus a known extension,
+// thumbnails get an extra .thumb before their extension.
+var uploadNameRegex = regexp.MustCompile(`^[0-9a-f]{32}(\.thumb)?\.[a-z0-9]{2,5}$`)
+
+type uploadOptions struct {
+	Storage  uploadStorage
+	MaxBytes int64
+	// images larger than this (on either side) get a thumbnail, 0 for none
+	ThumbnailPx int
+	// longest voice note accepted, 0 to only accept images
+	MaxVoiceDuration time.Duration
+	// other file types allowed, by extension
+	Attachments attachmentPolicy
+	// checked before anything is stored, nil to skip scanning
+	Scanner       uploadScanner
+	QuarantineDir string
+	// total size and per address limits, nil for none
+	Space *uploadSpace
+	// the post checks on who is uploading, run with the ?topic= it's for
+	Checks []postCheck
+}
+
+// getUploadClosure serves POST /upload, a multipart form with a single
+// "file" field.  The file's type is sniffed from its content (the client
+// supplied type is ignored).  Images and, when enabled, short webm/ogg
+// voice notes and attachments (by the name's extension) are accepted.  The response has the markdown
+// the composer should insert:
+//
+//	{"url": "/uploads/<name>", "markdown": "![](/uploads/<name>)"}
+//
+// The topic the upload is for goes in ?topic=, bans and the other checks
+// on the poster run before anything is read.
+func getUploadClosure(opts uploadOptions) func(w http.ResponseWriter, r *http.Request) {
+	bodyLimit := opts.MaxBytes
+	if attachmentMax := opts.Attachments.maxBytes(); attachmentMax > bodyLimit {
+		bodyLimit = attachmentMax
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		if opts.Space != nil && !opts.Space.allow(r) {
+			writeJSON(w, 429, map[string]string{"error": "Too many uploads, try again later."})
+			return
+		}
+		topic := r.URL.Query().Get("topic")
+		if rejection := runPostChecks(opts.Checks, r, &ChatPost{Topic: topic}); rejection != nil {
+			status, message := rejection.Status, rejection.Message
+			if rejection.Hold {
+				// there's nothing to hold, the chat linking it can be
+				status, message = 403, "Uploads are not allowed from you right now."
+			}
+			log.Printf("HTTP upload rejected (%s) client_ip: %s\n", rejection.Reason, clientIP(r))
+			writeJSON(w, status, map[string]string{"error": message})
+			return
+		}
+		// a little slack for the multipart framing
+		r.Body = http.MaxBytesReader(w, r.Body, bodyLimit+16*1024)
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			writeJSON(w, 400, map[string]string{"error": "Missing or too large file, uploads must be under " +
+				formatBytes(bodyLimit) + "."})
+			return
+		}
+		defer file.Close()
+		data, err := ioutil.ReadAll(io.LimitReader(file, bodyLimit+1))
+		if err != nil {
+			writeJSON(w, 400, map[string]string{"error": "Failed to read upload."})
+			return
+		}
+		contentType := http.DetectContentType(data)
+		ext, isImage := uploadImageTypes[contentType]
+		_, isAudio := uploadAudioTypes[contentType]
+		isAudio = isAudio && !isImage && opts.MaxVoiceDuration > 0
+		maxBytes := opts.MaxBytes
+		if isAudio {
+			ext = uploadAudioTypes[contentType]
+		} else if !isImage {
+			// anything else has to be an allowed attachment type
+			ext = strings.ToLower(filepath.Ext(header.Filename))
+			var allowed bool
+			if maxBytes, allowed = opts.Attachments.allows(ext, contentType); !allowed {
+				writeJSON(w, 415, map[string]string{"error": "Unsupported file type, " + opts.acceptedTypes() + " are allowed."})
+				return
+			}
+		}
+		if int64(len(data)) > maxBytes {
+			writeJSON(w, 413, map[string]string{"error": "File too large, " + strings.TrimPrefix(ext, ".") +
+				" uploads must be under " + formatBytes(maxBytes) + "."})
+			return
+		}
+		if isAudio {
+			duration, err := audioDuration(contentType, data)
+			if err != nil {
+				writeJSON(w, 415, map[string]string{"error": "Unable to read the length of your voice note."})
+				return
+			}
+			if duration > opts.MaxVoiceDuration {
+				writeJSON(w, 413, map[string]string{"error": "Voice note too long, voice notes must be under " +
+					opts.MaxVoiceDuration.String() + "."})
+				return
+			}
+		}
+		id := randomID(16)
+		name := id + ext
+		if opts.Scanner != nil {
+			ok, found, err := opts.Scanner.scan(name, contentType, data)
+			if err != nil {
+				log.Printf("Failed to scan upload %s: %v\n", name, err)
+				writeJSON(w, 503, map[string]string{"error": "Unable to scan your upload right now, try again shortly."})
+				return
+			}
+			if !ok {
+				log.Printf("HTTP upload %s rejected by scan (%s) client_ip: %s\n", name, found, clientIP(r))
+				quarantineUpload(opts.QuarantineDir, name, found, clientIP(r), data)
+				writeJSON(w, 422, map[string]string{"error": "Your upload was rejected by the virus scanner."})
+				return
+			}
+		}
+		storedType := contentType
+		if !isImage && !isAudio {
+			storedType = "application/octet-stream"
+		}
+		if opts.Space != nil && !opts.Space.reserve(int64(len(data))) {
+			log.Printf("HTTP upload refused, maxUploadsMB reached client_ip: %s\n", clientIP(r))
+			writeJSON(w, 507, map[string]string{"error": "Upload storage is full, try again later."})
+			return
+		}
+		if err := opts.Storage.Save(name, storedType, data); err != nil {
+			log.Printf("Failed to store upload: %q\n", err)
+			if opts.Space != nil {
+				opts.Space.release(int64(len(data)))
+			}
+			writeJSON(w, 500, map[string]string{"error": "Failed to store upload."})
+			return
+		}
+		log.Printf("HTTP upload stored %s (%d bytes) client_ip: %s\n", name, len(data), clientIP(r))
+		uploadURL := "/uploads/" + name
+		var markdown string
+		switch {
+		case isAudio:
+			markdown = "[voice note](" + uploadURL + ")"
+		case !isImage:
+			fileName := attachmentFileName(header.Filename, ext)
+			uploadURL += "?name=" + url.QueryEscape(fileName)
+			markdown = "[" + escapeMarkdown(fileName) + " (" + formatBytes(int64(len(data))) + ")](" + uploadURL + ")"
+		default:
+			markdown = "![](" + uploadURL + ")"
+			if thumbURL := storeThumbnail(opts, id, data); len(thumbURL) > 0 {
+				markdown = "[![](" + thumbURL + ")](" + uploadURL + ")"
+			}
+		}
+		writeJSON(w, 200, map[string]string{"url": uploadURL, "markdown": markdown})
+	}
+}
+
+func (opts uploadOptions) acceptedTypes() string {
+	accepted := []string{"gif, jpeg, png and webp images"}
+	if opts.MaxVoiceDuration > 0 {
+		accepted = append(accepted, "webm or ogg voice notes")
+	}
+	if len(opts.Attachments) > 0 {
+		accepted = append(accepted, opts.Attachments.String()+" files")
+	}
+	if len(accepted) == 1 {
+		return "only " + accepted[0]
+	}
+	return strings.Join(accepted[:len(accepted)-1], ", ") + " and " + accepted[len(accepted)-1]
+}
+
+// storeThumbnail returns the url of the upload's thumbnail, or blank when
+// it didn't need (or failed to get) one.
+func storeThumbnail(opts uploadOptions, id string, data []byte) string {
+	if opts.ThumbnailPx <= 0 {
+		return ""
+	}
+	thumb, contentType, ok, err := makeThumbnail(data, opts.ThumbnailPx)
+	if err != nil {
+		log.Printf("Failed to thumbnail upload %s: %v\n", id, err)
+		return ""
+	}
+	if !ok {
+		return ""
+	}
+	name := id + ".thumb" + uploadImageTypes[contentType]
+	if opts.Space != nil && !opts.Space.reserve(int64(len(thumb))) {
+		return ""
+	}
+	if err := opts.Storage.Save(name, contentType, thumb); err != nil {
+		log.Printf("Failed to store thumbnail: %q\n", err)
+		if opts.Space != nil {
+			opts.Space.release(int64(len(thumb)))
+		}
+		return ""
+	}
+	return "/uploads/" + name
+}
+
+// getUploadedFileClosure serves GET /uploads/<name> without ever listing
+// the directory or serving anything we didn't store ourselves.
+func getUploadedFileClosure(opts uploadOptions) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/uploads/")
+		if !uploadNameRegex.MatchString(name) {
+			http.NotFound(w, r)
+			return
+		}
+		f, modTime, err := opts.Storage.Open(name)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("Failed to open upload %s: %q\n", name, err)
+			}
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+		if contentType, found := uploadServedTypes[filepath.Ext(name)]; found {
+			w.Header().Set("Content-Type", contentType)
+		}
+		if isAttachment(name) {
+			setAttachmentHeaders(w, attachmentFileName(r.URL.Query().Get("name"), filepath.Ext(name)))
+		}
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		http.ServeContent(w, r, name, modTime, f)
+	}
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1024*1024 && n%(1024*1024) == 0:
+		return strconv.FormatInt(n/(1024*1024), 10) + "MB"
+	case n >= 1024:
+		return strconv.FormatInt(n/1024, 10) + "KB"
+	}
+	return strconv.FormatInt(n, 10) + " bytes"
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// uploadSpace keeps stored uploads under -maxUploadsMB in total, limits how
+// often an address can upload and reaps uploads no live chat links to.
+// Uploads are stored before the chat linking them is posted, so they're
+// left alone for a while first.  Archived pages don't keep them around.
+type uploadSpace struct {
+	mu      sync.Mutex
+	storage uploadStorage
+	max     int64 // bytes, 0 for no limit
+	used    int64
+	perIP   map[string]*uploadWindow // by networkKey
+	// names of the uploads live chats link to, nil until reapWith
+	linked func() (map[string]bool, error)
+}
+
+type uploadWindow struct {
+	start time.Time
+	count int
+}
+
+const (
+	maxUploadsPerHour = 30
+	uploadReapGrace   = time.Hour
+)
+
+var uploadLinkRegex = regexp.MustCompile(`/uploads/([0-9a-f]{32}(?:\.thumb)?\.[a-z0-9]{2,5})`)
+
+func newUploadSpace(storage uploadStorage, max int64) (*uploadSpace, error) {
+	uploads, err := storage.List()
+	if err != nil {
+		return nil, err
+	}
+	space := &uploadSpace{storage: storage, max: max, perIP: make(map[string]*uploadWindow)}
+	for _, upload := range uploads {
+		space.used += upload.Size
+	}
+	go space.cleanup()
+	return space, nil
+}
+
+// allow counts an upload against the request's address, false once it's
+// had maxUploadsPerHour.
+func (space *uploadSpace) allow(r *http.Request) bool {
+	key := networkKey(r)
+	now := time.Now()
+	space.mu.Lock()
+	defer space.mu.Unlock()
+	window, found := space.perIP[key]
+	if !found || now.Sub(window.start) >= time.Hour {
+		window = &uploadWindow{start: now}
+		space.perIP[key] = window
+	}
+	if window.count >= maxUploadsPerHour {
+		return false
+	}
+	window.count++
+	return true
+}
+
+// reserve makes room for size more bytes, false when there isn't any.
+func (space *uploadSpace) reserve(size int64) bool {
+	space.mu.Lock()
+	defer space.mu.Unlock()
+	if space.max > 0 && space.used+size > space.max {
+		return false
+	}
+	space.used += size
+	return true
+}
+
+// release gives back a reservation for an upload that wasn't stored.
+func (space *uploadSpace) release(size int64) {
+	space.mu.Lock()
+	defer space.mu.Unlock()
+	space.used -= size
+}
+
+// reapWith starts reaping uploads that linked doesn't list.
+func (space *uploadSpace) reapWith(linked func() (map[string]bool, error)) {
+	space.mu.Lock()
+	defer space.mu.Unlock()
+	space.linked = linked
+}
+
+func (space *uploadSpace) cleanup() {
+	for range time.Tick(time.Hour) {
+		space.mu.Lock()
+		for key, window := range space.perIP {
+			if time.Since(window.start) >= time.Hour {
+				delete(space.perIP, key)
+			}
+		}
+		linked := space.linked
+		space.mu.Unlock()
+		if linked != nil {
+			space.reap(linked)
+		}
+	}
+}
+
+func (space *uploadSpace) reap(linked func() (map[string]bool, error)) {
+	// listed before what's linked, so an upload posted in between is kept
+	uploads, err := space.storage.List()
+	if err != nil {
+		log.Printf("Failed to list uploads: %v\n", err)
+		return
+	}
+	names, err := linked()
+	if err != nil {
+		log.Printf("Failed to find linked uploads: %v\n", err)
+		return
+	}
+	reaped := 0
+	for _, upload := range uploads {
+		if names[upload.Name] || time.Since(upload.Stored) < uploadReapGrace {
+			continue
+		}
+		if err := space.storage.Delete(upload.Name); err != nil {
+			log.Printf("Failed to reap upload %s: %v\n", upload.Name, err)
+			continue
+		}
+		space.release(upload.Size)
+		reaped++
+	}
+	if reaped > 0 {
+		log.Printf("Reaped %d uploads no chat links to\n", reaped)
+	}
+}
+
+// liveUploadLinks lists the uploads linked from buffered, spilled, stored,
+// held and scheduled chats.
+func liveUploadLinks(manager *chatStore, spill *spillStore, stored *chatPersistence, held *holdQueue,
+	scheduled *scheduledPosts) func() (map[string]bool, error) {
+	return func() (map[string]bool, error) {
+		names := make(map[string]bool)
+		add := func(text string) {
+			for _, match := range uploadLinkRegex.FindAllStringSubmatch(text, -1) {
+				names[match[1]] = true
+			}
+		}
+		addChat := func(chat ChatPost) {
+			add(chat.Message)
+			for _, translated := range chat.Translations {
+				add(translated)
+			}
+		}
+		manager.eventsMatching(func(event *chatEvent) bool {
+			if chat, ok := event.Data.(ChatPost); ok {
+				addChat(chat)
+			}
+			return false
+		}, 0)
+		if spill != nil {
+			if _, err := spill.eventsMatching(func(spilled *spilledEvent) bool {
+				add(string(spilled.Data))
+				return false
+			}, 1); err != nil {
+				return nil, err
+			}
+		}
+		if stored != nil {
+			events, err := stored.store.Snapshot()
+			if err != nil {
+				return nil, err
+			}
+			for _, event := range events {
+				if chat, ok := decodeStored(event).Data.(ChatPost); ok {
+					addChat(chat)
+				}
+			}
+		}
+		for _, chat := range held.list() {
+			addChat(chat.Chat)
+		}
+		for _, post := range scheduled.list() {
+			addChat(post.Chat)
+		}
+		return names, nil
+	}
+}
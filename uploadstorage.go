@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// uploadStorage is where uploaded files live.  Names are always generated
+// by us (see uploadNameRegex), never taken from the client.
+type uploadStorage interface {
+	Save(name, contentType string, data []byte) error
+	// Open returns the stored file and when it was stored, or an error
+	// satisfying os.IsNotExist when there's no such file.
+	Open(name string) (io.ReadSeekCloser, time.Time, error)
+	// List returns every stored upload, for the total size and reaping.
+	List() ([]storedUpload, error)
+	Delete(name string) error
+}
+
+type storedUpload struct {
+	Name   string
+	Size   int64
+	Stored time.Time
+}
+
+// localStorage keeps uploads in a directory on local disk.
+type localStorage struct {
+	dir string
+}
+
+func newLocalStorage(dir string) (*localStorage, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &localStorage{dir: dir}, nil
+}
+
+func (storage *localStorage) Save(name, contentType string, data []byte) error {
+	return ioutil.WriteFile(filepath.Join(storage.dir, name), data, 0600)
+}
+
+func (storage *localStorage) Open(name string) (io.ReadSeekCloser, time.Time, error) {
+	f, err := os.Open(filepath.Join(storage.dir, name))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, time.Time{}, err
+	}
+	return f, info.ModTime(), nil
+}
+
+func (storage *localStorage) List() ([]storedUpload, error) {
+	files, err := ioutil.ReadDir(storage.dir)
+	if err != nil {
+		return nil, err
+	}
+	var uploads []storedUpload
+	for _, f := range files {
+		if uploadNameRegex.MatchString(f.Name()) {
+			uploads = append(uploads, storedUpload{f.Name(), f.Size(), f.ModTime()})
+		}
+	}
+	return uploads, nil
+}
+
+func (storage *localStorage) Delete(name string) error {
+	return os.Remove(filepath.Join(storage.dir, name))
+}
+
+// s3Storage keeps uploads in an S3 compatible bucket (AWS, MinIO, ...), so
+// hosted instances don't keep user content on ephemeral disks.
+type s3Storage struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+type s3Options struct {
+	Endpoint  string
+	Bucket    string
+	Prefix    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	UseSSL    bool
+}
+
+// Bound how long a single S3 request may take.
+const s3RequestTimeout = 30 * time.Second
+
+func newS3Storage(opts s3Options) (*s3Storage, error) {
+	client, err := minio.New(opts.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(opts.AccessKey, opts.SecretKey, ""),
+		Secure: opts.UseSSL,
+		Region: opts.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &s3Storage{client: client, bucket: opts.Bucket, prefix: opts.Prefix}, nil
+}
+
+func (storage *s3Storage) Save(name, contentType string, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s3RequestTimeout)
+	defer cancel()
+	_, err := storage.client.PutObject(ctx, storage.bucket, storage.prefix+name, bytes.NewReader(data),
+		int64(len(data)), minio.PutObjectOptions{ContentType: contentType})
+	return err
+}
+
+func (storage *s3Storage) Open(name string) (io.ReadSeekCloser, time.Time, error) {
+	// NOTE: no timeout here since the object is streamed to the client
+	// after we return.
+	object, err := storage.client.GetObject(context.Background(), storage.bucket, storage.prefix+name, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	info, err := object.Stat()
+	if err != nil {
+		object.Close()
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, time.Time{}, os.ErrNotExist
+		}
+		return nil, time.Time{}, err
+	}
+	return object, info.LastModified, nil
+}
+
+func (storage *s3Storage) List() ([]storedUpload, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s3RequestTimeout)
+	defer cancel()
+	var uploads []storedUpload
+	for object := range storage.client.ListObjects(ctx, storage.bucket, minio.ListObjectsOptions{Prefix: storage.prefix, Recursive: true}) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		name := strings.TrimPrefix(object.Key, storage.prefix)
+		if uploadNameRegex.MatchString(name) {
+			uploads = append(uploads, storedUpload{name, object.Size, object.LastModified})
+		}
+	}
+	return uploads, nil
+}
+
+func (storage *s3Storage) Delete(name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s3RequestTimeout)
+	defer cancel()
+	return storage.client.RemoveObject(ctx, storage.bucket, storage.prefix+name, minio.RemoveObjectOptions{})
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// userPost is one chat on a user's history page.
+type userPost struct {
+	Timestamp int64  `json:"timestamp"`
+	Topic     string `json:"topic"`
+	Message   string `json:"message"`
+	Action    bool   `json:"action,omitempty"`
+}
+
+type userPostsOptions struct {
+	Manager  *chatStore
+	Spill    *spillStore // nil without a spillDir
+	Renderer *chatRenderer
+	Firehose firehosePolicy
+	Bans     *topicBans
+}
+
+// findUserPosts returns up to limit of the newest chats posted as the given
+// display name, from memory and the disk spill.  A blank topic searches
+// every topic, except the ones the requester was removed from.  Names are
+// matched after rendering, the same way they were stored when posted.
+func findUserPosts(opts userPostsOptions, r *http.Request, name, topic string, limit int) []userPost {
+	rendered := opts.Renderer.renderName(name)
+	hidden := opts.Bans.unreadable(r)
+	matches := func(category string, chat ChatPost) bool {
+		// encrypted chats are only readable in their room
+		return !chat.Encrypted && chat.DisplayName == rendered &&
+			(len(topic) == 0 || chat.Topic == topic) && !hidden[chat.Topic]
+	}
+	var posts []userPost
+	for _, event := range opts.Manager.eventsMatching(func(event *chatEvent) bool {
+		chat, ok := event.Data.(ChatPost)
+		return ok && matches(event.Category, chat)
+	}, limit) {
+		chat := event.Data.(ChatPost)
+		posts = append(posts, userPost{event.Timestamp, chat.Topic, chat.Message, chat.Action})
+	}
+	if opts.Spill != nil && len(posts) < limit {
+		spilled, err := opts.Spill.eventsMatching(func(spilled *spilledEvent) bool {
+			var chat ChatPost
+			return json.Unmarshal(spilled.Data, &chat) == nil && matches(spilled.Category, chat)
+		}, limit-len(posts))
+		if err != nil {
+			log.Printf("Failed to read spilled user posts: %q\n", err)
+		}
+		for _, event := range spilled {
+			var chat ChatPost
+			json.Unmarshal(event.Data.(json.RawMessage), &chat)
+			posts = append(posts, userPost{event.Timestamp, chat.Topic, chat.Message, chat.Action})
+		}
+	}
+	sort.Slice(posts, func(i, j int) bool { return posts[i].Timestamp > posts[j].Timestamp })
+	if len(posts) > limit {
+		posts = posts[:limit]
+	}
+	return posts
+}
+
+// userPostsRequest reads the name from the path after prefix and the topic
+// and limit args.  When the firehose isn't visible to the requester, they
+// have to name a topic, otherwise this would list every topic's chats.
+func userPostsRequest(opts userPostsOptions, prefix string, r *http.Request) (name, topic string, limit int, err string) {
+	name = strings.TrimPrefix(r.URL.Path, prefix)
+	if len(strings.TrimSpace(name)) == 0 {
+		return "", "", 0, "Missing user name."
+	}
+	topic = r.URL.Query().Get("topic")
+	if len(topic) == 0 && !opts.Firehose.visibleTo(r) {
+		return "", "", 0, "A topic arg is required on this server."
+	}
+	limit = defaultHistoryLimit
+	if limitString := r.URL.Query().Get("limit"); len(limitString) > 0 {
+		parsed, parseErr := strconv.Atoi(limitString)
+		if parseErr != nil || parsed < 1 || parsed > maxHistoryLimit {
+			return "", "", 0, "Invalid limit arg, must be 1-" + strconv.Itoa(maxHistoryLimit) + "."
+		}
+		limit = parsed
+	}
+	return name, topic, limit, ""
+}
+
+// getUserAPIClosure serves GET /api/v1/user/<name>[?topic=T][&limit=N]
+//
+//	{"name": "...", "posts": [{"timestamp": ..., "topic": "...", "message": "..."}]}
+func getUserAPIClosure(opts userPostsOptions) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		name, topic, limit, errMessage := userPostsRequest(opts, "/api/v1/user/", r)
+		if len(errMessage) > 0 {
+			writeJSON(w, 400, map[string]string{"error": errMessage})
+			return
+		}
+		posts := findUserPosts(opts, r, name, topic, limit)
+		if posts == nil {
+			posts = []userPost{}
+		}
+		writeJSON(w, 200, map[string]interface{}{"name": opts.Renderer.renderName(name), "posts": posts})
+	}
+}
+
+// getUserPageClosure serves GET /user/<name>, the html version.
+func getUserPageClosure(opts userPostsOptions) func(w http.ResponseWriter, r *http.Request) {
+	page := template.Must(template.New("user_page").Funcs(template.FuncMap{
+		"postTime": serverTimes.minutes,
+		"html": func(s string) template.HTML {
+			// chats are sanitized when they're posted
+			return template.HTML(s)
+		},
+	}).Parse(getUserPageTemplateString()))
+	return func(w http.ResponseWriter, r *http.Request) {
+		logRequest(r)
+		if r.Method != "GET" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		name, topic, limit, errMessage := userPostsRequest(opts, "/user/", r)
+		if len(errMessage) > 0 {
+			http.Error(w, errMessage, 400)
+			return
+		}
+		data := struct {
+			Name  string
+			Topic string
+			Posts []userPost
+		}{opts.Renderer.renderName(name), topic, findUserPosts(opts, r, name, topic, limit)}
+		if err := page.Execute(w, data); err != nil {
+			log.Printf("Failed to render user page: %q\n", err)
+		}
+	}
+}
+
+func getUserPageTemplateString() string {
+	return `<html>
+    <head>
+      <title>micro-chat</title>
+			<meta name="viewport" content="width=device-width, initial-scale=1.0">
+			<link rel="icon" href="/favicon.ico">
+			<link rel="stylesheet" type="text/css" href="https://cdnjs.cloudflare.com/ajax/libs/skeleton/2.0.4/skeleton.min.css">
+			<link rel="stylesheet" href="https://cdnjs.cloudflare.com/ajax/libs/font-awesome/4.6.3/css/font-awesome.css">
+			<style>
+				body {
+					font-size: 1.7rem;
+					line-height: 1.4;
+					margin: 0.8rem 0 0.8rem 1.0rem;
+				}
+				h2 {
+					font-size: 2.4rem;
+				}
+				div.chat {
+					padding: 1.0rem;
+					margin-bottom: 1.0rem;
+					border-radius: 1.0rem;
+					box-shadow: 0 0.2rem 0.4rem 0 rgba(0, 0, 0, 0.2), 0 0.2rem 0.8rem 0 rgba(0, 0, 0, 0.19);
+				}
+				div.chat img {
+					width: 100%;
+					height: auto;
+				}
+				div.postTime {
+					font-size: 1.4rem;
+					color: #999999;
+				}
+				#footer {
+					font-size: 1.4rem;
+					color: #AAAAAA;
+					padding: 1rem;
+					text-align: center;
+				}
+			</style>
+    </head>
+    <body>
+			<div class="container">
+				<h2><i class="fa fa-user"></i> {{ html .Name }}</h2>
+				<a href="/{{ if .Topic }}?topic={{ .Topic }}{{ end }}">Back to chat.</a>
+				<hr />
+				{{ range .Posts }}
+				<div class="chat">
+					<div class="topic"><a class="topic" href="/?topic={{ .Topic }}"><i class="fa fa-comments"></i> {{ .Topic }}</a></div>
+					<div class="msg">{{ if .Action }}<b>{{ html $.Name }}</b> {{ end }}{{ html .Message }}</div>
+					<div class="postTime">{{ postTime .Timestamp }}</div>
+				</div>
+				{{ else }}
+				<p>No recent chats{{ if .Topic }} in {{ .Topic }}{{ end }}.</p>
+				{{ end }}
+			</div>
+			<div id="footer">
+			&copy; Urmom Lol 2016</div>
+    </body>
+  </html>`
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"regexp"
+	"time"
+)
+
+// Audio types accepted as voice notes, by sniffed content type.  These are
+// what browsers' MediaRecorder produces (webm from chrome, ogg from firefox).
+var uploadAudioTypes = map[string]string{
+	"application/ogg": ".ogg",
+	"video/webm":      ".webm",
+}
+
+// Served types for extensions the mime package may not know about.
+var uploadServedTypes = map[string]string{
+	".ogg":  "audio/ogg",
+	".webm": "audio/webm",
+}
+
+// Voice notes are posted as markdown links to the upload, which the
+// renderer swaps for an audio player.  Matched against sanitized html, so
+// only links to our own upload names (no quotes, no markup) qualify.
+var voiceNoteLinkRegex = regexp.MustCompile(`<a href="(/uploads/[0-9a-f]{32}\.(?:ogg|webm))"[^>]*>[^<]*</a>`)
+
+func renderVoiceNotes(message string) string {
+	return voiceNoteLinkRegex.ReplaceAllString(message, `<audio class="voice-note" controls preload="none" src="$1"></audio>`)
+}
+
+var errUnknownDuration = errors.New("unable to determine audio duration")
+
+func audioDuration(contentType string, data []byte) (time.Duration, error) {
+	switch contentType {
+	case "application/ogg":
+		return oggDuration(data)
+	case "video/webm":
+		return webmDuration(data)
+	}
+	return 0, errUnknownDuration
+}
+
+// oggDuration reads the granule position of the last page.  For opus that
+// always counts 48kHz samples, for vorbis the rate is in the id header.
+func oggDuration(data []byte) (time.Duration, error) {
+	rate := 0
+	if bytes.Contains(data[:minInt(len(data), 512)], []byte("OpusHead")) {
+		rate = 48000
+	} else if i := bytes.Index(data[:minInt(len(data), 512)], []byte("\x01vorbis")); i >= 0 && i+16 <= len(data) {
+		rate = int(binary.LittleEndian.Uint32(data[i+12 : i+16]))
+	}
+	last := bytes.LastIndex(data, []byte("OggS"))
+	if rate <= 0 || last < 0 || last+14 > len(data) {
+		return 0, errUnknownDuration
+	}
+	granule := int64(binary.LittleEndian.Uint64(data[last+6 : last+14]))
+	if granule < 0 {
+		return 0, errUnknownDuration
+	}
+	return time.Duration(granule) * time.Second / time.Duration(rate), nil
+}
+
+// EBML element ids needed to work out a webm file's length.
+const (
+	ebmlSegment       = 0x18538067
+	ebmlInfo          = 0x1549A966
+	ebmlTimecodeScale = 0x2AD7B1
+	ebmlDuration      = 0x4489
+	ebmlCluster       = 0x1F43B675
+	ebmlTimecode      = 0xE7
+	ebmlBlockGroup    = 0xA0
+	ebmlBlock         = 0xA1
+	ebmlSimpleBlock   = 0xA3
+)
+
+// webmDuration uses the segment's Duration when there is one, otherwise
+// the latest block timecode (MediaRecorder output usually has no Duration).
+// Master elements we care about are walked into rather than skipped, which
+// also copes with the unknown sizes live recordings use.
+func webmDuration(data []byte) (time.Duration, error) {
+	scale := int64(1000000) // nanoseconds per timecode tick
+	var declared float64
+	var clusterTime, latest int64
+	for pos := 0; pos < len(data); {
+		id, idLen := ebmlVint(data[pos:], true)
+		if idLen == 0 {
+			break
+		}
+		size, sizeLen := ebmlVint(data[pos+idLen:], false)
+		if sizeLen == 0 {
+			break
+		}
+		pos += idLen + sizeLen
+		switch id {
+		case ebmlSegment, ebmlInfo, ebmlCluster, ebmlBlockGroup:
+			continue
+		}
+		if size < 0 || size > int64(len(data)-pos) {
+			break
+		}
+		content := data[pos : pos+int(size)]
+		switch id {
+		case ebmlTimecodeScale:
+			if value := ebmlUint(content); value > 0 {
+				scale = value
+			}
+		case ebmlDuration:
+			if len(content) == 4 {
+				declared = float64(math.Float32frombits(binary.BigEndian.Uint32(content)))
+			} else if len(content) == 8 {
+				declared = math.Float64frombits(binary.BigEndian.Uint64(content))
+			}
+		case ebmlTimecode:
+			clusterTime = ebmlUint(content)
+		case ebmlSimpleBlock, ebmlBlock:
+			if _, trackLen := ebmlVint(content, false); trackLen > 0 && trackLen+2 <= len(content) {
+				relative := int64(int16(binary.BigEndian.Uint16(content[trackLen : trackLen+2])))
+				if clusterTime+relative > latest {
+					latest = clusterTime + relative
+				}
+			}
+		}
+		pos += int(size)
+	}
+	if declared > 0 {
+		return time.Duration(declared * float64(scale)), nil
+	}
+	if latest > 0 {
+		return time.Duration(latest * scale), nil
+	}
+	return 0, errUnknownDuration
+}
+
+// ebmlVint decodes a variable length integer, returning its value and
+// length (0 when invalid).  Element ids keep their length marker bits,
+// sizes don't, and an all ones size means unknown, returned as -1.
+func ebmlVint(data []byte, keepMarker bool) (int64, int) {
+	if len(data) == 0 || data[0] == 0 {
+		return 0, 0
+	}
+	length := 1
+	for mask := byte(0x80); data[0]&mask == 0; mask >>= 1 {
+		length++
+	}
+	if length > 8 || length > len(data) {
+		return 0, 0
+	}
+	value := int64(data[0])
+	if !keepMarker {
+		value &= int64(0xFF >> uint(length))
+	}
+	allOnes := value == int64(0xFF>>uint(length))
+	for _, b := range data[1:length] {
+		value = value<<8 | int64(b)
+		allOnes = allOnes && b == 0xFF
+	}
+	if !keepMarker && allOnes {
+		return -1, length
+	}
+	return value, length
+}
+
+func ebmlUint(data []byte) int64 {
+	var value int64
+	for _, b := range data {
+		value = value<<8 | int64(b)
+	}
+	return value
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
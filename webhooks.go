@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// topicWebhooks POSTs every chat published to a topic to the urls its
+// moderators registered, so a project topic can feed that project's own
+// tooling.  Admins can register hooks on every topic by leaving the topic
+// blank.  Each hook gets
+//
+//	{"topic": "...", "chat": {...the chat as /subscribe serves it...}}
+//
+// through the delivery queue, signed when the hook has a secret (see
+// deliveries.go).  Burn after reading and encrypted chats aren't sent.
+type topicWebhooks struct {
+	mu         sync.Mutex
+	path       string // where hooks are saved, blank to keep them in memory
+	hooks      map[string]*topicWebhook
+	client     *http.Client
+	deliveries *deliveryQueue
+}
+
+type topicWebhook struct {
+	ID     string `json:"id"`
+	Topic  string `json:"topic"` // blank for every topic
+	URL    string `json:"url"`
+	Secret string `json:"secret,omitempty"`
+	By     string `json:"by"`
+}
+
+type webhookPayload struct {
+	Topic string   `json:"topic"`
+	Chat  ChatPost `json:"chat"`
+}
+
+const maxWebhooksPerTopic = 10
+
+func newTopicWebhooks(path string, client *http.Client, deliveries *deliveryQueue) (*topicWebhooks, error) {
+	hooks := &topicWebhooks{path: path, hooks: make(map[string]*topicWebhook), client: client, deliveries: deliveries}
+	if len(path) > 0 {
+		data, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			var file struct {
+				Webhooks []*topicWebhook `json:"webhooks"`
+			}
+			if err := json.Unmarshal(data, &file); err != nil {
+				return nil, err
+			}
+			for _, hook := range file.Webhooks {
+				hooks.hooks[hook.ID] = hook
+			}
+		}
+	}
+	return hooks, nil
+}
+
+// published queues the chat for the hooks on its topic.  Registered with
+// chatStore.onPublish.
+func (hooks *topicWebhooks) published(event *chatEvent) {
+	chat, ok := event.Data.(ChatPost)
+	if !ok || chat.Burn || chat.Encrypted {
+		return
+	}
+	var targets []topicWebhook
+	hooks.mu.Lock()
+	for _, hook := range hooks.hooks {
+		if hook.Topic == chat.Topic || len(hook.Topic) == 0 {
+			targets = append(targets, *hook)
+		}
+	}
+	hooks.mu.Unlock()
+	if len(targets) == 0 {
+		return
+	}
+	body, err := json.Marshal(webhookPayload{Topic: chat.Topic, Chat: chat})
+	if err != nil {
+		log.Printf("Failed to encode webhook payload: %q\n", err)
+		return
+	}
+	for _, target := range targets {
+		hooks.deliveries.send(outboundDelivery{Kind: "webhook", Client: hooks.client, URL: target.URL,
+			Header: http.Header{"Content-Type": {"application/json"}}, Body: body, Secret: target.Secret})
+	}
+}
+
+// list returns the hooks on topic (all of them when topic is blank),
+// without their secrets.
+func (hooks *topicWebhooks) list(topic string) []topicWebhook {
+	hooks.mu.Lock()
+	defer hooks.mu.Unlock()
+	list := []topicWebhook{}
+	for _, hook := range hooks.hooks {
+		if len(topic) == 0 || hook.Topic == topic {
+			shown := *hook
+			shown.Secret = ""
+			list = append(list, shown)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Topic != list[j].Topic {
+			return list[i].Topic < list[j].Topic
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// save writes the hooks out when there's a webhooksFile.
+// NOTE: callers must hold hooks.mu
+func (hooks *topicWebhooks) save() error {
+	if len(hooks.path) == 0 {
+		return nil
+	}
+	var file struct {
+		Webhooks []*topicWebhook `json:"webhooks"`
+	}
+	for _, hook := range hooks.hooks {
+		file.Webhooks = append(file.Webhooks, hook)
+	}
+	sort.Slice(file.Webhooks, func(i, j int) bool { return file.Webhooks[i].ID < file.Webhooks[j].ID })
+	return saveJSONFile(hooks.path, file)
+}
+
+func validWebhookURL(raw string) bool {
+	parsed, err := url.Parse(raw)
+	return err == nil && len(raw) <= 2048 && (parsed.Scheme == "http" || parsed.Scheme == "https") &&
+		len(parsed.Host) > 0
+}
+
+// getTopicWebhooksClosure serves /admin/webhooks:
+//
+//	GET [?topic=] lists hooks, secrets left out
+//	POST topic, url[, secret] adds one, a blank topic (every topic) needs
+//	an admin
+//	POST id, delete=yes removes one
+func getTopicWebhooksClosure(hooks *topicWebhooks, access *accessControl) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			writeJSON(w, 200, map[string][]topicWebhook{"webhooks": hooks.list(r.URL.Query().Get("topic"))})
+			return
+		}
+		if r.Method != "POST" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		by, userRole := access.identify(r)
+		hooks.mu.Lock()
+		defer hooks.mu.Unlock()
+		if r.PostFormValue("delete") == "yes" {
+			hook, found := hooks.hooks[r.PostFormValue("id")]
+			if !found {
+				writeJSON(w, 404, map[string]string{"error": "No such webhook."})
+				return
+			}
+			if len(hook.Topic) == 0 && userRole < roleAdmin {
+				writeJSON(w, 403, map[string]string{"error": "Only admins can change webhooks on every topic."})
+				return
+			}
+			delete(hooks.hooks, hook.ID)
+			if err := hooks.save(); err != nil {
+				writeJSON(w, 500, map[string]string{"error": "Failed to save webhooks: " + err.Error()})
+				return
+			}
+			writeJSON(w, 200, map[string]string{"id": hook.ID, "deleted": "yes"})
+			return
+		}
+		topic := strings.TrimSpace(r.PostFormValue("topic"))
+		if len(topic) == 0 && userRole < roleAdmin {
+			writeJSON(w, 403, map[string]string{"error": "Only admins can add webhooks on every topic."})
+			return
+		}
+		hookURL := r.PostFormValue("url")
+		if !validWebhookURL(hookURL) {
+			writeJSON(w, 400, map[string]string{"error": "Missing or invalid url arg, must be an http(s) url."})
+			return
+		}
+		onTopic := 0
+		for _, hook := range hooks.hooks {
+			if hook.Topic == topic {
+				onTopic++
+			}
+		}
+		if onTopic >= maxWebhooksPerTopic {
+			writeJSON(w, 409, map[string]string{"error": "That topic already has as many webhooks as it can."})
+			return
+		}
+		hook := &topicWebhook{ID: randomID(8), Topic: topic, URL: hookURL, Secret: r.PostFormValue("secret"), By: by}
+		hooks.hooks[hook.ID] = hook
+		if err := hooks.save(); err != nil {
+			delete(hooks.hooks, hook.ID)
+			writeJSON(w, 500, map[string]string{"error": "Failed to save webhooks: " + err.Error()})
+			return
+		}
+		shown := *hook
+		shown.Secret = ""
+		writeJSON(w, 200, shown)
+	}
+}
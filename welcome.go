@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// welcomeGate shows first time visitors the operator's welcome page (house
+// rules, an acceptable use policy) with an "I agree" button before the chat
+// page, from -welcomeFile.  Agreeing is remembered by a cookie naming the
+// version of the page agreed to, so changing the file asks everyone again.
+// Crawlers go straight through, they can't agree to anything.
+type welcomeGate struct {
+	page    template.HTML // trusted, it's the operator's own html
+	version string
+}
+
+const (
+	welcomeCookieName = "microchat_welcome"
+	// where the agree button posts
+	welcomePath = "/welcome"
+)
+
+func newWelcomeGate(path string) (*welcomeGate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	return &welcomeGate{page: template.HTML(data), version: hex.EncodeToString(sum[:8])}, nil
+}
+
+func (gate *welcomeGate) agreed(r *http.Request) bool {
+	cookie, err := r.Cookie(welcomeCookieName)
+	return err == nil && cookie.Value == gate.version
+}
+
+// localPath keeps next on this server, anything else goes to the homepage.
+func localPath(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+// guard serves the welcome page in place of handler's page until the
+// visitor agrees.  A nil gate lets everyone through.
+func (gate *welcomeGate) guard(handler func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	if gate == nil {
+		return handler
+	}
+	page := template.Must(template.New("welcome_page").Parse(getWelcomeTemplateString()))
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" || gate.agreed(r) || crawlerAgents.MatchString(r.UserAgent()) {
+			handler(w, r)
+			return
+		}
+		data := struct {
+			Page template.HTML
+			Next string
+		}{gate.page, r.URL.RequestURI()}
+		// so nothing caches the welcome page as the chat page
+		w.Header().Set("Cache-Control", "no-store")
+		if err := page.Execute(w, data); err != nil {
+			log.Printf("Failed to render welcome page: %q\n", err)
+		}
+	}
+}
+
+// getWelcomeAgreeClosure serves POST /welcome with agree=yes and next, the
+// page to go on to.
+func getWelcomeAgreeClosure(gate *welcomeGate) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		if r.PostFormValue("agree") != "yes" {
+			http.Error(w, "You have to agree to the rules to use this chat.", 400)
+			return
+		}
+		ensureSession(w, r)
+		http.SetCookie(w, &http.Cookie{
+			Name:     welcomeCookieName,
+			Value:    gate.version,
+			Path:     "/",
+			Expires:  time.Now().Add(365 * 24 * time.Hour),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+			Secure:   r.TLS != nil,
+		})
+		http.Redirect(w, r, localPath(r.PostFormValue("next")), http.StatusSeeOther)
+	}
+}
+
+func getWelcomeTemplateString() string {
+	return `<html>
+    <head>
+      <title>micro-chat</title>
+			<meta name="viewport" content="width=device-width, initial-scale=1.0">
+			<link rel="icon" href="/favicon.ico">
+			<link rel="stylesheet" type="text/css" href="https://cdnjs.cloudflare.com/ajax/libs/skeleton/2.0.4/skeleton.min.css">
+			<style>
+				body {
+					font-size: 1.7rem;
+					line-height: 1.4;
+					margin: 0.8rem 0 0.8rem 1.0rem;
+				}
+				div.welcome {
+					margin: 2.0rem 0;
+				}
+				#footer {
+					font-size: 1.4rem;
+					color: #AAAAAA;
+					padding: 1rem;
+					text-align: center;
+				}
+			</style>
+    </head>
+    <body>
+			<div class="container">
+				<div class="welcome">{{ .Page }}</div>
+				<form method="POST" action="` + welcomePath + `">
+					<input type="hidden" name="agree" value="yes">
+					<input type="hidden" name="next" value="{{ .Next }}">
+					<input class="button-primary" type="submit" value="I agree">
+				</form>
+			</div>
+			<div id="footer">
+			&copy; Urmom Lol 2016</div>
+    </body>
+  </html>`
+}